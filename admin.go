@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// sequenceHandler reports the sequence number of the latest event in the
+// transaction log, which clients and replicas can use as a checkpoint.
+func sequenceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sequence uint64 `json:"sequence"`
+	}{transactionLogger.LastSequence()})
+}
+
+// tombstonesHandler lists the keys deleted within the tombstone retention
+// period. Reserved keys are left out, as they are in key listings.
+func tombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	tombstones := []Tombstone{}
+	for _, t := range Tombstones() {
+		if !isReservedKey(t.Key) {
+			tombstones = append(tombstones, t)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Tombstones []Tombstone `json:"tombstones"`
+	}{tombstones})
+}
+
+// statsHandler reports the size of the store along with the sequence
+// number of the latest logged event.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		StoreStats
+		Sequence   uint64                    `json:"sequence"`
+		Namespaces map[string]NamespaceUsage `json:"namespaces"`
+	}{Stats(), transactionLogger.LastSequence(), namespaceUsage()})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getSequence(t *testing.T) uint64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/sequence", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var body struct{ Sequence uint64 }
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Sequence
+}
+
+func TestSequenceAdvances(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+
+	if seq := getSequence(t); seq != 0 {
+		t.Errorf("expected sequence 0 on an empty log, got %d", seq)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader("value")))
+	}
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := getSequence(t); seq != 3 {
+		t.Errorf("expected sequence 3, got %d", seq)
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/a", nil))
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := getSequence(t); seq != 4 {
+		t.Errorf("expected sequence 4, got %d", seq)
+	}
+}
+
+func TestLastSequenceAfterReplay(t *testing.T) {
+	tl, err := NewTransactionLogger(writeLogFile(t, "3\t2\tkey-a\tone\n9\t2\tkey-b\ttwo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	events, errs := tl.ReadEvents()
+	for range events {
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if seq := tl.LastSequence(); seq != 9 {
+		t.Errorf("expected sequence 9 after replay, got %d", seq)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	withStore(t, map[string]string{"key": "value", "k2": ""})
+	withLogger(t)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var stats StoreStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if want := (StoreStats{Keys: 2, KeyBytes: 5, ValueBytes: 5}); stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+}
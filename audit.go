@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditEntry records one access to a key.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"` // get, put, delete, rename, or cas within a transaction
+	Key    string    `json:"key"`
+	Client string    `json:"client"` // user name from the request's credentials, or its address
+	Remote string    `json:"remote"`
+	Status int       `json:"status"`
+}
+
+// auditQueueSize bounds the entries waiting to be recorded. Entries that
+// arrive while the queue is full are dropped rather than stalling requests.
+const auditQueueSize = 4096
+
+// auditor receives an entry for every key access when auditing is enabled.
+var auditor *auditLog
+
+// auditLog records accesses separately from the transaction log. Entries
+// are written as JSON lines to w, if it is not nil, and the most recent
+// ones are kept in memory to be queried.
+type auditLog struct {
+	w       *bufio.Writer
+	dropped atomic.Uint64
+
+	mu     sync.Mutex
+	recent []AuditEntry // ring of the latest entries
+	next   int          // where the next entry goes in recent
+	full   bool         // whether recent has wrapped around
+
+	queue chan AuditEntry
+	done  chan struct{}
+}
+
+// newAuditLog starts an audit log keeping the latest recent entries in
+// memory and writing every entry to w, which may be nil.
+func newAuditLog(w io.Writer, recent int) *auditLog {
+	a := &auditLog{
+		recent: make([]AuditEntry, recent),
+		queue:  make(chan AuditEntry, auditQueueSize),
+		done:   make(chan struct{}),
+	}
+	if w != nil {
+		a.w = bufio.NewWriter(w)
+	}
+
+	go a.run()
+
+	return a
+}
+
+// Record queues e without blocking.
+func (a *auditLog) Record(e AuditEntry) {
+	select {
+	case a.queue <- e:
+	default:
+		a.dropped.Add(1)
+		slog.Warn("audit queue full, dropping entry", "op", e.Op, "key", e.Key)
+	}
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+
+	var enc *json.Encoder
+	if a.w != nil {
+		enc = json.NewEncoder(a.w)
+	}
+
+	for e := range a.queue {
+		if len(a.recent) > 0 {
+			a.mu.Lock()
+			a.recent[a.next] = e
+			a.next = (a.next + 1) % len(a.recent)
+			a.full = a.full || a.next == 0
+			a.mu.Unlock()
+		}
+
+		if enc == nil {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			slog.Error("failed to write audit entry", "err", err)
+		}
+		// Flush once the queue is drained, so a burst costs one write.
+		if len(a.queue) == 0 {
+			if err := a.w.Flush(); err != nil {
+				slog.Error("failed to write audit log", "err", err)
+			}
+		}
+	}
+}
+
+// Query returns up to limit of the entries kept in memory for key, newest
+// first. An empty key matches every entry, and limit <= 0 means no limit.
+func (a *auditLog) Query(key string, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := a.next
+	if a.full {
+		n = len(a.recent)
+	}
+
+	entries := []AuditEntry{}
+	for i := 1; i <= n; i++ {
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+		e := a.recent[(a.next-i+len(a.recent))%len(a.recent)]
+		if key == "" || e.Key == key {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// Dropped reports how many entries were lost to a full queue.
+func (a *auditLog) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Close records the queued entries. Nothing may be recorded after Close
+// is called, so it belongs after the server has shut down.
+func (a *auditLog) Close() {
+	close(a.queue)
+	<-a.done
+}
+
+// clientIdentity names the client making r: the user name from its basic
+// auth credentials if it sent any, otherwise its address.
+func clientIdentity(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// audit records op on key by the client making r.
+func audit(r *http.Request, op, key string, status int) {
+	if auditor == nil {
+		return
+	}
+
+	auditor.Record(AuditEntry{
+		Time:   time.Now(),
+		Op:     op,
+		Key:    key,
+		Client: clientIdentity(r),
+		Remote: r.RemoteAddr,
+		Status: status,
+	})
+}
+
+// statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// auditMiddleware records every request to a key route along with the
+// status it was answered with.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditor == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		op := map[string]string{
+			http.MethodGet:    "get",
+			http.MethodPut:    "put",
+			http.MethodDelete: "delete",
+			http.MethodPost:   "rename",
+		}[r.Method]
+		audit(r, op, requestKey(r), sw.status)
+	})
+}
+
+// auditHandler lists the latest audit entries, newest first, optionally
+// only those for the key given by the key parameter and at most limit of
+// them.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if auditor == nil {
+		http.Error(w, "auditing is disabled", http.StatusNotFound)
+		return
+	}
+
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries []AuditEntry `json:"entries"`
+		Dropped uint64       `json:"dropped"`
+	}{auditor.Query(r.URL.Query().Get("key"), limit), auditor.Dropped()})
+}
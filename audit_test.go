@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAuditor makes a the auditor for the duration of the test. Entries
+// are recorded asynchronously, so tests close it before looking at them.
+func withAuditor(t *testing.T, a *auditLog) {
+	t.Helper()
+
+	saved := auditor
+	auditor = a
+	t.Cleanup(func() { auditor = saved })
+}
+
+func TestAuditPut(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	var buf bytes.Buffer
+	a := newAuditLog(&buf, 10)
+	withAuditor(t, a)
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/audited", strings.NewReader("value"))
+	req.SetBasicAuth("alice", "secret")
+	req.RemoteAddr = "192.0.2.1:1234"
+	before := time.Now()
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+	a.Close()
+
+	entries := a.Query("audited", 0)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Op != "put" || e.Key != "audited" || e.Client != "alice" || e.Remote != "192.0.2.1:1234" || e.Status != http.StatusCreated {
+		t.Errorf("unexpected audit entry %+v", e)
+	}
+	if e.Time.Before(before) || e.Time.After(time.Now()) {
+		t.Errorf("audit entry time %v is outside the request", e.Time)
+	}
+
+	var written AuditEntry
+	if err := json.Unmarshal(buf.Bytes(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Op != e.Op || written.Key != e.Key || written.Client != e.Client || !written.Time.Equal(e.Time) {
+		t.Errorf("audit file has %+v, expected %+v", written, e)
+	}
+}
+
+func TestAuditClientFallsBackToAddress(t *testing.T) {
+	withStore(t, map[string]string{"audited": "value"})
+	a := newAuditLog(nil, 10)
+	withAuditor(t, a)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/audited", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+	a.Close()
+
+	entries := a.Query("", 0)
+	if len(entries) != 1 || entries[0].Op != "get" || entries[0].Client != "192.0.2.1" {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	a := newAuditLog(nil, 3)
+	for _, key := range []string{"a", "b", "a", "a", "b"} {
+		a.Record(AuditEntry{Op: "get", Key: key})
+	}
+	a.Close()
+
+	// Only the latest three entries are kept: a, a, b.
+	if entries := a.Query("", 0); len(entries) != 3 || entries[0].Key != "b" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if entries := a.Query("a", 0); len(entries) != 2 {
+		t.Errorf("expected 2 entries for a, got %d", len(entries))
+	}
+	if entries := a.Query("a", 1); len(entries) != 1 {
+		t.Errorf("expected the limit to apply, got %d entries", len(entries))
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	withAuditor(t, nil)
+	auditHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/audit", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d with auditing disabled, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	a := newAuditLog(nil, 10)
+	a.Record(AuditEntry{Op: "put", Key: "a"})
+	a.Record(AuditEntry{Op: "delete", Key: "b"})
+	a.Close()
+	withAuditor(t, a)
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/audit?key=b", nil))
+
+	var body struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Entries) != 1 || body.Entries[0].Op != "delete" {
+		t.Errorf("unexpected entries %+v", body.Entries)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/audit?limit=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for a bad limit, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// A backup file is
+//
+//	magic "KVBACKUP"
+//	uvarint version
+//	uvarint sequence of the latest event the backup reflects
+//	uvarint number of records
+//	records, each a type byte (backupPut or backupPutImmutable) followed
+//	by the uvarint length and bytes of the key, then of the value
+//	the SHA-256 of everything before it
+//
+// Unlike a snapshot, it is meant to leave the server, so it is compact
+// and carries a checksum.
+const (
+	backupMagic   = "KVBACKUP"
+	backupVersion = 1
+
+	backupPut          = 1
+	backupPutImmutable = 2
+)
+
+var errBadBackup = errors.New("invalid backup")
+
+// writeBackup writes entries to w as a backup reflecting the events up to
+// seq.
+func writeBackup(w io.Writer, seq uint64, entries []snapshotEntry) error {
+	sum := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, sum))
+
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+
+	bw.WriteString(backupMagic)
+	uvarint(backupVersion)
+	uvarint(seq)
+	uvarint(uint64(len(entries)))
+	for _, e := range entries {
+		if e.Immutable {
+			bw.WriteByte(backupPutImmutable)
+		} else {
+			bw.WriteByte(backupPut)
+		}
+		uvarint(uint64(len(e.Key)))
+		bw.WriteString(e.Key)
+		uvarint(uint64(len(e.Value)))
+		bw.WriteString(e.Value)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(sum.Sum(nil))
+	return err
+}
+
+// readBackup checks the backup in data and returns the sequence it
+// reflects and its entries.
+func readBackup(data []byte) (uint64, []snapshotEntry, error) {
+	if len(data) < len(backupMagic)+sha256.Size || string(data[:len(backupMagic)]) != backupMagic {
+		return 0, nil, fmt.Errorf("%w: not a backup file", errBadBackup)
+	}
+	body, footer := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], footer) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", errBadBackup)
+	}
+
+	r := bytes.NewReader(body[len(backupMagic):])
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errBadBackup, err)
+	}
+	if version != backupVersion {
+		return 0, nil, fmt.Errorf("%w: unsupported version %d", errBadBackup, version)
+	}
+	seq, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errBadBackup, err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errBadBackup, err)
+	}
+
+	readString := func() (string, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if size > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		b := make([]byte, size)
+		r.Read(b)
+		return string(b), nil
+	}
+
+	entries := make([]snapshotEntry, 0, min(n, uint64(r.Len())))
+	seen := make(map[string]bool)
+	for i := uint64(0); i < n; i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: record %d: %v", errBadBackup, i, err)
+		}
+		if kind != backupPut && kind != backupPutImmutable {
+			return 0, nil, fmt.Errorf("%w: record %d: unknown type %d", errBadBackup, i, kind)
+		}
+		var e snapshotEntry
+		if e.Key, err = readString(); err == nil {
+			e.Value, err = readString()
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: record %d: %v", errBadBackup, i, err)
+		}
+		if e.Key == "" || seen[e.Key] {
+			return 0, nil, fmt.Errorf("%w: record %d: empty or repeated key %q", errBadBackup, i, e.Key)
+		}
+		seen[e.Key] = true
+		e.Immutable = kind == backupPutImmutable
+		entries = append(entries, e)
+	}
+	if r.Len() != 0 {
+		return 0, nil, fmt.Errorf("%w: %d bytes after the last record", errBadBackup, r.Len())
+	}
+
+	return seq, entries, nil
+}
+
+// storeEntries returns the contents of the store, sorted by key.
+func storeEntries() ([]snapshotEntry, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	entries := make([]snapshotEntry, 0, store.keys)
+	err := store.data.each(func(k, v string) error {
+		entries = append(entries, snapshotEntry{k, v, mutable(k) != nil})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, err
+}
+
+// RestoreBackup makes the store hold exactly entries: keys not among them
+// are deleted and the rest put, as immutable where marked. Keys already
+// holding their value are left alone. It fails with ErrImmutable, and
+// changes nothing, if an immutable key would be changed or deleted.
+// Quotas aren't enforced, as on replay. The events to log are returned.
+func RestoreBackup(entries []snapshotEntry) ([]Event, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	events, err := checkRestore(entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEventsLocked(events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// CheckRestore reports what RestoreBackup would do with entries without
+// doing it: the events it would log, or the error it would fail with.
+func CheckRestore(entries []snapshotEntry) ([]Event, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkRestore(entries)
+}
+
+// checkRestore is CheckRestore for a caller holding at least the store's
+// read lock.
+func checkRestore(entries []snapshotEntry) ([]Event, error) {
+	restored := make(map[string]snapshotEntry, len(entries))
+	for _, e := range entries {
+		restored[e.Key] = e
+	}
+
+	var events []Event
+	var check error
+	err := store.data.each(func(k, v string) error {
+		e, ok := restored[k]
+		immutable := mutable(k) != nil
+		if ok && e.Value == v && e.Immutable == immutable {
+			delete(restored, k)
+			return nil
+		}
+		if immutable {
+			check = fmt.Errorf("key %s: %w", k, ErrImmutable)
+			return check
+		}
+		if !ok || e.Immutable {
+			// An existing key is deleted before it is made immutable,
+			// as only new keys can be.
+			events = append(events, Event{EventType: EventDelete, Key: k})
+		}
+		return nil
+	})
+	if check != nil {
+		return nil, check
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, ok := restored[e.Key]; !ok {
+			continue
+		}
+		if e.Immutable {
+			events = append(events, Event{EventType: EventPutImmutable, Key: e.Key, Value: e.Value})
+		} else {
+			events = append(events, Event{EventType: EventPut, Key: e.Key, Value: e.Value})
+		}
+	}
+
+	return events, nil
+}
+
+// backupHandler streams a backup of the store. Writes are held off only
+// while the store is copied, so a slow download doesn't block them.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	writeMu.Lock()
+	err := transactionLogger.Flush()
+	seq := transactionLogger.LastSequence()
+	var entries []snapshotEntry
+	if err == nil {
+		entries, err = storeEntries()
+	}
+	writeMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"kvstore-%d.backup\"", seq))
+	if err := writeBackup(w, seq, entries); err != nil {
+		slog.Warn("backup download failed", "err", err)
+		return
+	}
+	slog.Info("backup taken", "sequence", seq, "keys", len(entries))
+}
+
+// restoreHandler checks the backup in the request body and replaces the
+// contents of the store with it, logging the change as one batch so that
+// replay applies all of it or none. The backup is read whole and checked
+// before anything is changed.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxRestoreBytes)
+	data, err := readBody(r, config.MaxRestoreBytes)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errBodyTooLarge) || errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	seq, entries, err := readBackup(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, e := range entries {
+		if err := checkLoggable(e.Key, e.Value); err != nil {
+			http.Error(w, fmt.Sprintf("key %q: %v", e.Key, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	events, err := CheckRestore(entries)
+	if errors.Is(err, ErrImmutable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(events) > 0 {
+		err := commitWrite(func() {
+			transactionLogger.WriteBatch(events)
+		}, func() error {
+			return applyEvents(events)
+		})
+		if err != nil {
+			logFailed(w, err)
+			return
+		}
+	}
+	for _, e := range events {
+		notifyChange(e.EventType, e.Key, e.Value)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sequence uint64 `json:"sequence"`
+		Keys     int    `json:"keys"`
+		Changed  int    `json:"changed"`
+	}{seq, len(entries), len(events)})
+	slog.Info("backup restored", "sequence", seq, "keys", len(entries), "changed", len(events))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func takeBackup(t *testing.T) []byte {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup: unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Body.Bytes()
+}
+
+func restoreBackup(t *testing.T, backup []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(backup)))
+	return rec
+}
+
+func TestBackupRestore(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+
+	do := func(method, path, value string, header ...string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(value))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: unexpected status %d: %s", method, path, rec.Code, rec.Body)
+		}
+	}
+	do(http.MethodPut, "/v1/a", "1")
+	do(http.MethodPut, "/v1/b", "2")
+	do(http.MethodPut, "/v1/binary", "\x00\xff")
+	do(http.MethodPut, "/v1/empty", "")
+	do(http.MethodPut, "/v1/fixed", "f", "Immutable", "true")
+	want := fmt.Sprint(storeMap())
+	backup := takeBackup(t)
+
+	do(http.MethodPut, "/v1/a", "changed")
+	do(http.MethodDelete, "/v1/b", "")
+	do(http.MethodPut, "/v1/c", "3")
+
+	rec := restoreBackup(t, backup)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `"keys":5,"changed":3`) {
+		t.Errorf("unexpected response %s", rec.Body)
+	}
+	if got := fmt.Sprint(storeMap()); got != want {
+		t.Errorf("expected %q after the restore, got %q", want, got)
+	}
+	if err := mutable("fixed"); !errors.Is(err, ErrImmutable) {
+		t.Error("expected fixed to stay immutable")
+	}
+
+	// The restore is logged, so replay gives the same store.
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewTransactionLogger(tl.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	withStore(t, make(map[string]string))
+	if _, err := replayEvents(replayed, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(storeMap()); got != want {
+		t.Errorf("expected %q after replay, got %q", want, got)
+	}
+	if err := mutable("fixed"); !errors.Is(err, ErrImmutable) {
+		t.Error("expected fixed to be immutable after replay")
+	}
+}
+
+func TestRestoreRejectsBadBackups(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+	withLogger(t)
+	backup := takeBackup(t)
+	PutContent("a", "2", "", writeAlways)
+
+	corrupt := bytes.Clone(backup)
+	corrupt[len(backupMagic)+4] ^= 0xff
+	for name, body := range map[string][]byte{
+		"corrupt":      corrupt,
+		"truncated":    backup[:len(backup)-1],
+		"not a backup": []byte("a\t1\n"),
+	} {
+		if rec := restoreBackup(t, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusBadRequest, rec.Code)
+		}
+	}
+	if v, _ := Get("a"); v != "2" {
+		t.Errorf("a bad backup changed the store: a is %q", v)
+	}
+
+	// An immutable key can't be changed by a restore either.
+	PutContent("fixed", "f", "", writeImmutable)
+	if rec := restoreBackup(t, backup); rec.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, rec.Code)
+	}
+	if v, _ := Get("a"); v != "2" {
+		t.Errorf("a refused restore changed the store: a is %q", v)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// blobBackend is a memory store that keeps values of threshold bytes or
+// more in files under dir, named by the SHA-256 of their content, and
+// only their names in memory. Keys holding the same large value share its
+// file.
+//
+// The file transaction log refers to the same files rather than holding
+// the values (see blobRef), so the files are part of what a replay reads
+// and outlive the backend. Each is synced before it is given its name,
+// and one no key holds any more is kept until the next startup, when
+// collectBlobs removes those neither the store nor the replayed log
+// refers to.
+type blobBackend struct {
+	dir       string
+	threshold int
+
+	values memoryBackend     // values smaller than threshold
+	blobs  map[string]string // key -> name of the file holding its value
+	logged map[string]bool   // files the replayed log refers to, until collectBlobs
+}
+
+// openBlobBackend returns an empty blob backend keeping values of at
+// least threshold bytes in dir, creating dir if needed. The blobs a
+// previous run left in dir stay for the replay to refer to.
+func openBlobBackend(dir string, threshold int) (*blobBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create blob directory: %w", err)
+	}
+
+	return &blobBackend{
+		dir:       dir,
+		threshold: threshold,
+		values:    make(memoryBackend),
+		blobs:     make(map[string]string),
+		logged:    make(map[string]bool),
+	}, nil
+}
+
+// isBlobName reports whether name is one blobBackend gives its files.
+func isBlobName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// newMemoryStore returns an empty backend for the memory store: a blob
+// backend if config.StoreBlobThreshold is set, a plain map otherwise.
+func newMemoryStore() (kvBackend, error) {
+	if config.StoreBlobThreshold <= 0 {
+		return make(memoryBackend), nil
+	}
+	return openBlobBackend(config.StoreBlobDir, config.StoreBlobThreshold)
+}
+
+func (b *blobBackend) get(key string) (string, bool, error) {
+	if value, ok := b.values[key]; ok {
+		return value, true, nil
+	}
+	name, ok := b.blobs[key]
+	if !ok {
+		return "", false, nil
+	}
+	value, err := b.read(key, name)
+	return value, err == nil, err
+}
+
+func (b *blobBackend) read(key, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(b.dir, name))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the value of %s: %w", key, err)
+	}
+	return string(data), nil
+}
+
+// update runs fn on the backend itself. A put only fails writing a new
+// file, before it changes anything, so an update of one key is all or
+// nothing; updates of several stage their values first.
+func (b *blobBackend) update(fn func(w kvWriter) error) error { return fn(b) }
+
+// each reads every large value from its file as it gets to it.
+func (b *blobBackend) each(fn func(key, value string) error) error {
+	if err := b.values.each(fn); err != nil {
+		return err
+	}
+	for k, name := range b.blobs {
+		value, err := b.read(k, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(k, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachKey walks the keys without opening a file.
+func (b *blobBackend) eachKey(fn func(key string) error) error {
+	if err := b.values.eachKey(fn); err != nil {
+		return err
+	}
+	for k := range b.blobs {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blobBackend) put(key, value string) error {
+	if len(value) < b.threshold {
+		delete(b.blobs, key)
+		b.values[key] = value
+		return nil
+	}
+
+	name, err := writeBlob(b.dir, value, false)
+	if err != nil {
+		return fmt.Errorf("cannot store the value of %s: %w", key, err)
+	}
+	b.putBlob(key, name)
+	return nil
+}
+
+// putBlob stores the value in the file name under key, as replaying a
+// blobRef does without reading the file.
+func (b *blobBackend) putBlob(key, name string) {
+	delete(b.values, key)
+	b.blobs[key] = name
+}
+
+func (b *blobBackend) delete(key string) error {
+	delete(b.values, key)
+	delete(b.blobs, key)
+	return nil
+}
+
+// stage writes the files of the values a batch is about to put, so that
+// putting them can't fail part way through the batch.
+func (b *blobBackend) stage(values []string) error {
+	for _, value := range values {
+		if len(value) < b.threshold {
+			continue
+		}
+		if _, err := writeBlob(b.dir, value, false); err != nil {
+			return fmt.Errorf("cannot store a value: %w", err)
+		}
+	}
+	return nil
+}
+
+// stageValues has a blob store write the files of values before an update
+// of several keys puts them. The caller must hold the store's write lock.
+func stageValues(values []string) error {
+	if b, ok := store.data.(*blobBackend); ok {
+		return b.stage(values)
+	}
+	return nil
+}
+
+// blobName returns the name of the file that holds value.
+func blobName(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeBlob stores value in dir under its name, unless a file of that name
+// is there already, and returns the name. The file is written and synced
+// under a temporary name first, so that one by the real name always holds
+// the whole value, crash or not. With durable set the directory is synced
+// as well, for a caller about to refer to the file in the log.
+func writeBlob(dir, value string, durable bool) (string, error) {
+	name := blobName(value)
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		if durable {
+			// Whoever wrote it may not have synced the directory yet.
+			return name, syncDir(dir)
+		}
+		return name, nil
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if durable {
+		return name, syncDir(dir)
+	}
+	return name, nil
+}
+
+// syncDir syncs the directory dir, making the files created or renamed in
+// it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// blobRef is how the file transaction log refers to a value kept in a
+// blob file rather than holding it: the file's name and the value's size,
+// which replay records without reading the file. It is written as
+// name:size, and marked in the log as an event's value (see writeEvent and
+// writeJSONEvent).
+type blobRef struct {
+	name string
+	size int
+}
+
+func (r blobRef) String() string {
+	return r.name + ":" + strconv.Itoa(r.size)
+}
+
+func parseBlobRef(s string) (blobRef, error) {
+	name, size, _ := strings.Cut(s, ":")
+	n, err := strconv.Atoi(size)
+	if !isBlobName(name) || err != nil || n < 0 {
+		return blobRef{}, fmt.Errorf("bad blob reference %q", s)
+	}
+	return blobRef{name: name, size: n}, nil
+}
+
+// logBlob returns e with a blobRef in place of its value if it puts one of
+// at least threshold bytes, which it writes to dir first. Smaller values
+// and other events are returned as they are.
+func logBlob(e Event, dir string, threshold int) (Event, error) {
+	if e.EventType != EventPut && e.EventType != EventPutImmutable || threshold <= 0 || len(e.Value) < threshold {
+		return e, nil
+	}
+	name, err := writeBlob(dir, e.Value, true)
+	if err != nil {
+		return e, fmt.Errorf("failed to store the value of %s: %w", e.Key, err)
+	}
+	e.Value, e.blob = blobRef{name: name, size: len(e.Value)}.String(), true
+	return e, nil
+}
+
+// eventValue returns the value e puts, reading it from the store's blob
+// directory if the log referred to it with a blobRef.
+func eventValue(e Event) (string, error) {
+	if !e.blob {
+		return e.Value, nil
+	}
+	ref, err := parseBlobRef(e.Value)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(config.StoreBlobDir, ref.name))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the value of %s: %w", e.Key, err)
+	}
+	if len(data) != ref.size {
+		return "", fmt.Errorf("the value of %s is %d bytes, the log says %d", e.Key, len(data), ref.size)
+	}
+	return string(data), nil
+}
+
+// putEvent is set for the value e puts. A blob store takes a blobRef as it
+// is, as the size the log gives and the file named; other stores are given
+// the value read from the file. The caller must hold the store's write
+// lock.
+func putEvent(w kvWriter, e Event) (created bool, err error) {
+	b, ok := w.(*blobBackend)
+	if !e.blob || !ok {
+		value, err := eventValue(e)
+		if err != nil {
+			return false, err
+		}
+		return set(w, e.Key, value)
+	}
+
+	ref, err := parseBlobRef(e.Value)
+	if err != nil {
+		return false, err
+	}
+	old, exists := storedSize(e.Key)
+	b.putBlob(e.Key, ref.name)
+	recordSet(e.Key, old, exists, ref.size)
+	return !exists, nil
+}
+
+// keepLoggedBlobs records the files the replayed log refers to, so that
+// collectBlobs leaves them for the next replay, which may not be into a
+// blob store.
+func keepLoggedBlobs(names map[string]bool) {
+	store.Lock()
+	defer store.Unlock()
+
+	if b, ok := store.data.(*blobBackend); ok {
+		for name := range names {
+			b.logged[name] = true
+		}
+	}
+}
+
+// collectBlobs removes the files of a blob store that no key holds and the
+// replayed log doesn't refer to, along with any a crash left half written.
+// It runs once the log has been replayed.
+func collectBlobs() error {
+	store.Lock()
+	defer store.Unlock()
+
+	b, ok := store.data.(*blobBackend)
+	if !ok {
+		return nil
+	}
+	keep := b.logged
+	b.logged = make(map[string]bool)
+	for _, name := range b.blobs {
+		keep[name] = true
+	}
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return fmt.Errorf("cannot read blob directory: %w", err)
+	}
+	removed := 0
+	for _, e := range entries {
+		if isBlobName(e.Name()) && !keep[e.Name()] || strings.HasPrefix(e.Name(), ".tmp-") {
+			if err := os.Remove(filepath.Join(b.dir, e.Name())); err != nil {
+				return fmt.Errorf("cannot remove unused blob: %w", err)
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		slog.Info("removed unused blobs", "files", removed)
+	}
+
+	return nil
+}
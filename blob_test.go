@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withBlobStore makes the store a blob backend keeping values of at least
+// threshold bytes on disk, returning it and its directory.
+func withBlobStore(t *testing.T, threshold int) (*blobBackend, string) {
+	t.Helper()
+
+	withStore(t, make(map[string]string))
+	dir := t.TempDir()
+	b, err := openBlobBackend(dir, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := useBackend(b); err != nil {
+		t.Fatal(err)
+	}
+	return b, dir
+}
+
+func blobFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestBlobStore(t *testing.T) {
+	b, dir := withBlobStore(t, 16)
+	logger := withLogger(t)
+
+	small, large := "small", strings.Repeat("large ", 10)
+	router := newRouter()
+	for key, value := range map[string]string{"small": small, "large": large, "copy": large} {
+		if code := putKey(router, key, value); code != http.StatusCreated {
+			t.Fatalf("PUT %s: unexpected status %d", key, code)
+		}
+	}
+
+	if _, ok := b.values["small"]; !ok {
+		t.Error("expected the small value to be kept in memory")
+	}
+	if _, ok := b.values["large"]; ok {
+		t.Error("expected the large value to be kept on disk")
+	}
+	if n := blobFiles(t, dir); n != 1 {
+		t.Errorf("expected the keys holding the same large value to share one file, got %d", n)
+	}
+
+	for key, want := range map[string]string{"small": small, "large": large, "copy": large} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/"+key, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("GET %s: got status %d and %q", key, rec.Code, rec.Body)
+		}
+	}
+
+	// A file no key holds stays until it is collected.
+	putKey(router, "copy", "now small")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/large", nil))
+	if n := blobFiles(t, dir); n != 1 {
+		t.Errorf("expected the unused file to stay until collected, got %d files", n)
+	}
+	if err := collectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if n := blobFiles(t, dir); n != 0 {
+		t.Errorf("expected the unused file to be collected, got %d files", n)
+	}
+	putKey(router, "large", large)
+
+	// Replay into a fresh blob store, as on a restart, brings back both
+	// kinds of value.
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewTransactionLogger(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	b, dir = withBlobStore(t, 16)
+	if _, err := replayEvents(replayed, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"small": small, "large": large, "copy": "now small"} {
+		if got, err := Get(key); err != nil || got != want {
+			t.Errorf("%s after replay: got %q, %v", key, got, err)
+		}
+	}
+	if _, ok := b.blobs["large"]; !ok || blobFiles(t, dir) != 1 {
+		t.Error("expected replay to put the large value back on disk")
+	}
+}
+
+func TestCollectBlobs(t *testing.T) {
+	b, dir := withBlobStore(t, 1)
+
+	held, logged, unused := "held", "logged", "unused"
+	for _, value := range []string{held, logged, unused} {
+		if _, err := writeBlob(dir, value, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{".tmp-123", "README"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Put("a", held); err != nil {
+		t.Fatal(err)
+	}
+	keepLoggedBlobs(map[string]bool{blobName(logged): true})
+
+	if err := collectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{blobName(held), blobName(logged), "README"}
+	sort.Strings(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("expected %v to be left, got %v", want, names)
+	}
+	if len(b.logged) != 0 {
+		t.Error("expected the logged blobs to be forgotten once collected")
+	}
+}
+
+// TestBlobRefsReplay logs values above and below the threshold to a file
+// log that refers to the blobs, and replays them into a blob store and a
+// plain one.
+func TestBlobRefsReplay(t *testing.T) {
+	for _, format := range []LogFormat{LogFormatTab, LogFormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			_, dir := withBlobStore(t, 16)
+			saved := config.StoreBlobDir
+			config.StoreBlobDir = dir
+			t.Cleanup(func() { config.StoreBlobDir = saved })
+			logger := withLoggerOptions(t, FileLoggerOptions{Format: format, BlobDir: dir, BlobThreshold: 16})
+
+			small, large, other := "small", strings.Repeat("large ", 10), strings.Repeat("other ", 10)
+			want := map[string]string{"small": small, "large": large, "frozen": other}
+			router := newRouter()
+			for _, key := range []string{"small", "large", "replaced"} {
+				if code := putKey(router, key, large); code != http.StatusCreated {
+					t.Fatalf("PUT %s: unexpected status %d", key, code)
+				}
+			}
+			putKey(router, "small", small)
+			putKey(router, "replaced", other)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/v1/replaced", nil))
+			req := httptest.NewRequest(http.MethodPut, "/v1/frozen", strings.NewReader(other))
+			req.Header.Set("Immutable", "true")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			if err := logger.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(logger.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(data), large) || !strings.Contains(string(data), blobRef{name: blobName(large), size: len(large)}.String()) {
+				t.Fatalf("expected the log to refer to the large value, got %q", data)
+			}
+			if !strings.Contains(string(data), small) {
+				t.Fatalf("expected the log to hold the small value, got %q", data)
+			}
+
+			replay := func(t *testing.T) {
+				t.Helper()
+				replayed, err := NewTransactionLoggerWithOptions(logger.filename, FileLoggerOptions{Format: format})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer replayed.Close()
+				if _, err := replayEvents(replayed, 0, nil); err != nil {
+					t.Fatal(err)
+				}
+				for key, value := range want {
+					if got, err := Get(key); err != nil || got != value {
+						t.Errorf("%s after replay: got %q, %v", key, got, err)
+					}
+				}
+				if _, err := Get("replaced"); err == nil {
+					t.Error("expected the deleted key to stay deleted")
+				}
+				if _, meta, err := GetWithMetadata("frozen"); err != nil || !meta.Immutable {
+					t.Error("expected the immutable put to be replayed as immutable")
+				}
+				if stats := Stats(); stats.ValueBytes != int64(len(small)+len(large)+len(other)) {
+					t.Errorf("expected %d value bytes, got %d", len(small)+len(large)+len(other), stats.ValueBytes)
+				}
+			}
+
+			b, _ := withBlobStore(t, 16)
+			b.dir = dir
+			replay(t)
+			if b.blobs["large"] != blobName(large) {
+				t.Error("expected the blob store to take the reference as it is")
+			}
+
+			withStore(t, make(map[string]string))
+			replay(t)
+		})
+	}
+}
+
+// TestBlobStoreBatchIsAllOrNothing checks that a transaction whose values
+// can't be written to disk changes nothing.
+func TestBlobStoreBatchIsAllOrNothing(t *testing.T) {
+	_, dir := withBlobStore(t, 16)
+	if _, err := Put("a", "small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ApplyTx([]TxOp{
+		{Op: "put", Key: "a", Value: "replaced"},
+		{Op: "put", Key: "b", Value: strings.Repeat("large ", 10)},
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to fail")
+	}
+	if got, _ := Get("a"); got != "small" {
+		t.Errorf("expected a to be left alone, got %q", got)
+	}
+	if _, err := Get("b"); err == nil {
+		t.Error("expected b not to be created")
+	}
+	if stats := Stats(); stats.Keys != 1 || stats.ValueBytes != int64(len("small")) {
+		t.Errorf("expected the totals to be left alone, got %+v", stats)
+	}
+}
+
+func TestBlobStoreSizesWithoutReading(t *testing.T) {
+	_, dir := withBlobStore(t, 16)
+
+	large := strings.Repeat("large ", 10)
+	if _, err := Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Put("small", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With its file gone, the large value can't be read, but listing the
+	// keys and replacing the value don't need to read it.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int)
+	for _, k := range keys {
+		sizes[k.Key] = k.Size
+	}
+	if sizes["large"] != len(large) || sizes["small"] != 1 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+	if _, err := IdleKeys(time.Now()); err != nil {
+		t.Errorf("IdleKeys: %v", err)
+	}
+	if _, err := Put("large", "replaced"); err != nil {
+		t.Errorf("replacing the value: %v", err)
+	}
+	if stats := Stats(); stats.ValueBytes != int64(len("replaced")+1) {
+		t.Errorf("expected %d value bytes, got %d", len("replaced")+1, stats.ValueBytes)
+	}
+}
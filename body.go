@@ -0,0 +1,80 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	errBodyTooLarge        = errors.New("request body too large")
+	errMalformedBody       = errors.New("malformed request body")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// readBody reads a request body of at most limit bytes, transparently
+// decompressing it according to its Content-Encoding (gzip or deflate).
+// The limit applies to the decompressed size so that a small compressed
+// body can't expand into an arbitrarily large value.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	var body io.Reader = r.Body
+
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, bodyError(err)
+		}
+		defer zr.Close()
+		body = zr
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, bodyError(err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+
+	value, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if int64(len(value)) > limit {
+		return nil, errBodyTooLarge
+	}
+
+	return value, nil
+}
+
+// bodyError classifies an error from reading a (possibly compressed)
+// body: exceeding the MaxBytesReader limit is passed through, anything
+// else while decoding means the body was malformed.
+func bodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+
+	return fmt.Errorf("%w: %v", errMalformedBody, err)
+}
+
+// writeBodyError answers a request whose body couldn't be read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errMalformedBody):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errUnsupportedEncoding):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
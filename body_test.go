@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func putEncoded(body []byte, encoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/v1/compressed-key", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", encoding)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestPutGzipBody(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	rec := putEncoded(gzipped(t, []byte("compressed value")), "gzip")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := Get("compressed-key"); value != "compressed value" {
+		t.Errorf("unexpected stored value %q", value)
+	}
+}
+
+func TestPutDeflateBody(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte("deflated value"))
+	zw.Close()
+
+	rec := putEncoded(buf.Bytes(), "deflate")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if value, _ := Get("compressed-key"); value != "deflated value" {
+		t.Errorf("unexpected stored value %q", value)
+	}
+}
+
+func TestPutMalformedGzipBody(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	if rec := putEncoded([]byte("definitely not gzip"), "gzip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	truncated := gzipped(t, []byte(strings.Repeat("value ", 100)))
+	if rec := putEncoded(truncated[:len(truncated)/2], "gzip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for truncated body, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if _, err := Get("compressed-key"); err == nil {
+		t.Error("malformed body was stored")
+	}
+}
+
+func TestPutGzipBomb(t *testing.T) {
+	withStore(t, make(map[string]string))
+	defer func(limit int64) { config.MaxBodyBytes = limit }(config.MaxBodyBytes)
+	config.MaxBodyBytes = 4 << 10
+
+	// A few hundred bytes of gzip that expand well past the limit.
+	bomb := gzipped(t, make([]byte, 1<<20))
+	if int64(len(bomb)) > config.MaxBodyBytes {
+		t.Fatalf("compressed body is %d bytes, expected it under the limit", len(bomb))
+	}
+
+	if rec := putEncoded(bomb, "gzip"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+func TestPutUnsupportedEncoding(t *testing.T) {
+	if rec := putEncoded([]byte("value"), "br"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d, got %d", http.StatusUnsupportedMediaType, rec.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltDataBucket = []byte("kv")
+	boltMetaBucket = []byte("meta")
+	// boltImmutableBucket holds the keys that are immutable, with empty
+	// values, since the metadata that marks them is kept in memory.
+	boltImmutableBucket = []byte("immutable")
+	checkpointKey       = []byte("checkpoint")
+)
+
+// boltBackend keeps the store in a bbolt database, so the data survives a
+// restart without replaying the transaction log. The log then serves as a
+// write-ahead log: the database records a checkpoint, the sequence number
+// of the latest event known to be reflected in it, and only events after
+// the checkpoint are replayed on startup.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func openBoltBackend(path string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open store database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltDataBucket, boltMetaBucket, boltImmutableBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot initialize store database: %w", err)
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) get(key string) (value string, ok bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value, ok, _ = boltWriter{bucket: tx.Bucket(boltDataBucket)}.get(key)
+		return nil
+	})
+	return value, ok, err
+}
+
+func (b *boltBackend) update(fn func(w kvWriter) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltWriter{tx.Bucket(boltDataBucket), tx.Bucket(boltImmutableBucket)})
+	})
+}
+
+func (b *boltBackend) each(fn func(key, value string) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDataBucket).ForEach(func(k, v []byte) error {
+			return fn(string(k), string(v))
+		})
+	})
+}
+
+// eachKey walks the keys without copying their values out of the
+// database.
+func (b *boltBackend) eachKey(fn func(key string) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDataBucket).ForEach(func(k, _ []byte) error {
+			return fn(string(k))
+		})
+	})
+}
+
+// immutableKeys returns the keys marked immutable in the database.
+func (b *boltBackend) immutableKeys() ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltImmutableBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// checkpoint returns the sequence number recorded by setCheckpoint, or 0
+// if there is none.
+func (b *boltBackend) checkpoint() (uint64, error) {
+	var seq uint64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get(checkpointKey); len(v) == 8 {
+			seq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// setCheckpoint records that every event up to seq has been applied to the
+// database.
+func (b *boltBackend) setCheckpoint(seq uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, seq)
+		return tx.Bucket(boltMetaBucket).Put(checkpointKey, v)
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltWriter works on the data bucket within a bbolt transaction.
+type boltWriter struct {
+	bucket    *bolt.Bucket
+	immutable *bolt.Bucket // marks of immutable keys, nil for reads
+}
+
+func (w boltWriter) get(key string) (string, bool, error) {
+	v := w.bucket.Get([]byte(key))
+	if v == nil {
+		return "", false, nil
+	}
+	return string(v), true, nil // string copies v, which is only valid during the transaction
+}
+
+func (w boltWriter) put(key, value string) error {
+	return w.bucket.Put([]byte(key), []byte(value))
+}
+
+func (w boltWriter) delete(key string) error {
+	if err := w.immutable.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return w.bucket.Delete([]byte(key))
+}
+
+func (w boltWriter) markImmutable(key string) error {
+	return w.immutable.Put([]byte(key), nil)
+}
+
+// checkpointStore records the logger's latest sequence number as the
+// database's checkpoint. Every write is committed to the database before
+// it is logged, so once the logger has been flushed with writes blocked,
+// the database reflects every event the log holds.
+func checkpointStore(b *boltBackend) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := transactionLogger.Flush(); err != nil {
+		return err
+	}
+
+	return b.setCheckpoint(transactionLogger.LastSequence())
+}
+
+// startCheckpointer checkpoints the store at interval until the returned
+// function is called.
+func startCheckpointer(b *boltBackend, interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if err := checkpointStore(b); err != nil {
+					slog.Error("store checkpoint failed", "err", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// withBoltStore opens a bbolt store at path and makes it the store's
+// backend until the test ends or the returned function closes it.
+func withBoltStore(t *testing.T, path string) (*boltBackend, func()) {
+	t.Helper()
+
+	withStore(t, make(map[string]string)) // restores the previous backend afterwards
+
+	b, err := openBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := useBackend(b); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := false
+	closeStore := func() {
+		if !closed {
+			closed = true
+			b.Close()
+		}
+	}
+	t.Cleanup(closeStore)
+
+	return b, closeStore
+}
+
+func TestBoltStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.db")
+
+	_, closeStore := withBoltStore(t, path)
+	Put("kept", "one")
+	Put("dropped", "two")
+	Delete("dropped")
+	closeStore()
+
+	withBoltStore(t, path)
+	if got, err := Get("kept"); err != nil || got != "one" {
+		t.Errorf("expected kept=one after reopening, got %q, %v", got, err)
+	}
+	if _, err := Get("dropped"); err == nil {
+		t.Error("expected dropped to stay deleted after reopening")
+	}
+	if stats := Stats(); stats.Keys != 1 || stats.KeyBytes != 4 || stats.ValueBytes != 3 {
+		t.Errorf("unexpected stats after reopening: %+v", stats)
+	}
+}
+
+func TestBoltStoreRestartReplaysAfterCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, logPath := filepath.Join(dir, "kvstore.db"), filepath.Join(dir, "transaction.log")
+
+	// First run: one write is checkpointed, the next two are only
+	// guaranteed to be in the log when the process goes away.
+	b, closeStore := withBoltStore(t, dbPath)
+	tl, err := NewTransactionLogger(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	saved := transactionLogger
+	transactionLogger = tl
+	defer func() { transactionLogger = saved }()
+
+	Put("a", "1")
+	tl.WritePut("a", "1")
+	if err := checkpointStore(b); err != nil {
+		t.Fatal(err)
+	}
+	Put("b", "2")
+	tl.WritePut("b", "2")
+	Delete("a")
+	tl.WriteDelete("a")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closeStore()
+
+	// Second run: only the events after the checkpoint are replayed.
+	b, _ = withBoltStore(t, dbPath)
+	checkpoint, err := b.checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != 1 {
+		t.Fatalf("expected checkpoint 1, got %d", checkpoint)
+	}
+
+	tl, err = NewTransactionLogger(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	count, err := replayEventsAfter(tl, checkpoint, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected the 2 events after the checkpoint to be replayed, got %d", count)
+	}
+	if _, err := Get("a"); err == nil {
+		t.Error("expected a to be deleted")
+	}
+	if got, _ := Get("b"); got != "2" {
+		t.Errorf("expected b=2, got %q", got)
+	}
+}
+
+func TestBoltStoreTx(t *testing.T) {
+	withBoltStore(t, filepath.Join(t.TempDir(), "kvstore.db"))
+	Put("balance", "10")
+
+	expected := "7"
+	if _, err := ApplyTx([]TxOp{
+		{Op: "put", Key: "other", Value: "x"},
+		{Op: "cas", Key: "balance", Expected: &expected, Value: "5"},
+	}); err == nil {
+		t.Fatal("expected the cas to fail")
+	}
+	if _, err := Get("other"); err == nil {
+		t.Error("aborted transaction was applied")
+	}
+
+	expected = "10"
+	if _, err := ApplyTx([]TxOp{
+		{Op: "put", Key: "other", Value: "x"},
+		{Op: "cas", Key: "balance", Expected: &expected, Value: "5"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Get("balance"); got != "5" {
+		t.Errorf("expected balance=5, got %q", got)
+	}
+}
+
+func TestBoltStoreKeepsImmutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.db")
+
+	_, closeStore := withBoltStore(t, path)
+	if _, stored, err := PutContent("fixed", "one", "", writeImmutable); err != nil || !stored {
+		t.Fatalf("expected the immutable key to be created, got %v %v", stored, err)
+	}
+	Put("loose", "two")
+	closeStore()
+
+	withBoltStore(t, path)
+	if _, err := Put("fixed", "three"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("expected fixed to stay immutable after reopening, got %v", err)
+	}
+	if _, err := Put("loose", "three"); err != nil {
+		t.Errorf("expected loose to stay mutable, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling the database while its
+// circuit breaker is open.
+var errCircuitOpen = errors.New("database circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // calls go through
+	breakerHalfOpen                     // one call goes through to probe the database
+	breakerOpen                         // calls fail without being tried
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// circuitBreaker stops calls to a database that keeps failing, so that
+// they fail at once instead of each waiting for the connection to time
+// out. After threshold consecutive failures the circuit opens for
+// cooldown; the first call after that is let through as a probe, which
+// closes the circuit again if it succeeds and reopens it if it fails.
+//
+// A nil breaker lets every call through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the circuit last opened
+	probing  bool      // a probe is in flight while half-open
+}
+
+// newCircuitBreaker returns a breaker that opens after threshold
+// consecutive failures, or nil, which never opens, if threshold is 0.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns errCircuitOpen if a call shouldn't be made now. Once the
+// cooldown is over it lets a single probe through. Every call allowed
+// must be reported to record.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		slog.Info("database circuit breaker is half-open, probing the database")
+	case breakerHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+	}
+	b.probing = b.state == breakerHalfOpen
+
+	return nil
+}
+
+// record reports the result of a call allow let through.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		if b.state != breakerClosed {
+			slog.Info("database circuit breaker closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			slog.Warn("database circuit breaker opened", "failures", b.failures, "cooldown", b.cooldown, "err", err)
+		}
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// State returns the state of the circuit.
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// retryAfter returns how much longer the circuit stays open, or 0 if
+// calls are let through, if only as a probe.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	if left := b.cooldown - b.now().Sub(b.openedAt); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// breakerReporter is implemented by loggers that guard their backend
+// with a circuit breaker.
+type breakerReporter interface {
+	Breaker() *circuitBreaker
+}
+
+// loggerBreaker returns the circuit breaker of the transaction logger, or
+// nil if it has none.
+func loggerBreaker() *circuitBreaker {
+	if r, ok := transactionLogger.(breakerReporter); ok {
+		return r.Breaker()
+	}
+	return nil
+}
+
+// rejectWhenCircuitOpen answers 503 instead of calling next while the
+// transaction logger's circuit breaker is open, since the write couldn't
+// be logged. Retry-After says when the database will be tried again.
+func rejectWhenCircuitOpen(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := loggerBreaker().retryAfter(); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "database is unavailable, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(threshold int, cooldown time.Duration) (*circuitBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	b := newCircuitBreaker(threshold, cooldown)
+	b.now = clock.now
+	return b, clock
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b, clock := newTestBreaker(3, 10*time.Second)
+
+	// insert stands in for a database that is down until told otherwise.
+	down, calls := true, 0
+	insert := func() error {
+		if err := b.allow(); err != nil {
+			return err
+		}
+		calls++
+		var err error
+		if down {
+			err = errors.New("connection refused")
+		}
+		b.record(err)
+		return err
+	}
+	expect := func(state breakerState, wantCalls int) {
+		t.Helper()
+		if got := b.State(); got != state {
+			t.Errorf("expected the circuit to be %s, got %s", state, got)
+		}
+		if calls != wantCalls {
+			t.Errorf("expected %d calls to reach the database, got %d", wantCalls, calls)
+		}
+	}
+
+	insert()
+	insert()
+	expect(breakerClosed, 2)
+	insert()
+	expect(breakerOpen, 3)
+
+	// While open, calls fail without reaching the database.
+	if err := insert(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("expected %v, got %v", errCircuitOpen, err)
+	}
+	expect(breakerOpen, 3)
+	if got := b.retryAfter(); got != 10*time.Second {
+		t.Errorf("expected to retry after 10s, got %v", got)
+	}
+
+	// A failed probe opens the circuit for another cooldown.
+	clock.advance(10 * time.Second)
+	if got := b.retryAfter(); got != 0 {
+		t.Errorf("expected no wait once the cooldown is over, got %v", got)
+	}
+	insert()
+	expect(breakerOpen, 4)
+	clock.advance(5 * time.Second)
+	insert()
+	expect(breakerOpen, 4)
+
+	// Half-open lets a single probe through.
+	clock.advance(5 * time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != breakerHalfOpen {
+		t.Errorf("expected the circuit to be half-open, got %s", b.State())
+	}
+	if err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("expected a second probe to be refused, got %v", err)
+	}
+
+	// A successful probe closes it, and failures are counted afresh.
+	down = false
+	b.record(nil)
+	expect(breakerClosed, 4)
+	down = true
+	insert()
+	insert()
+	expect(breakerClosed, 6)
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *circuitBreaker
+	if newCircuitBreaker(0, time.Second) != nil {
+		t.Error("expected a threshold of 0 to disable the breaker")
+	}
+	for i := 0; i < 10; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.record(errors.New("connection refused"))
+	}
+	if b.State() != breakerClosed || b.retryAfter() != 0 {
+		t.Error("a nil breaker opened")
+	}
+}
+
+// breakerLogger is a logger guarded by a circuit breaker.
+type breakerLogger struct {
+	TransactionLogger
+	breaker *circuitBreaker
+}
+
+func (l breakerLogger) Breaker() *circuitBreaker { return l.breaker }
+
+func TestWritesRefusedWhileCircuitOpen(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+	b, clock := newTestBreaker(1, 10*time.Second)
+
+	savedLogger, savedChecks, savedGauges := transactionLogger, readinessChecks.m, metrics.gauges
+	t.Cleanup(func() {
+		transactionLogger, readinessChecks.m, metrics.gauges = savedLogger, savedChecks, savedGauges
+	})
+	transactionLogger = breakerLogger{TransactionLogger: NewMemoryTransactionLogger(), breaker: b}
+	readinessChecks.m = make(map[string]func() error)
+	metrics.gauges = nil
+	registerLoggerHealth(transactionLogger)
+
+	router := newRouter()
+	request := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader("2")))
+		return rec
+	}
+
+	b.allow()
+	b.record(errors.New("connection refused"))
+
+	rec := request(http.MethodPut, "/v1/a")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT: expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("expected Retry-After 10, got %q", got)
+	}
+	if got := storeMap()["a"]; got != "1" {
+		t.Errorf("a write went through while the circuit was open, a is %q", got)
+	}
+	if rec := request(http.MethodGet, "/v1/a"); rec.Code != http.StatusOK {
+		t.Errorf("GET: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if rec := request(http.MethodGet, "/ready"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready: expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec := request(http.MethodGet, "/metrics"); !strings.Contains(rec.Body.String(), "kvstore_db_circuit_state 2") {
+		t.Errorf("expected the open circuit in the metrics, got:\n%s", rec.Body.String())
+	}
+
+	// Once the cooldown is over, writes are let through to probe the
+	// database.
+	clock.advance(10 * time.Second)
+	if rec := request(http.MethodPut, "/v1/a"); rec.Code != http.StatusOK {
+		t.Errorf("PUT after cooldown: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	b.allow()
+	b.record(nil)
+	if rec := request(http.MethodGet, "/ready"); rec.Code != http.StatusOK {
+		t.Errorf("/ready after recovery: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if rec := request(http.MethodGet, "/metrics"); !strings.Contains(rec.Body.String(), "kvstore_db_circuit_state 0") {
+		t.Errorf("expected the closed circuit in the metrics, got:\n%s", rec.Body.String())
+	}
+}
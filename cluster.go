@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ringPoints is how many points each node has on the hash ring. More
+// points spread the keys more evenly between the nodes.
+const ringPoints = 128
+
+// hashRing assigns keys to the nodes of a cluster by consistent hashing.
+// Each node is placed at ringPoints points on a ring of 32-bit FNV-1a
+// hashes, and a key belongs to the node at the first point at or after
+// the key's own hash. Adding or removing a node only moves the keys
+// between its points and the ones before them.
+type hashRing struct {
+	points []uint32          // sorted
+	nodes  map[uint32]string // point -> node placed there
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]string, len(nodes)*ringPoints)}
+	for _, node := range nodes {
+		for i := 0; i < ringPoints; i++ {
+			p := ringHash(node + "#" + strconv.Itoa(i))
+			// On the rare collision the point goes to the node that sorts
+			// first, so that every node agrees on the owner whatever the
+			// order it was given the nodes in.
+			if other, ok := r.nodes[p]; ok && other < node {
+				continue
+			}
+			r.nodes[p] = node
+		}
+	}
+	for p := range r.nodes {
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// owner returns the node key belongs to.
+func (r *hashRing) owner(key string) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// parseClusterNodes returns the nodes of the comma-separated list, without
+// trailing slashes, checking that each is an absolute http or https URL
+// and that self is one of them. It returns nil if the list is empty.
+func parseClusterNodes(list, self string) ([]string, error) {
+	if list == "" {
+		if self != "" {
+			return nil, errors.New("-cluster-self needs -cluster-nodes")
+		}
+		return nil, nil
+	}
+
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		node = strings.TrimSuffix(strings.TrimSpace(node), "/")
+		u, err := url.Parse(node)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("bad cluster node %q, expected a URL such as http://10.0.0.1:4000", node)
+		}
+		if slices.Contains(nodes, node) {
+			return nil, fmt.Errorf("cluster node %s is listed twice", node)
+		}
+		nodes = append(nodes, node)
+	}
+	if !slices.Contains(nodes, strings.TrimSuffix(self, "/")) {
+		return nil, fmt.Errorf("-cluster-self %q must be one of -cluster-nodes", self)
+	}
+
+	return nodes, nil
+}
+
+// clusterRouting redirects requests for keys another node of the cluster
+// owns to that node.
+type clusterRouting struct {
+	ring *hashRing
+	self string
+}
+
+// newClusterRouting returns the routing of config.ClusterNodes, or nil if
+// the node isn't part of a cluster.
+func newClusterRouting() *clusterRouting {
+	nodes, err := parseClusterNodes(config.ClusterNodes, config.ClusterSelf)
+	if err != nil || nodes == nil {
+		// parseConfig has already rejected bad nodes.
+		return nil
+	}
+	return &clusterRouting{ring: newHashRing(nodes), self: strings.TrimSuffix(config.ClusterSelf, "/")}
+}
+
+// redirect answers a request for a key another node owns with a 307 to the
+// same path and query on that node. Unlike a 301 or 302, a 307 has the
+// client repeat the request as it was, method and body included, and
+// clients can remember which node has the key. Requests for keys this
+// node owns are passed to next.
+func (c *clusterRouting) redirect(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if owner := c.ring.owner(requestKey(r)); owner != c.self {
+			http.Redirect(w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ownsNewKey refuses a rename to a key another node owns, which would
+// leave the value on a node that no request for it is sent to.
+func (c *clusterRouting) ownsNewKey(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newKey := normalizeKey(r.URL.Query().Get("newKey"))
+		if owner := c.ring.owner(newKey); newKey != "" && owner != c.self {
+			http.Error(w, fmt.Sprintf("key %s belongs to %s; keys can't be renamed across nodes", newKey, owner), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
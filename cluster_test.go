@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testNodes = []string{"http://a:4000", "http://b:4000", "http://c:4000"}
+
+// withCluster makes the node self in a cluster of testNodes.
+func withCluster(t *testing.T, self string) *hashRing {
+	t.Helper()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ClusterNodes, config.ClusterSelf = strings.Join(testNodes, ","), self
+	return newHashRing(testNodes)
+}
+
+// keyOwnedBy returns a key ring assigns to node.
+func keyOwnedBy(t *testing.T, ring *hashRing, node string) string {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("key%d", i); ring.owner(key) == node {
+			return key
+		}
+	}
+	t.Fatalf("no key owned by %s", node)
+	return ""
+}
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing(testNodes)
+	reversed := newHashRing([]string{testNodes[2], testNodes[1], testNodes[0]})
+	shrunk := newHashRing(testNodes[:2])
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ring.owner(key)
+		counts[owner]++
+		if reversed.owner(key) != owner {
+			t.Fatalf("%s: owner depends on the order of the nodes", key)
+		}
+		// Removing c only moves c's keys.
+		if owner != testNodes[2] && shrunk.owner(key) != owner {
+			t.Errorf("%s moved from %s to %s when another node left", key, owner, shrunk.owner(key))
+		}
+	}
+	for _, node := range testNodes {
+		if counts[node] < 500 {
+			t.Errorf("expected the keys to be spread over the nodes, got %v", counts)
+			break
+		}
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	ring := withCluster(t, "http://a:4000/")
+	router := newRouter()
+
+	remote := keyOwnedBy(t, ring, "http://b:4000")
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, "/v1/"+remote+"?encoding=base64", strings.NewReader("dmFsdWU=")))
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("%s %s: expected a redirect, got %d", method, remote, rec.Code)
+		}
+		if want := "http://b:4000/v1/" + remote + "?encoding=base64"; rec.Header().Get("Location") != want {
+			t.Errorf("%s %s: expected Location %s, got %s", method, remote, want, rec.Header().Get("Location"))
+		}
+	}
+	if _, err := Get(remote); err == nil {
+		t.Errorf("expected %s not to be stored here", remote)
+	}
+
+	local := keyOwnedBy(t, ring, "http://a:4000")
+	if code := putKey(router, local, "value"); code != http.StatusCreated {
+		t.Fatalf("PUT %s: expected it to be stored here, got %d", local, code)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/"+local, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "value" {
+		t.Errorf("GET %s: got %d %q", local, rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/"+local+"/rename?newKey="+remote, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a rename to a key on another node to be refused, got %d", rec.Code)
+	}
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	for _, tt := range []struct {
+		nodes, self string
+		ok          bool
+	}{
+		{"", "", true},
+		{"http://a:4000, http://b:4000/", "http://b:4000", true},
+		{"", "http://a:4000", false},
+		{"http://a:4000", "", false},
+		{"http://a:4000,http://b:4000", "http://c:4000", false},
+		{"http://a:4000,http://a:4000/", "http://a:4000", false},
+		{"a:4000", "a:4000", false},
+		{"http://a:4000/kv", "http://a:4000/kv", false},
+	} {
+		if _, err := parseClusterNodes(tt.nodes, tt.self); (err == nil) != tt.ok {
+			t.Errorf("nodes %q, self %q: got error %v", tt.nodes, tt.self, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// CompactionStats describes the log before and after a compaction.
+type CompactionStats struct {
+	BytesBefore   int64 `json:"bytes_before"`
+	BytesAfter    int64 `json:"bytes_after"`
+	RecordsBefore int   `json:"records_before"`
+	RecordsAfter  int   `json:"records_after"`
+}
+
+// Compact rewrites the log so that it only holds the latest put of every
+// live key, dropping overwritten values and deleted keys. Events keep
+// their original sequence numbers. The compacted log is written to a
+// temporary file which is then renamed over the old one, so a crash
+// mid-compaction leaves the old log intact. Writes are blocked while the
+// compaction runs.
+func (ftl *FileTransactionLogger) Compact() (CompactionStats, error) {
+	return ftl.compact(nil)
+}
+
+// compact compacts the log as Compact does, adding the bytes of the old
+// log to read, if set, as they are read, so that the progress of a long
+// compaction can be followed.
+func (ftl *FileTransactionLogger) compact(read *atomic.Int64) (CompactionStats, error) {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	var stats CompactionStats
+
+	if err := ftl.flush(); err != nil {
+		return stats, err
+	}
+
+	if ftl.options.CompactBackups > 0 {
+		if err := ftl.backup(); err != nil {
+			return stats, err
+		}
+	}
+
+	src, err := os.Open(ftl.filename)
+	if err != nil {
+		return stats, fmt.Errorf("cannot open transaction log: %w", err)
+	}
+	defer src.Close()
+
+	live := make(map[string]Event)
+	scanner := newBufferScanner(src)
+	var decoder logDecoder
+	for scanner.Scan() {
+		n := int64(scanner.Len())
+		stats.BytesBefore += n
+		if read != nil {
+			read.Add(n)
+		}
+
+		e, ok, err := decoder.decode(scanner.Bytes())
+		if err != nil {
+			return stats, fmt.Errorf("input parse error: %w", err)
+		}
+		if !ok {
+			continue // the format header
+		}
+		stats.RecordsBefore++
+
+		switch e.EventType {
+		case EventDelete:
+			delete(live, e.Key)
+		case EventPut, EventPutImmutable:
+			live[e.Key] = e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	events := make([]Event, 0, len(live))
+	for _, e := range live {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+
+	// The compacted log is written in the configured format, which moves
+	// a log written in another one over to it.
+	stats.BytesAfter, err = ftl.rewrite(ftl.options.Format, decoder.base, events)
+	if err != nil {
+		return stats, err
+	}
+	stats.RecordsAfter = len(events)
+
+	ftl.sinceRecs = 0
+	ftl.sinceBytes = 0
+
+	return stats, nil
+}
+
+// Truncate drops the events with sequence numbers up to and including
+// seq from the log, once a snapshot holds their effect. The header of the
+// truncated log records seq, so that sequence numbers carry on from it
+// even if no events are left. The log can only be replayed on top of the
+// snapshot after this.
+func (ftl *FileTransactionLogger) Truncate(seq uint64) error {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	if err := ftl.flush(); err != nil {
+		return err
+	}
+
+	src, err := os.Open(ftl.filename)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log: %w", err)
+	}
+	defer src.Close()
+
+	var kept []Event
+	var decoder logDecoder
+	scanner := newBufferScanner(src)
+	for scanner.Scan() {
+		e, ok, err := decoder.decode(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("input parse error: %w", err)
+		}
+		if ok && e.Sequence > seq {
+			kept = append(kept, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	if decoder.base > seq {
+		seq = decoder.base
+	}
+	size, err := ftl.rewrite(ftl.format, seq, kept)
+	if err != nil {
+		return err
+	}
+
+	ftl.sinceRecs = len(kept)
+	ftl.sinceBytes = size
+
+	return nil
+}
+
+// rewrite replaces the log file with one holding events in format after
+// a header recording base, and returns the size of the new file. The new
+// log is written to a temporary file which is then renamed over the old
+// one, so a crash part way leaves the old log intact. The caller must
+// hold ftl.mu and have flushed the writer.
+func (ftl *FileTransactionLogger) rewrite(format LogFormat, base uint64, events []Event) (int64, error) {
+	tmpName := ftl.filename + ".rewrite"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create new log: %w", err)
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	header, err := w.WriteString(logHeader(format, base))
+	if err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write new log: %w", err)
+	}
+	size := int64(header)
+	for _, e := range events {
+		n, err := format.codec().encode(w, e)
+		if err != nil {
+			tmp.Close()
+			return 0, fmt.Errorf("failed to write new log: %w", err)
+		}
+		size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write new log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to sync new log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close new log: %w", err)
+	}
+
+	if err := os.Rename(tmpName, ftl.filename); err != nil {
+		return 0, fmt.Errorf("failed to replace transaction log: %w", err)
+	}
+
+	file, err := os.OpenFile(ftl.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return 0, fmt.Errorf("cannot reopen transaction log: %w", err)
+	}
+	ftl.file.Close()
+	ftl.file = file
+	ftl.writer.Reset(file)
+	ftl.format, ftl.version = format, logFormatVersion
+
+	return size, nil
+}
+
+// backup copies the log to a timestamped .bak file next to it before it
+// is compacted, then removes the oldest backups beyond the configured
+// retention count.
+func (ftl *FileTransactionLogger) backup() error {
+	src, err := os.Open(ftl.filename)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log: %w", err)
+	}
+	defer src.Close()
+
+	name := fmt.Sprintf("%s.%s.bak", ftl.filename, time.Now().UTC().Format("20060102T150405.000000000"))
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create log backup: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write log backup: %w", err)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to sync log backup: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close log backup: %w", err)
+	}
+
+	backups, err := ftl.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > ftl.options.CompactBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("failed to remove old log backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// backups returns the paths of the log's backups, oldest first.
+func (ftl *FileTransactionLogger) backups() ([]string, error) {
+	backups, err := filepath.Glob(ftl.filename + ".*.bak")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups) // timestamps in the names sort chronologically
+
+	return backups, nil
+}
+
+// compactor runs compactions of a file logger in the background, either
+// on a fixed interval or when the logger reports that it has grown past
+// one of its thresholds.
+type compactor struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startCompactor(ftl *FileTransactionLogger) *compactor {
+	c := &compactor{quit: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(c.done)
+
+		var tick <-chan time.Time
+		if ftl.options.CompactInterval > 0 {
+			ticker := time.NewTicker(ftl.options.CompactInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-c.quit:
+				return
+			case <-tick:
+			case <-ftl.compactions:
+			}
+
+			stats, err := ftl.Compact()
+			if err != nil {
+				slog.Error("compaction failed", "err", err)
+				continue
+			}
+			slog.Info("compacted transaction log",
+				"bytes_before", stats.BytesBefore, "bytes_after", stats.BytesAfter,
+				"records_before", stats.RecordsBefore, "records_after", stats.RecordsAfter)
+		}
+	}()
+
+	return c
+}
+
+// stop waits for any running compaction to finish and stops the compactor.
+func (c *compactor) stop() {
+	close(c.quit)
+	<-c.done
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	filename := writeLogFile(t, "1\t2\tkey-a\tone\n"+
+		"2\t2\tkey-b\ttwo\n"+
+		"3\t2\tkey-a\tthree\n"+
+		"4\t1\tkey-b\t\n"+
+		"5\t2\tkey-c\tfour\n")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	ftl := tl.(*FileTransactionLogger)
+
+	stats, err := ftl.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RecordsBefore != 5 || stats.RecordsAfter != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3\t2\tkey-a\tthree\n5\t2\tkey-c\tfour\n"
+	if string(content) != want {
+		t.Errorf("got log %q, want %q", content, want)
+	}
+	if stats.BytesAfter != int64(len(want)) {
+		t.Errorf("BytesAfter = %d, want %d", stats.BytesAfter, len(want))
+	}
+}
+
+func TestAutomaticCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{CompactRecords: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	tl.Run()
+
+	for i := 0; i < 20; i++ {
+		tl.WritePut("counter", "value")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		content, _ := os.ReadFile(filename)
+		if lines := strings.Count(string(content), "\n"); lines > 0 && lines < 5 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("log was not compacted automatically")
+}
+
+func TestCompactBackup(t *testing.T) {
+	original := "1\t2\tkey-a\tone\n2\t2\tkey-a\ttwo\n"
+	filename := writeLogFile(t, original)
+
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{CompactBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	ftl := tl.(*FileTransactionLogger)
+
+	if _, err := ftl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := ftl.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %d", len(backups))
+	}
+	content, err := os.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != original {
+		t.Errorf("backup %q does not match the pre-compaction log %q", content, original)
+	}
+
+	// Only the newest backups are retained.
+	for i := 0; i < 3; i++ {
+		if _, err := ftl.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err = ftl.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups to be retained, got %d", len(backups))
+	}
+}
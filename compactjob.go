@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// compactJobsKept bounds the finished compaction jobs remembered for
+// GET /v1/_compact/{id}; the oldest are forgotten first.
+const compactJobsKept = 16
+
+// Compaction job states.
+const (
+	CompactRunning = "running"
+	CompactDone    = "done"
+	CompactFailed  = "failed"
+)
+
+// logCompacter is a transaction logger that can compact its log while
+// reporting how much of it has been read.
+type logCompacter interface {
+	Size() (int64, error)
+	compact(read *atomic.Int64) (CompactionStats, error)
+}
+
+// compactJob is a compaction started through the API.
+type compactJob struct {
+	id      uint64
+	started time.Time
+	total   int64        // size of the log when the job started
+	read    atomic.Int64 // bytes of the log read so far
+
+	// Set once the compaction is over, under compactJobs' lock.
+	state    string
+	finished time.Time
+	stats    CompactionStats
+	err      error
+}
+
+// CompactionJob is the state of a compaction job as the API reports it.
+// BytesProcessed counts the bytes of the old log read so far, out of
+// BytesTotal, its size when the job started; writes made since can take
+// it past that.
+type CompactionJob struct {
+	ID             string           `json:"id"`
+	State          string           `json:"state"`
+	BytesProcessed int64            `json:"bytes_processed"`
+	BytesTotal     int64            `json:"bytes_total"`
+	StartedAt      time.Time        `json:"started_at"`
+	FinishedAt     *time.Time       `json:"finished_at,omitempty"`
+	Stats          *CompactionStats `json:"stats,omitempty"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// compactJobs holds the compaction jobs started through the API. At most
+// one runs at a time.
+var compactJobs = struct {
+	sync.Mutex
+	jobs    []*compactJob // oldest first
+	running *compactJob
+	nextID  uint64
+}{}
+
+// report describes j. The caller must hold compactJobs' lock.
+func (j *compactJob) report() CompactionJob {
+	r := CompactionJob{
+		ID:             strconv.FormatUint(j.id, 10),
+		State:          j.state,
+		BytesProcessed: j.read.Load(),
+		BytesTotal:     j.total,
+		StartedAt:      j.started,
+	}
+	if j.state != CompactRunning {
+		finished := j.finished
+		r.FinishedAt = &finished
+	}
+	if j.state == CompactDone {
+		stats := j.stats
+		r.Stats = &stats
+	}
+	if j.err != nil {
+		r.Error = j.err.Error()
+	}
+	return r
+}
+
+// startCompactJob starts compacting c in the background, returning the
+// job, or the job already running and false if there is one.
+func startCompactJob(c logCompacter) (*compactJob, bool) {
+	compactJobs.Lock()
+	defer compactJobs.Unlock()
+
+	if compactJobs.running != nil {
+		return compactJobs.running, false
+	}
+
+	compactJobs.nextID++
+	j := &compactJob{id: compactJobs.nextID, started: time.Now(), state: CompactRunning}
+	j.total, _ = c.Size()
+	compactJobs.running = j
+	compactJobs.jobs = append(compactJobs.jobs, j)
+	if len(compactJobs.jobs) > compactJobsKept {
+		compactJobs.jobs = compactJobs.jobs[len(compactJobs.jobs)-compactJobsKept:]
+	}
+
+	go func() {
+		stats, err := c.compact(&j.read)
+
+		compactJobs.Lock()
+		defer compactJobs.Unlock()
+		j.finished = time.Now()
+		j.stats, j.err = stats, err
+		if err != nil {
+			j.state = CompactFailed
+			slog.Error("compaction job failed", "id", j.id, "err", err)
+		} else {
+			j.state = CompactDone
+			slog.Info("compaction job done", "id", j.id,
+				"bytes_before", stats.BytesBefore, "bytes_after", stats.BytesAfter,
+				"records_before", stats.RecordsBefore, "records_after", stats.RecordsAfter)
+		}
+		compactJobs.running = nil
+	}()
+
+	return j, true
+}
+
+// compactStartHandler starts compacting the transaction log in the
+// background and answers 202 with the job, whose progress is at the
+// Location it gives. While a compaction is running it answers 409 with
+// that job instead.
+func compactStartHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := transactionLogger.(logCompacter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("the %s backend can't be compacted", config.Backend), http.StatusNotImplemented)
+		return
+	}
+
+	j, started := startCompactJob(c)
+	status := http.StatusAccepted
+	if !started {
+		status = http.StatusConflict
+	}
+
+	compactJobs.Lock()
+	report := j.report()
+	compactJobs.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/_compact/"+report.ID)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// compactStatusHandler reports the progress of a compaction job.
+func compactStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "bad compaction job id", http.StatusBadRequest)
+		return
+	}
+
+	compactJobs.Lock()
+	var report *CompactionJob
+	for _, j := range compactJobs.jobs {
+		if j.id == id {
+			rep := j.report()
+			report = &rep
+		}
+	}
+	compactJobs.Unlock()
+
+	if report == nil {
+		http.Error(w, "no such compaction job", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingCompacter is a memory logger whose compactions read half of a
+// 100 byte log and then wait until release is closed.
+type blockingCompacter struct {
+	*MemoryTransactionLogger
+	release chan struct{}
+}
+
+func (c blockingCompacter) Size() (int64, error) { return 100, nil }
+
+func (c blockingCompacter) compact(read *atomic.Int64) (CompactionStats, error) {
+	read.Add(50)
+	<-c.release
+	read.Add(50)
+	return CompactionStats{BytesBefore: 100, BytesAfter: 40}, nil
+}
+
+func compactRequest(t *testing.T, method, path string) (int, CompactionJob) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	var job CompactionJob
+	if rec.Code == http.StatusAccepted || rec.Code == http.StatusConflict || rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, job
+}
+
+// waitForCompaction polls the job until it is no longer running.
+func waitForCompaction(t *testing.T, id string) CompactionJob {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, job := compactRequest(t, http.MethodGet, "/v1/_compact/"+id)
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status %d for job %s", code, id)
+		}
+		if job.State != CompactRunning {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compaction job %s still running: %+v", id, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompactJob(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+	for i := 0; i < 10; i++ {
+		tl.WritePut("counter", "value")
+	}
+	tl.WriteDelete("counter")
+	tl.WritePut("kept", "value")
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, job := compactRequest(t, http.MethodPost, "/v1/_compact")
+	if code != http.StatusAccepted || job.ID == "" {
+		t.Fatalf("expected the job to be accepted, got %d %+v", code, job)
+	}
+
+	job = waitForCompaction(t, job.ID)
+	if job.State != CompactDone || job.Stats == nil || job.FinishedAt == nil {
+		t.Fatalf("expected the job to be done, got %+v", job)
+	}
+	if job.Stats.RecordsBefore != 12 || job.Stats.RecordsAfter != 1 {
+		t.Errorf("unexpected stats %+v", *job.Stats)
+	}
+	if job.BytesProcessed != job.BytesTotal || job.BytesTotal == 0 {
+		t.Errorf("expected all %d bytes to be processed, got %d", job.BytesTotal, job.BytesProcessed)
+	}
+
+	if code, _ := compactRequest(t, http.MethodGet, "/v1/_compact/999"); code != http.StatusNotFound {
+		t.Errorf("expected status %d for an unknown job, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestCompactJobConflict(t *testing.T) {
+	saved := transactionLogger
+	t.Cleanup(func() { transactionLogger = saved })
+
+	c := blockingCompacter{NewMemoryTransactionLogger(), make(chan struct{})}
+	transactionLogger = c
+
+	code, first := compactRequest(t, http.MethodPost, "/v1/_compact")
+	if code != http.StatusAccepted {
+		t.Fatalf("expected the first job to be accepted, got %d", code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, job := compactRequest(t, http.MethodGet, "/v1/_compact/"+first.ID)
+		if job.State != CompactRunning {
+			t.Fatalf("expected the job to be running, got %+v", job)
+		}
+		if job.BytesProcessed == 50 && job.BytesTotal == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected half the log to be processed, got %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, second := compactRequest(t, http.MethodPost, "/v1/_compact")
+	if code != http.StatusConflict || second.ID != first.ID {
+		t.Errorf("expected 409 naming job %s, got %d %+v", first.ID, code, second)
+	}
+
+	close(c.release)
+	if job := waitForCompaction(t, first.ID); job.State != CompactDone || job.BytesProcessed != 100 {
+		t.Errorf("expected the job to finish, got %+v", job)
+	}
+
+	// Another compaction can start once the first is over.
+	c.release = make(chan struct{})
+	close(c.release)
+	transactionLogger = c
+	if code, job := compactRequest(t, http.MethodPost, "/v1/_compact"); code != http.StatusAccepted || job.ID == first.ID {
+		t.Errorf("expected a new job to be accepted, got %d %+v", code, job)
+	} else {
+		waitForCompaction(t, job.ID)
+	}
+}
+
+func TestCompactJobUnsupported(t *testing.T) {
+	saved := transactionLogger
+	t.Cleanup(func() { transactionLogger = saved })
+	transactionLogger = NewMemoryTransactionLogger()
+
+	if code, _ := compactRequest(t, http.MethodPost, "/v1/_compact"); code != http.StatusNotImplemented {
+		t.Errorf("expected status %d, got %d", http.StatusNotImplemented, code)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// compressMiddleware gzips responses of at least config.CompressMinBytes
+// for clients that accept gzip. Responses are held back until they reach
+// the threshold, so small ones go out unchanged. Range requests, partial
+// and non-200 responses, content types that are already compressed and
+// WebSocket connections are never compressed.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.CompressMinBytes <= 0 || r.Method == http.MethodHead || r.Header.Get("Range") != "" || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, threshold: config.CompressMinBytes}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reports whether the client lists gzip in Accept-Encoding
+// without ruling it out with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(accept, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.TrimSpace(name) != "gzip" {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+
+	return false
+}
+
+// compressedTypes are content types that gain nothing from gzip.
+var compressedTypes = []string{"image/", "video/", "audio/", "application/gzip", "application/x-gzip", "application/zip", "application/zstd"}
+
+func alreadyCompressed(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers a response until it is known whether it reaches
+// the compression threshold.
+type compressWriter struct {
+	http.ResponseWriter
+	threshold int64
+
+	status  int
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	decided bool // whether the response has started going out, compressed or not
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.gz != nil {
+			return cw.gz.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf.Write(p)
+	if int64(cw.buf.Len()) >= cw.threshold {
+		if err := cw.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// start sends the headers and the buffered body, compressing it if the
+// response qualifies.
+func (cw *compressWriter) start() error {
+	cw.decided = true
+
+	h := cw.Header()
+	compress := cw.status == http.StatusOK &&
+		int64(cw.buf.Len()) >= cw.threshold &&
+		h.Get("Content-Encoding") == ""
+
+	if compress {
+		// Sniff the type from the uncompressed body, as net/http would,
+		// since it can't be sniffed once the body is gzipped.
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(cw.buf.Bytes()))
+		}
+		compress = !alreadyCompressed(h.Get("Content-Type"))
+	}
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		cw.gz = gzip.NewWriter(cw.ResponseWriter)
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+
+	return err
+}
+
+// FlushError sends what has been written so far, settling whether the
+// response is compressed if that is still open, so streamed responses
+// reach the client as they are written.
+func (cw *compressWriter) FlushError() error {
+	if !cw.decided {
+		if err := cw.start(); err != nil {
+			return err
+		}
+	}
+	if cw.gz != nil {
+		if err := cw.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close sends whatever is still buffered and finishes the gzip stream.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.start(); err != nil {
+			return err
+		}
+	}
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	return nil
+}
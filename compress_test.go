@@ -0,0 +1,89 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getWithEncoding(t *testing.T, path, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressLargeValue(t *testing.T) {
+	large := strings.Repeat("compressible ", 1000)
+	withStore(t, map[string]string{"large": large})
+
+	rec := getWithEncoding(t, "/v1/large", "gzip, deflate")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected a gzipped response, got Content-Encoding %q", got)
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Error("Content-Length of the uncompressed value was kept")
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != large {
+		t.Error("decompressed body doesn't match the value")
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	large := strings.Repeat("compressible ", 1000)
+	withStore(t, map[string]string{
+		"large": large,
+		"small": "tiny",
+		"gzip":  "\x1f\x8b\x08" + large, // sniffed as application/x-gzip
+	})
+
+	for _, tc := range []struct {
+		name, path, acceptEncoding string
+		header                     []string
+	}{
+		{"below threshold", "/v1/small", "gzip", nil},
+		{"no Accept-Encoding", "/v1/large", "", nil},
+		{"gzip refused", "/v1/large", "gzip;q=0, identity", nil},
+		{"range request", "/v1/large", "gzip", []string{"Range", "bytes=0-99"}},
+		{"already compressed", "/v1/gzip", "gzip", nil},
+		{"error response", "/v1/missing", "gzip", nil},
+	} {
+		rec := getWithEncoding(t, tc.path, tc.acceptEncoding, tc.header...)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected no compression, got Content-Encoding %q", tc.name, got)
+		}
+	}
+
+	rec := getWithEncoding(t, "/v1/small", "gzip")
+	if rec.Body.String() != "tiny" || rec.Header().Get("Content-Length") != "4" {
+		t.Errorf("small response changed: %q, Content-Length %q", rec.Body, rec.Header().Get("Content-Length"))
+	}
+
+	rec = getWithEncoding(t, "/v1/large", "gzip", "Range", "bytes=0-99")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != large[:100] {
+		t.Errorf("range request broken: status %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+}
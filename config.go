@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings that can be tuned from the command line.
+type Config struct {
+	ConfigFile  string // file flags not given on the command line are read from
+	PrintConfig bool   // print the effective configuration and exit
+
+	Addr               string        // address the server listens on
+	TLSCertFile        string        // certificate to serve TLS (and HTTP/2) with
+	TLSKeyFile         string        // private key matching TLSCertFile
+	ReadTimeout        time.Duration // maximum time to read a whole request
+	ReadHeaderTimeout  time.Duration // maximum time to read the request headers
+	WriteTimeout       time.Duration // maximum time to write a response
+	IdleTimeout        time.Duration // how long idle keep-alive connections are kept open
+	HandlerTimeout     time.Duration // maximum time a handler may take before 503; 0 disables
+	KeepAlive          bool          // keep connections open between requests
+	HTTP2              bool          // serve HTTP/2, over TLS or as h2c over plaintext
+	HTTP2MaxStreams    int           // requests a client can have in flight on one HTTP/2 connection
+	MaxConnections     int           // connections open at once; 0 doesn't limit them
+	MaxConnectionsMode string        // what happens to connections over the limit: wait or refuse
+
+	MaxBodyBytes     int64         // upper bound on the size of a request body
+	MaxRestoreBytes  int64         // upper bound on the size of a backup given to /admin/restore
+	CompressMinBytes int64         // smallest response gzipped for clients that accept it; 0 disables
+	ShutdownTimeout  time.Duration // how long shutdown waits for in-flight requests
+
+	MaxConcurrentWrites int // writes served at once; 0 doesn't limit them
+	MaxQueuedWrites     int // writes waiting for a slot before 503 is returned
+
+	EmptyValueNoContent bool // answer GET of an empty value with 204 rather than 200
+	ReadOnly            bool // refuse every write with 503
+
+	Backend         string // transaction log backend: file or postgres, or several separated by commas
+	BackendFallback string // what to do when the backend can't be opened: none, file or read-only
+	LogPrimary      string // backend replayed from when several are given
+
+	Store                   string        // where the store keeps its data: memory, bbolt or log
+	StorePath               string        // path of the bbolt database
+	StoreCacheKeys          int           // values the log store keeps in memory
+	StoreCheckpointInterval time.Duration // how often the bbolt store records a checkpoint
+	StoreBlobThreshold      int           // size from which the memory store keeps values on disk; 0 disables
+	StoreBlobDir            string        // where the memory store keeps large values
+
+	LogLevel string // minimum level of messages logged: error, warn, info or debug
+	Verbose  bool   // log at debug level, whatever LogLevel says
+
+	SlowOpThreshold time.Duration // warn about store and log operations slower than this; 0 disables
+
+	OTLPEndpoint string // URL spans are exported to over OTLP/HTTP; empty disables tracing
+
+	LogBodies       bool   // log request and response bodies at debug level
+	LogBodiesMax    int    // bytes of each body kept for logging
+	LogBodiesRedact string // how logged bodies are redacted: none, mask or hash
+
+	LogFile          string        // path of the file transaction log
+	LogFlushInterval time.Duration // how often buffered log writes are flushed; 0 writes through
+	LogBufferSize    int           // size of the log write buffer in bytes
+	LogSync          bool          // fsync the log after every flush
+	LogFormat        string        // format of new log files: tab or json
+	LogMmapThreshold int64         // size in bytes from which the log is replayed through mmap; 0 disables
+	LogShards        int           // number of files the log is split into by key hash
+	LogCloseTimeout  time.Duration // how long shutdown waits for queued events to be logged; 0 waits indefinitely
+	RecoveryFile     string        // where events still queued after LogCloseTimeout are saved
+
+	CompactInterval time.Duration // how often to compact the log; 0 disables
+	CompactRecords  int           // compact after this many appended events; 0 disables
+	CompactBytes    int64         // compact after this many appended bytes; 0 disables
+	CompactBackups  int           // number of pre-compaction log backups to keep
+
+	DiskMaxUsage      float64       // percentage of the log's disk in use at which writes are refused; 0 disables
+	DiskCheckInterval time.Duration // how often the disk usage is checked
+
+	TombstoneRetention time.Duration // how long deleted keys are remembered (0 disables)
+	IdleTTL            time.Duration // how long a key can go unread and unwritten before it is deleted (0 disables)
+
+	DeadLetterFile string // where events that failed to persist are kept; empty only logs them
+
+	KeyNormalize string // how keys are normalized: none, lower, trim or lower-trim
+	WritePolicy  string // when writes are acknowledged: write-behind or write-ahead
+
+	TransientRetryAfter time.Duration // Retry-After of writes refused because the log failed transiently; 0 omits it
+
+	MaxPrefixResults int // most key/value pairs returned by a prefix read; 0 means no limit
+	MaxTxOps         int // most operations in one transaction; 0 means no limit
+	MaxListKeys      int // most keys returned by a key listing; 0 means no limit
+
+	ValueSchema string // JSON Schema file PUT values must conform to, or prefix=file pairs
+
+	NamespaceQuotas string // namespace=keys:bytes pairs capping what each namespace holds
+
+	ServiceName string // name given in the banner at /
+
+	SnapshotFile     string        // where snapshots of the store are kept; empty disables them
+	SnapshotInterval time.Duration // how often to snapshot the store and truncate the log
+
+	Seed          string // JSON object of key/values written to the store at startup
+	SeedOverwrite bool   // let the seed overwrite keys that already exist
+
+	SequenceCheck string        // sequence validation on replay: increasing, strict or lenient
+	FastReplay    bool          // replay a memory store into a copy without locking, instead of in place
+	ReplayTimeout time.Duration // give up on the startup replay after this long; 0 means never
+	ReplayFailure string        // what to do when the replay fails: abort or read-only
+	ReplayOnError string        // what the file log does with a bad record: abort, skip or repair
+
+	Audit       bool   // record every key access in the audit log
+	AuditFile   string // file the audit log is appended to; empty keeps it in memory only
+	AuditRecent int    // audit entries kept in memory for /admin/audit
+
+	ClusterNodes string // comma-separated base URLs of the nodes keys are spread over
+	ClusterSelf  string // this node's URL in ClusterNodes
+
+	WebhookURLs    string // comma-separated URLs notified of every change
+	WebhookSecret  string // key for the HMAC signature of webhook payloads
+	WebhookRetries int    // extra delivery attempts for a failed webhook
+
+	DBHost            string        // postgres host
+	DBName            string        // postgres database name
+	DBUser            string        // postgres user
+	DBPassword        string        // postgres password
+	DBHealthInterval  time.Duration // how often to ping postgres for readiness
+	DBReplayPageSize  int           // rows read per query when replaying from postgres
+	DBReplayPrefetch  int           // pages read ahead while replaying from postgres
+	DBBreakerFailures int           // consecutive postgres failures that stop writes; 0 disables
+	DBBreakerCooldown time.Duration // how long writes stay stopped before postgres is tried again
+	DBScrubInterval   time.Duration // how often the store is checked against the postgres log; 0 disables
+	DBScrubRepair     bool          // reset keys that drifted from the postgres log to its state
+}
+
+var config = Config{
+	Addr:               ":4000",
+	ReadTimeout:        30 * time.Second,
+	ReadHeaderTimeout:  10 * time.Second,
+	WriteTimeout:       30 * time.Second,
+	IdleTimeout:        2 * time.Minute,
+	HandlerTimeout:     25 * time.Second,
+	KeepAlive:          true,
+	HTTP2:              true,
+	HTTP2MaxStreams:    250,
+	MaxConnectionsMode: ConnLimitWait,
+
+	Backend:         "file",
+	BackendFallback: "none",
+
+	Store:                   "memory",
+	StorePath:               "kvstore.db",
+	StoreCacheKeys:          10000,
+	StoreCheckpointInterval: time.Minute,
+	StoreBlobDir:            "blobs",
+
+	LogLevel:        "info",
+	SlowOpThreshold: time.Second,
+	LogBodiesMax:    1024,
+	LogBodiesRedact: "hash",
+
+	KeyNormalize: "none",
+	WritePolicy:  WriteBehind,
+
+	TransientRetryAfter: 5 * time.Second,
+
+	ServiceName: "kvstore",
+
+	DiskCheckInterval: 10 * time.Second,
+
+	LogFile:          "transaction.log",
+	LogShards:        1,
+	LogFormat:        string(LogFormatTab),
+	LogMmapThreshold: 64 << 20,
+	LogCloseTimeout:  10 * time.Second,
+	RecoveryFile:     "transaction.recovery",
+
+	MaxBodyBytes:     1 << 20, // 1 MiB
+	MaxRestoreBytes:  1 << 30, // 1 GiB
+	CompressMinBytes: 1024,
+	ShutdownTimeout:  30 * time.Second,
+	CompactBackups:   3,
+	MaxPrefixResults: 1000,
+	MaxTxOps:         1000,
+	MaxListKeys:      1000,
+	SnapshotInterval: 10 * time.Minute,
+	SequenceCheck:    string(SequenceIncreasing),
+	FastReplay:       true,
+	ReplayFailure:    "abort",
+	ReplayOnError:    string(ReplayAbort),
+
+	AuditRecent:       10000,
+	WebhookRetries:    3,
+	DBHealthInterval:  5 * time.Second,
+	DBReplayPageSize:  10000,
+	DBReplayPrefetch:  1,
+	DBBreakerFailures: 5,
+	DBBreakerCooldown: 30 * time.Second,
+}
+
+// defaultConfig holds the settings used when neither the command line nor
+// the -config file changes them.
+var defaultConfig = config
+
+// parseFlags overrides the defaults in config with the settings in the
+// -config file, and those with command line flags.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	return parseConfig(&config, fs, args)
+}
+
+// registerFlags defines a flag in fs for every setting of c, defaulting
+// to its current value.
+func registerFlags(c *Config, fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "file of name = value lines setting flags not given on the command line; reread by POST /admin/reload")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print the configuration resolved from the command line and the -config file as JSON, with secrets redacted, and exit")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "TLS certificate file; enables HTTPS and HTTP/2")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "TLS private key file")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "maximum duration for reading the request headers, which bounds connections held open by trickled headers")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long to keep idle keep-alive connections open")
+	fs.BoolVar(&c.KeepAlive, "keep-alive", c.KeepAlive, "keep connections open for further requests; turning it off frees idle connections straight away, but every request then pays for a new connection, and TLS handshake, and HTTP/2 can't multiplex")
+	fs.BoolVar(&c.HTTP2, "http2", c.HTTP2, "serve HTTP/2, negotiated over TLS or spoken over plaintext as h2c by clients that ask for it; many small requests then share a connection, but one slow client's stream can hold its connection's flow-control window, and h2c isn't understood by every proxy")
+	fs.IntVar(&c.HTTP2MaxStreams, "http2-max-streams", c.HTTP2MaxStreams, "requests a client can have in flight at once on one HTTP/2 connection")
+	fs.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "maximum number of client connections open at once, idle keep-alive and WebSocket connections included, to keep a flood of them from using up file descriptors (0 disables)")
+	fs.StringVar(&c.MaxConnectionsMode, "max-connections-mode", c.MaxConnectionsMode, "what happens to connections over -max-connections: wait leaves them unaccepted until a connection closes, refuse accepts and closes them at once")
+	fs.DurationVar(&c.HandlerTimeout, "handler-timeout", c.HandlerTimeout, "answer 503 to requests not handled within this long, which must be shorter than -write-timeout; websockets and streamed prefix reads are exempt (0 disables)")
+	fs.StringVar(&c.Backend, "backend", c.Backend, "transaction log backend: file or postgres, or both separated by a comma to log every write to each")
+	fs.StringVar(&c.LogPrimary, "log-primary", c.LogPrimary, "with several backends, the one replayed on startup; the others are written but never replayed (default the first)")
+	fs.StringVar(&c.BackendFallback, "backend-fallback", c.BackendFallback, "what to do when the backend can't be opened at startup: none exits, file logs to -log-file instead (a separate log, not synced back), read-only serves what the store holds and refuses writes")
+	fs.StringVar(&c.Store, "store", c.Store, "where to keep the data: memory, rebuilt from the log on startup; bbolt, an on-disk database; or log, read from the postgres transaction log as needed, with no replay, for data too large for memory")
+	fs.IntVar(&c.StoreCacheKeys, "store-cache-keys", c.StoreCacheKeys, "number of recently used values the log store keeps in memory, and of writes it keeps before flushing the log")
+	fs.StringVar(&c.StorePath, "store-path", c.StorePath, "path of the bbolt store database")
+	fs.DurationVar(&c.StoreCheckpointInterval, "store-checkpoint-interval", c.StoreCheckpointInterval, "how often the bbolt store records how much of the log it reflects")
+	fs.IntVar(&c.StoreBlobThreshold, "store-blob-threshold", c.StoreBlobThreshold, "keep values of this many bytes or more in files under -store-blob-dir rather than in memory, reading them back on every get; the memory store only (0 disables)")
+	fs.StringVar(&c.StoreBlobDir, "store-blob-dir", c.StoreBlobDir, "directory of the values kept on disk by -store-blob-threshold, which the file log refers to rather than holding them; those nothing refers to are removed on startup")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of messages to log: error, warn, info or debug; requests and key operations are logged at debug")
+	fs.BoolVar(&c.Verbose, "verbose", c.Verbose, "log at debug level, including every request")
+	fs.DurationVar(&c.SlowOpThreshold, "slow-op-threshold", c.SlowOpThreshold, "log a warning, naming the operation and key, for every store operation and transaction log write or read that takes longer than this, and count them in kvstore_slow_operations (0 disables)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "export request traces over OTLP/HTTP to this URL, such as http://localhost:4318; tracing is off when empty")
+	fs.BoolVar(&c.LogBodies, "log-bodies", c.LogBodies, "log request and response bodies at debug level, redacted with -log-bodies-redact")
+	fs.IntVar(&c.LogBodiesMax, "log-bodies-max", c.LogBodiesMax, "bytes of each body kept when logging bodies")
+	fs.StringVar(&c.LogBodiesRedact, "log-bodies-redact", c.LogBodiesRedact, "how logged bodies are redacted: none logs them as they are, mask logs only their length, hash logs their SHA-256")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "path of the file transaction log")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "maximum size in bytes of a request body")
+	fs.Int64Var(&c.MaxRestoreBytes, "max-restore-bytes", c.MaxRestoreBytes, "maximum size in bytes of a backup given to POST /admin/restore, which is held in memory while it is checked and applied")
+	fs.Int64Var(&c.CompressMinBytes, "compress-min-bytes", c.CompressMinBytes, "gzip responses of at least this many bytes for clients that accept it (0 disables)")
+	fs.DurationVar(&c.LogFlushInterval, "log-flush-interval", c.LogFlushInterval, "buffer transaction log writes and flush them at this interval (0 writes every event immediately)")
+	fs.IntVar(&c.LogBufferSize, "log-buffer-size", c.LogBufferSize, "size in bytes of the transaction log write buffer")
+	fs.BoolVar(&c.LogSync, "log-sync", c.LogSync, "fsync the transaction log after every write")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of the file transaction log: tab or json; an existing log is converted when it is next compacted")
+	fs.IntVar(&c.LogShards, "log-shards", c.LogShards, "split the transaction log into this many files, named after -log-file with the shard number appended, by key hash, each written by its own goroutine; a log can't be resharded in place")
+	fs.Int64Var(&c.LogMmapThreshold, "log-mmap-threshold", c.LogMmapThreshold, "replay transaction logs of at least this many bytes by mapping them into memory, where supported (0 disables)")
+	fs.DurationVar(&c.LogCloseTimeout, "log-close-timeout", c.LogCloseTimeout, "how long shutdown waits for the events still queued to be logged before saving them to -recovery-file instead (0 waits indefinitely)")
+	fs.StringVar(&c.RecoveryFile, "recovery-file", c.RecoveryFile, "file the events a stuck transaction logger couldn't write at shutdown are saved to; they are applied and logged on the next startup, and the file removed (empty disables)")
+	fs.DurationVar(&c.CompactInterval, "compact-interval", c.CompactInterval, "compact the transaction log at this interval (0 disables)")
+	fs.IntVar(&c.CompactRecords, "compact-records", c.CompactRecords, "compact the transaction log after this many new events (0 disables)")
+	fs.Int64Var(&c.CompactBytes, "compact-bytes", c.CompactBytes, "compact the transaction log after this many new bytes (0 disables)")
+	fs.IntVar(&c.CompactBackups, "compact-backups", c.CompactBackups, "number of transaction log backups taken before compaction to keep (0 disables)")
+	fs.Float64Var(&c.DiskMaxUsage, "disk-max-usage", c.DiskMaxUsage, "refuse writes with 507 Insufficient Storage while the disk holding the transaction log is at least this percent full (0 disables)")
+	fs.DurationVar(&c.DiskCheckInterval, "disk-check-interval", c.DiskCheckInterval, "how often to check the disk usage when -disk-max-usage is set")
+	fs.StringVar(&c.SnapshotFile, "snapshot-file", c.SnapshotFile, "snapshot the store to this file and truncate the transaction log to the events after it; startup loads the snapshot and replays only those")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "how often to snapshot the store when -snapshot-file is set")
+	fs.StringVar(&c.Seed, "seed", c.Seed, "after replay, write the key/values in this JSON object to the store and the transaction log")
+	fs.BoolVar(&c.SeedOverwrite, "seed-overwrite", c.SeedOverwrite, "let -seed overwrite keys that already exist instead of skipping them")
+	fs.IntVar(&c.MaxPrefixResults, "max-prefix-results", c.MaxPrefixResults, "most key/value pairs returned by GET /v1/_prefix/ (0 means no limit)")
+	fs.IntVar(&c.MaxListKeys, "max-list-keys", c.MaxListKeys, "most keys returned by one GET /v1/_keys request, which then returns a token for the next page (0 means no limit)")
+	fs.IntVar(&c.MaxTxOps, "max-tx-ops", c.MaxTxOps, "most operations accepted in one POST /v1/_tx request (0 means no limit)")
+	fs.StringVar(&c.ServiceName, "service-name", c.ServiceName, "name of the service in the banner GET / returns, such as the deployment it belongs to")
+	fs.StringVar(&c.ValueSchema, "value-schema", c.ValueSchema, "reject PUT values that aren't JSON or don't conform to the JSON Schema in this file with 422; comma-separated prefix=file pairs give keys under each prefix their own schema, the longest matching prefix winning, and leave other keys unchecked")
+	fs.StringVar(&c.NamespaceQuotas, "namespace-quotas", c.NamespaceQuotas, "comma-separated namespace=keys:bytes pairs capping the keys and the bytes of keys and values in each namespace, the part of a key before its first slash, with 0 for no limit; * gives the quota of unlisted namespaces, and writes past a quota are refused with 507")
+	fs.StringVar(&c.KeyNormalize, "key-normalize", c.KeyNormalize, "how keys are normalized before they are stored, read or logged: none, lower, trim (surrounding whitespace) or lower-trim")
+	fs.StringVar(&c.WritePolicy, "write-policy", c.WritePolicy, "write-behind answers writes once applied and logs them in the background; write-ahead also waits until they are committed to the transaction log")
+	fs.DurationVar(&c.TransientRetryAfter, "transient-retry-after", c.TransientRetryAfter, "Retry-After sent with the 503 answering a write-ahead write whose log write failed transiently, such as on a dropped database connection (0 omits the header)")
+	fs.StringVar(&c.DeadLetterFile, "dead-letter-file", c.DeadLetterFile, "append events the transaction logger fails to persist to this file as JSON lines, listed by GET /v1/_deadletter")
+	fs.DurationVar(&c.TombstoneRetention, "tombstone-retention", c.TombstoneRetention, "how long to keep tombstones for deleted keys (0 disables)")
+	fs.DurationVar(&c.IdleTTL, "idle-ttl", c.IdleTTL, "delete keys that haven't been read or written for this long, logging a delete for each; reserved and immutable keys are kept, and after a restart keys count as accessed when they were replayed (0 disables)")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "refuse writes with 503 Service Unavailable")
+	fs.BoolVar(&c.EmptyValueNoContent, "empty-value-no-content", c.EmptyValueNoContent, "answer GET of an empty value with 204 No Content instead of 200")
+	fs.IntVar(&c.MaxConcurrentWrites, "max-concurrent-writes", c.MaxConcurrentWrites, "maximum number of PUT and DELETE requests served at once (0 disables)")
+	fs.IntVar(&c.MaxQueuedWrites, "max-queued-writes", c.MaxQueuedWrites, "maximum number of writes waiting for a slot before answering 503")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+
+	fs.StringVar(&c.SequenceCheck, "sequence-check", c.SequenceCheck, "sequence number validation on replay: increasing, strict or lenient")
+	fs.BoolVar(&c.FastReplay, "fast-replay", c.FastReplay, "replay a memory store into a copy without locking and install it when done, rather than locking the store for every event")
+	fs.DurationVar(&c.ReplayTimeout, "replay-timeout", c.ReplayTimeout, "how long the startup replay may take before it is treated as failed (0 waits forever)")
+	fs.StringVar(&c.ReplayFailure, "replay-failure", c.ReplayFailure, "what to do when the startup replay fails or times out: abort, or read-only to serve the keys replayed so far and refuse writes")
+	fs.StringVar(&c.ReplayOnError, "replay-on-error", c.ReplayOnError, "what to do with a bad record in the file log on replay: abort, skip it, or repair the log by moving it to a .rejected file")
+	fs.BoolVar(&c.Audit, "audit", c.Audit, "record who read or modified which key")
+	fs.StringVar(&c.AuditFile, "audit-file", c.AuditFile, "append audit entries to this file as JSON lines")
+	fs.IntVar(&c.AuditRecent, "audit-recent", c.AuditRecent, "number of recent audit entries kept for /admin/audit")
+	fs.StringVar(&c.ClusterNodes, "cluster-nodes", c.ClusterNodes, "comma-separated base URLs, such as http://10.0.0.1:4000, of the nodes keys are spread over by consistent hashing; requests for a key another node owns are answered with a 307 redirect to it, while listings, prefix reads and transactions only cover this node's keys")
+	fs.StringVar(&c.ClusterSelf, "cluster-self", c.ClusterSelf, "this node's URL as given in -cluster-nodes")
+	fs.StringVar(&c.WebhookURLs, "webhook-urls", c.WebhookURLs, "comma-separated URLs to POST every change to")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "shared secret used to sign webhook payloads")
+	fs.IntVar(&c.WebhookRetries, "webhook-retries", c.WebhookRetries, "how many times to retry a failed webhook delivery")
+	fs.StringVar(&c.DBHost, "db-host", c.DBHost, "postgres host")
+	fs.StringVar(&c.DBName, "db-name", c.DBName, "postgres database name")
+	fs.StringVar(&c.DBUser, "db-user", c.DBUser, "postgres user")
+	fs.StringVar(&c.DBPassword, "db-password", c.DBPassword, "postgres password")
+	fs.DurationVar(&c.DBHealthInterval, "db-health-interval", c.DBHealthInterval, "how often to ping postgres to track readiness")
+	fs.IntVar(&c.DBReplayPageSize, "db-replay-page-size", c.DBReplayPageSize, "rows read per query when replaying the postgres log")
+	fs.IntVar(&c.DBReplayPrefetch, "db-replay-prefetch", c.DBReplayPrefetch, "pages of the postgres log read ahead during replay")
+	fs.IntVar(&c.DBBreakerFailures, "db-breaker-failures", c.DBBreakerFailures, "consecutive postgres insert failures after which writes are refused with 503 (0 disables)")
+	fs.DurationVar(&c.DBBreakerCooldown, "db-breaker-cooldown", c.DBBreakerCooldown, "how long writes are refused before postgres is tried again")
+	fs.DurationVar(&c.DBScrubInterval, "db-scrub-interval", c.DBScrubInterval, "how often to replay the postgres log in the background and compare the result with the store, reporting drift in the log and metrics (0 disables)")
+	fs.BoolVar(&c.DBScrubRepair, "db-scrub-repair", c.DBScrubRepair, "reset keys a scrub finds drifted to the state in the postgres log")
+}
+
+// parseConfig sets c from the command line args and then the -config
+// file, if any, and checks the result. Flags on the command line take
+// precedence over the file.
+func parseConfig(c *Config, fs *flag.FlagSet, args []string) error {
+	registerFlags(c, fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if c.ConfigFile != "" {
+		if err := applyConfigFile(fs, c.ConfigFile, set); err != nil {
+			return err
+		}
+	}
+
+	if !validLogLevel(c.LogLevel) {
+		return fmt.Errorf("unknown log level %q, expected one of error, warn, info, debug", c.LogLevel)
+	}
+	if c.Verbose {
+		c.LogLevel = "debug"
+	}
+	if _, ok := bodyRedactors[c.LogBodiesRedact]; !ok {
+		return fmt.Errorf("unknown body redaction %q, expected one of none, mask, hash", c.LogBodiesRedact)
+	}
+	if _, ok := keyNormalizers[c.KeyNormalize]; !ok {
+		return fmt.Errorf("unknown key normalization %q, expected one of none, lower, trim, lower-trim", c.KeyNormalize)
+	}
+	if c.WritePolicy != WriteBehind && c.WritePolicy != WriteAhead {
+		return fmt.Errorf("unknown write policy %q, expected %s or %s", c.WritePolicy, WriteBehind, WriteAhead)
+	}
+	if c.Store != "memory" && c.Store != "bbolt" && c.Store != "log" {
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+	if c.Store == "log" && (c.Backend != "postgres" || c.BackendFallback != "none") {
+		return errors.New("-store log reads from the postgres log, so it needs -backend postgres and no -backend-fallback")
+	}
+	if c.StoreBlobThreshold < 0 {
+		return errors.New("-store-blob-threshold can't be negative")
+	}
+	if c.StoreBlobThreshold > 0 && c.Store != "memory" {
+		return fmt.Errorf("-store-blob-threshold only applies to the memory store, not %s", c.Store)
+	}
+	if c.StoreCacheKeys < 1 {
+		return errors.New("-store-cache-keys must be at least 1")
+	}
+	if c.SnapshotFile != "" && c.Store != "memory" {
+		return fmt.Errorf("-snapshot-file only applies to the memory store; the %s store keeps its own checkpoint", c.Store)
+	}
+	if c.ReplayFailure != "abort" && c.ReplayFailure != "read-only" {
+		return fmt.Errorf("unknown replay failure policy %q, expected abort or read-only", c.ReplayFailure)
+	}
+	switch ReplayErrorPolicy(c.ReplayOnError) {
+	case ReplayAbort, ReplaySkip, ReplayRepair:
+	default:
+		return fmt.Errorf("unknown replay error policy %q, expected abort, skip or repair", c.ReplayOnError)
+	}
+	if _, err := parseNamespaceQuotas(c.NamespaceQuotas); err != nil {
+		return err
+	}
+	if c.LogShards < 1 {
+		return errors.New("-log-shards must be at least 1")
+	}
+	if c.LogShards > 1 && SequenceCheck(c.SequenceCheck) == SequenceStrict {
+		return errors.New("-sequence-check=strict can't be used with -log-shards, as each shard's sequence numbers have gaps")
+	}
+	if c.SnapshotFile != "" && c.SnapshotInterval <= 0 {
+		return errors.New("-snapshot-interval must be positive")
+	}
+	if c.DiskMaxUsage < 0 || c.DiskMaxUsage > 100 {
+		return errors.New("-disk-max-usage must be between 0 and 100")
+	}
+	if c.DiskMaxUsage > 0 && c.DiskCheckInterval <= 0 {
+		return errors.New("-disk-check-interval must be positive")
+	}
+	if c.IdleTTL < 0 {
+		return errors.New("-idle-ttl can't be negative")
+	}
+	if c.TransientRetryAfter < 0 {
+		return errors.New("-transient-retry-after can't be negative")
+	}
+	if _, err := parseClusterNodes(c.ClusterNodes, c.ClusterSelf); err != nil {
+		return err
+	}
+	if c.DBBreakerFailures > 0 && c.DBBreakerCooldown <= 0 {
+		return errors.New("-db-breaker-cooldown must be positive")
+	}
+
+	if c.HTTP2MaxStreams < 1 {
+		return errors.New("-http2-max-streams must be at least 1")
+	}
+	if c.MaxConnections < 0 {
+		return errors.New("-max-connections must not be negative")
+	}
+	if !validConnLimitMode(c.MaxConnectionsMode) {
+		return fmt.Errorf("unknown connection limit mode %q, expected one of wait, refuse", c.MaxConnectionsMode)
+	}
+	if c.HandlerTimeout > 0 && c.WriteTimeout > 0 && c.HandlerTimeout >= c.WriteTimeout {
+		return errors.New("-handler-timeout must be shorter than -write-timeout, or its 503 can't be written")
+	}
+
+	switch c.BackendFallback {
+	case "none", "read-only":
+	case "file":
+		if slices.Contains(strings.Split(c.Backend, ","), "file") {
+			return errors.New("-backend-fallback=file needs another -backend")
+		}
+	default:
+		return fmt.Errorf("unknown backend fallback %q, expected none, file or read-only", c.BackendFallback)
+	}
+
+	if c.LogPrimary != "" && !slices.Contains(strings.Split(c.Backend, ","), c.LogPrimary) {
+		return fmt.Errorf("-log-primary %s isn't one of the backends in -backend", c.LogPrimary)
+	}
+
+	return validateBackend(c.Backend, c.BackendFallback, set)
+}
+
+// backendFlags lists the flags that only apply to each backend.
+var backendFlags = map[string][]string{
+	"file": {
+		"log-file", "log-flush-interval", "log-buffer-size", "log-sync", "log-format", "log-mmap-threshold", "log-shards", "replay-on-error",
+		"compact-interval", "compact-records", "compact-bytes", "compact-backups",
+		"disk-max-usage", "disk-check-interval",
+	},
+	"postgres": {
+		"db-host", "db-name", "db-user", "db-password", "db-health-interval",
+		"db-replay-page-size", "db-replay-prefetch", "db-breaker-failures", "db-breaker-cooldown",
+		"db-scrub-interval", "db-scrub-repair",
+	},
+}
+
+// validateBackend checks that backend is known and that no flag in set
+// configures a backend that isn't selected, so that configuring both the
+// file and postgres loggers is an error rather than one of them being
+// ignored. The flags of the fallback backend are allowed too.
+func validateBackend(backend, fallback string, set map[string]bool) error {
+	backends := strings.Split(backend, ",")
+	for i, b := range backends {
+		if _, ok := backendFlags[b]; !ok {
+			return fmt.Errorf("unknown backend %q", b)
+		}
+		if slices.Contains(backends[:i], b) {
+			return fmt.Errorf("backend %q is given more than once", b)
+		}
+	}
+
+	for other, names := range backendFlags {
+		if slices.Contains(backends, other) || other == fallback {
+			continue
+		}
+		for _, name := range names {
+			if set[name] {
+				return fmt.Errorf("-%s configures the %s backend, but the %s backend is selected; choose one with -backend", name, other, backend)
+			}
+		}
+	}
+
+	return nil
+}
+
+// secretFlags are the flags whose values printConfig redacts.
+var secretFlags = map[string]bool{"db-password": true, "webhook-secret": true}
+
+// printConfig writes c to w as a JSON object of flag names and values, as
+// they would be given on the command line or in a -config file. Secrets
+// that are set are shown as REDACTED.
+func printConfig(w io.Writer, c Config) error {
+	fs := flag.NewFlagSet("kvstore", flag.ContinueOnError)
+	registerFlags(&c, fs)
+
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		values[f.Name] = value
+	})
+	delete(values, "print-config")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
+
+// applyConfigFile sets the flags in fs named in the file at path, except
+// those in set, which were given on the command line. Each line of the
+// file is blank, a # comment or name = value, with the name of a flag
+// without its dash. Flags it sets are added to set.
+func applyConfigFile(fs *flag.FlagSet, path string, set map[string]bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	fromFile := make(map[string]bool)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", path, i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "config" {
+			return fmt.Errorf("%s:%d: config files can't include other config files", path, i+1)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		fromFile[name] = true
+	}
+
+	for name := range fromFile {
+		set[name] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseTestFlags(t *testing.T, args ...string) error {
+	t.Helper()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	fs := flag.NewFlagSet("kvstore", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseFlags(fs, args)
+}
+
+func TestParseFlagsBothBackends(t *testing.T) {
+	for _, args := range [][]string{
+		{"-db-host", "localhost"},
+		{"-backend", "file", "-db-name", "kvstore"},
+		{"-backend", "postgres", "-log-file", "other.log"},
+		{"-backend", "postgres", "-backend-fallback", "read-only", "-log-file", "other.log"},
+	} {
+		err := parseTestFlags(t, args...)
+		if err == nil || !strings.Contains(err.Error(), "-backend") {
+			t.Errorf("%v: expected a backend conflict error, got %v", args, err)
+		}
+	}
+}
+
+func TestParseFlagsOneBackend(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-log-file", "other.log", "-compact-records", "100"},
+		{"-backend", "postgres", "-db-host", "localhost", "-db-name", "kvstore"},
+		{"-backend", "file,postgres", "-log-file", "other.log", "-db-host", "localhost", "-log-primary", "postgres"},
+		{"-backend", "postgres", "-db-host", "localhost", "-backend-fallback", "file", "-log-file", "other.log"},
+	} {
+		if err := parseTestFlags(t, args...); err != nil {
+			t.Errorf("%v: unexpected error %v", args, err)
+		}
+	}
+}
+
+func TestParseFlagsBackendFallback(t *testing.T) {
+	if err := parseTestFlags(t, "-backend-fallback", "file"); err == nil {
+		t.Error("expected an error for falling back to the backend that failed")
+	}
+	if err := parseTestFlags(t, "-backend-fallback", "postgres"); err == nil {
+		t.Error("expected an error for an unknown fallback")
+	}
+}
+
+func TestParseFlagsUnknownBackend(t *testing.T) {
+	if err := parseTestFlags(t, "-backend", "sqlite"); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func TestParseFlagsSeveralBackends(t *testing.T) {
+	for _, args := range [][]string{
+		{"-backend", "file,sqlite"},
+		{"-backend", "file,file"},
+		{"-backend", "file,postgres", "-log-primary", "sqlite"},
+		{"-backend", "file", "-log-primary", "postgres"},
+		{"-backend", "file,postgres", "-backend-fallback", "file"},
+	} {
+		if err := parseTestFlags(t, args...); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestParseFlagsMaxConnections(t *testing.T) {
+	if err := parseTestFlags(t, "-max-connections", "-1"); err == nil {
+		t.Error("expected an error for a negative connection limit")
+	}
+	if err := parseTestFlags(t, "-max-connections-mode", "drop"); err == nil {
+		t.Error("expected an error for an unknown connection limit mode")
+	}
+}
+
+func TestParseFlagsLogStore(t *testing.T) {
+	if err := parseTestFlags(t, "-store", "log"); err == nil {
+		t.Error("expected an error for the log store on the file backend")
+	}
+	if err := parseTestFlags(t, "-store", "log", "-backend", "postgres", "-backend-fallback", "file", "-log-file", "other.log"); err == nil {
+		t.Error("expected an error for the log store with a fallback")
+	}
+	if err := parseTestFlags(t, "-store", "log", "-backend", "postgres", "-backend-fallback", "none"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseFlagsStoreBlobThreshold(t *testing.T) {
+	if err := parseTestFlags(t, "-store", "bbolt", "-store-blob-threshold", "1024"); err == nil {
+		t.Error("expected an error for blobs with the bbolt store")
+	}
+	if err := parseTestFlags(t, "-store-blob-threshold", "-1"); err == nil {
+		t.Error("expected an error for a negative blob threshold")
+	}
+	if err := parseTestFlags(t, "-store", "memory", "-store-blob-threshold", "1024"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseFlagsSnapshotNeedsMemoryStore(t *testing.T) {
+	if err := parseTestFlags(t, "-store", "bbolt", "-snapshot-file", "kvstore.snapshot"); err == nil {
+		t.Error("expected -snapshot-file with the bbolt store to be rejected")
+	}
+	if err := parseTestFlags(t, "-store", "memory", "-snapshot-file", "kvstore.snapshot"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kvstore.conf")
+	content := "addr = :7000\nlog-level = debug\ndb-password = from-file\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseTestFlags(t, "-config", file, "-addr", ":5000", "-backend", "postgres", "-db-password", "hunter2", "-print-config"); err != nil {
+		t.Fatal(err)
+	}
+	if !config.PrintConfig {
+		t.Error("expected -print-config to be set")
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "from-file") {
+		t.Errorf("the password was printed:\n%s", buf.String())
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"addr":           ":5000", // the command line wins over the file
+		"log-level":      "debug", // from the file
+		"backend":        "postgres",
+		"db-password":    "REDACTED",
+		"webhook-secret": "", // unset secrets are shown as unset
+		"read-timeout":   "30s",
+	} {
+		if got[name] != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got[name])
+		}
+	}
+	if _, ok := got["print-config"]; ok {
+		t.Error("expected -print-config itself to be left out")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/netutil"
+)
+
+// What happens to connections over -max-connections.
+const (
+	// ConnLimitWait leaves them in the kernel's accept queue until a
+	// connection closes, so clients see a slow connect.
+	ConnLimitWait = "wait"
+	// ConnLimitRefuse accepts and closes them at once, so clients fail
+	// fast and can go elsewhere.
+	ConnLimitRefuse = "refuse"
+)
+
+// refusedConns counts the connections closed for being over the limit.
+var refusedConns atomic.Uint64
+
+// listen opens the server's listener on addr, accepting at most limit
+// connections at once, or any number if limit is 0. mode, ConnLimitWait
+// or ConnLimitRefuse, decides what happens to the rest. The limit covers
+// every connection, whether it is serving a request, idle between
+// requests or hijacked for a WebSocket, which is what holds file
+// descriptors; limitWrites only bounds the requests being served.
+func listen(addr string, limit int, mode string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case limit <= 0:
+		return ln, nil
+	case mode == ConnLimitRefuse:
+		return &refusingListener{Listener: ln, slots: make(chan struct{}, limit)}, nil
+	default:
+		return netutil.LimitListener(ln, limit), nil
+	}
+}
+
+// refusingListener closes the connections it accepts beyond the number
+// it has slots for.
+type refusingListener struct {
+	net.Listener
+	slots chan struct{} // one token per open connection
+}
+
+func (l *refusingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: c, release: func() { <-l.slots }}, nil
+		default:
+			refusedConns.Add(1)
+			slog.Debug("refused connection over the limit", "remote", c.RemoteAddr(), "limit", cap(l.slots))
+			c.Close()
+		}
+	}
+}
+
+// limitedConn gives up its slot once, when it is first closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// registerConnLimitMetrics exposes the number of refused connections as a
+// gauge.
+func registerConnLimitMetrics() {
+	registerGauge("kvstore_connections_refused", "Connections closed on accept for being over -max-connections.", func() float64 {
+		return float64(refusedConns.Load())
+	})
+}
+
+// validConnLimitMode reports whether mode is one listen accepts.
+func validConnLimitMode(mode string) bool {
+	return mode == ConnLimitWait || mode == ConnLimitRefuse
+}
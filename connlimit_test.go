@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// serveLimited serves on a listener limited to limit connections in mode
+// until the test ends. Requests are held until release is closed.
+func serveLimited(t *testing.T, limit int, mode string) (addr string, release chan struct{}) {
+	t.Helper()
+
+	ln, err := listen("127.0.0.1:0", limit, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release = make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String(), release
+}
+
+// sendRequest opens a connection to addr and sends a GET on it.
+func sendRequest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readResponse reads the response to the request sent on c, waiting at
+// most wait.
+func readResponse(c net.Conn, wait time.Duration) (*http.Response, error) {
+	c.SetReadDeadline(time.Now().Add(wait))
+	return http.ReadResponse(bufio.NewReader(c), nil)
+}
+
+func TestMaxConnectionsWait(t *testing.T) {
+	addr, release := serveLimited(t, 2, ConnLimitWait)
+	first := sendRequest(t, addr)
+	sendRequest(t, addr)
+	third := sendRequest(t, addr)
+	close(release)
+
+	if resp, err := readResponse(first, 5*time.Second); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first connection to be served, got %v", err)
+	}
+	if _, err := readResponse(third, 200*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the third connection to wait, got %v", err)
+	}
+
+	// Closing a connection lets the waiting one in.
+	first.Close()
+	if resp, err := readResponse(third, 5*time.Second); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the third connection to be served once one closed, got %v", err)
+	}
+}
+
+func TestMaxConnectionsRefuse(t *testing.T) {
+	addr, release := serveLimited(t, 2, ConnLimitRefuse)
+	before := refusedConns.Load()
+	first := sendRequest(t, addr)
+	sendRequest(t, addr)
+	// Let the server accept the first two before the third arrives.
+	time.Sleep(50 * time.Millisecond)
+	third := sendRequest(t, addr)
+
+	if _, err := readResponse(third, 5*time.Second); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the third connection to be closed, got %v", err)
+	}
+	if got := refusedConns.Load() - before; got != 1 {
+		t.Errorf("expected 1 refused connection, got %d", got)
+	}
+
+	close(release)
+	if resp, err := readResponse(first, 5*time.Second); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first connection to be served, got %v", err)
+	}
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := sendRequest(t, addr)
+		resp, err := readResponse(c, 5*time.Second)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a new connection to be served once one closed, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeadLetter records events the transaction logger failed to persist.
+// Under write-behind these are writes the store has and the log lacks;
+// under write-ahead such writes are refused instead, and aren't
+// dead-lettered. Ops has the form of a /v1/_tx request, so once the
+// cause is fixed the events can be replayed by posting {"ops": [...]} to
+// /v1/_tx. Mind that the keys may have been written again since.
+type DeadLetter struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+	Ops   []TxOp    `json:"ops"`
+}
+
+// deadLetters receives the events the logger fails to persist, if
+// -dead-letter-file is set.
+var deadLetters *deadLetterLog
+
+// deadLetterLog appends dead letters to a file as JSON lines.
+type deadLetterLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// openDeadLetterLog opens the dead-letter file at path for appending,
+// creating it if needed.
+func openDeadLetterLog(path string) (*deadLetterLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open dead-letter file: %w", err)
+	}
+
+	return &deadLetterLog{path: path, file: f}, nil
+}
+
+// deadLetter records that events couldn't be persisted because of err.
+// Without a dead-letter log they are only reported in the server log.
+func deadLetter(events []Event, err error) {
+	slog.Error("failed to persist events", "events", len(events), "err", err)
+	if deadLetters == nil {
+		return
+	}
+	if werr := deadLetters.add(events, err); werr != nil {
+		slog.Error("failed to write dead letter, events are lost", "err", werr)
+	}
+}
+
+// deadLetterUnlogged dead-letters events a logger failed to write, or
+// dropped once it had stopped. Under write-ahead their writes were never
+// applied, and the clients that made them were answered with an error,
+// so there is nothing to replay: they are only reported.
+func deadLetterUnlogged(events []Event, err error) {
+	if config.WritePolicy == WriteAhead {
+		slog.Error("failed to log events, their writes were refused", "events", len(events), "err", err)
+		return
+	}
+	deadLetter(events, err)
+}
+
+// add appends a dead letter for events and syncs it to stable storage,
+// since the file holds the only copy of them.
+func (d *deadLetterLog) add(events []Event, cause error) error {
+	letter := DeadLetter{Time: time.Now().UTC(), Error: cause.Error(), Ops: make([]TxOp, 0, len(events))}
+	for _, e := range events {
+		op := TxOp{Key: e.Key}
+		switch e.EventType {
+		case EventPut, EventPutImmutable:
+			op.Op, op.Value = "put", e.Value
+		case EventDelete:
+			op.Op = "delete"
+		default:
+			continue
+		}
+		letter.Ops = append(letter.Ops, op)
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// List returns up to limit dead letters, newest first. limit <= 0 means
+// no limit.
+func (d *deadLetterLog) List(limit int) ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	letters := []DeadLetter{}
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var letter DeadLetter
+		if err := dec.Decode(&letter); err != nil {
+			return nil, fmt.Errorf("malformed dead letter: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+
+	for i, j := 0, len(letters)-1; i < j; i, j = i+1, j-1 {
+		letters[i], letters[j] = letters[j], letters[i]
+	}
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+
+	return letters, nil
+}
+
+func (d *deadLetterLog) Close() error {
+	return d.file.Close()
+}
+
+// deadLetterHandler lists the dead letters, newest first, at most limit
+// of them.
+func deadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if deadLetters == nil {
+		http.Error(w, "the dead-letter log is disabled", http.StatusNotFound)
+		return
+	}
+
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	letters, err := deadLetters.List(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries []DeadLetter `json:"entries"`
+	}{letters})
+}
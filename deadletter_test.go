@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withDeadLetters sends dead letters to a file in a temporary directory
+// until the test ends.
+func withDeadLetters(t *testing.T) *deadLetterLog {
+	t.Helper()
+
+	d, err := openDeadLetterLog(filepath.Join(t.TempDir(), "deadletter.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := deadLetters
+	deadLetters = d
+	t.Cleanup(func() {
+		d.Close()
+		deadLetters = saved
+	})
+
+	return d
+}
+
+func TestFailedEventsAreDeadLettered(t *testing.T) {
+	d := withDeadLetters(t)
+
+	tl, err := NewTransactionLogger(filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	defer tl.Close()
+
+	// Pull the file out from under the logger, so its next write fails.
+	tl.(*FileTransactionLogger).file.Close()
+	tl.WriteBatch([]Event{
+		{EventType: EventPut, Key: "a", Value: "1"},
+		{EventType: EventDelete, Key: "b"},
+	})
+	select {
+	case <-tl.Err():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write didn't fail")
+	}
+
+	letters, err := d.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %+v", letters)
+	}
+	want := []TxOp{{Op: "put", Key: "a", Value: "1"}, {Op: "delete", Key: "b"}}
+	if !reflect.DeepEqual(letters[0].Ops, want) {
+		t.Errorf("expected ops %+v, got %+v", want, letters[0].Ops)
+	}
+	if letters[0].Error == "" {
+		t.Error("the dead letter doesn't say why the events failed")
+	}
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	d := withDeadLetters(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := d.add([]Event{{EventType: EventPut, Key: key, Value: "v"}}, errLoggerStopped); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_deadletter?limit=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	var body struct {
+		Entries []DeadLetter `json:"entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Entries) != 2 || body.Entries[0].Ops[0].Key != "c" || body.Entries[1].Ops[0].Key != "b" {
+		t.Errorf("expected the 2 newest dead letters, got %+v", body.Entries)
+	}
+
+	deadLetters = nil
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_deadletter", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled: expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// errDiskStatsUnsupported is returned by statDisk on platforms where the
+// free space of a file system can't be read.
+var errDiskStatsUnsupported = errors.New("disk usage is not available on this platform")
+
+// diskStats describes the file system holding a path.
+type diskStats struct {
+	total uint64 // size of the file system in bytes
+	free  uint64 // bytes available to the server
+}
+
+// usage returns the percentage of the file system that is unavailable.
+func (s diskStats) usage() float64 {
+	if s.total == 0 {
+		return 0
+	}
+	return 100 * (1 - float64(s.free)/float64(s.total))
+}
+
+// diskStatter reads the usage of the file system holding a path. Tests
+// replace it to simulate a filling disk.
+var diskStatter = statDisk
+
+// diskMonitor checks the usage of the disk holding the transaction log
+// periodically. While it is at or above maxUsage percent, writes are
+// refused with 507 Insufficient Storage; once space is freed they are
+// accepted again.
+type diskMonitor struct {
+	path     string
+	maxUsage float64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startDiskMonitor(path string, maxUsage float64, interval time.Duration) *diskMonitor {
+	m := &diskMonitor{
+		path:     path,
+		maxUsage: maxUsage,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.check()
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.quit:
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+
+	return m
+}
+
+// check refuses or accepts writes according to the current disk usage.
+// If the usage can't be read, nothing changes.
+func (m *diskMonitor) check() {
+	stats, err := diskStatter(m.path)
+	if err != nil {
+		slog.Warn("failed to read disk usage", "path", m.path, "err", err)
+		return
+	}
+
+	usage := stats.usage()
+	wasFull := diskFull.Load() != nil
+	switch {
+	case usage >= m.maxUsage:
+		reason := fmt.Sprintf("disk holding %s is %.1f%% full, over the %.1f%% limit", m.path, usage, m.maxUsage)
+		diskFull.Store(&reason)
+		if !wasFull {
+			slog.Error("disk is full, refusing writes", "path", m.path, "usage", usage, "free", stats.free)
+		}
+	case wasFull:
+		diskFull.Store(nil)
+		slog.Info("disk has space again, accepting writes", "path", m.path, "usage", usage)
+	}
+}
+
+func (m *diskMonitor) stop() {
+	close(m.quit)
+	<-m.done
+}
+
+// registerDiskMetrics exposes the size of the file transaction log and
+// the space left on the disk holding path.
+func registerDiskMetrics(tl TransactionLogger, path string) {
+	if s, ok := tl.(interface{ Size() (int64, error) }); ok {
+		registerGauge("kvstore_log_bytes", "Size of the transaction log file in bytes.", func() float64 {
+			size, _ := s.Size()
+			return float64(size)
+		})
+	}
+	registerGauge("kvstore_disk_free_bytes", "Bytes available on the disk holding the transaction log.", func() float64 {
+		stats, _ := diskStatter(path)
+		return float64(stats.free)
+	})
+	registerGauge("kvstore_disk_usage_percent", "Percentage of the disk holding the transaction log that is in use.", func() float64 {
+		stats, _ := diskStatter(path)
+		return stats.usage()
+	})
+	registerGauge("kvstore_disk_full", "Whether writes are refused because the disk is too full.", func() float64 {
+		if diskFull.Load() != nil {
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// statDisk can't read disk usage on this platform.
+func statDisk(path string) (diskStats, error) {
+	return diskStats{}, errDiskStatsUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// statDisk reads the usage of the file system holding path.
+func statDisk(path string) (diskStats, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return diskStats{}, err
+	}
+
+	bsize := uint64(fs.Bsize)
+	return diskStats{total: uint64(fs.Blocks) * bsize, free: uint64(fs.Bavail) * bsize}, nil
+}
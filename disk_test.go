@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWritesRefusedWhenDiskIsFull(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+
+	// A 1000 byte disk, free tells how much of it is left.
+	free := uint64(500)
+	savedStatter, savedGauges := diskStatter, metrics.gauges
+	t.Cleanup(func() {
+		diskStatter, metrics.gauges = savedStatter, savedGauges
+		diskFull.Store(nil)
+	})
+	diskStatter = func(path string) (diskStats, error) {
+		return diskStats{total: 1000, free: free}, nil
+	}
+	metrics.gauges = nil
+	registerDiskMetrics(tl, t.TempDir())
+	m := &diskMonitor{path: t.TempDir(), maxUsage: 90}
+
+	router := newRouter()
+	request := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader("value")))
+		return rec
+	}
+
+	m.check()
+	if rec := request(http.MethodPut, "/v1/a"); rec.Code != http.StatusCreated {
+		t.Errorf("PUT at 50%%: expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	free = 50
+	m.check()
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if rec := request(method, "/v1/a"); rec.Code != http.StatusInsufficientStorage {
+			t.Errorf("%s at 95%%: expected status %d, got %d", method, http.StatusInsufficientStorage, rec.Code)
+		}
+	}
+	if rec := request(http.MethodGet, "/v1/a"); rec.Code != http.StatusOK {
+		t.Errorf("GET at 95%%: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	body := request(http.MethodGet, "/metrics").Body.String()
+	for _, want := range []string{"kvstore_disk_full 1", "kvstore_disk_free_bytes 50", "kvstore_disk_usage_percent 95", "kvstore_log_bytes "} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+
+	// Writes are accepted again once space is freed.
+	free = 200
+	m.check()
+	if rec := request(http.MethodPut, "/v1/a"); rec.Code != http.StatusOK {
+		t.Errorf("PUT at 80%%: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestStatDisk(t *testing.T) {
+	stats, err := statDisk(t.TempDir())
+	if err == errDiskStatsUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.total == 0 || stats.free > stats.total {
+		t.Errorf("implausible disk stats %+v", stats)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// runLogCommand implements the offline "dump" and "verify" subcommands,
+// which inspect a transaction log file without starting the server.
+func runLogCommand(name string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	filename := fs.String("file", "transaction.log", "transaction log file to read")
+	sequenceCheck := fs.String("sequence-check", string(SequenceIncreasing), "sequence number validation: increasing, strict or lenient")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	options := FileLoggerOptions{SequenceCheck: SequenceCheck(*sequenceCheck)}
+	switch name {
+	case "dump":
+		return dumpLog(*filename, options, out)
+	case "verify":
+		return verifyLog(*filename, options, out)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// dumpLog prints every event in the log, one per line. The start of a
+// batch is printed with the number of events in it.
+func dumpLog(filename string, options FileLoggerOptions, out io.Writer) error {
+	return readLogFile(filename, options, func(e Event) error {
+		switch e.EventType {
+		case EventPut, EventPutImmutable:
+			if e.blob {
+				fmt.Fprintf(out, "%d\t%s\t%s\tblob %s\n", e.Sequence, e.EventType, e.Key, e.Value)
+				break
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s\t%q\n", e.Sequence, e.EventType, e.Key, e.Value)
+		case EventBegin:
+			fmt.Fprintf(out, "%d\t%s\t%s\n", e.Sequence, e.EventType, e.Value)
+		default:
+			fmt.Fprintf(out, "%d\t%s\t%s\n", e.Sequence, e.EventType, e.Key)
+		}
+		return nil
+	})
+}
+
+// verifyLog replays the log into a scratch map, checking sequence numbers
+// as configured in options, and prints the reconstructed final state.
+// As on startup, the events of a batch are only applied once all of them
+// have been read, so a batch the log ends part way through is reported
+// and left out. The log format carries no checksums, so none are
+// verified.
+func verifyLog(filename string, options FileLoggerOptions, out io.Writer) error {
+	state := make(map[string]string)
+	var count int
+	var last uint64
+
+	apply := func(e Event) {
+		if e.EventType == EventDelete {
+			delete(state, e.Key)
+		} else {
+			state[e.Key] = e.Value
+		}
+	}
+
+	var batch []Event // events of the batch being read
+	batchSize := 0    // number of events in the batch being read
+	err := readLogFile(filename, options, func(e Event) error {
+		last = e.Sequence
+
+		switch e.EventType {
+		case EventBegin:
+			if batchSize > 0 {
+				return fmt.Errorf("event %d: batch starts inside another batch", e.Sequence)
+			}
+			n, err := strconv.Atoi(e.Value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("event %d: bad batch size %q", e.Sequence, e.Value)
+			}
+			batchSize = n
+			return nil
+		case EventDelete, EventPut, EventPutImmutable:
+		default:
+			return fmt.Errorf("event %d: unknown event type %d", e.Sequence, e.EventType)
+		}
+
+		count++
+		if batchSize == 0 {
+			apply(e)
+			return nil
+		}
+		if batch = append(batch, e); len(batch) == batchSize {
+			for _, e := range batch {
+				apply(e)
+			}
+			batch, batchSize = nil, 0
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("verification failed after %d events: %w", count, err)
+	}
+
+	fmt.Fprintf(out, "ok: %d events, last sequence %d\n", count, last)
+	if batchSize > 0 {
+		fmt.Fprintf(out, "incomplete batch: %d of %d events at the end of the log, left out\n", len(batch), batchSize)
+	}
+	fmt.Fprintf(out, "final state: %d keys\n", len(state))
+
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(out, "%s\t%q\n", k, state[k])
+	}
+
+	return nil
+}
+
+// readLogFile calls fn for each record of an existing transaction log
+// file in turn, batch markers included, stopping at the first error.
+// Sequence numbers are checked as options say. The file is only opened
+// for reading, so that inspecting a log never changes it, and a log the
+// server would repair or truncate is shown as it is.
+func readLogFile(filename string, options FileLoggerOptions, fn func(Event) error) error {
+	if !options.SequenceCheck.valid() {
+		return fmt.Errorf("unknown sequence check %q", options.SequenceCheck)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner, release := openLogScanner(file, options.MmapThreshold)
+	defer release()
+
+	var decoder logDecoder
+	var last uint64
+	for line := 1; scanner.Scan(); line++ {
+		e, ok, err := decoder.decode(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: input parse error: %w", line, err)
+		}
+		if !ok {
+			// The header. A log truncated after a snapshot carries on
+			// from the snapshot's sequence number.
+			last = decoder.base
+			continue
+		}
+		if err := options.SequenceCheck.check(last, e.Sequence); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		last = max(last, e.Sequence)
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	return nil
+}
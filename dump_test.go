@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLogFile(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+const sampleLog = "1\t2\tkey-a\tHello, world\n" +
+	"2\t2\tkey-b\tsecond value\n" +
+	"3\t1\tkey-a\t\n" +
+	"4\t2\tkey-c\t\n"
+
+func TestDumpLog(t *testing.T) {
+	filename := writeLogFile(t, sampleLog)
+
+	var out bytes.Buffer
+	if err := runLogCommand("dump", []string{"--file", filename}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "1\tPUT\tkey-a\t\"Hello, world\"\n" +
+		"2\tPUT\tkey-b\t\"second value\"\n" +
+		"3\tDELETE\tkey-a\n" +
+		"4\tPUT\tkey-c\t\"\"\n"
+	if out.String() != want {
+		t.Errorf("unexpected dump output:\n%s", out.String())
+	}
+}
+
+func TestVerifyLog(t *testing.T) {
+	filename := writeLogFile(t, sampleLog)
+
+	var out bytes.Buffer
+	if err := runLogCommand("verify", []string{"--file", filename}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "ok: 4 events, last sequence 4\n" +
+		"final state: 2 keys\n" +
+		"key-b\t\"second value\"\n" +
+		"key-c\t\"\"\n"
+	if out.String() != want {
+		t.Errorf("unexpected verify output:\n%s", out.String())
+	}
+}
+
+func TestVerifyLogOutOfSequence(t *testing.T) {
+	filename := writeLogFile(t, "1\t2\tkey-a\tvalue\n3\t2\tkey-b\tvalue\n2\t1\tkey-a\t\n")
+
+	var out bytes.Buffer
+	err := runLogCommand("verify", []string{"--file", filename}, &out)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "after 2 events") {
+		t.Error("unexpected error: ", err)
+	}
+}
+
+func TestVerifyLogMissingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing.log")
+
+	if err := runLogCommand("verify", []string{"--file", filename}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("verify should not create the log file")
+	}
+}
+
+func TestDumpReadOnlyLog(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can open read-only files for writing")
+	}
+	filename := writeLogFile(t, sampleLog)
+	if err := os.Chmod(filename, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, command := range []string{"dump", "verify"} {
+		if err := runLogCommand(command, []string{"--file", filename}, &bytes.Buffer{}); err != nil {
+			t.Errorf("%s: %v", command, err)
+		}
+	}
+}
+
+func TestDumpAndVerifyBatches(t *testing.T) {
+	filename := writeLogFile(t, "#kvstore-log format=tab version=1 base=4\n"+
+		"5\t2\ta\t1\n"+
+		"6\t3\t\t2\n"+
+		"7\t2\tb\t2\n"+
+		"8\t3\t\t2\n"+
+		"9\t2\tc\t3\n")
+
+	var out bytes.Buffer
+	if err := runLogCommand("dump", []string{"--file", filename}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "5\tPUT\ta\t\"1\"\n" +
+		"6\tBEGIN\t2\n" +
+		"7\tPUT\tb\t\"2\"\n" +
+		"8\tBEGIN\t2\n" +
+		"9\tPUT\tc\t\"3\"\n"
+	if out.String() != want {
+		t.Errorf("unexpected dump output:\n%s", out.String())
+	}
+
+	// The second BEGIN is inside the first batch.
+	err := runLogCommand("verify", []string{"--file", filename}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "batch starts inside another batch") {
+		t.Errorf("expected the nested batch to be reported, got %v", err)
+	}
+
+	filename = writeLogFile(t, "1\t2\ta\t1\n2\t3\t\t2\n3\t2\tb\t2\n")
+	out.Reset()
+	if err := runLogCommand("verify", []string{"--file", filename}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want = "ok: 2 events, last sequence 3\n" +
+		"incomplete batch: 1 of 2 events at the end of the log, left out\n" +
+		"final state: 1 keys\n" +
+		"a\t\"1\"\n"
+	if out.String() != want {
+		t.Errorf("unexpected verify output:\n%s", out.String())
+	}
+}
@@ -1,39 +1,238 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var transactionLogger TransactionLogger
 
+// writeMu serializes requests that change the store, so that changes are
+// recorded in the transaction log in the same order they are applied.
+var writeMu sync.Mutex
+
 func keyValuePutHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key := requestKey(r)
+	if isReservedKey(key) {
+		http.Error(w, fmt.Sprintf("keys starting with %q are reserved", reservedPrefix), http.StatusBadRequest)
+		return
+	}
+
+	codec, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	value, err := io.ReadAll(r.Body)
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	value, err := readBody(r, config.MaxBodyBytes)
 	defer r.Body.Close()
 
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if codec != nil {
+		if value, err = codec.decodeValue(value); err != nil {
+			http.Error(w, fmt.Sprintf("malformed %s body: %v", r.URL.Query().Get("encoding"), err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The Content-Type is kept with the value and returned by GET. For an
+	// encoded body it is that of the decoded bytes, binary unless said
+	// otherwise.
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			http.Error(w, fmt.Sprintf("malformed Content-Type %q: %v", contentType, err), http.StatusBadRequest)
+			return
+		}
+	} else if codec != nil {
+		contentType = "application/octet-stream"
+	}
+
+	checked, err := checkValue(key, string(value))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkLoggable(key, checked); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value = []byte(checked)
+
+	// If-None-Match: * only creates the key, failing if it already
+	// exists; If-Match: * only updates it, failing if it doesn't.
+	createOnly := r.Header.Get("If-None-Match") == "*"
+	updateOnly := r.Header.Get("If-Match") == "*"
+	if createOnly && updateOnly {
+		http.Error(w, "If-Match: * and If-None-Match: * can't both hold", http.StatusBadRequest)
+		return
+	}
+
+	// Immutable: true creates the key as immutable, refusing every later
+	// put and delete of it. Only a new key can be made immutable.
+	immutable := false
+	if h := r.Header.Get("Immutable"); h != "" {
+		if immutable, err = strconv.ParseBool(h); err != nil {
+			http.Error(w, fmt.Sprintf("malformed Immutable header %q", h), http.StatusBadRequest)
+			return
+		}
+	}
+	if immutable && updateOnly {
+		http.Error(w, "If-Match: * can't create an immutable key", http.StatusBadRequest)
+		return
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	cond := writeAlways
+	switch {
+	case immutable:
+		cond = writeImmutable
+	case createOnly:
+		cond = writeIfAbsent
+	case updateOnly:
+		cond = writeIfExists
+	}
+	// The put is checked before it is logged and only made once it is,
+	// so the log never misses a change to the store. writeMu keeps the
+	// check good until then.
+	created, stored, err := CheckPut(key, string(value), cond)
+	if errors.Is(err, ErrImmutable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if createOnly && !stored {
+		http.Error(w, "key already exists", http.StatusPreconditionFailed)
+		return
+	}
+	if immutable && !stored {
+		http.Error(w, "key already exists; only a new key can be made immutable", http.StatusConflict)
+		return
+	}
+	if updateOnly && !stored {
+		http.Error(w, ErrNoSuchKey.Error(), http.StatusNotFound)
+		return
+	}
+
+	span := startSpan(r.Context(), "store.put").onKey(key)
+	err = commitWrite(func() {
+		if immutable {
+			transactionLogger.WritePutImmutable(key, string(value))
+		} else {
+			transactionLogger.WritePut(key, string(value))
+		}
+	}, func() error {
+		_, _, err := PutContent(key, string(value), contentType, cond)
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		logFailed(w, err)
+		return
+	}
+	notifyChange(EventPut, key, string(value))
 
-	transactionLogger.WritePut(key, string(value))
-	w.WriteHeader(http.StatusCreated)
-	log.Printf("PUT key=%s value=%s\n", key, string(value))
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	// Clients asking for JSON get the stored value and its new version
+	// back, which saves CAS loops a round trip.
+	if wantsJSON(r) {
+		_, meta, _ := GetWithMetadata(key)
+		echo := string(value)
+		if codec != nil {
+			echo = codec.encode(value)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Key     string `json:"key"`
+			Value   string `json:"value"`
+			Version uint64 `json:"version"`
+		}{key, echo, meta.Version})
+	} else {
+		w.WriteHeader(status)
+	}
+	slog.Debug("PUT", "key", key, "bytes", len(value))
+}
+
+// wantsJSON reports whether the client listed application/json in its
+// Accept header.
+func wantsJSON(r *http.Request) bool {
+	return accepts(r, "application/json")
+}
+
+// accepts reports whether the client listed mediaType in its Accept
+// header.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, listed := range strings.Split(accept, ",") {
+			if listed, _, _ := strings.Cut(listed, ";"); strings.TrimSpace(listed) == mediaType {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key := requestKey(r)
+	if isReservedKey(key) {
+		http.Error(w, fmt.Sprintf("keys starting with %q are reserved", reservedPrefix), http.StatusBadRequest)
+		return
+	}
+
+	codec, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	value, err := Get(key)
+	span := startSpan(r.Context(), "store.get").onKey(key)
+	value, meta, err := GetWithMetadata(key)
+	endSpan(span, err)
 	if errors.Is(err, ErrNoSuchKey) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -43,70 +242,1102 @@ func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Write([]byte(value))
-	log.Printf("GET key=%s\n", key)
+	size := len(value)
+	if codec != nil {
+		value = codec.encode([]byte(value))
+	}
+
+	// Last-Modified is the time of the key's latest write, and
+	// X-Kvstore-Created that of the write that created it. Both have
+	// second precision, so a value written twice within a second can
+	// look unmodified to a client that saw the first.
+	w.Header().Set("Last-Modified", meta.Updated.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Kvstore-Created", meta.Created.UTC().Format(http.TimeFormat))
+
+	if r.URL.Query().Get("meta") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Size  int    `json:"size"`
+			Metadata
+		}{key, value, size, meta})
+		slog.Debug("GET", "key", key, "meta", true)
+		return
+	}
+
+	// An empty value is still a value: it's answered with 200 and
+	// Content-Length: 0 (or 204 if configured), never with the 404 of a
+	// missing key.
+	if value == "" && config.EmptyValueNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		slog.Debug("GET", "key", key)
+		return
+	}
+
+	// A value is served with the Content-Type it was put with, unless it
+	// is encoded; otherwise ServeContent sniffs one. ServeContent also
+	// sets the Content-Length, answers If-Modified-Since with 304 when
+	// the value hasn't changed since, and takes care of Range requests,
+	// answering 206 with the requested bytes or 416 when the range can't
+	// be satisfied.
+	if meta.ContentType != "" && codec == nil {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	http.ServeContent(w, r, "", meta.Updated, strings.NewReader(value))
+	slog.Debug("GET", "key", key)
 }
 
 func keyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key := requestKey(r)
+	if isReservedKey(key) {
+		http.Error(w, fmt.Sprintf("keys starting with %q are reserved", reservedPrefix), http.StatusBadRequest)
+		return
+	}
+	// A key the log can't hold was never stored, but its delete would
+	// still break the log.
+	if err := checkLoggable(key, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	// If-Match: <value> only deletes the key while it still holds value,
+	// so a key updated in the meantime is kept. An entity tag, the
+	// version in quotes as in If-Match: "3", only deletes the key at
+	// that version instead. If-Match: * only deletes an existing key.
+	// Like a put, the delete is checked, logged and only then made.
+	var match deleteMatch
+	ifMatch, conditional := r.Header["If-Match"]
+	if conditional {
+		version, isTag, err := parseVersionTag(ifMatch[0])
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case isTag:
+			match = matchVersion(version)
+		case ifMatch[0] != "*":
+			match = matchValue(ifMatch[0])
+		}
+	}
+	deleted, err := CheckDelete(key, match)
+	// Deleting a missing key succeeds, but there is nothing to log.
+	exists := true
+	if !conditional && errors.Is(err, ErrNoSuchKey) {
+		deleted, err, exists = true, nil, false
+	}
+	if errors.Is(err, ErrNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrImmutable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "key doesn't match If-Match", http.StatusPreconditionFailed)
+		return
+	}
 
-	transactionLogger.WriteDelete(key)
+	if exists {
+		span := startSpan(r.Context(), "store.delete").onKey(key)
+		err := commitWrite(func() {
+			transactionLogger.WriteDelete(key)
+		}, func() error {
+			return Delete(key)
+		})
+		endSpan(span, err)
+		if err != nil {
+			logFailed(w, err)
+			return
+		}
+		notifyChange(EventDelete, key, "")
+	}
 	w.Write([]byte(fmt.Sprintf("value of key %s deleted successfully", key)))
-	log.Printf("DELETE key=%s\n", key)
+	slog.Debug("DELETE", "key", key)
+}
+
+// parseVersionTag reads a version from an entity tag, a version number
+// in double quotes. It reports false for a header that isn't quoted, and
+// fails for a quoted one that doesn't hold a version.
+func parseVersionTag(header string) (uint64, bool, error) {
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false, nil
+	}
+
+	version, err := strconv.ParseUint(header[1:len(header)-1], 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("entity tag %s isn't a version", header)
+	}
+	return version, true, nil
+}
+
+// keyValueExistsHandler answers whether a key exists as
+// {"exists": bool}, with 200 either way.
+func keyValueExistsHandler(w http.ResponseWriter, r *http.Request) {
+	key := requestKey(r)
+	if isReservedKey(key) {
+		http.Error(w, fmt.Sprintf("keys starting with %q are reserved", reservedPrefix), http.StatusBadRequest)
+		return
+	}
+
+	span := startSpan(r.Context(), "store.exists").onKey(key)
+	exists, err := Exists(key)
+	endSpan(span, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Exists bool `json:"exists"`
+	}{exists})
+	slog.Debug("GET exists", "key", key, "exists", exists)
+}
+
+// keyValueRandomHandler answers with a key picked at random and its value
+// as {"key": ..., "value": ...}, or 404 if the store is empty. Values can
+// be base64 encoded with ?encoding= as on GET.
+func keyValueRandomHandler(w http.ResponseWriter, r *http.Request) {
+	codec, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	span := startSpan(r.Context(), "store.random")
+	key, value, ok, err := RandomKey()
+	endSpan(span, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "the store is empty", http.StatusNotFound)
+		return
+	}
+	if codec != nil {
+		value = codec.encode([]byte(value))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{key, value})
+	slog.Debug("GET random", "key", key)
+}
+
+// keyValueRenameHandler moves the value of a key to the key given by the
+// newKey parameter. The move is logged as one batch, a delete of the old
+// key followed by a put of the new one, so replay never applies half of
+// it. An existing newKey is only replaced with ?overwrite=true.
+func keyValueRenameHandler(w http.ResponseWriter, r *http.Request) {
+	key := requestKey(r)
+	newKey := normalizeKey(r.URL.Query().Get("newKey"))
+	if newKey == "" {
+		http.Error(w, "newKey is required", http.StatusBadRequest)
+		return
+	}
+	if isReservedKey(key) || isReservedKey(newKey) {
+		http.Error(w, fmt.Sprintf("keys starting with %q are reserved", reservedPrefix), http.StatusBadRequest)
+		return
+	}
+	// The value was checked when it was put, so only the new key needs
+	// to be.
+	if err := checkLoggable(newKey, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	value, err := CheckRename(key, newKey, overwrite)
+	if errors.Is(err, ErrNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrKeyExists) {
+		http.Error(w, fmt.Sprintf("key %s already exists", newKey), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrImmutable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if newKey != key {
+		span := startSpan(r.Context(), "store.rename").onKey(key)
+		err := commitWrite(func() {
+			transactionLogger.WriteBatch([]Event{
+				{EventType: EventDelete, Key: key},
+				{EventType: EventPut, Key: newKey, Value: value},
+			})
+		}, func() error {
+			_, err := rename(key, newKey, overwrite)
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			logFailed(w, err)
+			return
+		}
+		notifyChange(EventDelete, key, "")
+		notifyChange(EventPut, newKey, value)
+	}
+	w.Write([]byte(fmt.Sprintf("key %s renamed to %s", key, newKey)))
+	slog.Debug("RENAME", "key", key, "newKey", newKey)
+}
+
+// keyValueListHandler lists the stored keys. The listing can be filtered
+// by a glob pattern (?pattern=, with path.Match syntax), sorted by key or
+// value size (?sort=key|size&order=asc|desc), include value sizes
+// (?include=size) and be paged through with ?offset= and ?limit=.
+// ?idle_gt= lists only keys not read or written for that long.
+//
+// ?prefix= lists only the keys starting with the prefix. With
+// ?delimiter=, as in S3, keys with the delimiter somewhere after the
+// prefix are rolled up into their common prefix up to and including the
+// delimiter, so ?prefix=a/&delimiter=/ lists a/b but not a/c/d, which is
+// reported under "prefixes" as a/c/. Prefixes are listed in full in key
+// order, after the pattern and idle filters; sorting and paging only
+// apply to the keys.
+//
+// Filtering has to test every key in the store, so a pattern costs O(n)
+// in the size of the keyspace even when it matches few keys.
+func keyValueListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	pattern := query.Get("pattern")
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, fmt.Sprintf("invalid pattern %q: %v", pattern, err), http.StatusBadRequest)
+		return
+	}
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "key"
+	}
+	if sortBy != "key" && sortBy != "size" {
+		http.Error(w, "sort must be one of key, size", http.StatusBadRequest)
+		return
+	}
+
+	order := query.Get("order")
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		http.Error(w, "order must be one of asc, desc", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := intQueryParam(query, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := intQueryParam(query, "limit", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A token resumes a key-ordered listing after the last key of the
+	// previous page, which, unlike an offset, neither skips nor repeats
+	// keys when others are written in between.
+	token := query.Get("token")
+	var after string
+	if token != "" {
+		if sortBy != "key" || offset != 0 {
+			http.Error(w, "token only applies to sort=key, without offset", http.StatusBadRequest)
+			return
+		}
+		if after, err = decodePageToken(token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.MaxListKeys > 0 && (limit == 0 || limit > config.MaxListKeys) {
+		limit = config.MaxListKeys
+	}
+
+	idle, idleOnly, err := durationQueryParam(query, "idle_gt")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var keys []KeyInfo
+	span := startSpan(r.Context(), "store.list")
+	if idleOnly {
+		keys, err = IdleKeys(time.Now().Add(-idle))
+	} else {
+		keys, err = List()
+	}
+	endSpan(span, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys = visibleKeys(keys)
+	if pattern != "" {
+		keys = matchKeys(keys, pattern)
+	}
+	var prefixes []string
+	if prefix, delimiter := query.Get("prefix"), query.Get("delimiter"); prefix != "" || delimiter != "" {
+		keys, prefixes = groupKeys(keys, prefix, delimiter)
+	}
+	sortKeys(keys, sortBy, order == "desc")
+	if token != "" {
+		keys = keysAfter(keys, after, order == "desc")
+	}
+
+	next, nextToken := 0, ""
+	if offset > len(keys) {
+		offset = len(keys)
+	}
+	keys = keys[offset:]
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+		if token == "" {
+			next = offset + limit
+		}
+		if sortBy == "key" {
+			nextToken = encodePageToken(keys[len(keys)-1].Key)
+		}
+	}
+
+	var body struct {
+		Keys      interface{} `json:"keys"`
+		Prefixes  []string    `json:"prefixes,omitempty"`
+		Next      int         `json:"next,omitempty"`       // offset of the next page
+		NextToken string      `json:"next_token,omitempty"` // token of the next page
+	}
+	body.Next, body.NextToken = next, nextToken
+	body.Prefixes = prefixes
+	if query.Get("include") == "size" {
+		body.Keys = keys
+	} else {
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = k.Key
+		}
+		body.Keys = names
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// keyValueDeleteIdleHandler deletes every key that has not been read or
+// written for longer than the gt parameter, logging a delete for each.
+func keyValueDeleteIdleHandler(w http.ResponseWriter, r *http.Request) {
+	idle, ok, err := durationQueryParam(r.URL.Query(), "gt")
+	if err == nil && !ok {
+		err = errors.New("gt is required")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Store errors are never transient, so logFailed answers them with
+	// 500 like a log that failed for good.
+	deleted, err := deleteIdleKeys(r.Context(), time.Now().Add(-idle))
+	if err != nil {
+		logFailed(w, err)
+		return
+	}
+
+	sort.Strings(deleted)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Deleted []string `json:"deleted"`
+	}{deleted})
+	slog.Debug("DELETE idle keys", "idle", idle, "keys", len(deleted))
+}
+
+// visibleKeys drops the server's reserved keys from a listing.
+func visibleKeys(keys []KeyInfo) []KeyInfo {
+	visible := keys[:0]
+	for _, k := range keys {
+		if !isReservedKey(k.Key) {
+			visible = append(visible, k)
+		}
+	}
+
+	return visible
+}
+
+// matchKeys filters keys down to those matching a valid glob pattern.
+func matchKeys(keys []KeyInfo, pattern string) []KeyInfo {
+	matched := keys[:0]
+	for _, k := range keys {
+		if ok, _ := path.Match(pattern, k.Key); ok {
+			matched = append(matched, k)
+		}
+	}
+
+	return matched
+}
+
+// groupKeys filters keys down to those starting with prefix. If delimiter
+// isn't empty, the keys where it occurs after the prefix are left out and
+// returned instead as the distinct prefixes they share up to the first
+// such delimiter, in order.
+func groupKeys(keys []KeyInfo, prefix, delimiter string) ([]KeyInfo, []string) {
+	grouped := keys[:0]
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k.Key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			rest := k.Key[len(prefix):]
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				common := prefix + rest[:i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					prefixes = append(prefixes, common)
+				}
+				continue
+			}
+		}
+		grouped = append(grouped, k)
+	}
+	sort.Strings(prefixes)
+
+	return grouped, prefixes
+}
+
+// sortKeys orders keys by name or by value size. Ties in size are broken
+// by name so that paging through a listing is stable.
+func sortKeys(keys []KeyInfo, by string, desc bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if desc {
+			a, b = b, a
+		}
+		if by == "size" && a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		return a.Key < b.Key
+	})
+}
+
+// keysAfter returns the keys that follow after in keys, which are sorted
+// by key, in descending order if desc is set.
+func keysAfter(keys []KeyInfo, after string, desc bool) []KeyInfo {
+	return keys[sort.Search(len(keys), func(i int) bool {
+		if desc {
+			return keys[i].Key < after
+		}
+		return keys[i].Key > after
+	}):]
+}
+
+// encodePageToken returns the opaque token that resumes a key-ordered
+// listing after key.
+func encodePageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodePageToken returns the key a page token resumes after.
+func decodePageToken(token string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("malformed page token %q", token)
+	}
+	return string(key), nil
+}
+
+// intQueryParam parses a non-negative integer query parameter, falling
+// back to def when it is absent.
+func intQueryParam(query url.Values, name string, def int) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+
+	return n, nil
+}
+
+// durationQueryParam parses the positive duration in query parameter
+// name, reporting whether it was given.
+func durationQueryParam(query url.Values, name string) (time.Duration, bool, error) {
+	s := query.Get(name)
+	if s == "" {
+		return 0, false, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false, fmt.Errorf("%s must be a positive duration such as 1h", name)
+	}
+
+	return d, true, nil
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.Method, r.RequestURI)
+		slog.Debug("request", "method", r.Method, "uri", r.RequestURI)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func initializeFileTransactionLog() error {
+// initializeStore opens the configured store backend. It returns the
+// bbolt backend, which needs checkpointing and closing, or nil for the
+// others.
+func initializeStore() (*boltBackend, error) {
+	if config.Store == "memory" && config.StoreBlobThreshold > 0 {
+		data, err := newMemoryStore()
+		if err != nil {
+			return nil, err
+		}
+		return nil, useBackend(data)
+	}
+	if config.Store != "bbolt" {
+		return nil, nil
+	}
+
+	b, err := openBoltBackend(config.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := useBackend(b); err != nil {
+		b.Close()
+		return nil, fmt.Errorf("failed to read store database: %w", err)
+	}
+
+	return b, nil
+}
+
+// initializeTransactionLog opens the configured transaction log and
+// replays the events after sequence number after into the store, or with
+// config.Store set to log, has the store read from the log. If the
+// replay fails or takes longer than config.ReplayTimeout, the server
+// either gives up or, with config.ReplayFailure set to read-only, keeps
+// what was replayed and refuses writes. Events saved to
+// config.RecoveryFile at the last shutdown are then applied and logged.
+// If the logger can't be created at all, config.BackendFallback decides
+// whether to give up, log to the file backend instead, or serve
+// read-only.
+func initializeTransactionLog(after uint64) error {
 	var err error
 
-	transactionLogger, err = NewTransactionLogger("transaction.log")
+	transactionLogger, err = openTransactionLogger(config.Backend)
+	if err != nil && config.BackendFallback != "none" {
+		slog.Warn("failed to create event logger, falling back", "backend", config.Backend, "fallback", config.BackendFallback, "err", err)
+
+		switch config.BackendFallback {
+		case "file":
+			// The rest of startup treats the node as running on the
+			// file backend, which it is until it is restarted.
+			config.Backend = "file"
+			transactionLogger, err = openTransactionLogger(config.Backend)
+		case "read-only":
+			// Serve what the store or snapshot holds. The memory logger
+			// is never run, so nothing is logged to it.
+			setReadOnly(fmt.Sprintf("the %s backend is unavailable: %v", config.Backend, err))
+			transactionLogger = NewMemoryTransactionLogger()
+			return nil
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create event logger: %w", err)
 	}
+	registerLoggerHealth(transactionLogger)
 
-	events, errors := transactionLogger.ReadEvents()
-	count, ok, e := 0, true, Event{}
-
-	for ok && err == nil {
-		select {
-		case err, ok = <-errors: //retrieving any errors
-		case e, ok = <-events:
-			switch e.EventType {
-			case EventDelete:
-				err = Delete(e.Key)
-				count++
-			case EventPut:
-				err = Put(e.Key, e.Value)
-				count++
-			}
+	if config.Store == "log" {
+		if err := useLogStore(transactionLogger); err != nil {
+			return err
+		}
+		return startTransactionLog()
+	}
+
+	ctx := context.Background()
+	if config.ReplayTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ReplayTimeout)
+		defer cancel()
+	}
+
+	// Report not ready until the store has been rebuilt, in case anything
+	// asks before replay is over.
+	replaying := addReadinessCheck("replay", func() error { return errors.New("replaying transaction log") })
+	_, err = replayEventsContext(ctx, transactionLogger, after, replayProgressEvery, logReplayProgress)
+	replaying()
+	if err != nil {
+		if config.ReplayFailure != "read-only" {
+			return fmt.Errorf("failed to replay transaction log: %w", err)
 		}
+
+		// Serve what was replayed, but leave the logger stopped: the rest
+		// of the log is unread, so new events would be numbered from the
+		// wrong place.
+		setReadOnly(fmt.Sprintf("transaction log replay failed: %v", err))
+		slog.Error("transaction log replay failed, serving read-only", "err", err)
+		return nil
+	}
+	if err := restoreVersions(transactionLogger); err != nil {
+		return err
+	}
+	if err := collectBlobs(); err != nil {
+		return err
 	}
-	log.Printf("%d events replayed\n", count)
+	if transactionLogger.LastSequence() < after {
+		// Compaction can drop the latest events, but a log this far behind
+		// may also have been replaced, in which case new events would be
+		// skipped on the next startup.
+		slog.Warn("transaction log ends before the store's checkpoint",
+			"sequence", transactionLogger.LastSequence(), "checkpoint", after)
+	}
+
+	return startTransactionLog()
+}
+
+// useLogStore makes the store read from tl's log in place of a replay.
+// The keys' metadata is still read into memory, with their versions.
+func useLogStore(tl TransactionLogger) error {
+	b, err := newLogBackend(tl, config.StoreCacheKeys)
+	if err != nil {
+		return err
+	}
+	if err := b.lookup.prepareLookups(); err != nil {
+		return err
+	}
+	if err := useBackend(b); err != nil {
+		return fmt.Errorf("failed to read the store from the transaction log: %w", err)
+	}
+	slog.Info("serving the store from the transaction log", "keys", Stats().Keys, "sequence", tl.LastSequence())
+
+	return restoreVersions(tl)
+}
 
+// startTransactionLog runs the transaction logger, then logs the events a
+// stuck logger left behind at the last shutdown. They come after
+// everything in the log, and before anything new.
+func startTransactionLog() error {
 	transactionLogger.Run()
 
-	return err
+	if config.RecoveryFile != "" {
+		n, err := recoverEvents(transactionLogger, config.RecoveryFile)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			slog.Warn("recovered events left unlogged at the last shutdown", "events", n, "file", config.RecoveryFile)
+		}
+	}
+
+	return nil
+}
+
+// openTransactionLogger creates the transaction logger of backend. Several
+// backends separated by commas are each opened and written together, and
+// replayed from config.LogPrimary, or the first if it isn't set.
+func openTransactionLogger(backend string) (TransactionLogger, error) {
+	if strings.Contains(backend, ",") {
+		backends := strings.Split(backend, ",")
+		primary := 0
+		if config.LogPrimary != "" {
+			primary = slices.Index(backends, config.LogPrimary)
+		}
+
+		var loggers []TransactionLogger
+		for _, b := range backends {
+			tl, err := openTransactionLogger(b)
+			if err != nil {
+				for _, opened := range loggers {
+					opened.Close()
+				}
+				return nil, fmt.Errorf("%s backend: %w", b, err)
+			}
+			loggers = append(loggers, tl)
+		}
+		return NewMultiTransactionLogger(primary, loggers...)
+	}
+
+	switch backend {
+	case "file":
+		options := FileLoggerOptions{
+			FlushInterval: config.LogFlushInterval,
+			BufferSize:    config.LogBufferSize,
+			Sync:          config.LogSync,
+			MmapThreshold: config.LogMmapThreshold,
+			CloseTimeout:  config.LogCloseTimeout,
+			RecoveryFile:  config.RecoveryFile,
+
+			CompactInterval: config.CompactInterval,
+			CompactRecords:  config.CompactRecords,
+			CompactBytes:    config.CompactBytes,
+			CompactBackups:  config.CompactBackups,
+
+			SequenceCheck: SequenceCheck(config.SequenceCheck),
+			Format:        LogFormat(config.LogFormat),
+			OnError:       ReplayErrorPolicy(config.ReplayOnError),
+		}
+		if config.Store == "memory" && config.StoreBlobThreshold > 0 {
+			options.BlobDir, options.BlobThreshold = config.StoreBlobDir, config.StoreBlobThreshold
+		}
+		if config.LogShards > 1 {
+			return NewShardedTransactionLogger(config.LogFile, config.LogShards, options)
+		}
+		if err := checkShardLayout(config.LogFile, 1); err != nil {
+			return nil, err
+		}
+		return NewTransactionLoggerWithOptions(config.LogFile, options)
+	case "postgres":
+		return NewPostgresTransactionLogger(PostgresDBParams{
+			host:     config.DBHost,
+			dbName:   config.DBName,
+			user:     config.DBUser,
+			password: config.DBPassword,
+
+			healthInterval: config.DBHealthInterval,
+			replayPageSize: config.DBReplayPageSize,
+			replayPrefetch: config.DBReplayPrefetch,
+
+			breakerFailures: config.DBBreakerFailures,
+			breakerCooldown: config.DBBreakerCooldown,
+
+			closeTimeout: config.LogCloseTimeout,
+			recoveryFile: config.RecoveryFile,
+		})
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+}
+
+// keyRoute matches everything after /v1/ as the key, so hierarchical keys
+// such as a/b/c work. Keys are taken from the decoded path: percent
+// escapes are decoded (a%2Fb is the same key as a/b) and the path is not
+// cleaned, so a//b and a/./b are keys in their own right. Admin endpoints
+// are registered before it and use the reserved "_" prefix, which keys
+// can't start with. So are POST .../rename and GET .../exists, which
+// shadow those methods for keys ending in /rename or /exists.
+const keyRoute = "/v1/{key:.+}"
+
+func newRouter() *mux.Router {
+	r := mux.NewRouter().SkipClean(true)
+	r.Use(inflight.middleware)
+	r.Use(tracingMiddleware)
+	r.Use(loggingMiddleware)
+	r.Use(compressMiddleware)
+	r.Use(bodyLoggingMiddleware)
+	r.Use(timeoutMiddleware)
+
+	writeLimits.Store(newWriteLimiter(config.MaxConcurrentWrites, config.MaxQueuedWrites))
+	write := func(h http.HandlerFunc) http.Handler {
+		return rejectWhenReadOnly(rejectWhenCircuitOpen(limitWrites(h)))
+	}
+
+	r.HandleFunc("/v1/_keys", keyValueListHandler).Methods("GET")
+	r.HandleFunc("/v1/_prefix/{prefix:.*}", prefixHandler).Methods("GET")
+	r.HandleFunc("/v1/_selftest", selfTestHandler).Methods("GET")
+	r.HandleFunc("/v1/_stats", statsHandler).Methods("GET")
+	r.HandleFunc("/v1/_random", keyValueRandomHandler).Methods("GET")
+	r.HandleFunc("/v1/_deadletter", deadLetterHandler).Methods("GET")
+	r.HandleFunc("/v1/_subscribers", subscribersHandler).Methods("GET")
+	r.HandleFunc("/v1/_ws", websocketHandler).Methods("GET")
+	r.Handle("/v1/_idle", write(keyValueDeleteIdleHandler)).Methods("DELETE")
+	r.Handle("/v1/_tx", write(txHandler)).Methods("POST")
+	r.HandleFunc("/v1/_compact", compactStartHandler).Methods("POST")
+	r.HandleFunc("/v1/_compact/{id}", compactStatusHandler).Methods("GET")
+	r.HandleFunc("/admin/sequence", sequenceHandler).Methods("GET")
+	r.HandleFunc("/admin/sequence/check", sequenceCheckHandler).Methods("GET")
+	r.HandleFunc("/admin/tombstones", tombstonesHandler).Methods("GET")
+	r.HandleFunc("/admin/audit", auditHandler).Methods("GET")
+	r.HandleFunc("/admin/reload", reloadHandler).Methods("POST")
+	r.HandleFunc("/admin/backup", backupHandler).Methods("GET")
+	r.Handle("/admin/restore", write(restoreHandler)).Methods("POST")
+	r.HandleFunc("/ready", readyHandler).Methods("GET")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	cluster := newClusterRouting()
+	r.Handle(keyRoute+"/rename", cluster.redirect(cluster.ownsNewKey(auditMiddleware(write(keyValueRenameHandler))))).Methods("POST")
+	r.Handle(keyRoute+"/exists", cluster.redirect(auditMiddleware(http.HandlerFunc(keyValueExistsHandler)))).Methods("GET")
+	r.Handle(keyRoute, cluster.redirect(auditMiddleware(write(keyValuePutHandler)))).Methods("PUT")
+	r.Handle(keyRoute, cluster.redirect(auditMiddleware(http.HandlerFunc(keyValueGetHandler)))).Methods("GET")
+	r.Handle(keyRoute, cluster.redirect(auditMiddleware(write(keyValueDeleteHandler)))).Methods("DELETE")
+	r.HandleFunc("/", rootHandler(r)).Methods("GET")
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+
+	return r
+}
+
+// methodNotAllowedHandler answers requests for a path that router serves,
+// but not with the request's method, with 405 and an Allow header
+// listing the methods that are served there.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := make(map[string]bool)
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, method := range methods {
+				probe := r.Clone(r.Context())
+				probe.Method = method
+				if route.Match(probe, &mux.RouteMatch{}) {
+					allowed[method] = true
+				}
+			}
+			return nil
+		})
+
+		methods := make([]string, 0, len(allowed))
+		for method := range allowed {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+	})
+}
+
+// newServer builds the HTTP server with the configured address, timeouts
+// and protocols. With HTTP/2 on, it is negotiated when serving over TLS,
+// and spoken as h2c over plaintext to clients that upgrade to it or start
+// with it; other requests are served over HTTP/1.1 as before.
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(config.KeepAlive)
+
+	if !config.HTTP2 {
+		// A non-nil, empty map stops TLS from negotiating HTTP/2.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return srv
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams: uint32(config.HTTP2MaxStreams),
+		IdleTimeout:          config.IdleTimeout,
+	}
+	// ConfigureServer only fails on a TLSConfig with unsuitable cipher
+	// suites, and the server has none of its own.
+	http2.ConfigureServer(srv, h2)
+	srv.Handler = h2c.NewHandler(handler, h2)
+
+	return srv
 }
 
 func main() {
-	err := initializeFileTransactionLog()
+	if len(os.Args) > 1 && (os.Args[1] == "dump" || os.Args[1] == "verify") {
+		if err := runLogCommand(os.Args[1], os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	configArgs = os.Args[1:]
+	if err := parseFlags(flag.CommandLine, configArgs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if config.PrintConfig {
+		if err := printConfig(os.Stdout, config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	setupLogging(config.LogLevel)
+	readOnlyConfigured.Store(config.ReadOnly)
+	slowOpThreshold.Store(int64(config.SlowOpThreshold))
+	if config.OTLPEndpoint != "" {
+		stopTracing, err := setupTracing(context.Background(), config.OTLPEndpoint)
+		if err != nil {
+			fatal("failed to set up tracing", err)
+		}
+		defer stopTracing(context.Background())
+	}
+	bodyRedactor = bodyRedactors[config.LogBodiesRedact]
+	normalizeKey = keyNormalizers[config.KeyNormalize]
+	if config.ValueSchema != "" {
+		hook, err := loadSchemaHook(config.ValueSchema)
+		if err != nil {
+			fatal("cannot load value schema", err)
+		}
+		valueHook = hook
+	}
+	quotas, err := parseNamespaceQuotas(config.NamespaceQuotas)
+	if err != nil {
+		fatal("bad namespace quotas", err)
+	}
+	namespaceQuotas = quotas
+
+	bb, err := initializeStore()
+	if err != nil {
+		fatal("failed to open store", err)
+	}
+	var checkpoint uint64
+	if bb != nil {
+		if checkpoint, err = bb.checkpoint(); err != nil {
+			fatal("failed to read store checkpoint", err)
+		}
+	}
+	if config.SnapshotFile != "" {
+		if checkpoint, err = loadSnapshot(config.SnapshotFile); err != nil {
+			fatal("failed to load snapshot", err)
+		}
+	}
+
+	if config.DeadLetterFile != "" {
+		if deadLetters, err = openDeadLetterLog(config.DeadLetterFile); err != nil {
+			fatal("failed to open dead-letter log", err)
+		}
+		defer deadLetters.Close()
+	}
+
+	err = initializeTransactionLog(checkpoint)
+	if err != nil {
+		fatal("failed to initialize transaction log", err)
+	}
+	go watchTransactionLog(transactionLogger)
+	if config.Seed != "" {
+		if readOnly.Load() != nil {
+			slog.Warn("not seeding the store, the transaction log isn't running", "seed", config.Seed)
+		} else {
+			n, err := seedStore(config.Seed, config.SeedOverwrite)
+			if err != nil {
+				fatal("failed to seed store", err)
+			}
+			slog.Info("seeded store", "seed", config.Seed, "keys", n)
+		}
+	}
+
+	var stopCheckpointer func()
+	if bb != nil {
+		stopCheckpointer = startCheckpointer(bb, config.StoreCheckpointInterval)
+	}
+	stopSnapshotter := func() {}
+	if config.SnapshotFile != "" && readOnly.Load() == nil {
+		stopSnapshotter = startSnapshotter(config.SnapshotFile, config.SnapshotInterval)
+	}
+	registerStoreMetrics()
+	registerSlowOpMetrics()
+	if slices.Contains(strings.Split(config.Backend, ","), "file") {
+		logDir := filepath.Dir(config.LogFile)
+		registerDiskMetrics(transactionLogger, logDir)
+		if config.DiskMaxUsage > 0 {
+			monitor := startDiskMonitor(logDir, config.DiskMaxUsage, config.DiskCheckInterval)
+			defer monitor.stop()
+		}
+	}
+
+	if config.TombstoneRetention > 0 {
+		stopGC := startTombstoneGC(config.TombstoneRetention)
+		defer stopGC()
+	}
+	stopIdleExpiry := func() {}
+	if config.IdleTTL > 0 {
+		stopIdleExpiry = startIdleExpiry(config.IdleTTL)
+	}
+	stopScrubber := func() {}
+	backends := strings.Split(config.Backend, ",")
+	if i := slices.Index(backends, "postgres"); i >= 0 && config.DBScrubInterval > 0 && readOnly.Load() == nil {
+		tl := transactionLogger
+		if m, ok := tl.(*MultiTransactionLogger); ok {
+			tl = m.loggers[i]
+		}
+		stopScrubber = startScrubber(tl, config.DBScrubInterval, config.DBScrubRepair)
+	}
+
+	if config.Audit {
+		var w io.Writer
+		if config.AuditFile != "" {
+			f, err := os.OpenFile(config.AuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				fatal("cannot open audit log", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		auditor = newAuditLog(w, config.AuditRecent)
+		defer auditor.Close()
+	}
+
+	if config.WebhookURLs != "" {
+		notifier := newWebhookNotifier(strings.Split(config.WebhookURLs, ","), config.WebhookSecret, config.WebhookRetries)
+		addChangeSubscriber(notifier)
+		defer notifier.Close()
+	}
+
+	srv := newServer(newRouter())
+	ln, err := listen(srv.Addr, config.MaxConnections, config.MaxConnectionsMode)
 	if err != nil {
-		panic(err)
+		fatal("cannot listen", err)
 	}
-	mux := mux.NewRouter()
-	mux.Use(loggingMiddleware)
+	registerConnLimitMetrics()
+	go func() {
+		slog.Info("started server", "addr", srv.Addr, "max_connections", config.MaxConnections)
 
-	mux.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
-	mux.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
-	mux.HandleFunc("/v1/{key}", keyValueDeleteHandler).Methods("DELETE")
+		var err error
+		if config.TLSCertFile != "" {
+			err = srv.ServeTLS(ln, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server failed", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
 
-	log.Println("started server on port :4000")
-	log.Fatal(http.ListenAndServe(":4000", mux))
+	stopSnapshotter()
+	stopScrubber()
+	stopIdleExpiry()
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx, srv); err != nil {
+		fatal("shutdown failed", err)
+	}
+	if bb != nil {
+		// The logger has been closed, so everything applied is logged.
+		stopCheckpointer()
+		if err := bb.setCheckpoint(transactionLogger.LastSequence()); err != nil {
+			slog.Error("failed to checkpoint store", "err", err)
+		}
+		bb.Close()
+	}
+	slog.Info("server stopped")
 }
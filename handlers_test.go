@@ -0,0 +1,1177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestPutBodyTooLarge(t *testing.T) {
+	defer func(limit int64) { config.MaxBodyBytes = limit }(config.MaxBodyBytes)
+	config.MaxBodyBytes = 8
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/large-key", strings.NewReader("this body is too large"))
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+// withStore swaps the contents of the store for m until the test ends.
+func withStore(t *testing.T, m map[string]string) {
+	t.Helper()
+
+	saved, savedMeta, savedTombstones, savedUsage := store.data, store.meta, store.tombstones, store.usage
+	savedKeys, savedKeyBytes, savedValueBytes := store.keys, store.keyBytes, store.valueBytes
+	t.Cleanup(func() {
+		store.data, store.meta, store.tombstones, store.usage = saved, savedMeta, savedTombstones, savedUsage
+		store.keys, store.keyBytes, store.valueBytes = savedKeys, savedKeyBytes, savedValueBytes
+	})
+
+	if err := useBackend(memoryBackend(m)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withLogger points the handlers at a file transaction logger in a
+// temporary directory until the test ends.
+func withLogger(t *testing.T) *FileTransactionLogger {
+	t.Helper()
+	return withLoggerOptions(t, FileLoggerOptions{})
+}
+
+// withLoggerOptions is like withLogger, but opens the logger with options.
+func withLoggerOptions(t *testing.T, options FileLoggerOptions) *FileTransactionLogger {
+	t.Helper()
+
+	tl, err := NewTransactionLoggerWithOptions(filepath.Join(t.TempDir(), "transaction.log"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+
+	saved := transactionLogger
+	transactionLogger = tl
+	t.Cleanup(func() {
+		tl.Close()
+		transactionLogger = saved
+	})
+
+	return tl.(*FileTransactionLogger)
+}
+
+func TestListKeysSorted(t *testing.T) {
+	withStore(t, map[string]string{
+		"a": "xx",
+		"b": "xxxx",
+		"c": "x",
+		"d": "xxxx",
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"?sort=key&order=asc", []string{"a", "b", "c", "d"}},
+		{"?sort=key&order=desc", []string{"d", "c", "b", "a"}},
+		{"?sort=size&order=asc", []string{"c", "a", "b", "d"}},
+		{"?sort=size&order=desc", []string{"d", "b", "a", "c"}},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys"+tt.query, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", tt.query, rec.Code)
+		}
+
+		var body struct{ Keys []string }
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body.Keys, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, body.Keys, tt.want)
+		}
+	}
+}
+
+func TestListKeysIncludeSizePaged(t *testing.T) {
+	withStore(t, map[string]string{
+		"a": "xx",
+		"b": "xxxx",
+		"c": "x",
+		"d": "xxxx",
+	})
+
+	var got []KeyInfo
+	path := "/v1/_keys?include=size&sort=size&order=desc&limit=3"
+	for {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var body struct {
+			Keys []KeyInfo
+			Next int
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, body.Keys...)
+
+		if body.Next == 0 {
+			break
+		}
+		path = fmt.Sprintf("/v1/_keys?include=size&sort=size&order=desc&limit=3&offset=%d", body.Next)
+	}
+
+	want := []KeyInfo{{"d", 4}, {"b", 4}, {"a", 2}, {"c", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestListKeysBadSort(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?sort=value", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	withStore(t, map[string]string{"blob": "0123456789"})
+
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"", http.StatusOK, "0123456789", ""},
+		{"bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v1/blob", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.rangeHeader, tt.status, rec.Code)
+		}
+		if tt.status != http.StatusRequestedRangeNotSatisfiable && rec.Body.String() != tt.body {
+			t.Errorf("%q: expected body %q, got %q", tt.rangeHeader, tt.body, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%q: expected Content-Range %q, got %q", tt.rangeHeader, tt.contentRange, got)
+		}
+		if got := rec.Header().Get("Accept-Ranges"); tt.status != http.StatusRequestedRangeNotSatisfiable && got != "bytes" {
+			t.Errorf("%q: expected Accept-Ranges bytes, got %q", tt.rangeHeader, got)
+		}
+	}
+}
+
+func TestPutIfNoneMatch(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	put := func(value string) int {
+		req := httptest.NewRequest(http.MethodPut, "/v1/lock", strings.NewReader(value))
+		req.Header.Set("If-None-Match", "*")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put("owner-a"); code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := put("owner-b"); code != http.StatusPreconditionFailed {
+		t.Errorf("expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+
+	if value, _ := Get("lock"); value != "owner-a" {
+		t.Errorf("expected value owner-a, got %q", value)
+	}
+}
+
+func TestPutIfMatch(t *testing.T) {
+	withStore(t, map[string]string{"existing": "old"})
+	tl := withLogger(t)
+
+	put := func(key, value string) int {
+		req := httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader(value))
+		req.Header.Set("If-Match", "*")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put("missing", "value"); code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, code)
+	}
+	if _, err := Get("missing"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected the missing key not to be created, got %v", err)
+	}
+	if code := put("existing", "new"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if value, _ := Get("existing"); value != "new" {
+		t.Errorf("expected value new, got %q", value)
+	}
+
+	// Only the update is logged.
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readAll(t, tl.filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Key != "existing" || events[0].Value != "new" {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/existing", strings.NewReader("value"))
+	req.Header.Set("If-Match", "*")
+	req.Header.Set("If-None-Match", "*")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("both conditions: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	put := func(value string) {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/meta-key", strings.NewReader(value)))
+		if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+			t.Fatalf("PUT failed with status %d", rec.Code)
+		}
+	}
+
+	before := time.Now()
+	put("first")
+	put("second value")
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/meta-key?meta=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var body struct {
+		Key     string
+		Value   string
+		Size    int
+		Version uint64
+		Created time.Time
+		Updated time.Time
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Key != "meta-key" || body.Value != "second value" || body.Size != len("second value") {
+		t.Errorf("unexpected key/value/size: %+v", body)
+	}
+	if body.Version != 2 {
+		t.Errorf("expected version 2, got %d", body.Version)
+	}
+	if body.Created.Before(before) || body.Updated.Before(body.Created) {
+		t.Errorf("unexpected timestamps: created %v, updated %v", body.Created, body.Updated)
+	}
+}
+
+func TestListKeysPattern(t *testing.T) {
+	withStore(t, map[string]string{
+		"user:1:session":  "",
+		"user:2:session":  "",
+		"user:2:profile":  "",
+		"user:10:session": "",
+		"config:a":        "",
+		"config:b":        "",
+		"config:c":        "",
+	})
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"user:*:session", []string{"user:10:session", "user:1:session", "user:2:session"}},
+		{"user:?:session", []string{"user:1:session", "user:2:session"}},
+		{"config:[ab]", []string{"config:a", "config:b"}},
+		{"config:[^a]", []string{"config:b", "config:c"}},
+		{"nothing*", []string{}},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?pattern="+url.QueryEscape(tt.pattern), nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", tt.pattern, rec.Code)
+		}
+
+		var body struct{ Keys []string }
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body.Keys, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.pattern, body.Keys, tt.want)
+		}
+	}
+}
+
+func TestListKeysDelimiter(t *testing.T) {
+	withStore(t, map[string]string{
+		"a/b":     "",
+		"a/c/d":   "",
+		"a/c/e":   "",
+		"a/f/g/h": "",
+		"a//i":    "",
+		"b":       "",
+		"b/j":     "",
+	})
+
+	tests := []struct {
+		query    string
+		keys     []string
+		prefixes []string
+	}{
+		{"", []string{"a//i", "a/b", "a/c/d", "a/c/e", "a/f/g/h", "b", "b/j"}, nil},
+		{"prefix=a/", []string{"a//i", "a/b", "a/c/d", "a/c/e", "a/f/g/h"}, nil},
+		{"delimiter=/", []string{"b"}, []string{"a/", "b/"}},
+		{"prefix=a/&delimiter=/", []string{"a/b"}, []string{"a//", "a/c/", "a/f/"}},
+		{"prefix=a/f/&delimiter=/", []string{}, []string{"a/f/g/"}},
+		{"prefix=a/c&delimiter=/", []string{}, []string{"a/c/"}},
+		{"prefix=a/&delimiter=/&pattern=a/*/*", []string{}, []string{"a//", "a/c/"}},
+		{"delimiter=/&limit=1&order=desc", []string{"b"}, []string{"a/", "b/"}},
+		{"prefix=z/&delimiter=/", []string{}, nil},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?"+tt.query, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", tt.query, rec.Code)
+		}
+
+		var body struct {
+			Keys     []string
+			Prefixes []string
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body.Keys, tt.keys) {
+			t.Errorf("%s: got keys %v, want %v", tt.query, body.Keys, tt.keys)
+		}
+		if !reflect.DeepEqual(body.Prefixes, tt.prefixes) {
+			t.Errorf("%s: got prefixes %v, want %v", tt.query, body.Prefixes, tt.prefixes)
+		}
+	}
+}
+
+func TestListKeysBadPattern(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?pattern="+url.QueryEscape("user:[a"), nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestServerNegotiatesHTTP2(t *testing.T) {
+	withStore(t, map[string]string{"h2-key": "h2-value"})
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer(newRouter())
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/v1/h2-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "h2-value" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+// h2cClient speaks HTTP/2 over plaintext from the first byte, without
+// upgrading from HTTP/1.1.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestServerSpeaksH2C(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer(newRouter())
+	ts.Start()
+	defer ts.Close()
+
+	client := h2cClient()
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/v1/h2c-key", strings.NewReader("h2c-value"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT: expected 201 over HTTP/2, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+
+	resp, err = client.Get(ts.URL + "/v1/h2c-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("GET: expected HTTP/2, got %s", resp.Proto)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "h2c-value" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// HTTP/1.1 clients are served as before.
+	resp, err = http.Get(ts.URL + "/v1/h2c-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP/1.1 GET: expected 200 over HTTP/1.1, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestServerHTTP2Disabled(t *testing.T) {
+	withStore(t, map[string]string{"h2-key": "h2-value"})
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.HTTP2 = false
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer(newRouter())
+	ts.Start()
+	defer ts.Close()
+
+	if resp, err := h2cClient().Get(ts.URL + "/v1/h2-key"); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected h2c to be refused, got %s", resp.Proto)
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/h2-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d over HTTP/1.1, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestPutEchoesValueAndVersion(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	for version, value := range []string{"first", "second"} {
+		req := httptest.NewRequest(http.MethodPut, "/v1/echo-key", strings.NewReader(value))
+		req.Header.Set("Accept", "text/plain, application/json;q=0.9")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if want := []int{http.StatusCreated, http.StatusOK}[version]; rec.Code != want {
+			t.Fatalf("expected status %d, got %d", want, rec.Code)
+		}
+
+		var body struct {
+			Key     string
+			Value   string
+			Version uint64
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Key != "echo-key" || body.Value != value || body.Version != uint64(version+1) {
+			t.Errorf("unexpected echo %+v", body)
+		}
+	}
+}
+
+func TestPutPlainHasEmptyBody(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/plain-key", strings.NewReader("value")))
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected an empty body, got %q", rec.Body.String())
+	}
+}
+
+func TestHierarchicalKeys(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"/v1/a/b/c", "a/b/c"},
+		{"/v1/a//b", "a//b"},
+		{"/v1/hello%20world", "hello world"},
+		{"/v1/caf%C3%A9%2Fmenu", "café/menu"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader("value of "+tt.key)))
+		if rec.Code != http.StatusCreated {
+			t.Errorf("PUT %s: unexpected status %d", tt.path, rec.Code)
+			continue
+		}
+
+		if value, err := Get(tt.key); err != nil || value != "value of "+tt.key {
+			t.Errorf("PUT %s: stored under unexpected key, Get(%q) = %q, %v", tt.path, tt.key, value, err)
+		}
+
+		rec = httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "value of "+tt.key {
+			t.Errorf("GET %s: unexpected response %d %q", tt.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	// An escaped slash addresses the same key as a literal one.
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/a%2Fb%2Fc", nil))
+	if rec.Body.String() != "value of a/b/c" {
+		t.Errorf("GET /v1/a%%2Fb%%2Fc: unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestPutCreateVersusUpdate(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	put := func(key, value string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader(value)))
+		return rec.Code
+	}
+
+	if code := put("status-key", "one"); code != http.StatusCreated {
+		t.Errorf("create: expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := put("status-key", "two"); code != http.StatusOK {
+		t.Errorf("update: expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestGetLastModified(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	PutContent("dated", "v", "", writeAlways)
+	_, meta, err := GetWithMetadata("dated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := meta.Updated.UTC().Format(http.TimeFormat)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/dated", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != lastModified {
+		t.Errorf("expected Last-Modified %q, got %q", lastModified, got)
+	}
+	if got, want := rec.Header().Get("X-Kvstore-Created"), meta.Created.UTC().Format(http.TimeFormat); got != want {
+		t.Errorf("expected X-Kvstore-Created %q, got %q", want, got)
+	}
+
+	for since, want := range map[string]int{
+		lastModified: http.StatusNotModified,
+		meta.Updated.Add(-time.Hour).UTC().Format(http.TimeFormat): http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/dated", nil)
+		req.Header.Set("If-Modified-Since", since)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("If-Modified-Since %s: expected status %d, got %d", since, want, rec.Code)
+		}
+	}
+}
+
+func TestPutUpdateAfterReplay(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	tl, err := NewTransactionLogger(writeLogFile(t, "1\t2\treplayed-key\tone\n2\t2\tdeleted-key\ttwo\n3\t1\tdeleted-key\t\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayEvents(tl, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	saved := transactionLogger
+	transactionLogger = tl
+	defer func() {
+		tl.Close()
+		transactionLogger = saved
+	}()
+
+	put := func(key string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader("value")))
+		return rec.Code
+	}
+
+	if code := put("replayed-key"); code != http.StatusOK {
+		t.Errorf("replayed key: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := put("deleted-key"); code != http.StatusCreated {
+		t.Errorf("deleted key: expected status %d, got %d", http.StatusCreated, code)
+	}
+}
+
+func TestGetEmptyValueVersusMissing(t *testing.T) {
+	withStore(t, map[string]string{"empty": ""})
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/empty", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("empty value: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "0" {
+		t.Errorf("empty value: expected Content-Length 0, got %q", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("empty value: expected an empty body, got %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing key: expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestGetEmptyValueNoContent(t *testing.T) {
+	withStore(t, map[string]string{"empty": ""})
+
+	saved := config.EmptyValueNoContent
+	config.EmptyValueNoContent = true
+	defer func() { config.EmptyValueNoContent = saved }()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/empty", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing key: expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestRenameHandler(t *testing.T) {
+	withStore(t, map[string]string{"old": "value", "taken": "other"})
+	logger := withLogger(t)
+
+	rename := func(key, query string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/"+key+"/rename?"+query, nil))
+		return rec.Code
+	}
+
+	if code := rename("old", "newKey=dir/new"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if v, err := Get("dir/new"); err != nil || v != "value" {
+		t.Errorf("expected dir/new to hold value, got %q, %v", v, err)
+	}
+
+	if code := rename("old", "newKey=x"); code != http.StatusNotFound {
+		t.Errorf("missing source: expected status %d, got %d", http.StatusNotFound, code)
+	}
+	if code := rename("dir/new", "newKey=taken"); code != http.StatusConflict {
+		t.Errorf("existing destination: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := rename("dir/new", "newKey=taken&overwrite=true"); code != http.StatusOK {
+		t.Errorf("overwrite: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := rename("taken", ""); code != http.StatusBadRequest {
+		t.Errorf("no newKey: expected status %d, got %d", http.StatusBadRequest, code)
+	}
+
+	// The rename is logged as a delete of the old key and a put of the new.
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := NewTransactionLogger(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withStore(t, map[string]string{"taken": "other"})
+	if _, err := replayEvents(replay, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := Get("taken"); err != nil || v != "value" {
+		t.Errorf("after replay expected taken to hold value, got %q, %v", v, err)
+	}
+	if _, err := Get("dir/new"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("after replay expected dir/new to be gone, got %v", err)
+	}
+}
+
+func TestIdleKeysHandlers(t *testing.T) {
+	withStore(t, map[string]string{"cold": "1", "warm": "2", reservedPrefix + "internal": "3"})
+	logger := withLogger(t)
+	for key := range storeMap() {
+		setAccessed(key, time.Now().Add(-2*time.Hour))
+	}
+	setAccessed("warm", time.Now())
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?idle_gt=1h", nil))
+	var listed struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed.Keys, []string{"cold"}) {
+		t.Errorf("expected idle keys [cold], got %v", listed.Keys)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?idle_gt=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad duration: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/_idle?gt=1h", nil))
+	var purged struct {
+		Deleted []string `json:"deleted"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&purged); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(purged.Deleted, []string{"cold"}) {
+		t.Errorf("expected [cold] to be deleted, got %v", purged.Deleted)
+	}
+	if _, ok := storeMap()[reservedPrefix+"internal"]; !ok {
+		t.Error("reserved key was deleted")
+	}
+
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := NewTransactionLogger(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := replay.ReadEvents()
+	e := <-events
+	if e.EventType != EventDelete || e.Key != "cold" {
+		t.Errorf("expected a logged delete of cold, got %+v", e)
+	}
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/_idle", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("missing gt: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	withStore(t, map[string]string{"a": "1", "b": "2"})
+	tl := withLogger(t)
+
+	del := func(key, ifMatch string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/"+key, nil)
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := del("a", "other"); code != http.StatusPreconditionFailed {
+		t.Errorf("mismatch: expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+	if value, _ := Get("a"); value != "1" {
+		t.Errorf("mismatch: expected a to be kept, got %q", value)
+	}
+	if code := del("a", "1"); code != http.StatusOK {
+		t.Errorf("match: expected status %d, got %d", http.StatusOK, code)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("match: expected a to be deleted, got %v", err)
+	}
+	if code := del("missing", "1"); code != http.StatusNotFound {
+		t.Errorf("missing key: expected status %d, got %d", http.StatusNotFound, code)
+	}
+	if code := del("missing", "*"); code != http.StatusNotFound {
+		t.Errorf("missing key, *: expected status %d, got %d", http.StatusNotFound, code)
+	}
+	if code := del("b", "*"); code != http.StatusOK {
+		t.Errorf("*: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Only the deletes that happened are logged.
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readAll(t, tl.filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Key != "a" || events[1].Key != "b" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestDeleteIfMatchVersion(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	router := newRouter()
+	putKey(router, "a", "1")
+	putKey(router, "a", "2")
+	_, meta, _ := GetWithMetadata("a")
+
+	del := func(ifMatch string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/a", nil)
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := del(`"x"`); code != http.StatusBadRequest {
+		t.Errorf("not a version: expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := del(fmt.Sprintf(`"%d"`, meta.Version-1)); code != http.StatusPreconditionFailed {
+		t.Errorf("stale version: expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+	if value, _ := Get("a"); value != "2" {
+		t.Errorf("stale version: expected a to be kept, got %q", value)
+	}
+	if code := del(fmt.Sprintf(`"%d"`, meta.Version)); code != http.StatusOK {
+		t.Errorf("current version: expected status %d, got %d", http.StatusOK, code)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("current version: expected a to be deleted, got %v", err)
+	}
+	if code := del(fmt.Sprintf(`"%d"`, meta.Version)); code != http.StatusNotFound {
+		t.Errorf("missing key: expected status %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestDeleteLogsOnlyLoggableExistingKeys(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+	tl := withLogger(t)
+
+	del := func(key string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/"+key, nil))
+		return rec.Code
+	}
+
+	// The tab format can't hold a key with a tab in it.
+	if code := del("tab%09key"); code != http.StatusBadRequest {
+		t.Errorf("unloggable key: expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := del("missing"); code != http.StatusOK {
+		t.Errorf("missing key: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := del("a"); code != http.StatusOK {
+		t.Errorf("existing key: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readAll(t, tl.filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Key != "a" {
+		t.Errorf("expected only the delete of a to be logged, got %+v", events)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	for _, tt := range []struct {
+		method, path, allow string
+	}{
+		{http.MethodPatch, "/v1/a", "DELETE, GET, PUT"},
+		{http.MethodPost, "/v1/a/b", "DELETE, GET, PUT"},
+		{http.MethodPut, "/metrics", "GET"},
+	} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, http.StatusMethodNotAllowed, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, got)
+		}
+	}
+}
+
+func TestListKeysTokenPages(t *testing.T) {
+	data := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		data[fmt.Sprintf("k%02d", i)] = "v"
+	}
+	withStore(t, data)
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.MaxListKeys = 3
+
+	page := func(query string) (keys []string, nextToken string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+		}
+		var body struct {
+			Keys      []string
+			NextToken string `json:"next_token"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Keys, body.NextToken
+	}
+
+	// Without a limit a page holds at most MaxListKeys keys.
+	got, token := page("")
+	if want := []string{"k00", "k01", "k02"}; !reflect.DeepEqual(got, want) || token == "" {
+		t.Fatalf("first page: expected %v and a token, got %v and %q", want, got, token)
+	}
+
+	// The same token returns the same page.
+	again, _ := page("token=" + token)
+	if second, _ := page("token=" + token); !reflect.DeepEqual(again, second) {
+		t.Errorf("the token returned %v, then %v", again, second)
+	}
+
+	// Writes between pages neither shift nor repeat keys: a key added
+	// before the token is not returned, one added after it is.
+	Put("k00a", "v")
+	Put("k05a", "v")
+	Delete("k07")
+	for token != "" {
+		var keys []string
+		keys, token = page("token=" + token)
+		got = append(got, keys...)
+	}
+	want := []string{"k00", "k01", "k02", "k03", "k04", "k05", "k05a", "k06", "k08", "k09"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Descending listings resume below the token, and ?limit can't
+	// raise the page size past MaxListKeys.
+	got, token = page("order=desc&limit=4")
+	keys, _ := page("order=desc&limit=4&token=" + token)
+	if want := []string{"k09", "k08", "k06", "k05a", "k05", "k04"}; !reflect.DeepEqual(append(got, keys...), want) {
+		t.Errorf("descending: expected %v, got %v", want, append(got, keys...))
+	}
+}
+
+func TestListKeysBadToken(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	for _, query := range []string{"token=%25%25", "token=azA&sort=size", "token=azA&offset=1"} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, rec.Code)
+		}
+	}
+}
+
+func TestExistsHandler(t *testing.T) {
+	withStore(t, map[string]string{"present": "value", "empty": "", "a/b": "nested"})
+
+	for key, want := range map[string]bool{"present": true, "empty": true, "a/b": true, "absent": false, "a": false} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/"+key+"/exists", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", key, http.StatusOK, rec.Code)
+			continue
+		}
+		var body struct {
+			Exists *bool `json:"exists"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if body.Exists == nil || *body.Exists != want {
+			t.Errorf("%s: expected exists %v, got %s", key, want, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/"+selfTestKey+"/exists", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("reserved key: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestImmutableKey(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+
+	do := func(method, path, value string, header ...string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(value))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(http.MethodPut, "/v1/config/region", "eu-west", "Immutable", "true"); code != http.StatusCreated {
+		t.Fatalf("create: expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := do(http.MethodPut, "/v1/config/region", "us-east"); code != http.StatusConflict {
+		t.Errorf("overwrite: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := do(http.MethodPut, "/v1/config/region", "us-east", "If-Match", "*"); code != http.StatusConflict {
+		t.Errorf("update: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := do(http.MethodDelete, "/v1/config/region", ""); code != http.StatusConflict {
+		t.Errorf("delete: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := do(http.MethodDelete, "/v1/config/region", "", "If-Match", "eu-west"); code != http.StatusConflict {
+		t.Errorf("conditional delete: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := do(http.MethodPost, "/v1/config/region/rename?newKey=config/moved", ""); code != http.StatusConflict {
+		t.Errorf("rename: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if value, err := Get("config/region"); err != nil || value != "eu-west" {
+		t.Errorf("expected the immutable value to be kept, got %q (%v)", value, err)
+	}
+
+	// Only a new key can be made immutable.
+	do(http.MethodPut, "/v1/config/mode", "fast")
+	if code := do(http.MethodPut, "/v1/config/mode", "slow", "Immutable", "true"); code != http.StatusConflict {
+		t.Errorf("existing key: expected status %d, got %d", http.StatusConflict, code)
+	}
+	if code := do(http.MethodPut, "/v1/config/other", "x", "Immutable", "maybe"); code != http.StatusBadRequest {
+		t.Errorf("bad header: expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := do(http.MethodPut, "/v1/config/mode", "slow"); code != http.StatusOK {
+		t.Errorf("mutable key: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// The flag is logged with the put, so replay restores it.
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	withStore(t, make(map[string]string))
+	replayed, err := NewTransactionLogger(tl.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	if _, err := replayEvents(replayed, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete("config/region"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("expected the replayed key to be immutable, got %v", err)
+	}
+	if err := Delete("config/mode"); err != nil {
+		t.Errorf("expected the mutable key to be deleted, got %v", err)
+	}
+}
+
+func TestRandomKeyHandler(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_random", nil))
+		return rec
+	}
+
+	if rec := get(); rec.Code != http.StatusNotFound {
+		t.Errorf("empty store: expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	withStore(t, map[string]string{"a": "1", "b": "2"})
+	rec := get()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	var got struct{ Key, Value string }
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if (got.Key != "a" || got.Value != "1") && (got.Key != "b" || got.Value != "2") {
+		t.Errorf("expected one of the stored keys, got %+v", got)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readinessChecks are consulted by /ready. Each reports whether a
+// dependency the server needs to handle requests is usable.
+var readinessChecks = struct {
+	sync.Mutex
+	m map[string]func() error
+}{m: make(map[string]func() error)}
+
+// addReadinessCheck registers a named check with /ready, returning a
+// function that removes it again.
+func addReadinessCheck(name string, check func() error) (remove func()) {
+	readinessChecks.Lock()
+	readinessChecks.m[name] = check
+	readinessChecks.Unlock()
+
+	return func() {
+		readinessChecks.Lock()
+		delete(readinessChecks.m, name)
+		readinessChecks.Unlock()
+	}
+}
+
+// readyHandler answers 200 when every readiness check passes and 503
+// otherwise, reporting the state of each check.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	readinessChecks.Lock()
+	names := make([]string, 0, len(readinessChecks.m))
+	for name := range readinessChecks.m {
+		names = append(names, name)
+	}
+	checks := make(map[string]func() error, len(names))
+	for name, check := range readinessChecks.m {
+		checks[name] = check
+	}
+	readinessChecks.Unlock()
+	sort.Strings(names)
+
+	ready := true
+	results := make(map[string]string, len(names))
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			ready = false
+			results[name] = "down: " + err.Error()
+		} else {
+			results[name] = "up"
+		}
+	}
+
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "not ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{status, results})
+}
+
+// healthReporter is implemented by loggers whose backend can become
+// unreachable while the server runs.
+type healthReporter interface {
+	Healthy() error
+}
+
+// registerLoggerHealth wires a logger that reports its health into /ready
+// and the metrics.
+func registerLoggerHealth(tl TransactionLogger) {
+	if r, ok := tl.(breakerReporter); ok && r.Breaker() != nil {
+		b := r.Breaker()
+		addReadinessCheck("database_circuit", func() error {
+			if b.State() == breakerOpen {
+				return errCircuitOpen
+			}
+			return nil
+		})
+		registerGauge("kvstore_db_circuit_state", "State of the circuit breaker guarding the database: 0 closed, 1 half-open, 2 open.", func() float64 {
+			return float64(b.State())
+		})
+	}
+
+	h, ok := tl.(healthReporter)
+	if !ok {
+		return
+	}
+
+	addReadinessCheck("database", h.Healthy)
+	registerGauge("kvstore_db_up", "Whether the database backing the transaction log is reachable.", func() float64 {
+		if h.Healthy() != nil {
+			return 0
+		}
+		return 1
+	})
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// dbMonitor pings a database periodically and remembers whether the last
+// ping succeeded, so readiness can follow the database going away and
+// coming back.
+type dbMonitor struct {
+	db       pinger
+	interval time.Duration
+
+	mu  sync.RWMutex
+	err error // result of the latest ping
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startDBMonitor(db pinger, interval time.Duration) *dbMonitor {
+	m := &dbMonitor{
+		db:       db,
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.ping()
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.quit:
+				return
+			case <-ticker.C:
+				m.ping()
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *dbMonitor) ping() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	err := m.db.PingContext(ctx)
+
+	m.mu.Lock()
+	wasUp := m.err == nil
+	m.err = err
+	m.mu.Unlock()
+
+	switch {
+	case wasUp && err != nil:
+		slog.Warn("database is unreachable", "err", err)
+	case !wasUp && err == nil:
+		slog.Info("database is reachable again")
+	}
+}
+
+// Err returns the error from the latest ping, or nil if it succeeded.
+func (m *dbMonitor) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.err
+}
+
+func (m *dbMonitor) stop() {
+	close(m.quit)
+	<-m.done
+}
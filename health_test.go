@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDB is a pinger whose reachability can be toggled.
+type fakeDB struct{ down atomic.Bool }
+
+func (db *fakeDB) PingContext(ctx context.Context) error {
+	if db.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// monitoredLogger is a logger backed by a monitored fake database.
+type monitoredLogger struct {
+	TransactionLogger
+	monitor *dbMonitor
+}
+
+func (l monitoredLogger) Healthy() error { return l.monitor.Err() }
+
+func TestReadinessTracksDatabase(t *testing.T) {
+	db := &fakeDB{}
+	monitor := startDBMonitor(db, 5*time.Millisecond)
+	defer monitor.stop()
+
+	saved := readinessChecks.m
+	readinessChecks.m = make(map[string]func() error)
+	defer func() { readinessChecks.m = saved }()
+	savedGauges := metrics.gauges
+	metrics.gauges = nil
+	defer func() { metrics.gauges = savedGauges }()
+
+	registerLoggerHealth(monitoredLogger{monitor: monitor})
+
+	// waitFor polls /ready and /metrics until they report the expected state.
+	waitFor := func(status int, gauge string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			ready := httptest.NewRecorder()
+			newRouter().ServeHTTP(ready, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			metrics := httptest.NewRecorder()
+			newRouter().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			if ready.Code == status && strings.Contains(metrics.Body.String(), gauge) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected /ready %d and %q, got %d %s and metrics:\n%s", status, gauge, ready.Code, ready.Body.String(), metrics.Body.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor(http.StatusOK, "kvstore_db_up 1")
+
+	db.down.Store(true)
+	waitFor(http.StatusServiceUnavailable, "kvstore_db_up 0")
+
+	db.down.Store(false)
+	waitFor(http.StatusOK, "kvstore_db_up 1")
+}
+
+func TestReadyWithoutChecks(t *testing.T) {
+	saved := readinessChecks.m
+	readinessChecks.m = make(map[string]func() error)
+	defer func() { readinessChecks.m = saved }()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
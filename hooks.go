@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// ValueHook lets embedders transform or validate values before they are
+// stored. OnPut returns the value to store in place of the one in the
+// request; an error rejects the PUT with 422 Unprocessable Entity and
+// nothing is stored or logged.
+type ValueHook interface {
+	OnPut(key, value string) (string, error)
+}
+
+// valueHook is consulted on every PUT when set. It is nil by default, or
+// checks values against the schemas given with -value-schema.
+var valueHook ValueHook
+
+// Validator checks values before they are stored, enforcing rules such as
+// the value being JSON. An error rejects the write with 422 Unprocessable
+// Entity and nothing is stored or logged.
+type Validator interface {
+	Validate(key, value string) error
+}
+
+// ValidatorFunc lets a function be used as a Validator.
+type ValidatorFunc func(key, value string) error
+
+func (f ValidatorFunc) Validate(key, value string) error { return f(key, value) }
+
+type patternValidator struct {
+	pattern   string
+	validator Validator
+}
+
+// validators are the validators registered with RegisterValidator, in the
+// order they were registered.
+var validators []patternValidator
+
+// RegisterValidator has v check the values written to keys matching
+// pattern, a glob in the path.Match syntax of ?pattern= on /v1/_keys, so
+// that orders/* matches orders/1 but not orders/1/items. Validators must be
+// registered before the server starts; a key matching several patterns is
+// checked by each validator in turn.
+func RegisterValidator(pattern string, v Validator) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid validator pattern %q: %w", pattern, err)
+	}
+	validators = append(validators, patternValidator{pattern, v})
+	return nil
+}
+
+// checkValue passes value through valueHook, if set, and the validators
+// registered for key, returning the value to store.
+func checkValue(key, value string) (string, error) {
+	if valueHook != nil {
+		v, err := valueHook.OnPut(key, value)
+		if err != nil {
+			return "", err
+		}
+		value = v
+	}
+
+	for _, pv := range validators {
+		if ok, _ := path.Match(pv.pattern, key); !ok {
+			continue
+		}
+		if err := pv.validator.Validate(key, value); err != nil {
+			return "", err
+		}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type hookFunc func(key, value string) (string, error)
+
+func (f hookFunc) OnPut(key, value string) (string, error) { return f(key, value) }
+
+func withValueHook(t *testing.T, hook ValueHook) {
+	t.Helper()
+
+	saved := valueHook
+	valueHook = hook
+	t.Cleanup(func() { valueHook = saved })
+}
+
+func TestValueHookTransforms(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	withValueHook(t, hookFunc(func(key, value string) (string, error) {
+		return strings.ToUpper(value), nil
+	}))
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/shout", strings.NewReader("hello")))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if got, _ := Get("shout"); got != "HELLO" {
+		t.Errorf("expected the hook's value HELLO, got %q", got)
+	}
+}
+
+func TestValueHookRejects(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+	withValueHook(t, hookFunc(func(key, value string) (string, error) {
+		return "", errors.New("value must not be empty")
+	}))
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/rejected", strings.NewReader("")))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, rec.Code)
+	}
+
+	if _, err := Get("rejected"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("rejected value was stored")
+	}
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := tl.LastSequence(); seq != 0 {
+		t.Errorf("rejected value was logged at sequence %d", seq)
+	}
+}
+
+func withValidator(t *testing.T, pattern string, v Validator) {
+	t.Helper()
+
+	saved := validators
+	t.Cleanup(func() { validators = saved })
+	if err := RegisterValidator(pattern, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatorRejectsMatchingKeys(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	schema, err := compileSchema(map[string]any{
+		"type":     "object",
+		"required": []any{"id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withValidator(t, "orders/*", ValidatorFunc(func(key, value string) error {
+		var v any
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return fmt.Errorf("value is not JSON: %v", err)
+		}
+		var errs []string
+		if schema.validate(v, "", &errs); len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	}))
+
+	put := func(key, value string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader(value)))
+		return rec.Code
+	}
+
+	for _, value := range []string{`{"id": `, `{"name": "x"}`} {
+		if code := put("orders/1", value); code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status %d, got %d", value, http.StatusUnprocessableEntity, code)
+		}
+	}
+	if _, err := Get("orders/1"); !errors.Is(err, ErrNoSuchKey) {
+		t.Error("rejected value was stored")
+	}
+
+	if code := put("orders/1", `{"id": 1}`); code != http.StatusCreated {
+		t.Errorf("valid value: expected status %d, got %d", http.StatusCreated, code)
+	}
+	// Keys the pattern doesn't match aren't checked.
+	for _, key := range []string{"notes/1", "orders/1/items"} {
+		if code := put(key, `{"id": `); code != http.StatusCreated {
+			t.Errorf("%s: expected status %d, got %d", key, http.StatusCreated, code)
+		}
+	}
+
+	if err := RegisterValidator("[", ValidatorFunc(func(key, value string) error { return nil })); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// deleteIdleKeys deletes every key that has not been read or written
+// since cutoff, logging a delete for each before the keys are removed,
+// and returns the keys deleted. A key read between the sweep and its
+// removal is still removed.
+func deleteIdleKeys(ctx context.Context, cutoff time.Time) ([]string, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	deleted, err := CheckDeleteIdle(cutoff)
+	if err != nil || len(deleted) == 0 {
+		return nil, err
+	}
+
+	span := startSpan(ctx, "store.delete_idle")
+	err = commitWrite(func() {
+		for _, key := range deleted {
+			transactionLogger.WriteDelete(key)
+		}
+	}, func() error {
+		return DeleteKeys(deleted)
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range deleted {
+		notifyChange(EventDelete, key, "")
+	}
+
+	return deleted, nil
+}
+
+// startIdleExpiry deletes keys that have gone unread and unwritten for
+// ttl in the background until the returned function is called. Sweeps
+// are skipped while the server is read-only.
+//
+// Accesses aren't logged, so after a restart every key counts as
+// accessed when it was replayed.
+func startIdleExpiry(ttl time.Duration) (stop func()) {
+	// As with tombstones, sweep often enough that a key outlives its TTL
+	// by at most a tenth of it, without spinning for tiny TTLs.
+	interval := ttl / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case now := <-ticker.C:
+				if readOnlyReason() != "" {
+					continue
+				}
+				deleted, err := deleteIdleKeys(context.Background(), now.Add(-ttl))
+				if err != nil {
+					slog.Error("idle key expiry failed", "err", err)
+				} else if len(deleted) > 0 {
+					slog.Debug("expired idle keys", "ttl", ttl, "keys", len(deleted))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdleExpiry(t *testing.T) {
+	withStore(t, map[string]string{"untouched": "1", "read": "2", "written": "3"})
+	logger := withLogger(t)
+
+	stop := startIdleExpiry(100 * time.Millisecond)
+	defer func() { stop() }()
+
+	// Looking the keys up with Get would count as accessing them.
+	stored := func(key string) bool {
+		store.RLock()
+		defer store.RUnlock()
+		_, ok := storeMap()[key]
+		return ok
+	}
+
+	router := newRouter()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if !stored("untouched") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("untouched key did not expire")
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/read", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET read: unexpected status %d", rec.Code)
+		}
+		if code := putKey(router, "written", "3"); code != http.StatusOK {
+			t.Fatalf("PUT written: unexpected status %d", code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Stop sweeping, so the accessed keys can't expire while they are
+	// checked.
+	stop()
+	stop = func() {}
+
+	for _, key := range []string{"read", "written"} {
+		if !stored(key) {
+			t.Errorf("regularly accessed key %s expired", key)
+		}
+	}
+
+	// The expiry is logged, so replay doesn't bring the key back.
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewTransactionLogger(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := drain(replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expired bool
+	for _, e := range events {
+		if e.EventType == EventDelete {
+			if e.Key != "untouched" {
+				t.Errorf("unexpected delete of %s", e.Key)
+			}
+			expired = true
+		}
+	}
+	if !expired {
+		t.Error("expected a logged delete of untouched")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// keyNormalizers map the keys clients send to the keys stored, so that
+// variants of a key name the same entry. Each must be idempotent:
+// normalizing a normalized key leaves it unchanged.
+var keyNormalizers = map[string]func(string) string{
+	// none stores keys as they are sent.
+	"none": func(key string) string { return key },
+	// lower makes keys case-insensitive.
+	"lower": strings.ToLower,
+	// trim drops leading and trailing whitespace.
+	"trim": strings.TrimSpace,
+	// lower-trim does both.
+	"lower-trim": func(key string) string { return strings.ToLower(strings.TrimSpace(key)) },
+}
+
+// normalizeKey is the normalizer chosen by config.KeyNormalize. It is
+// applied to keys from requests before they reach the store or the log,
+// and to keys replayed from the log, so entries logged before the
+// normalizer was chosen end up under the same keys as new ones.
+var normalizeKey = keyNormalizers["none"]
+
+// requestKey returns the normalized key of a request to a keyRoute.
+func requestKey(r *http.Request) string {
+	return normalizeKey(mux.Vars(r)["key"])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withKeyNormalizer normalizes keys with the named normalizer until the
+// test ends.
+func withKeyNormalizer(t *testing.T, name string) {
+	t.Helper()
+
+	saved := normalizeKey
+	t.Cleanup(func() { normalizeKey = saved })
+	normalizeKey = keyNormalizers[name]
+}
+
+func TestKeyNormalizersIdempotent(t *testing.T) {
+	keys := []string{"foo", "Foo", " FOO\t", "a/B/c", "ÄÖü", "", "  "}
+	for name, normalize := range keyNormalizers {
+		for _, key := range keys {
+			once := normalize(key)
+			if twice := normalize(once); twice != once {
+				t.Errorf("%s: %q normalizes to %q, then to %q", name, key, once, twice)
+			}
+		}
+	}
+}
+
+func TestLowercaseKeysCollide(t *testing.T) {
+	withStore(t, make(map[string]string))
+	tl := withLogger(t)
+	withKeyNormalizer(t, "lower")
+
+	router := newRouter()
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := request(http.MethodPut, "/v1/Foo", "1"); rec.Code != http.StatusCreated {
+		t.Errorf("PUT Foo: expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+	if rec := request(http.MethodPut, "/v1/foo", "2"); rec.Code != http.StatusOK {
+		t.Errorf("PUT foo: expected status %d for an existing key, got %d", http.StatusOK, rec.Code)
+	}
+	if rec := request(http.MethodGet, "/v1/FOO", ""); rec.Body.String() != "2" {
+		t.Errorf("GET FOO: expected 2, got %q", rec.Body.String())
+	}
+	if got := storeMap(); len(got) != 1 || got["foo"] != "2" {
+		t.Errorf("expected only foo=2 in the store, got %v", got)
+	}
+
+	if rec := request(http.MethodDelete, "/v1/fOO", ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE fOO: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if len(storeMap()) != 0 {
+		t.Errorf("expected the key to be deleted, got %v", storeMap())
+	}
+
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readAll(t, tl.filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	for _, e := range events {
+		if e.Key != "foo" {
+			t.Errorf("expected the normalized key in the log, got %+v", e)
+		}
+	}
+}
+
+func TestReplayNormalizesKeys(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withKeyNormalizer(t, "lower")
+
+	// A log written before keys were normalized.
+	tl, err := NewTransactionLogger(writeLogFile(t, "1\t2\tFoo\t1\n2\t2\tfoo\t2\n3\t2\tBar\t3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	if _, err := replayEventsContext(context.Background(), tl, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := storeMap()
+	if len(got) != 2 || got["foo"] != "2" || got["bar"] != "3" {
+		t.Errorf("expected foo=2 and bar=3, got %v", got)
+	}
+}
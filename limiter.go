@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// writeLimiter bounds the number of mutating requests being served at
+// once. Requests over the limit wait for a slot, up to a bounded number
+// of them; beyond that they are turned away with 503.
+type writeLimiter struct {
+	slots   chan struct{} // one token per request being served
+	waiting chan struct{} // one token per request served or waiting
+}
+
+// newWriteLimiter returns a limiter serving at most limit requests with up
+// to queue more waiting, or nil, which doesn't limit, if limit is 0.
+func newWriteLimiter(limit, queue int) *writeLimiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &writeLimiter{
+		slots:   make(chan struct{}, limit),
+		waiting: make(chan struct{}, limit+queue),
+	}
+}
+
+// writeLimits is the limiter limitWrites applies. It is replaced when the
+// limits are reloaded; requests already holding a slot keep it in the
+// limiter they got it from.
+var writeLimits atomic.Pointer[writeLimiter]
+
+// limitWrites serves next through the current writeLimits.
+func limitWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeLimits.Load().serve(w, r, next)
+	})
+}
+
+func (l *writeLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.serve(w, r, next)
+	})
+}
+
+// serve calls next once a slot is free, or answers 503 if too many
+// requests are already waiting. A nil limiter calls next right away.
+func (l *writeLimiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if l == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	select {
+	case l.waiting <- struct{}{}:
+	default:
+		http.Error(w, "too many concurrent writes", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() { <-l.waiting }()
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-r.Context().Done():
+		http.Error(w, "request cancelled while queued", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() { <-l.slots }()
+
+	next.ServeHTTP(w, r)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogFormat selects how the file logger writes events, one per line.
+type LogFormat string
+
+const (
+	// LogFormatTab writes the sequence number, event type, key and value
+	// separated by tabs. It is the original format and the default, but
+	// keys can't contain tabs, keys and values can't contain newlines, and
+	// values can't end in a carriage return, which reading drops.
+	LogFormatTab LogFormat = "tab"
+	// LogFormatJSON writes each event as a JSON object, which can hold any
+	// key or value and is easy for other tools to read. Keys and values
+	// that aren't valid UTF-8 are written in base64.
+	LogFormatJSON LogFormat = "json"
+)
+
+// logHeaderPrefix starts the line at the top of a log that records its
+// format and, for a log truncated after a snapshot, the sequence number
+// its events follow. Logs without one are in the tab format, which
+// predates it, and start at the beginning.
+const logHeaderPrefix = "#kvstore-log"
+
+// logFormatVersion is the version of the header and the formats it names
+// that new logs are written in. Version 2 added the key64 and value64
+// fields of the JSON format. Version 1 logs are still read and appended
+// to, but only with keys and values that version could hold.
+const logFormatVersion = 2
+
+// logCodec reads and writes the lines of one log format.
+type logCodec struct {
+	encode func(w io.Writer, e Event) (int, error)
+	decode func(line []byte) (Event, error)
+}
+
+var logCodecs = map[LogFormat]logCodec{
+	LogFormatTab:  {encode: writeEvent, decode: parseEvent},
+	LogFormatJSON: {encode: writeJSONEvent, decode: parseJSONEvent},
+}
+
+func (f LogFormat) valid() bool {
+	_, ok := logCodecs[f]
+	return f == "" || ok
+}
+
+func (f LogFormat) codec() logCodec {
+	if f == "" {
+		return logCodecs[LogFormatTab]
+	}
+	return logCodecs[f]
+}
+
+// logHeader returns the line a log in format f whose events follow
+// sequence number base starts with. Tab logs starting at the beginning
+// get none, so that they stay readable by older versions.
+func logHeader(f LogFormat, base uint64) string {
+	if f == "" {
+		f = LogFormatTab
+	}
+	if f == LogFormatTab && base == 0 {
+		return ""
+	}
+
+	// The tab format hasn't changed since version 1, which older versions
+	// can still read.
+	version := logFormatVersion
+	if f == LogFormatTab {
+		version = 1
+	}
+	header := fmt.Sprintf("%s format=%s version=%d", logHeaderPrefix, f, version)
+	if base > 0 {
+		header += fmt.Sprintf(" base=%d", base)
+	}
+	return header + "\n"
+}
+
+// isLogHeader reports whether line is a format header rather than an
+// event. No event line in either format starts with '#'.
+func isLogHeader(line []byte) bool {
+	return len(line) > 0 && line[0] == '#'
+}
+
+// parseLogHeader returns the format, version and base sequence number
+// recorded in a header line.
+func parseLogHeader(line string) (format LogFormat, version int, base uint64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != logHeaderPrefix {
+		return "", 0, 0, fmt.Errorf("bad log header %q", line)
+	}
+
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "format":
+			format = LogFormat(value)
+		case "version":
+			version, err = strconv.Atoi(value)
+			if err != nil || version < 1 || version > logFormatVersion {
+				return "", 0, 0, fmt.Errorf("unsupported log format version %q", value)
+			}
+		case "base":
+			if base, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return "", 0, 0, fmt.Errorf("bad log base sequence %q", value)
+			}
+		}
+	}
+	if format == "" || !format.valid() {
+		return "", 0, 0, fmt.Errorf("unknown log format %q", format)
+	}
+
+	return format, version, base, nil
+}
+
+// detectLogFormat reads the format and version of the log in r from its
+// first line, reporting false if the log is empty. A tab log without a
+// header is version 1.
+func detectLogFormat(r io.Reader) (LogFormat, int, bool, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", 0, false, err
+	}
+	if line == "" {
+		return "", 0, false, nil
+	}
+	if !isLogHeader([]byte(line)) {
+		return LogFormatTab, 1, true, nil
+	}
+
+	format, version, _, err := parseLogHeader(strings.TrimSuffix(line, "\n"))
+	return format, version, true, err
+}
+
+// checkEntry returns an error if a version of format f can't hold key or
+// value: reading the log back would fail, or give back something else.
+func (f LogFormat) checkEntry(version int, key, value string) error {
+	switch f {
+	case LogFormatJSON:
+		if version < 2 && !(utf8.ValidString(key) && utf8.ValidString(value)) {
+			return errors.New("keys and values must be valid UTF-8 in a version 1 JSON log")
+		}
+	case LogFormatTab, "":
+		if strings.ContainsAny(key, "\t\n") {
+			return errors.New("keys can't contain tabs or newlines in a tab log")
+		}
+		if strings.Contains(value, "\n") || strings.HasSuffix(value, "\r") {
+			return errors.New("values can't contain newlines or end in a carriage return in a tab log")
+		}
+	}
+
+	return nil
+}
+
+// jsonEvent is an event as it appears in a JSON log. Time was added
+// later, so older logs don't have it. A key or value that isn't valid
+// UTF-8, which JSON strings can't hold, goes in Key64 or Value64 instead,
+// in base64.
+type jsonEvent struct {
+	Seq     uint64 `json:"seq"`
+	Type    string `json:"type"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Key64   string `json:"key64,omitempty"`
+	Value64 string `json:"value64,omitempty"`
+	Time    string `json:"time,omitempty"` // RFC 3339, with nanoseconds
+}
+
+// blobTypeSuffix ends the type of a JSON event whose value is a blobRef.
+const blobTypeSuffix = "_BLOB"
+
+// writeJSONEvent writes e as a line of JSON.
+func writeJSONEvent(w io.Writer, e Event) (int, error) {
+	je := jsonEvent{Seq: e.Sequence, Type: e.EventType.String(), Key: e.Key, Value: e.Value}
+	if e.blob {
+		je.Type += blobTypeSuffix
+	}
+	if !e.Time.IsZero() {
+		je.Time = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if !utf8.ValidString(je.Key) {
+		je.Key, je.Key64 = "", base64.StdEncoding.EncodeToString([]byte(e.Key))
+	}
+	if !utf8.ValidString(je.Value) {
+		je.Value, je.Value64 = "", base64.StdEncoding.EncodeToString([]byte(e.Value))
+	}
+	line, err := json.Marshal(je)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.Write(append(line, '\n'))
+}
+
+// parseJSONEvent decodes a line written by writeJSONEvent.
+func parseJSONEvent(line []byte) (Event, error) {
+	var je jsonEvent
+	if err := json.Unmarshal(line, &je); err != nil {
+		return Event{}, err
+	}
+
+	e := Event{Sequence: je.Seq, Key: je.Key, Value: je.Value}
+	if je.Key64 != "" {
+		key, err := base64.StdEncoding.DecodeString(je.Key64)
+		if err != nil {
+			return e, fmt.Errorf("bad base64 key: %w", err)
+		}
+		e.Key = string(key)
+	}
+	if je.Value64 != "" {
+		value, err := base64.StdEncoding.DecodeString(je.Value64)
+		if err != nil {
+			return e, fmt.Errorf("bad base64 value: %w", err)
+		}
+		e.Value = string(value)
+	}
+	if je.Time != "" {
+		t, err := time.Parse(time.RFC3339Nano, je.Time)
+		if err != nil {
+			return e, fmt.Errorf("bad event time %q", je.Time)
+		}
+		e.Time = t
+	}
+	eventType, blob := strings.CutSuffix(je.Type, blobTypeSuffix)
+	e.blob = blob
+	for _, t := range []EventType{EventDelete, EventPut, EventBegin, EventPutImmutable} {
+		if eventType == t.String() {
+			e.EventType = t
+			return e, nil
+		}
+	}
+
+	return e, fmt.Errorf("bad event type %q", je.Type)
+}
+
+// logDecoder decodes the lines of a log in order, taking the format and
+// base sequence number from the header if the log starts with one.
+type logDecoder struct {
+	format LogFormat
+	base   uint64
+	lines  int
+}
+
+// decode parses the next line of the log, reporting false if it was the
+// header rather than an event. The event doesn't keep hold of line.
+func (d *logDecoder) decode(line []byte) (Event, bool, error) {
+	d.lines++
+	if d.lines == 1 && isLogHeader(line) {
+		format, _, base, err := parseLogHeader(string(line))
+		d.format, d.base = format, base
+		return Event{}, false, err
+	}
+
+	e, err := d.format.codec().decode(line)
+	return e, err == nil, err
+}
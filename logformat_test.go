@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{Format: LogFormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+
+	want := []Event{
+		{Sequence: 1, EventType: EventPut, Key: "tab\tkey", Value: "line one\nline two"},
+		{Sequence: 2, EventType: EventPut, Key: `quote"key`, Value: "back\\slash \x00 ünïcode ✓"},
+		{Sequence: 3, EventType: EventPut, Key: "empty", Value: ""},
+		{Sequence: 4, EventType: EventDelete, Key: "tab\tkey"},
+		{Sequence: 5, EventType: EventPut, Key: "not utf-8 \xff", Value: "\xfe\n\x00"},
+	}
+	for _, e := range want {
+		if e.EventType == EventDelete {
+			tl.WriteDelete(e.Key)
+		} else {
+			tl.WritePut(e.Key, e.Value)
+		}
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if lines[0] != "#kvstore-log format=json version=2" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("log line %q is not JSON", line)
+		}
+	}
+
+	// The format is read from the header, not the options.
+	got, err := readAll(t, filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The JSON format keeps the time each event was logged.
+	for i := range got {
+		if got[i].Time.IsZero() {
+			t.Errorf("event %d has no time", got[i].Sequence)
+		}
+		got[i].Time = time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+}
+
+func TestJSONLogBatch(t *testing.T) {
+	filename := writeLogFile(t, "#kvstore-log format=json version=1\n"+
+		`{"seq":1,"type":"BEGIN","value":"2"}`+"\n"+
+		`{"seq":2,"type":"PUT","key":"a","value":"1"}`+"\n"+
+		`{"seq":3,"type":"DELETE","key":"b"}`+"\n")
+
+	got, err := readAll(t, filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Sequence: 2, EventType: EventPut, Key: "a", Value: "1"},
+		{Sequence: 3, EventType: EventDelete, Key: "b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+}
+
+func TestExistingLogKeepsFormat(t *testing.T) {
+	filename := writeLogFile(t, "1\t2\tkey-a\tone\n")
+
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{Format: LogFormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ftl := tl.(*FileTransactionLogger)
+	events, _ := tl.ReadEvents()
+	for range events {
+	}
+	tl.Run()
+	tl.WritePut("key-b", "two")
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filename)
+	if want := "1\t2\tkey-a\tone\n2\t2\tkey-b\ttwo\n"; string(content) != want {
+		t.Errorf("got log %q, want %q", content, want)
+	}
+
+	// Compaction rewrites the log in the configured format.
+	if _, err := ftl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	tl.WritePut("key-c", "three")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ = os.ReadFile(filename)
+	if !strings.HasPrefix(string(content), "#kvstore-log format=json version=2\n") {
+		t.Errorf("compacted log has no JSON header: %q", content)
+	}
+	got, err := readAll(t, filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := Event{Sequence: 3, EventType: EventPut, Key: "key-c", Value: "three"}
+	if len(got) == 3 {
+		got[2].Time = time.Time{}
+	}
+	if len(got) != 3 || !reflect.DeepEqual(got[2], last) {
+		t.Errorf("unexpected events after compaction: %+v", got)
+	}
+}
+
+func TestBadLogHeader(t *testing.T) {
+	for _, header := range []string{
+		"#kvstore-log format=yaml version=1",
+		"#kvstore-log format=json version=3",
+		"#something else",
+	} {
+		filename := writeLogFile(t, header+"\n")
+		if _, err := NewTransactionLogger(filename); err == nil {
+			t.Errorf("expected an error for header %q", header)
+		}
+	}
+}
+
+func TestUnknownLogFormat(t *testing.T) {
+	if _, err := NewTransactionLoggerWithOptions(filepath.Join(t.TempDir(), "transaction.log"), FileLoggerOptions{Format: "xml"}); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+}
+
+func TestLogFormatCheckEntry(t *testing.T) {
+	for _, tt := range []struct {
+		format     LogFormat
+		version    int
+		key, value string
+		ok         bool
+	}{
+		{LogFormatTab, 1, "key", "tab\tin value \xff\x00", true},
+		{LogFormatTab, 1, "tab\tkey", "v", false},
+		{LogFormatTab, 1, "new\nline", "v", false},
+		{LogFormatTab, 1, "key", "new\nline", false},
+		{LogFormatTab, 1, "key", "ends in\r", false},
+		{LogFormatJSON, 2, "\xff", "\n\xff\x00", true},
+		{LogFormatJSON, 1, "key", "tab\tand\nnewline", true},
+		{LogFormatJSON, 1, "key", "\xff", false},
+		{LogFormatJSON, 1, "\xff", "v", false},
+	} {
+		err := tt.format.checkEntry(tt.version, tt.key, tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s version %d, %q=%q: got error %v", tt.format, tt.version, tt.key, tt.value, err)
+		}
+	}
+}
+
+func TestVersion1JSONLogRefusesBinary(t *testing.T) {
+	filename := writeLogFile(t, "#kvstore-log format=json version=1\n")
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{Format: LogFormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	// Version 1 readers would ignore value64 and read an empty value, so
+	// the log can't take one until a compaction rewrites it as version 2.
+	ftl := tl.(*FileTransactionLogger)
+	if err := ftl.checkEntry("key", "\xff"); err == nil {
+		t.Error("expected a version 1 log to refuse a value that isn't UTF-8")
+	}
+	if _, err := ftl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ftl.checkEntry("key", "\xff"); err != nil {
+		t.Errorf("expected the compacted log to take the value: %v", err)
+	}
+}
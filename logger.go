@@ -2,21 +2,77 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// entryChecker is implemented by loggers whose log can't hold every key
+// and value.
+type entryChecker interface {
+	checkEntry(key, value string) error
+}
+
+// ErrUnloggable is returned for a key or value the transaction log can't
+// record, which would otherwise be stored and then lost or break the log
+// when it is replayed.
+var ErrUnloggable = errors.New("the transaction log can't hold this key or value")
+
+// checkLoggable returns an ErrUnloggable error if transactionLogger can't
+// record key and value.
+func checkLoggable(key, value string) error {
+	c, ok := transactionLogger.(entryChecker)
+	if !ok {
+		return nil
+	}
+	if err := c.checkEntry(key, value); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnloggable, err)
+	}
+
+	return nil
+}
+
 type TransactionLogger interface {
 	WriteDelete(key string)
 	WritePut(key, value string)
+
+	// WritePutImmutable logs a put that creates key as immutable, so
+	// that replay restores it as one.
+	WritePutImmutable(key, value string)
+
+	// WriteBatch logs events as a unit: replay applies either all of
+	// them or, if the log was cut short while they were written, none.
+	WriteBatch(events []Event)
+
 	Err() <-chan error
 
+	// Flush blocks until every event written so far has been committed
+	// to stable storage, returning any error that prevented it.
+	Flush() error
+
+	// LastSequence returns the sequence number of the latest event
+	// written to (or read from) the log.
+	LastSequence() uint64
+
 	ReadEvents() (<-chan Event, <-chan error)
 
 	Run()
+	Close() error
 }
 
 type Event struct {
@@ -24,6 +80,44 @@ type Event struct {
 	EventType EventType
 	Key       string
 	Value     string
+
+	// Time is when the event was logged. Logs that don't record it, such
+	// as the tab format, read back the zero time.
+	Time time.Time
+
+	flushed chan<- error // set on the marker events sent by Flush
+	batch   []Event      // set on the events sent by WriteBatch
+
+	// size is the number of bytes of the log file read for the event,
+	// counting the header, batch markers and rejected records before it,
+	// or 0 if it wasn't read from a file. Replay adds it up to report
+	// progress.
+	size int64
+
+	// blob is set on a put read from a file log that refers to its value
+	// with a blobRef, which Value then holds.
+	blob bool
+}
+
+// errLoggerStopped is returned by Flush once the logger's writer has
+// stopped, either because it was closed or because a write failed.
+var errLoggerStopped = errors.New("transaction logger is not running")
+
+// flushEvents queues a flush marker on q behind any pending events and
+// waits for the writer goroutine, whose exit closes done, to acknowledge
+// it.
+func flushEvents(q *eventQueue, done <-chan struct{}) error {
+	flushed := make(chan error, 1)
+	if !q.enqueue(Event{flushed: flushed}, done) {
+		return errLoggerStopped
+	}
+
+	select {
+	case err := <-flushed:
+		return err
+	case <-done:
+		return errLoggerStopped
+	}
 }
 
 type EventType byte
@@ -32,76 +126,573 @@ const (
 	_                     = iota
 	EventDelete EventType = iota
 	EventPut
+
+	// EventBegin starts a batch in the file log. Its value is the number
+	// of events in the batch, which follow it directly.
+	EventBegin
+
+	// EventPutImmutable is a put that creates an immutable key, which
+	// later puts and deletes are refused for.
+	EventPutImmutable
 )
 
+func (t EventType) String() string {
+	switch t {
+	case EventDelete:
+		return "DELETE"
+	case EventPut:
+		return "PUT"
+	case EventBegin:
+		return "BEGIN"
+	case EventPutImmutable:
+		return "PUT_IMMUTABLE"
+	default:
+		return fmt.Sprintf("EventType(%d)", byte(t))
+	}
+}
+
 // File Transaction Logger Implementation
 
 type FileTransactionLogger struct {
-	events       chan<- Event // write only channel for sending events
-	errors       <-chan error // read-only channel for receiving errors
-	lastSequence uint64       // last used event sequence number
-	file         *os.File     // location of transaction log
+	queue        *eventQueue       // events on their way to the writer
+	errors       <-chan error      // read-only channel for receiving errors
+	done         chan struct{}     // closed once the writer goroutine exits
+	lastSequence uint64            // last used event sequence number, accessed atomically
+	filename     string            // path of the transaction log
+	file         *os.File          // location of transaction log
+	writer       *bufio.Writer     // buffers writes to file
+	options      FileLoggerOptions // buffering, durability and compaction settings
+	format       LogFormat         // format of the log file, which may differ from options.Format
+	version      int               // version of the log file's format
+
+	mu          sync.Mutex    // serializes writes with compaction
+	compactor   *compactor    // runs automatic compactions, if enabled
+	sinceRecs   int           // events appended since the last compaction
+	sinceBytes  int64         // bytes appended since the last compaction
+	compactions chan struct{} // signals the compactor that a threshold was crossed
+
+	truncateAt int64       // offset of a batch left incomplete at the end of the log, or -1
+	rejected   []byteRange // bad records to cut out of the log under ReplayRepair
+
+	presequenced bool // events arrive numbered, as they do for the shards of a sharded log
+}
+
+// FileLoggerOptions controls how the file logger trades throughput for
+// durability. The zero value writes every event straight to the file.
+type FileLoggerOptions struct {
+	// FlushInterval is how often buffered events are written to the file.
+	// When zero each event is written as soon as it is received.
+	FlushInterval time.Duration
+	// BufferSize is the size of the write buffer in bytes. A full buffer
+	// is written out regardless of FlushInterval.
+	BufferSize int
+	// Sync makes every write to the file be followed by an fsync.
+	Sync bool
+
+	// CompactInterval schedules a compaction at this interval. Zero
+	// disables interval based compaction.
+	CompactInterval time.Duration
+	// CompactRecords triggers a compaction once this many events have
+	// been appended since the last one. Zero disables the threshold.
+	CompactRecords int
+	// CompactBytes triggers a compaction once this many bytes have been
+	// appended since the last one. Zero disables the threshold.
+	CompactBytes int64
+	// CompactBackups is how many copies of the log taken before
+	// compactions are kept. Zero disables backups.
+	CompactBackups int
+
+	// SequenceCheck is how strictly sequence numbers are validated when
+	// the log is read back.
+	SequenceCheck SequenceCheck
+
+	// Format is the format new logs are written in, LogFormatTab if
+	// empty. An existing log keeps the format it was written in until it
+	// is next compacted, when it is rewritten in this one.
+	Format LogFormat
+
+	// OnError is what reading the log does with a record that can't be
+	// parsed or is out of sequence. The zero value aborts.
+	OnError ReplayErrorPolicy
+
+	// MmapThreshold is the size in bytes from which the log is read
+	// through a memory mapping rather than a read buffer, where the
+	// platform supports it. Zero always uses the buffer.
+	MmapThreshold int64
+
+	// CloseTimeout is how long Close waits for the events still queued
+	// to be written. Those left unwritten are then saved to RecoveryFile.
+	// Zero, or no RecoveryFile, waits for as long as writing takes.
+	CloseTimeout time.Duration
+	RecoveryFile string
+
+	// BlobDir, if set, is where values of at least BlobThreshold bytes
+	// are written, each to a file named by its SHA-256, for the log to
+	// refer to rather than hold. It is the memory store's blob directory.
+	BlobDir       string
+	BlobThreshold int
+}
+
+// SequenceCheck selects how sequence numbers are validated on replay.
+type SequenceCheck string
+
+const (
+	// SequenceIncreasing requires sequence numbers to strictly increase,
+	// allowing gaps such as those left by compaction. It is the default.
+	SequenceIncreasing SequenceCheck = "increasing"
+	// SequenceStrict additionally rejects gaps: every event must follow
+	// the previous one by exactly one.
+	SequenceStrict SequenceCheck = "strict"
+	// SequenceLenient only rejects sequence numbers that go backwards,
+	// accepting gaps and repeats left by merged or reset logs.
+	SequenceLenient SequenceCheck = "lenient"
+)
+
+func (c SequenceCheck) valid() bool {
+	switch c {
+	case "", SequenceIncreasing, SequenceStrict, SequenceLenient:
+		return true
+	}
+	return false
+}
+
+// check validates that next may follow last, which is zero before the
+// first event of a log.
+func (c SequenceCheck) check(last, next uint64) error {
+	switch c {
+	case SequenceStrict:
+		if last != 0 && next != last+1 {
+			return fmt.Errorf("transaction numbers out of sequence: %d follows %d, expected %d", next, last, last+1)
+		}
+	case SequenceLenient:
+		if next < last {
+			return fmt.Errorf("transaction numbers out of sequence: %d follows %d", next, last)
+		}
+	default:
+		if next <= last {
+			return fmt.Errorf("transaction numbers out of sequence: %d follows %d", next, last)
+		}
+	}
+
+	return nil
 }
 
 func NewTransactionLogger(filename string) (TransactionLogger, error) {
+	return NewTransactionLoggerWithOptions(filename, FileLoggerOptions{})
+}
+
+func NewTransactionLoggerWithOptions(filename string, options FileLoggerOptions) (TransactionLogger, error) {
+	if !options.SequenceCheck.valid() {
+		return nil, fmt.Errorf("unknown sequence check %q", options.SequenceCheck)
+	}
+	if !options.Format.valid() {
+		return nil, fmt.Errorf("unknown log format %q", options.Format)
+	}
+
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
 
-	return &FileTransactionLogger{file: file}, nil
+	// Reading through ReadAt leaves the file offset at the start for
+	// ReadEvents.
+	format, version, exists, err := detectLogFormat(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read transaction log format: %w", err)
+	}
+	if !exists {
+		format, version = options.Format, logFormatVersion
+		if _, err := file.WriteString(logHeader(format, 0)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot write transaction log header: %w", err)
+		}
+	}
+
+	size := options.BufferSize
+	if size <= 0 {
+		size = 4096
+	}
+
+	return &FileTransactionLogger{
+		filename: filename,
+		file:     file,
+		writer:   bufio.NewWriterSize(file, size),
+		options:  options,
+		format:   format,
+		version:  version,
+
+		truncateAt: -1,
+	}, nil
 }
 
 func (ftl *FileTransactionLogger) Run() {
-	events := make(chan Event, 16)
-	ftl.events = events
+	ftl.queue = newEventQueue(16)
+	events := ftl.queue.events
 
 	errors := make(chan error, 1)
 	ftl.errors = errors
 
+	ftl.done = make(chan struct{})
+
+	// Drop a batch that an earlier run didn't finish writing, so that new
+	// events aren't taken for the rest of it on the next replay.
+	var truncateErr error
+	if ftl.truncateAt >= 0 {
+		truncateErr = ftl.file.Truncate(ftl.truncateAt)
+		ftl.truncateAt = -1
+	}
+
+	var repairErr error
+	if truncateErr == nil && len(ftl.rejected) > 0 {
+		repairErr = ftl.repair(ftl.rejected)
+		ftl.rejected = nil
+	}
+
+	ftl.compactions = make(chan struct{}, 1)
+	if truncateErr == nil && repairErr == nil && (ftl.options.CompactInterval > 0 || ftl.options.CompactRecords > 0 || ftl.options.CompactBytes > 0) {
+		ftl.compactor = startCompactor(ftl)
+	}
+
 	go func() {
-		for e := range events {
-			ftl.lastSequence++
-			_, err := fmt.Fprintf(ftl.file, "%d\t%d\t%s\t%s\n", ftl.lastSequence, e.EventType, e.Key, e.Value)
-			if err != nil {
-				errors <- err
-				return
-			}
-			// map operations
-			switch e.EventType {
-			case EventDelete:
-				Delete(e.Key)
-			case EventPut:
-				Put(e.Key, e.Value)
+		defer ftl.queue.stop()
+		defer close(ftl.done)
+
+		if truncateErr != nil {
+			errors <- fmt.Errorf("failed to truncate incomplete batch: %w", truncateErr)
+			return
+		}
+		if repairErr != nil {
+			errors <- fmt.Errorf("failed to repair transaction log: %w", repairErr)
+			return
+		}
+
+		var tick <-chan time.Time
+		if ftl.options.FlushInterval > 0 {
+			ticker := time.NewTicker(ftl.options.FlushInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					ftl.mu.Lock()
+					err := ftl.flush()
+					ftl.mu.Unlock()
+					if err != nil {
+						errors <- err
+					}
+					return
+				}
+
+				if e.flushed != nil {
+					ftl.mu.Lock()
+					err := ftl.sync()
+					ftl.mu.Unlock()
+					e.flushed <- err
+					if err != nil {
+						errors <- err
+						return
+					}
+					continue
+				}
+
+				batch := []Event{e}
+				if e.batch != nil {
+					begin := Event{Sequence: e.Sequence, EventType: EventBegin, Value: strconv.Itoa(len(e.batch))}
+					batch = append([]Event{begin}, e.batch...)
+				}
+				ftl.queue.start(e)
+				err := ftl.write(batch, tick == nil)
+				ftl.queue.finish()
+				if err != nil {
+					deadLetterUnlogged(batch, err)
+					errors <- err
+					return
+				}
+			case <-tick:
+				ftl.mu.Lock()
+				err := ftl.flush()
+				ftl.mu.Unlock()
+				if err != nil {
+					errors <- err
+					return
+				}
 			}
 		}
 	}()
 }
 
+// write appends events to the log under the next sequence numbers, or
+// under their own if the logger is presequenced, flushing straight away
+// when flush is set.
+func (ftl *FileTransactionLogger) write(events []Event, flush bool) error {
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+
+	var written int64
+	now := time.Now()
+	for _, e := range events {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		if ftl.presequenced {
+			atomic.StoreUint64(&ftl.lastSequence, e.Sequence)
+		} else {
+			e.Sequence = atomic.AddUint64(&ftl.lastSequence, 1)
+		}
+
+		if ftl.options.BlobDir != "" {
+			var err error
+			if e, err = logBlob(e, ftl.options.BlobDir, ftl.options.BlobThreshold); err != nil {
+				return err
+			}
+		}
+		n, err := ftl.format.codec().encode(ftl.writer, e)
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+	if flush {
+		if err := ftl.flush(); err != nil {
+			return err
+		}
+	}
+
+	ftl.sinceRecs += len(events)
+	ftl.sinceBytes += written
+	if (ftl.options.CompactRecords > 0 && ftl.sinceRecs >= ftl.options.CompactRecords) ||
+		(ftl.options.CompactBytes > 0 && ftl.sinceBytes >= ftl.options.CompactBytes) {
+		select {
+		case ftl.compactions <- struct{}{}:
+		default: // a compaction is already pending
+		}
+	}
+
+	return nil
+}
+
+// checkEntry returns an error if key or value can't be logged, either in
+// the format of the log file or in the one the next compaction rewrites
+// it in.
+func (ftl *FileTransactionLogger) checkEntry(key, value string) error {
+	ftl.mu.Lock()
+	format, version := ftl.format, ftl.version
+	ftl.mu.Unlock()
+
+	if err := format.checkEntry(version, key, value); err != nil {
+		return err
+	}
+	return ftl.options.Format.checkEntry(logFormatVersion, key, value)
+}
+
+// writeEvent writes e in the tab separated log line format.
+// A put whose value is a blobRef has a b after its event type.
+func writeEvent(w io.Writer, e Event) (int, error) {
+	if e.blob {
+		return fmt.Fprintf(w, "%d\t%db\t%s\t%s\n", e.Sequence, e.EventType, e.Key, e.Value)
+	}
+	return fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", e.Sequence, e.EventType, e.Key, e.Value)
+}
+
+// flush writes any buffered events to the file, syncing it to stable
+// storage if the logger was configured to.
+func (ftl *FileTransactionLogger) flush() error {
+	if ftl.writer.Buffered() == 0 {
+		return nil
+	}
+	if err := ftl.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write transaction log: %w", err)
+	}
+	if ftl.options.Sync {
+		if err := ftl.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync transaction log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (ftl *FileTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&ftl.lastSequence)
+}
+
+// Size returns the size of the log file in bytes.
+func (ftl *FileTransactionLogger) Size() (int64, error) {
+	info, err := ftl.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// sync writes out any buffered events and fsyncs the file whether or not
+// the logger was configured to sync on every write.
+func (ftl *FileTransactionLogger) sync() error {
+	if err := ftl.flush(); err != nil {
+		return err
+	}
+	if err := ftl.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync transaction log: %w", err)
+	}
+
+	return nil
+}
+
+// Flush waits until every event written so far is in the log file and
+// the file has been synced to stable storage.
+func (ftl *FileTransactionLogger) Flush() error {
+	return flushEvents(ftl.queue, ftl.done)
+}
+
+// Close stops accepting events, writes out anything still buffered and
+// closes the log file. If writing takes longer than the CloseTimeout
+// option, the events still queued are saved to the RecoveryFile instead
+// and the file is left open, as the writer may still be using it.
+func (ftl *FileTransactionLogger) Close() error {
+	if ftl.compactor != nil {
+		ftl.compactor.stop()
+	}
+	if ftl.queue != nil {
+		if err := ftl.queue.close(ftl.done, ftl.options.CloseTimeout, ftl.options.RecoveryFile); err != nil {
+			return err
+		}
+	}
+
+	return ftl.file.Close()
+}
+
 func (ftl *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-	scanner := bufio.NewScanner(ftl.file)
+	scanner, release := openLogScanner(ftl.file, ftl.options.MmapThreshold)
 	outEvent := make(chan Event)    // unbuffered event channel
 	outError := make(chan error, 1) // buffered error channel
 
 	go func() {
-		var e Event
 		defer close(outEvent)
 		defer close(outError)
+		defer release()
 
-		for scanner.Scan() {
-			line := scanner.Text()
+		// Events of a batch are held back until all of them have been
+		// read, so that a batch cut short by a crash isn't applied.
+		var (
+			offset     int64   // offset of the next line
+			counted    int64   // offset up to which the events passed on account for the bytes read
+			lineNo     int     // number of the current line, from 1
+			batch      []Event // events of the batch being read
+			batchSize  int     // number of events in the batch being read
+			batchRead  int     // lines of the batch read so far, rejected ones included
+			batchBad   bool    // whether a line of the batch was rejected
+			batchStart int64   // offset of the batch's BEGIN line
+			batchSeq   uint64  // last sequence before the batch
+			skipped    int     // records rejected under OnError
+			decoder    logDecoder
+		)
 
-			if _, err := fmt.Sscanf(line, "%d\t%d\t%s\t%s", &e.Sequence, &e.EventType, &e.Key, &e.Value); err != nil {
-				outError <- fmt.Errorf("input parse error: %w", err)
+		// endBatch passes on the events of the batch being read once all
+		// of its lines have been, unless one was rejected, in which case
+		// the whole batch is dropped so that it stays all or nothing.
+		endBatch := func(end int64) {
+			if batchRead < batchSize {
 				return
 			}
-			// Sanity check! Are the sequence numbers in increasing order?
-			if ftl.lastSequence >= e.Sequence {
-				outError <- fmt.Errorf("transaction numbers out of sequence")
-				return
+			if batchBad {
+				slog.Warn("dropping transaction log batch with a bad record", "log", ftl.filename, "offset", batchStart)
+				ftl.rejected = append(ftl.rejected, byteRange{batchStart, end})
+			} else {
+				for _, e := range batch {
+					// size holds the offset of the end of the event's
+					// line until now.
+					end := e.size
+					e.size, counted = end-counted, end
+					outEvent <- e
+				}
 			}
+			batch, batchSize, batchRead, batchBad = nil, 0, 0, false
+		}
 
-			ftl.lastSequence = e.Sequence // Update last used sequence
+		// reject handles a bad record under the OnError policy, reporting
+		// whether reading has to stop.
+		reject := func(lineStart int64, err error) bool {
+			if ftl.options.OnError != ReplaySkip && ftl.options.OnError != ReplayRepair {
+				outError <- err
+				return true
+			}
+
+			skipped++
+			slog.Warn("skipping bad transaction log record", "log", ftl.filename, "line", lineNo, "err", err)
+			if batchSize > 0 {
+				batchRead++
+				batchBad = true
+				endBatch(offset)
+			} else {
+				ftl.rejected = append(ftl.rejected, byteRange{lineStart, offset})
+			}
+			return false
+		}
+
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			lineStart := offset
+			offset += int64(scanner.Len())
+			lineNo++
+
+			e, ok, err := decoder.decode(line)
+			if err != nil {
+				if reject(lineStart, fmt.Errorf("input parse error: %w", err)) {
+					return
+				}
+				continue
+			}
+			if !ok {
+				// The header. A log truncated after a snapshot
+				// carries on from the snapshot's sequence number.
+				if decoder.base > atomic.LoadUint64(&ftl.lastSequence) {
+					atomic.StoreUint64(&ftl.lastSequence, decoder.base)
+				}
+				continue
+			}
+			// Sanity check! Are the sequence numbers in order?
+			last := atomic.LoadUint64(&ftl.lastSequence)
+			if err := ftl.options.SequenceCheck.check(last, e.Sequence); err != nil {
+				if reject(lineStart, err) {
+					return
+				}
+				continue
+			}
+
+			if e.Sequence > last {
+				atomic.StoreUint64(&ftl.lastSequence, e.Sequence) // Update last used sequence
+			}
+
+			if e.EventType == EventBegin {
+				if batchSize > 0 {
+					if reject(lineStart, fmt.Errorf("batch at sequence %d starts inside another batch", e.Sequence)) {
+						return
+					}
+					continue
+				}
+				n, err := strconv.Atoi(e.Value)
+				if err != nil || n <= 0 {
+					if reject(lineStart, fmt.Errorf("bad batch size %q at sequence %d", e.Value, e.Sequence)) {
+						return
+					}
+					continue
+				}
+				batch, batchSize, batchStart, batchSeq = nil, n, lineStart, last
+				continue
+			}
+			if batchSize > 0 {
+				e.size = offset
+				batch = append(batch, e)
+				batchRead++
+				endBatch(offset)
+				continue
+			}
+			e.size, counted = offset-counted, offset
 			outEvent <- e
 		}
 
@@ -109,19 +700,97 @@ func (ftl *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 			outError <- fmt.Errorf("transaction log read failure: %w", err)
 			return
 		}
+
+		if batchSize > 0 {
+			// The log ends part way through a batch. Its events are
+			// dropped, and Run truncates the log to where it started.
+			ftl.truncateAt = batchStart
+			atomic.StoreUint64(&ftl.lastSequence, batchSeq)
+			for len(ftl.rejected) > 0 && ftl.rejected[len(ftl.rejected)-1].start >= batchStart {
+				ftl.rejected = ftl.rejected[:len(ftl.rejected)-1]
+			}
+		}
+		if skipped > 0 {
+			slog.Warn("skipped bad transaction log records", "log", ftl.filename, "records", skipped, "policy", ftl.options.OnError)
+		}
+		if ftl.options.OnError != ReplayRepair {
+			ftl.rejected = nil
+		}
 	}()
 
 	return outEvent, outError
 }
 
+// parseEvent decodes a single "sequence\ttype\tkey\tvalue" log line. The
+// value is everything after the third tab, so it may contain spaces and
+// may be empty (as it is for deletes). Only the key and value are copied
+// out of line.
+func parseEvent(line []byte) (Event, error) {
+	var e Event
+
+	// Cutting the fields off one by one saves allocating a slice of them
+	// for every line replayed.
+	seqField, rest, _ := bytes.Cut(line, []byte{'\t'})
+	typeField, rest, _ := bytes.Cut(rest, []byte{'\t'})
+	key, value, ok := bytes.Cut(rest, []byte{'\t'})
+	if !ok {
+		return e, fmt.Errorf("expected 4 tab separated fields, got %d", bytes.Count(line, []byte{'\t'})+1)
+	}
+
+	seq, err := parseUintField(seqField, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad sequence %q: %w", seqField, err)
+	}
+	if n := len(typeField); n > 0 && typeField[n-1] == 'b' {
+		e.blob = true
+		typeField = typeField[:n-1]
+	}
+	eventType, err := parseUintField(typeField, 8)
+	if err != nil {
+		return e, fmt.Errorf("bad event type %q: %w", typeField, err)
+	}
+
+	e.Sequence = seq
+	e.EventType = EventType(eventType)
+	e.Key = string(key)
+	e.Value = string(value)
+
+	return e, nil
+}
+
+// parseUintField is strconv.ParseUint in base 10 for a field of a log
+// line, which it only copies to report a malformed one.
+func parseUintField(field []byte, bitSize int) (uint64, error) {
+	limit := uint64(1)<<bitSize - 1
+	var n uint64
+	for _, c := range field {
+		d := uint64(c - '0')
+		if c < '0' || c > '9' || n > (limit-d)/10 {
+			return strconv.ParseUint(string(field), 10, bitSize)
+		}
+		n = n*10 + d
+	}
+	if len(field) == 0 {
+		return strconv.ParseUint("", 10, bitSize)
+	}
+
+	return n, nil
+}
+
+func (ftl *FileTransactionLogger) WriteBatch(events []Event) {
+	ftl.queue.send(Event{batch: events}, ftl.done)
+}
+
 func (ftl *FileTransactionLogger) WritePut(key, value string) {
-	ftl.events <- Event{EventType: EventPut, Key: key, Value: value}
+	ftl.queue.send(Event{EventType: EventPut, Key: key, Value: value}, ftl.done)
+}
 
+func (ftl *FileTransactionLogger) WritePutImmutable(key, value string) {
+	ftl.queue.send(Event{EventType: EventPutImmutable, Key: key, Value: value}, ftl.done)
 }
 
 func (ftl *FileTransactionLogger) WriteDelete(key string) {
-	ftl.events <- Event{EventType: EventDelete, Key: key}
-
+	ftl.queue.send(Event{EventType: EventDelete, Key: key}, ftl.done)
 }
 
 func (ftl *FileTransactionLogger) Err() <-chan error {
@@ -131,9 +800,19 @@ func (ftl *FileTransactionLogger) Err() <-chan error {
 // Postgres Transaction Logger Implementation
 
 type PostgresTransactionLogger struct {
-	events chan<- Event
-	errors <-chan error
-	db     *sql.DB
+	queue        *eventQueue // events on their way to the writer
+	errors       <-chan error
+	done         chan struct{} // closed once the writer goroutine exits
+	lastSequence uint64        // sequence of the latest row read or inserted, accessed atomically
+	db           *sql.DB
+	monitor      *dbMonitor      // tracks whether the database is reachable
+	breaker      *circuitBreaker // stops inserts while the database keeps failing
+
+	pageSize int // rows read per query when replaying
+	prefetch int // pages read ahead of the one being replayed
+
+	closeTimeout time.Duration
+	recoveryFile string
 }
 
 type PostgresDBParams struct {
@@ -141,6 +820,17 @@ type PostgresDBParams struct {
 	host     string
 	user     string
 	password string
+
+	healthInterval time.Duration // how often to ping the database; defaults to 5s
+
+	breakerFailures int           // consecutive insert failures that open the circuit; 0 disables the breaker
+	breakerCooldown time.Duration // how long the circuit stays open before a probe
+
+	replayPageSize int // rows read per query when replaying; defaults to 10000
+	replayPrefetch int // pages read ahead during replay
+
+	closeTimeout time.Duration // how long Close waits for queued inserts; 0 waits for as long as they take
+	recoveryFile string        // where inserts still queued after closeTimeout are saved
 }
 
 func NewPostgresTransactionLogger(config PostgresDBParams) (TransactionLogger, error) {
@@ -155,13 +845,43 @@ func NewPostgresTransactionLogger(config PostgresDBParams) (TransactionLogger, e
 		return nil, fmt.Errorf("failed to open db connection: %w", err)
 	}
 
-	ptl := &PostgresTransactionLogger{db: db}
+	// Recycle connections regularly so that ones left broken by a
+	// database restart are replaced rather than reused indefinitely.
+	db.SetConnMaxLifetime(30 * time.Minute)
+	db.SetConnMaxIdleTime(time.Minute)
+
+	ptl := &PostgresTransactionLogger{
+		db:           db,
+		pageSize:     config.replayPageSize,
+		prefetch:     config.replayPrefetch,
+		closeTimeout: config.closeTimeout,
+		recoveryFile: config.recoveryFile,
+	}
+	if ptl.pageSize <= 0 {
+		ptl.pageSize = 10000
+	}
+	if ptl.prefetch < 0 {
+		ptl.prefetch = 0
+	}
 	exists, _ := ptl.verifyTableExists()
 	if !exists {
 		if err = ptl.createTable(); err != nil {
 			return nil, fmt.Errorf("failed to create table: %w", err)
 		}
 	}
+	if err = ptl.migrateVersions(); err != nil {
+		return nil, fmt.Errorf("failed to create key_versions table: %w", err)
+	}
+	if err = ptl.migrateTimes(); err != nil {
+		return nil, fmt.Errorf("failed to add logged_at to transactions: %w", err)
+	}
+
+	interval := config.healthInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ptl.monitor = startDBMonitor(db, interval)
+	ptl.breaker = newCircuitBreaker(config.breakerFailures, config.breakerCooldown)
 
 	return ptl, nil
 }
@@ -189,32 +909,177 @@ func (ptl *PostgresTransactionLogger) createTable() error {
 	return err
 }
 
+// migrateTimes adds the logged_at column, the time each event was logged,
+// to a table created before it. Its earlier rows are left without one.
+func (ptl *PostgresTransactionLogger) migrateTimes() error {
+	_, err := ptl.db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS logged_at TIMESTAMPTZ`)
+	return err
+}
+
+// migrateVersions creates the key_versions table, which holds the version
+// of every existing key: the number of times it was put since it was last
+// created. It is updated along with every insert into transactions, so
+// versions survive restarts even when the store doesn't replay the whole
+// log. A table created next to an existing log is filled in from it.
+func (ptl *PostgresTransactionLogger) migrateVersions() error {
+	var exists bool
+	query := `SELECT EXISTS (SELECT FROM pg_tables WHERE schemaname='public' AND tablename = 'key_versions');`
+	if err := ptl.db.QueryRow(query).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := ptl.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE key_versions(
+		key VARCHAR(255) PRIMARY KEY, version BIGINT NOT NULL);`); err != nil {
+		return err
+	}
+
+	// Count each key's puts since its latest delete; keys whose latest
+	// event is a delete have none and are left out.
+	if _, err := tx.Exec(`INSERT INTO key_versions (key, version)
+		SELECT t.key, COUNT(*) FROM transactions t
+		WHERE t.event_type IN ($1, $3) AND t.sequence > COALESCE(
+			(SELECT MAX(d.sequence) FROM transactions d WHERE d.key = t.key AND d.event_type = $2), 0)
+		GROUP BY t.key;`, EventPut, EventDelete, EventPutImmutable); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordVersion updates key_versions for e within tx.
+func recordVersion(tx *sql.Tx, e Event) error {
+	var err error
+	switch e.EventType {
+	case EventPut, EventPutImmutable:
+		_, err = tx.Exec(`INSERT INTO key_versions (key, version) VALUES ($1, 1)
+			ON CONFLICT (key) DO UPDATE SET version = key_versions.version + 1`, e.Key)
+	case EventDelete:
+		_, err = tx.Exec(`DELETE FROM key_versions WHERE key = $1`, e.Key)
+	}
+	return err
+}
+
+// Versions returns the version of every key from the key_versions table.
+func (ptl *PostgresTransactionLogger) Versions() (map[string]uint64, error) {
+	rows, err := ptl.db.Query(`SELECT key, version FROM key_versions`)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[string]uint64)
+	for rows.Next() {
+		var key string
+		var version uint64
+		if err := rows.Scan(&key, &version); err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+		versions[key] = version
+	}
+
+	return versions, rows.Err()
+}
+
 func (ptl *PostgresTransactionLogger) Run() {
-	events := make(chan Event, 16)
-	ptl.events = events
+	ptl.queue = newEventQueue(16)
+	events := ptl.queue.events
 
 	errors := make(chan error, 1)
 	ptl.errors = errors
 
+	ptl.done = make(chan struct{})
+
 	go func() {
-		query := `INSERT INTO transactions (event_type, key, value) VALUES ($1, $2, $3)`
+		defer ptl.queue.stop()
+		defer close(ptl.done)
+
+		query := `INSERT INTO transactions (event_type, key, value, logged_at) VALUES ($1, $2, $3, $4) RETURNING sequence`
 
+		var failed error // first failure since the last flush
 		for e := range events {
-			_, err := ptl.db.Exec(query, e.EventType, e.Key, e.Value)
-			if err != nil {
-				errors <- err
+			if e.flushed != nil {
+				e.flushed <- failed
+				failed = nil
+				continue
+			}
+
+			// Every insert is a transaction of its own, so that
+			// key_versions is updated with it.
+			batch := e.batch
+			if batch == nil {
+				batch = []Event{e}
 			}
-			// map operations
-			switch e.EventType {
-			case EventDelete:
-				Delete(e.Key)
-			case EventPut:
-				Put(e.Key, e.Value)
+			ptl.queue.start(e)
+			err := ptl.breaker.allow()
+			if err == nil {
+				err = ptl.insertBatch(query, batch)
+				ptl.breaker.record(err)
+			}
+			err = classifyDBError(err)
+			ptl.queue.finish()
+			if err != nil {
+				deadLetterUnlogged(batch, err)
+				if failed == nil {
+					failed = err
+				}
+				select {
+				case errors <- err:
+				default: // an earlier error has not been received yet
+				}
 			}
 		}
 	}()
 }
 
+// insertBatch inserts events in a single SQL transaction, so that either
+// all of them are logged or none are.
+func (ptl *PostgresTransactionLogger) insertBatch(query string, events []Event) (err error) {
+	// Inserts happen after the requests that made them have been
+	// answered, so their spans start traces of their own.
+	span := startSpan(context.Background(), "postgres.insert",
+		attribute.String("db.system", "postgresql"), attribute.Int("db.rows", len(events)))
+	defer func() { endSpan(span, err) }()
+
+	tx, err := ptl.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var sequence uint64
+	for _, e := range events {
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		if err := tx.QueryRow(query, e.EventType, e.Key, e.Value, e.Time).Scan(&sequence); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := recordVersion(tx, e); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&ptl.lastSequence, sequence)
+
+	return nil
+}
+
+// ReadEvents reads the log a page at a time, keyset-paginated by sequence
+// number, so that replaying a large table neither holds a single cursor
+// open for the whole replay nor loads every row at once. The next pages
+// are fetched while the current one is being applied.
 func (ptl *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	outEvent := make(chan Event)
 	outError := make(chan error, 1)
@@ -223,45 +1088,227 @@ func (ptl *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error)
 		defer close(outEvent)
 		defer close(outError)
 
-		query := `SELECT sequence, event_type, key, value FROM transactions ORDER BY sequence`
-
-		rows, err := ptl.db.Query(query)
+		err := readPages(ptl.fetchPage, ptl.pageSize, ptl.prefetch, func(e Event) {
+			atomic.StoreUint64(&ptl.lastSequence, e.Sequence)
+			outEvent <- e
+		})
 		if err != nil {
-			outError <- fmt.Errorf("sql query error: %w", err)
-			return
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
 		}
+	}()
 
-		defer rows.Close()
+	return outEvent, outError
+}
 
-		e := Event{}
+// ScanEvents reads the whole log again, passing each event to fn, without
+// touching the logger's sequence numbers. It is safe to call while the
+// logger runs.
+func (ptl *PostgresTransactionLogger) ScanEvents(fn func(Event)) error {
+	return readPages(ptl.fetchPage, ptl.pageSize, ptl.prefetch, fn)
+}
 
-		for rows.Next() {
-			err = rows.Scan(&e.Sequence, &e.EventType, &e.Key, &e.Value)
-			if err != nil {
-				outError <- fmt.Errorf("error reading row: %w", err)
+// prepareLookups indexes the log by key, which lookups of a key's latest
+// event need on a large table, and takes the latest sequence number from
+// the table instead of a replay.
+func (ptl *PostgresTransactionLogger) prepareLookups() error {
+	if _, err := ptl.db.Exec(`CREATE INDEX IF NOT EXISTS transactions_key_sequence ON transactions (key, sequence)`); err != nil {
+		return fmt.Errorf("failed to index transactions by key: %w", err)
+	}
+
+	var sequence uint64
+	if err := ptl.db.QueryRow(`SELECT COALESCE(MAX(sequence), 0) FROM transactions`).Scan(&sequence); err != nil {
+		return fmt.Errorf("failed to read the latest sequence: %w", err)
+	}
+	atomic.StoreUint64(&ptl.lastSequence, sequence)
+
+	return nil
+}
+
+// latest returns the latest event of key, found through the index made
+// by prepareLookups rather than by reading the log.
+func (ptl *PostgresTransactionLogger) latest(key string) (e Event, ok bool, err error) {
+	span := startSpan(context.Background(), "postgres.latest", attribute.String("db.system", "postgresql")).onKey(key)
+	defer func() { endSpan(span, err) }()
+
+	e.Key = key
+	var loggedAt sql.NullTime
+	err = ptl.db.QueryRow(`SELECT sequence, event_type, value, logged_at FROM transactions WHERE key = $1 ORDER BY sequence DESC LIMIT 1`, key).
+		Scan(&e.Sequence, &e.EventType, &e.Value, &loggedAt)
+	e.Time = loggedAt.Time
+	if errors.Is(err, sql.ErrNoRows) {
+		return Event{}, false, nil
+	}
+	if err != nil {
+		return Event{}, false, err
+	}
+
+	return e, true, nil
+}
+
+// eachLatest calls fn with the latest event of every key, streaming the
+// rows rather than loading them all.
+func (ptl *PostgresTransactionLogger) eachLatest(fn func(e Event) error) error {
+	rows, err := ptl.db.Query(`SELECT DISTINCT ON (key) sequence, event_type, key, value, logged_at FROM transactions ORDER BY key, sequence DESC`)
+	if err != nil {
+		return fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Event
+		var loggedAt sql.NullTime
+		if err := rows.Scan(&e.Sequence, &e.EventType, &e.Key, &e.Value, &loggedAt); err != nil {
+			return fmt.Errorf("sql scan error: %w", err)
+		}
+		e.Time = loggedAt.Time
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// fetchPage returns up to limit events with sequence numbers above after.
+func (ptl *PostgresTransactionLogger) fetchPage(after uint64, limit int) (_ []Event, err error) {
+	query := `SELECT sequence, event_type, key, value, logged_at FROM transactions WHERE sequence > $1 ORDER BY sequence LIMIT $2`
+
+	span := startSpan(context.Background(), "postgres.fetch_page",
+		attribute.String("db.system", "postgresql"), attribute.Int64("db.after_sequence", int64(after)))
+	defer func() { endSpan(span, err) }()
+
+	rows, err := ptl.db.Query(query, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0, limit)
+	for rows.Next() {
+		var e Event
+		var loggedAt sql.NullTime
+		if err := rows.Scan(&e.Sequence, &e.EventType, &e.Key, &e.Value, &loggedAt); err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+		e.Time = loggedAt.Time
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// readPages passes every event returned by fetch to emit, in order. fetch
+// is asked for pages of pageSize events following the last one emitted,
+// until it returns a short page. Up to prefetch pages are fetched ahead of
+// the one being emitted.
+func readPages(fetch func(after uint64, limit int) ([]Event, error), pageSize, prefetch int, emit func(Event)) error {
+	type page struct {
+		events []Event
+		err    error
+	}
+
+	pages := make(chan page, prefetch)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer close(pages)
+
+		var after uint64
+		for {
+			events, err := fetch(after, pageSize)
+			select {
+			case pages <- page{events, err}:
+			case <-quit:
+				return
+			}
+			if err != nil || len(events) < pageSize {
 				return
 			}
+			after = events[len(events)-1].Sequence
+		}
+	}()
 
-			outEvent <- e
+	for p := range pages {
+		if p.err != nil {
+			return p.err
 		}
+		for _, e := range p.events {
+			emit(e)
+		}
+	}
 
-		err = rows.Err()
-		if err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
+	return nil
+}
+
+// checkEntry returns an error for keys and values the VARCHAR(255)
+// columns of the transactions table can't hold: text with a NUL byte or
+// that isn't valid UTF-8, or more than 255 characters of it.
+func (ptl *PostgresTransactionLogger) checkEntry(key, value string) error {
+	for _, s := range []string{key, value} {
+		if !utf8.ValidString(s) || strings.ContainsRune(s, 0) {
+			return errors.New("keys and values must be UTF-8 without NUL bytes in the postgres log")
 		}
-	}()
+		if utf8.RuneCountInString(s) > 255 {
+			return errors.New("keys and values can't be longer than 255 characters in the postgres log")
+		}
+	}
 
-	return outEvent, outError
+	return nil
 }
 
 func (ptl *PostgresTransactionLogger) WriteDelete(key string) {
-	ptl.events <- Event{EventType: EventDelete, Key: key}
+	ptl.queue.send(Event{EventType: EventDelete, Key: key}, ptl.done)
+}
+
+func (ptl *PostgresTransactionLogger) WriteBatch(events []Event) {
+	ptl.queue.send(Event{batch: events}, ptl.done)
 }
 
 func (ptl *PostgresTransactionLogger) WritePut(key, value string) {
-	ptl.events <- Event{EventType: EventPut, Key: key, Value: value}
+	ptl.queue.send(Event{EventType: EventPut, Key: key, Value: value}, ptl.done)
+}
+
+func (ptl *PostgresTransactionLogger) WritePutImmutable(key, value string) {
+	ptl.queue.send(Event{EventType: EventPutImmutable, Key: key, Value: value}, ptl.done)
 }
 
 func (ptl *PostgresTransactionLogger) Err() <-chan error {
 	return ptl.errors
 }
+
+func (ptl *PostgresTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&ptl.lastSequence)
+}
+
+// Flush waits until every event written so far has been inserted,
+// returning the first insert that failed since the previous flush.
+func (ptl *PostgresTransactionLogger) Flush() error {
+	return flushEvents(ptl.queue, ptl.done)
+}
+
+// Healthy reports whether the latest periodic ping of the database
+// succeeded.
+func (ptl *PostgresTransactionLogger) Healthy() error {
+	return ptl.monitor.Err()
+}
+
+// Breaker returns the circuit breaker guarding inserts.
+func (ptl *PostgresTransactionLogger) Breaker() *circuitBreaker {
+	return ptl.breaker
+}
+
+// Close waits for pending events to be written and closes the database.
+// Events still queued once closeTimeout has passed are saved to the
+// recovery file instead, and the database is left open for the insert
+// that is stuck.
+func (ptl *PostgresTransactionLogger) Close() error {
+	ptl.monitor.stop()
+	if ptl.queue != nil {
+		if err := ptl.queue.close(ptl.done, ptl.closeTimeout, ptl.recoveryFile); err != nil {
+			return err
+		}
+	}
+
+	return ptl.db.Close()
+}
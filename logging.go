@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// logLevel is the minimum level of the messages the server logs. Every
+// request and key operation is logged at debug level, so the default,
+// info, leaves out keys and values along with the per-request noise.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes slog's default logger, which the log package also
+// writes through, log to stderr at level, which validLogLevel accepts.
+func setupLogging(level string) {
+	setLogLevel(level)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// setLogLevel changes the level logged at to level, which validLogLevel
+// accepts.
+func setLogLevel(level string) {
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	logLevel.Set(l)
+}
+
+// validLogLevel reports whether level names a level setupLogging accepts.
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "error", "warn", "info", "debug":
+		return true
+	}
+	return false
+}
+
+// fatal logs err and exits, as log.Fatal does.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// bodyRedactors turn a request or response body into what is logged of
+// it when body logging is enabled.
+var bodyRedactors = map[string]func([]byte) string{
+	// none logs the body as it is.
+	"none": func(b []byte) string { return string(b) },
+	// mask logs only the length of the body.
+	"mask": func(b []byte) string { return fmt.Sprintf("[%d bytes redacted]", len(b)) },
+	// hash logs a SHA-256 of the body, so equal bodies can be recognized.
+	"hash": func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	},
+}
+
+// bodyRedactor is applied to every body logged. It is set from
+// config.LogBodiesRedact, and may be replaced by code embedding the
+// server with a redactor of its own.
+var bodyRedactor = bodyRedactors["hash"]
+
+// bodyLoggingMiddleware logs request and response bodies at debug level
+// when config.LogBodies is set. Only the first config.LogBodiesMax bytes
+// of each body are kept, and they pass through bodyRedactor before being
+// logged. It runs inside compressMiddleware, so responses are logged
+// before they are compressed. WebSocket traffic isn't logged.
+func bodyLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.LogBodies || !slog.Default().Enabled(r.Context(), slog.LevelDebug) || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req := &cappedBuffer{max: config.LogBodiesMax}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, req), r.Body}
+		}
+		resp := &bodyWriter{ResponseWriter: w, body: cappedBuffer{max: config.LogBodiesMax}}
+
+		next.ServeHTTP(resp, r)
+
+		slog.Debug("bodies", "method", r.Method, "uri", r.RequestURI,
+			"request", bodyRedactor(req.buf.Bytes()), "request_truncated", req.truncated,
+			"response", bodyRedactor(resp.body.buf.Bytes()), "response_truncated", resp.body.truncated)
+	})
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the
+// rest, noting that it did.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	room := c.max - c.buf.Len()
+	if room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// bodyWriter copies a response body into a cappedBuffer as it is written.
+type bodyWriter struct {
+	http.ResponseWriter
+	body cappedBuffer
+}
+
+func (bw *bodyWriter) Write(p []byte) (int, error) {
+	bw.body.Write(p)
+	return bw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (bw *bodyWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withLogOutput sends the default logger's output to the returned buffer
+// at level for the duration of the test.
+func withLogOutput(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+
+	saved, savedWriter, savedFlags := slog.Default(), log.Writer(), log.Flags()
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() {
+		slog.SetDefault(saved)
+		log.SetOutput(savedWriter)
+		log.SetFlags(savedFlags)
+	})
+
+	return &buf
+}
+
+func TestDebugLogsSuppressedAtInfo(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	put := func() {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/logged-key", strings.NewReader("secret-value")))
+	}
+
+	buf := withLogOutput(t, slog.LevelInfo)
+	put()
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing logged at info level, got %q", buf)
+	}
+
+	buf = withLogOutput(t, slog.LevelDebug)
+	put()
+	if !strings.Contains(buf.String(), "key=logged-key") {
+		t.Errorf("expected the PUT to be logged at debug level, got %q", buf)
+	}
+	if strings.Contains(buf.String(), "secret-value") {
+		t.Errorf("value leaked into the log: %q", buf)
+	}
+}
+
+func TestParseFlagsLogLevel(t *testing.T) {
+	if err := parseTestFlags(t, "-log-level", "loud"); err == nil {
+		t.Error("expected an unknown log level to be rejected")
+	}
+	if err := parseTestFlags(t, "-log-level", "warn", "-verbose"); err != nil || config.LogLevel != "debug" {
+		t.Errorf("expected -verbose to select debug, got %q, %v", config.LogLevel, err)
+	}
+}
+
+func TestBodyLogging(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	savedConfig, savedRedactor := config, bodyRedactor
+	t.Cleanup(func() { config, bodyRedactor = savedConfig, savedRedactor })
+
+	put := func(value string) string {
+		buf := withLogOutput(t, slog.LevelDebug)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/body-key?echo=true", strings.NewReader(value)))
+		return buf.String()
+	}
+
+	if logged := put("off-by-default"); strings.Contains(logged, "off-by-default") || strings.Contains(logged, "bodies") {
+		t.Errorf("bodies logged while disabled: %q", logged)
+	}
+
+	config.LogBodies = true
+	bodyRedactor = bodyRedactors["none"]
+	if logged := put("plain-value"); !strings.Contains(logged, "request=plain-value") {
+		t.Errorf("expected the request body to be logged, got %q", logged)
+	}
+
+	bodyRedactor = bodyRedactors["mask"]
+	if logged := put("masked-value"); strings.Contains(logged, "masked-value") || !strings.Contains(logged, `request="[12 bytes redacted]"`) {
+		t.Errorf("expected the request body to be masked, got %q", logged)
+	}
+
+	bodyRedactor = bodyRedactors["hash"]
+	if logged := put("hashed-value"); strings.Contains(logged, "hashed-value") || !strings.Contains(logged, "request=sha256:") {
+		t.Errorf("expected the request body to be hashed, got %q", logged)
+	}
+
+	// A custom hook sees the body cut to the size cap.
+	config.LogBodiesMax = 4
+	var seen []string
+	bodyRedactor = func(b []byte) string {
+		seen = append(seen, string(b))
+		return "custom"
+	}
+	logged := put("long-value")
+	if len(seen) != 2 || seen[0] != "long" {
+		t.Errorf("expected the hook to see the first 4 bytes of each body, saw %q", seen)
+	}
+	if !strings.Contains(logged, "request=custom request_truncated=true") {
+		t.Errorf("expected the hook's output and the truncation to be logged, got %q", logged)
+	}
+}
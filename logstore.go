@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// keyLookup is implemented by transaction loggers that can find the
+// latest event of a key in their log, so that with -store log the store
+// can be read from the log itself instead of being replayed into memory.
+type keyLookup interface {
+	// prepareLookups readies the log for lookups by key and moves the
+	// logger to the end of its log without reading it, in place of a
+	// replay.
+	prepareLookups() error
+
+	// latest returns the latest event of key, if the log has one.
+	latest(key string) (e Event, ok bool, err error)
+
+	// eachLatest calls fn with the latest event of every key in the log,
+	// deleted keys included.
+	eachLatest(fn func(e Event) error) error
+}
+
+// logBackend serves the store from a transaction log that keyLookup can
+// query, for datasets too large to hold in memory. Values read are kept
+// in a cache of the most recently used keys.
+//
+// The node is the only writer to its log, but the log is written after
+// the store, and under write-behind some time after. Writes are therefore
+// kept in pending, which is read before the cache and the log, until the
+// log is flushed. That happens once pending reaches the cache's size, so
+// the writes remembered are bounded too.
+//
+// Only values are left out of memory: the store still keeps the metadata
+// of every key, read by a scan of the log at startup.
+type logBackend struct {
+	tl      TransactionLogger
+	lookup  keyLookup
+	cache   *lruCache
+	pending map[string]*string // written, not yet known to be logged; nil for a delete
+}
+
+// newLogBackend returns a backend reading from tl, which must implement
+// keyLookup, caching up to cacheSize keys.
+func newLogBackend(tl TransactionLogger, cacheSize int) (*logBackend, error) {
+	lookup, ok := tl.(keyLookup)
+	if !ok {
+		return nil, errors.New("the transaction log can't be read by key")
+	}
+
+	return &logBackend{
+		tl:      tl,
+		lookup:  lookup,
+		cache:   newLRUCache(max(cacheSize, 1)),
+		pending: make(map[string]*string),
+	}, nil
+}
+
+func (b *logBackend) get(key string) (string, bool, error) {
+	if v, ok := b.pending[key]; ok {
+		if v == nil {
+			return "", false, nil
+		}
+		return *v, true, nil
+	}
+	if v, ok, cached := b.cache.get(key); cached {
+		return v, ok, nil
+	}
+
+	e, ok, err := b.lookup.latest(key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up key in the transaction log: %w", err)
+	}
+	ok = ok && e.EventType != EventDelete
+	if !ok {
+		e.Value = ""
+	}
+	b.cache.add(key, e.Value, ok)
+
+	return e.Value, ok, nil
+}
+
+// update applies the changes fn makes once it succeeds. Before it runs,
+// the pending writes are flushed to the log if there are too many.
+func (b *logBackend) update(fn func(w kvWriter) error) error {
+	if len(b.pending) >= b.cache.size {
+		if err := b.tl.Flush(); err != nil {
+			return fmt.Errorf("failed to flush pending writes: %w", err)
+		}
+		for k, v := range b.pending {
+			if v == nil {
+				b.cache.add(k, "", false)
+			} else {
+				b.cache.add(k, *v, true)
+			}
+		}
+		clear(b.pending)
+	}
+
+	w := logWriter{b: b, changes: make(map[string]*string)}
+	if err := fn(w); err != nil {
+		return err
+	}
+	for k, v := range w.changes {
+		b.pending[k] = v
+	}
+
+	return nil
+}
+
+// eachKey is each without the values, which still have to be read with
+// their events.
+func (b *logBackend) eachKey(fn func(key string) error) error {
+	return b.each(func(k, _ string) error { return fn(k) })
+}
+
+func (b *logBackend) each(fn func(key, value string) error) error {
+	err := b.lookup.eachLatest(func(e Event) error {
+		if _, ok := b.pending[e.Key]; ok || e.EventType == EventDelete {
+			return nil
+		}
+		return fn(e.Key, e.Value)
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range b.pending {
+		if v == nil {
+			continue
+		}
+		if err := fn(k, *v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// immutableKeys returns the keys last written as immutable, so that
+// useBackend marks them so.
+func (b *logBackend) immutableKeys() ([]string, error) {
+	var keys []string
+	err := b.lookup.eachLatest(func(e Event) error {
+		if e.EventType == EventPutImmutable {
+			keys = append(keys, e.Key)
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+// logWriter collects the changes of an update.
+type logWriter struct {
+	b       *logBackend
+	changes map[string]*string
+}
+
+func (w logWriter) get(key string) (string, bool, error) {
+	if v, ok := w.changes[key]; ok {
+		if v == nil {
+			return "", false, nil
+		}
+		return *v, true, nil
+	}
+	return w.b.get(key)
+}
+
+func (w logWriter) put(key, value string) error {
+	w.changes[key] = &value
+	return nil
+}
+
+func (w logWriter) delete(key string) error {
+	w.changes[key] = nil
+	return nil
+}
+
+// lruCache holds up to size keys, with their values or their absence,
+// evicting the least recently used. It has a lock of its own, as readers
+// holding the store's read lock share it.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value string
+	ok    bool // whether the key exists
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the cached value of key and whether it exists, and reports
+// whether key was cached at all.
+func (c *lruCache) get(key string) (value string, ok, cached bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, cached := c.entries[key]
+	if !cached {
+		return "", false, false
+	}
+	c.order.MoveToFront(el)
+	e := el.Value.(*lruEntry)
+
+	return e.value, e.ok, true
+}
+
+func (c *lruCache) add(key, value string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, cached := c.entries[key]; cached {
+		el.Value = &lruEntry{key, value, ok}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, ok})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withLogStore serves the store from tl until the test ends, as -store log
+// does at startup, keeping up to cacheSize values.
+func withLogStore(t *testing.T, tl *MemoryTransactionLogger, cacheSize int) *logBackend {
+	t.Helper()
+
+	withStore(t, make(map[string]string))
+	saved, savedCache := transactionLogger, config.StoreCacheKeys
+	t.Cleanup(func() { transactionLogger, config.StoreCacheKeys = saved, savedCache })
+	transactionLogger, config.StoreCacheKeys = tl, cacheSize
+
+	if err := useLogStore(tl); err != nil {
+		t.Fatal(err)
+	}
+	return store.data.(*logBackend)
+}
+
+func TestLogStoreReadsFromTheLog(t *testing.T) {
+	tl := NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1"},
+		Event{Sequence: 2, EventType: EventPut, Key: "b", Value: "2"},
+		Event{Sequence: 3, EventType: EventDelete, Key: "a"},
+		Event{Sequence: 4, EventType: EventPutImmutable, Key: "c", Value: "3"},
+		Event{Sequence: 5, EventType: EventPut, Key: "b", Value: "updated"},
+	)
+	b := withLogStore(t, tl, 10)
+
+	if tl.LastSequence() != 5 {
+		t.Errorf("expected the logger to carry on from sequence 5, got %d", tl.LastSequence())
+	}
+	if len(b.pending) != 0 || b.cache.order.Len() != 0 {
+		t.Fatal("expected nothing to be held in memory before the first read")
+	}
+	if stats := Stats(); stats.Keys != 2 {
+		t.Errorf("expected 2 keys, got %+v", stats)
+	}
+
+	if v, err := Get("b"); err != nil || v != "updated" {
+		t.Errorf("b: expected updated, got %q, %v", v, err)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("a: expected ErrNoSuchKey, got %v", err)
+	}
+	if v, err := Get("c"); err != nil || v != "3" {
+		t.Errorf("c: expected 3, got %q, %v", v, err)
+	}
+	store.RLock()
+	err := mutable("c")
+	store.RUnlock()
+	if !errors.Is(err, ErrImmutable) {
+		t.Error("expected c to be immutable")
+	}
+	if b.cache.order.Len() != 3 {
+		t.Errorf("expected the 3 keys read to be cached, got %d", b.cache.order.Len())
+	}
+}
+
+func TestLogStoreWrites(t *testing.T) {
+	tl := NewMemoryTransactionLogger()
+	b := withLogStore(t, tl, 2)
+
+	do := func(method, path, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(value)))
+		return rec
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if rec := do(http.MethodPut, "/v1/"+key, "value of "+key); rec.Code != http.StatusCreated {
+			t.Fatalf("%s: unexpected status %d", key, rec.Code)
+		}
+	}
+	if rec := do(http.MethodDelete, "/v1/b", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: unexpected status %d", rec.Code)
+	}
+	if len(b.pending) > 2 {
+		t.Errorf("expected at most 2 pending writes, got %d", len(b.pending))
+	}
+
+	check := func() {
+		t.Helper()
+		for key, want := range map[string]int{"a": http.StatusOK, "b": http.StatusNotFound, "c": http.StatusOK, "d": http.StatusOK} {
+			rec := do(http.MethodGet, "/v1/"+key, "")
+			if rec.Code != want {
+				t.Errorf("%s: expected status %d, got %d", key, want, rec.Code)
+			} else if want == http.StatusOK && rec.Body.String() != "value of "+key {
+				t.Errorf("%s: unexpected value %q", key, rec.Body)
+			}
+		}
+	}
+	check()
+
+	// A restart reads the same store back from the log.
+	withLogStore(t, tl, 2)
+	check()
+	if stats := Stats(); stats.Keys != 3 {
+		t.Errorf("expected 3 keys after the restart, got %+v", stats)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryTransactionLogger keeps its events in a slice instead of a file or
+// a database, which makes it a fast stand-in for tests and benchmarks.
+// Writes are recorded synchronously, so they are visible to ReadEvents and
+// Events as soon as WritePut or WriteDelete returns. Fail stands in for a
+// failing backend. Nothing survives the process.
+type MemoryTransactionLogger struct {
+	mu           sync.Mutex
+	events       []Event
+	lastSequence uint64
+	closed       bool
+	failed       error // set by Fail, returned by the next Flush
+
+	errors chan error
+}
+
+// NewMemoryTransactionLogger returns a logger whose log already holds
+// events, as if they had been written by an earlier run.
+func NewMemoryTransactionLogger(events ...Event) *MemoryTransactionLogger {
+	return &MemoryTransactionLogger{
+		events: append([]Event(nil), events...),
+		errors: make(chan error, 1),
+	}
+}
+
+func (mtl *MemoryTransactionLogger) Run() {}
+
+func (mtl *MemoryTransactionLogger) write(events ...Event) {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	if mtl.closed {
+		return
+	}
+	now := time.Now()
+	for _, e := range events {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		mtl.lastSequence++
+		e.Sequence = mtl.lastSequence
+		mtl.events = append(mtl.events, e)
+	}
+}
+
+func (mtl *MemoryTransactionLogger) WritePut(key, value string) {
+	mtl.write(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+func (mtl *MemoryTransactionLogger) WritePutImmutable(key, value string) {
+	mtl.write(Event{EventType: EventPutImmutable, Key: key, Value: value})
+}
+
+func (mtl *MemoryTransactionLogger) WriteDelete(key string) {
+	mtl.write(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteBatch records events together; nothing can interrupt it half way.
+func (mtl *MemoryTransactionLogger) WriteBatch(events []Event) {
+	mtl.write(events...)
+}
+
+func (mtl *MemoryTransactionLogger) Err() <-chan error {
+	return mtl.errors
+}
+
+// Flush has nothing to wait for, since writes are recorded immediately.
+// It returns the error passed to Fail since the last flush, if any.
+func (mtl *MemoryTransactionLogger) Flush() error {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	if mtl.closed {
+		return errLoggerStopped
+	}
+	err := mtl.failed
+	mtl.failed = nil
+	return err
+}
+
+// Fail makes the logger report err as a real one reports a failed write:
+// on Err, unless an earlier error hasn't been received yet, and from the
+// next Flush. Events are still recorded.
+func (mtl *MemoryTransactionLogger) Fail(err error) {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	if mtl.failed == nil {
+		mtl.failed = err
+	}
+	select {
+	case mtl.errors <- err:
+	default:
+	}
+}
+
+// Events returns a copy of the events recorded so far, in order.
+func (mtl *MemoryTransactionLogger) Events() []Event {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	return append([]Event(nil), mtl.events...)
+}
+
+func (mtl *MemoryTransactionLogger) LastSequence() uint64 {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	return mtl.lastSequence
+}
+
+// ReadEvents replays the events recorded so far, in order.
+func (mtl *MemoryTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	mtl.mu.Lock()
+	events := append([]Event(nil), mtl.events...)
+	mtl.mu.Unlock()
+
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for _, e := range events {
+			mtl.mu.Lock()
+			if e.Sequence > mtl.lastSequence {
+				mtl.lastSequence = e.Sequence
+			}
+			mtl.mu.Unlock()
+
+			outEvent <- e
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Close stops the logger recording further events.
+func (mtl *MemoryTransactionLogger) Close() error {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	mtl.closed = true
+	return nil
+}
+
+// prepareLookups moves the logger to the end of its log, as a replay
+// would.
+func (mtl *MemoryTransactionLogger) prepareLookups() error {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	if n := len(mtl.events); n > 0 && mtl.events[n-1].Sequence > mtl.lastSequence {
+		mtl.lastSequence = mtl.events[n-1].Sequence
+	}
+	return nil
+}
+
+// latest returns the latest event of key.
+func (mtl *MemoryTransactionLogger) latest(key string) (Event, bool, error) {
+	mtl.mu.Lock()
+	defer mtl.mu.Unlock()
+
+	for i := len(mtl.events) - 1; i >= 0; i-- {
+		if mtl.events[i].Key == key {
+			return mtl.events[i], true, nil
+		}
+	}
+	return Event{}, false, nil
+}
+
+// eachLatest calls fn with the latest event of every key, in the order
+// the keys were first written.
+func (mtl *MemoryTransactionLogger) eachLatest(fn func(e Event) error) error {
+	mtl.mu.Lock()
+	latest := make(map[string]int)
+	var keys []string
+	for i, e := range mtl.events {
+		if _, ok := latest[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		latest[e.Key] = i
+	}
+	events := make([]Event, len(keys))
+	for i, k := range keys {
+		events[i] = mtl.events[latest[k]]
+	}
+	mtl.mu.Unlock()
+
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
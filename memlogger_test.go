@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemoryLoggerReplay(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	tl := NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "kept", Value: "one"},
+		Event{Sequence: 2, EventType: EventPut, Key: "dropped", Value: "two"},
+		Event{Sequence: 3, EventType: EventDelete, Key: "dropped"},
+	)
+
+	count, err := replayEvents(tl, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 events replayed, got %d", count)
+	}
+	if got, _ := Get("kept"); got != "one" {
+		t.Errorf("expected kept=one, got %q", got)
+	}
+	if _, err := Get("dropped"); err == nil {
+		t.Error("expected dropped to be deleted by replay")
+	}
+	if seq := tl.LastSequence(); seq != 3 {
+		t.Errorf("expected last sequence 3, got %d", seq)
+	}
+
+	tl.WritePut("next", "value")
+	if seq := tl.LastSequence(); seq != 4 {
+		t.Errorf("expected a write after replay to get sequence 4, got %d", seq)
+	}
+}
+
+func TestMemoryLoggerHandlersRoundTrip(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	tl := NewMemoryTransactionLogger()
+	saved := transactionLogger
+	transactionLogger = tl
+	defer func() { transactionLogger = saved }()
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/v1/a", strings.NewReader("1")),
+		httptest.NewRequest(http.MethodPut, "/v1/b", strings.NewReader("2")),
+		httptest.NewRequest(http.MethodPut, "/v1/a", strings.NewReader("3")),
+		httptest.NewRequest(http.MethodDelete, "/v1/b", nil),
+	} {
+		newRouter().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Replaying what the handlers logged into an empty store rebuilds it.
+	withStore(t, make(map[string]string))
+	if _, err := replayEvents(tl, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(storeMap()) != 1 || storeMap()["a"] != "3" {
+		t.Errorf("unexpected store after replay: %v", storeMap())
+	}
+}
+
+func TestMemoryLoggerEvents(t *testing.T) {
+	tl := NewMemoryTransactionLogger()
+	tl.Run()
+	tl.WritePut("a", "1")
+	tl.WriteBatch([]Event{{EventType: EventPutImmutable, Key: "b", Value: "2"}, {EventType: EventDelete, Key: "a"}})
+
+	var got []string
+	for _, e := range tl.Events() {
+		got = append(got, fmt.Sprintf("{%d %s %s %s}", e.Sequence, e.EventType, e.Key, e.Value))
+	}
+	if want := "[{1 PUT a 1} {2 PUT_IMMUTABLE b 2} {3 DELETE a }]"; fmt.Sprint(got) != want {
+		t.Errorf("expected events %s, got %v", want, got)
+	}
+
+	// The events replay as they were recorded.
+	replayed, err := drain(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed, tl.Events()) {
+		t.Errorf("replayed %+v, recorded %+v", replayed, tl.Events())
+	}
+}
+
+func TestMemoryLoggerFail(t *testing.T) {
+	tl := NewMemoryTransactionLogger()
+	tl.Run()
+	defer tl.Close()
+
+	diskFull := errors.New("disk full")
+	tl.Fail(diskFull)
+	tl.Fail(errors.New("later failure"))
+	select {
+	case err := <-tl.Err():
+		if err != diskFull {
+			t.Errorf("expected the first failure on Err, got %v", err)
+		}
+	default:
+		t.Fatal("expected a failure on Err")
+	}
+	if err := tl.Flush(); err != diskFull {
+		t.Errorf("expected Flush to return the first failure, got %v", err)
+	}
+	if err := tl.Flush(); err != nil {
+		t.Errorf("expected the failure to be reported once, got %v", err)
+	}
+}
+
+func BenchmarkPutHandlerMemoryLogger(b *testing.B) {
+	saved, savedMeta, savedLogger := store.data, store.meta, transactionLogger
+	store.data, store.meta, transactionLogger = memoryBackend{}, make(map[string]*Metadata), NewMemoryTransactionLogger()
+	defer func() { store.data, store.meta, transactionLogger = saved, savedMeta, savedLogger }()
+
+	router := newRouter()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/bench", strings.NewReader("value")))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// gauge is a metric whose current value is read when it is scraped.
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+var metrics = struct {
+	sync.Mutex
+	gauges []*gauge
+}{}
+
+// registerGauge adds a gauge to the /metrics exposition, returning a
+// function that removes it again.
+func registerGauge(name, help string, value func() float64) (unregister func()) {
+	g := &gauge{name: name, help: help, value: value}
+
+	metrics.Lock()
+	metrics.gauges = append(metrics.gauges, g)
+	metrics.Unlock()
+
+	return func() {
+		metrics.Lock()
+		defer metrics.Unlock()
+		for i, other := range metrics.gauges {
+			if other == g {
+				metrics.gauges = append(metrics.gauges[:i], metrics.gauges[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// metricsHandler serves the registered metrics in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	gauges := append([]*gauge(nil), metrics.gauges...)
+	metrics.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+			g.name, g.help, g.name, g.name, strconv.FormatFloat(g.value(), 'g', -1, 64))
+	}
+}
+
+// registerStoreMetrics exposes the size of the store as gauges.
+func registerStoreMetrics() {
+	registerGauge("kvstore_keys", "Number of keys in the store.", func() float64 {
+		return float64(Stats().Keys)
+	})
+	registerGauge("kvstore_key_bytes", "Total size of the keys in the store in bytes.", func() float64 {
+		return float64(Stats().KeyBytes)
+	})
+	registerGauge("kvstore_value_bytes", "Total size of the values in the store in bytes.", func() float64 {
+		return float64(Stats().ValueBytes)
+	})
+}
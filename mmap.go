@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// errMmapUnsupported is returned by mmapFile on platforms that can't map
+// files into memory.
+var errMmapUnsupported = errors.New("memory-mapped files are not available on this platform")
+
+// lineScanner reads a log a line at a time, splitting it as
+// bufio.ScanLines does: a trailing carriage return is dropped and the
+// last line needn't end in a newline.
+type lineScanner interface {
+	Scan() bool
+	// Bytes returns the line read by Scan, without its line ending. It
+	// is only valid until the next call to Scan, so decoders copy what
+	// they keep out of it.
+	Bytes() []byte
+	// Len returns how many bytes of the log the line took up, line
+	// ending included, so that offsets into the log come out right
+	// however lines end.
+	Len() int
+	Err() error
+}
+
+// openLogScanner returns a scanner over the lines of file, along with a
+// function releasing what it holds. Files of at least mmapThreshold bytes
+// are read straight from a memory mapping, which saves copying them into
+// a read buffer and lets events be decoded where they lie; smaller ones,
+// or any file on platforms without mmap, are read through a buffer. A
+// threshold of zero never maps.
+func openLogScanner(file *os.File, mmapThreshold int64) (lineScanner, func()) {
+	if mmapThreshold > 0 {
+		if info, err := file.Stat(); err == nil && info.Size() > 0 && info.Size() >= mmapThreshold {
+			data, err := mmapFile(file, info.Size())
+			if err == nil {
+				return &mmapScanner{data: data}, func() { munmapFile(data) }
+			}
+			slog.Warn("cannot map transaction log, reading it through a buffer", "log", file.Name(), "err", err)
+		}
+	}
+
+	return newBufferScanner(file), func() {}
+}
+
+// bufferScanner is a lineScanner reading through a bufio.Scanner.
+type bufferScanner struct {
+	*bufio.Scanner
+	n int
+}
+
+func newBufferScanner(r io.Reader) *bufferScanner {
+	s := &bufferScanner{Scanner: bufio.NewScanner(r)}
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			s.n = advance
+		}
+		return advance, token, err
+	})
+	return s
+}
+
+func (s *bufferScanner) Len() int { return s.n }
+
+// mmapScanner splits mapped bytes into lines. Its lines are slices of the
+// mapping, never copied. Unlike bufio.Scanner it has no limit on the
+// length of a line.
+type mmapScanner struct {
+	data []byte
+	pos  int
+	line []byte
+	n    int
+}
+
+func (s *mmapScanner) Scan() bool {
+	if s.pos >= len(s.data) {
+		return false
+	}
+
+	rest := s.data[s.pos:]
+	line := rest
+	if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+		line = rest[:i]
+		s.n = i + 1
+	} else {
+		s.n = len(rest)
+	}
+	s.pos += s.n
+	s.line = bytes.TrimSuffix(line, []byte{'\r'})
+
+	return true
+}
+
+func (s *mmapScanner) Bytes() []byte { return s.line }
+
+func (s *mmapScanner) Len() int { return s.n }
+
+func (s *mmapScanner) Err() error { return nil }
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// mmapFile can't map files on this platform.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) {}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMmapReplayMatchesScanner(t *testing.T) {
+	for name, tt := range map[string]struct {
+		log     string
+		options FileLoggerOptions
+	}{
+		"tab": {log: sampleLog},
+		"header": {
+			log: "#kvstore-log format=tab version=1 base=10\n11\t2\ta\t1\n12\t2\tb\tx\ty\n",
+		},
+		"json": {
+			log: "#kvstore-log format=json version=1\n" +
+				`{"seq":1,"type":"put","key":"a\tb","value":"line\nbreak"}` + "\n" +
+				`{"seq":2,"type":"delete","key":"a\tb"}` + "\n",
+		},
+		"no final newline": {log: "1\t2\ta\t1\n2\t2\tb\t2"},
+		"crlf":             {log: "1\t2\ta\t1\r\n2\t2\tb\t2\r\n"},
+		"batches": {
+			log: "1\t3\t\t2\n2\t2\ta\t1\n3\t2\tb\t2\n4\t3\t\t2\n5\t2\tc\t3\n",
+		},
+		"skip bad records": {
+			log:     "1\t2\ta\t1\nnot an event\n2\t2\tb\t2\n",
+			options: FileLoggerOptions{OnError: ReplaySkip},
+		},
+		"abort on bad record": {log: "1\t2\ta\t1\nnot an event\n2\t2\tb\t2\n"},
+	} {
+		filename := writeLogFile(t, tt.log)
+
+		scanned, scanErr := readAll(t, filename, tt.options)
+		tt.options.MmapThreshold = 1
+		mapped, mapErr := readAll(t, filename, tt.options)
+
+		if !reflect.DeepEqual(scanned, mapped) {
+			t.Errorf("%s: the scanner read %+v, the mapping %+v", name, scanned, mapped)
+		}
+		if fmt.Sprint(scanErr) != fmt.Sprint(mapErr) {
+			t.Errorf("%s: the scanner failed with %v, the mapping with %v", name, scanErr, mapErr)
+		}
+	}
+}
+
+func TestOpenLogScanner(t *testing.T) {
+	file, err := os.Open(writeLogFile(t, sampleLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, tt := range []struct {
+		threshold int64
+		mapped    bool
+	}{
+		{0, false},
+		{int64(len(sampleLog)) + 1, false},
+		{int64(len(sampleLog)), true},
+	} {
+		scanner, release := openLogScanner(file, tt.threshold)
+		_, mapped := scanner.(*mmapScanner)
+		release()
+
+		if _, err := mmapFile(file, 1); err == errMmapUnsupported {
+			tt.mapped = false
+		}
+		if mapped != tt.mapped {
+			t.Errorf("threshold %d: expected mapped %v, got %v", tt.threshold, tt.mapped, mapped)
+		}
+	}
+}
+
+// writeBenchLog writes n events to a log in a temporary directory.
+func writeBenchLog(b *testing.B, n int) string {
+	b.Helper()
+
+	filename := filepath.Join(b.TempDir(), "transaction.log")
+	file, err := os.Create(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(file)
+	for _, e := range replayBenchEvents(n) {
+		e.Value = strings.Repeat(e.Value, 10)
+		if _, err := writeEvent(w, e); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	return filename
+}
+
+func benchmarkFileReplay(b *testing.B, mmapThreshold int64) {
+	filename := writeBenchLog(b, 500000)
+
+	saved := store.data
+	defer func() { store.data = saved }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.data = memoryBackend{}
+		tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{MmapThreshold: mmapThreshold})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := replayEvents(tl, 0, nil); err != nil {
+			b.Fatal(err)
+		}
+		tl.Close()
+	}
+}
+
+func BenchmarkFileReplayScanner(b *testing.B) { benchmarkFileReplay(b, 0) }
+func BenchmarkFileReplayMmap(b *testing.B)    { benchmarkFileReplay(b, 1) }
+
+func TestRepairCRLFLog(t *testing.T) {
+	const log = "1\t2\ta\t1\r\nnot a record\r\n2\t2\tb\t2\r\n"
+
+	for _, threshold := range []int64{0, 1} {
+		filename := writeLogFile(t, log)
+		tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{OnError: ReplayRepair, MmapThreshold: threshold})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, errs := tl.ReadEvents()
+		var bytes int64
+		for e := range events {
+			bytes += e.size
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		tl.Run()
+		if err := tl.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The offsets of the lines count their carriage returns, so the
+		// events account for the whole log and the repair cuts out
+		// exactly the bad line.
+		if bytes != int64(len(log)) {
+			t.Errorf("threshold %d: events account for %d bytes, want %d", threshold, bytes, len(log))
+		}
+		content, _ := os.ReadFile(filename)
+		if want := "1\t2\ta\t1\r\n2\t2\tb\t2\r\n"; string(content) != want {
+			t.Errorf("threshold %d: got repaired log %q, want %q", threshold, content, want)
+		}
+	}
+}
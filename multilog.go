@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MultiTransactionLogger writes every event to several transaction loggers,
+// such as a local file for fast recovery and postgres for durability
+// elsewhere. Each logger numbers its events itself, so their sequence
+// numbers only agree if their logs started out equal.
+//
+// Replay reads the primary logger alone, as reading them all would apply
+// every event more than once. The others are read too, but only so they
+// carry on numbering from the end of their own logs; their events are
+// dropped. LastSequence is the primary's, which is what checkpoints and
+// snapshots are taken against.
+type MultiTransactionLogger struct {
+	loggers []TransactionLogger
+	primary int // index in loggers of the logger replayed from
+
+	errors <-chan error
+	done   chan struct{} // closed by Close to stop forwarding the loggers' errors
+}
+
+// NewMultiTransactionLogger returns a logger writing to each of loggers
+// and replaying from loggers[primary].
+func NewMultiTransactionLogger(primary int, loggers ...TransactionLogger) (*MultiTransactionLogger, error) {
+	if len(loggers) == 0 {
+		return nil, errors.New("a multi logger needs at least one logger")
+	}
+	if primary < 0 || primary >= len(loggers) {
+		return nil, fmt.Errorf("primary logger %d out of range for %d loggers", primary, len(loggers))
+	}
+
+	return &MultiTransactionLogger{loggers: loggers, primary: primary}, nil
+}
+
+func (m *MultiTransactionLogger) Run() {
+	errs := make(chan error, len(m.loggers))
+	m.errors = errs
+	m.done = make(chan struct{})
+
+	for i, tl := range m.loggers {
+		tl.Run()
+		go func(i int, tl TransactionLogger) {
+			select {
+			case err := <-tl.Err():
+				errs <- fmt.Errorf("transaction logger %d: %w", i, err)
+			case <-m.done:
+			}
+		}(i, tl)
+	}
+}
+
+// checkEntry returns an error if any of the loggers can't log key and
+// value.
+func (m *MultiTransactionLogger) checkEntry(key, value string) error {
+	for i, tl := range m.loggers {
+		if c, ok := tl.(entryChecker); ok {
+			if err := c.checkEntry(key, value); err != nil {
+				return fmt.Errorf("transaction logger %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *MultiTransactionLogger) WritePut(key, value string) {
+	for _, tl := range m.loggers {
+		tl.WritePut(key, value)
+	}
+}
+
+func (m *MultiTransactionLogger) WritePutImmutable(key, value string) {
+	for _, tl := range m.loggers {
+		tl.WritePutImmutable(key, value)
+	}
+}
+
+func (m *MultiTransactionLogger) WriteDelete(key string) {
+	for _, tl := range m.loggers {
+		tl.WriteDelete(key)
+	}
+}
+
+// WriteBatch logs events as a batch in every logger. Each keeps the batch
+// whole, but a crash can leave it in some logs and not the others.
+func (m *MultiTransactionLogger) WriteBatch(events []Event) {
+	for _, tl := range m.loggers {
+		tl.WriteBatch(events)
+	}
+}
+
+// Err returns a channel receiving the first error of each logger. A
+// logger stops when it fails while the others carry on, so the writes
+// after an error are missing from the failed logger's log only.
+func (m *MultiTransactionLogger) Err() <-chan error {
+	return m.errors
+}
+
+// Flush flushes every logger at once, returning the errors of those that
+// failed.
+func (m *MultiTransactionLogger) Flush() error {
+	errs := make([]error, len(m.loggers))
+	var wg sync.WaitGroup
+	for i, tl := range m.loggers {
+		wg.Add(1)
+		go func(i int, tl TransactionLogger) {
+			defer wg.Done()
+			if err := tl.Flush(); err != nil {
+				errs[i] = fmt.Errorf("transaction logger %d: %w", i, err)
+			}
+		}(i, tl)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (m *MultiTransactionLogger) LastSequence() uint64 {
+	return m.loggers[m.primary].LastSequence()
+}
+
+// Healthy reports the loggers that can tell whether they are healthy,
+// returning the errors of those that aren't.
+func (m *MultiTransactionLogger) Healthy() error {
+	var errs []error
+	for i, tl := range m.loggers {
+		if h, ok := tl.(healthReporter); ok {
+			if err := h.Healthy(); err != nil {
+				errs = append(errs, fmt.Errorf("transaction logger %d: %w", i, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ReadEvents passes on the events of the primary logger, reading the
+// others alongside and dropping theirs. It fails if any of them does.
+func (m *MultiTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		errs := make([]error, len(m.loggers))
+		var wg sync.WaitGroup
+		for i, tl := range m.loggers {
+			if i == m.primary {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, tl TransactionLogger) {
+				defer wg.Done()
+				events, errc := tl.ReadEvents()
+				for range events {
+				}
+				if err := <-errc; err != nil {
+					errs[i] = fmt.Errorf("transaction logger %d: %w", i, err)
+				}
+			}(i, tl)
+		}
+
+		events, errc := m.loggers[m.primary].ReadEvents()
+		for e := range events {
+			outEvent <- e
+		}
+		if err := <-errc; err != nil {
+			errs[m.primary] = err
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (m *MultiTransactionLogger) Close() error {
+	if m.done != nil {
+		close(m.done)
+	}
+
+	var errs []error
+	for _, tl := range m.loggers {
+		errs = append(errs, tl.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingLogger is a memory logger whose Err channel is fed by the test.
+type failingLogger struct {
+	*MemoryTransactionLogger
+	errs chan error
+}
+
+func (l failingLogger) Err() <-chan error { return l.errs }
+
+// unreadableLogger is a memory logger whose replay fails.
+type unreadableLogger struct {
+	*MemoryTransactionLogger
+}
+
+func (l unreadableLogger) ReadEvents() (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	errs <- errors.New("corrupt log")
+	close(errs)
+	close(events)
+	return events, errs
+}
+
+// drain reads every event and the error of tl's replay.
+func drain(tl TransactionLogger) ([]Event, error) {
+	events, errs := tl.ReadEvents()
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	return got, <-errs
+}
+
+func TestMultiLoggerWritesToAll(t *testing.T) {
+	a, b := NewMemoryTransactionLogger(), NewMemoryTransactionLogger()
+	m, err := NewMultiTransactionLogger(0, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Run()
+	defer m.Close()
+
+	m.WritePut("a", "1")
+	m.WriteBatch([]Event{{EventType: EventPut, Key: "b", Value: "2"}, {EventType: EventDelete, Key: "a"}})
+	m.WritePutImmutable("c", "3")
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[{1 PUT a 1} {2 PUT b 2} {3 DELETE a } {4 PUT_IMMUTABLE c 3}]"
+	for i, tl := range []*MemoryTransactionLogger{a, b} {
+		events, err := drain(tl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, fmt.Sprintf("{%d %s %s %s}", e.Sequence, e.EventType, e.Key, e.Value))
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("logger %d: expected %s, got %v", i, want, got)
+		}
+	}
+}
+
+func TestMultiLoggerErrors(t *testing.T) {
+	ok := NewMemoryTransactionLogger()
+	failing := failingLogger{NewMemoryTransactionLogger(), make(chan error, 1)}
+	m, err := NewMultiTransactionLogger(0, ok, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Run()
+	defer m.Close()
+
+	failing.errs <- errors.New("disk on fire")
+	select {
+	case err := <-m.Err():
+		if err == nil || err.Error() != "transaction logger 1: disk on fire" {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the secondary logger's error on the combined channel")
+	}
+}
+
+func TestMultiLoggerReplaysPrimary(t *testing.T) {
+	a := NewMemoryTransactionLogger(Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1"})
+	b := NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "b", Value: "1"},
+		Event{Sequence: 2, EventType: EventPut, Key: "b", Value: "2"},
+	)
+
+	m, err := NewMultiTransactionLogger(1, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := drain(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Key != "b" || events[1].Key != "b" {
+		t.Errorf("expected the primary's events only, got %v", events)
+	}
+	if m.LastSequence() != 2 || a.LastSequence() != 1 {
+		t.Errorf("expected the loggers to carry on from their own logs, got %d and %d", m.LastSequence(), a.LastSequence())
+	}
+
+	// A secondary that can't be read fails the replay.
+	m, err = NewMultiTransactionLogger(0, a, unreadableLogger{NewMemoryTransactionLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := drain(m); err == nil {
+		t.Error("expected the secondary's replay error")
+	}
+
+	if _, err := NewMultiTransactionLogger(2, a, b); err == nil {
+		t.Error("expected an error for a primary out of range")
+	}
+}
+
+func TestMultiLoggerCheckEntry(t *testing.T) {
+	m, err := NewMultiTransactionLogger(0, NewMemoryTransactionLogger(), &PostgresTransactionLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The memory logger takes anything, but postgres doesn't.
+	for _, tt := range []struct {
+		value string
+		ok    bool
+	}{
+		{"ünïcode", true},
+		{strings.Repeat("ü", 255), true},
+		{strings.Repeat("x", 256), false},
+		{"nul \x00", false},
+		{"\xff", false},
+	} {
+		if err := m.checkEntry("key", tt.value); (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v", tt.value, err)
+		}
+	}
+}
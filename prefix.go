@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// KeyValue is a key along with its value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// ScanPrefix returns the keys starting with prefix and their values in
+// key order, at most limit of them unless limit is 0, starting after the
+// key after unless it is empty. truncated reports whether more keys
+// matched. The store is read under a single hold of the
+// read lock, so the result is a snapshot as with List. Every matching pair
+// is copied, values included, before limit is applied, so a broad prefix
+// over a large store costs memory in proportion to what it matches.
+// Reserved keys are left out.
+func ScanPrefix(prefix, after string, limit int) (pairs []KeyValue, truncated bool, err error) {
+	store.RLock()
+	err = store.data.each(func(k, v string) error {
+		if strings.HasPrefix(k, prefix) && k > after && !isReservedKey(k) {
+			pairs = append(pairs, KeyValue{k, v})
+		}
+		return nil
+	})
+	store.RUnlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	if limit > 0 && len(pairs) > limit {
+		pairs, truncated = pairs[:limit], true
+	}
+
+	return pairs, truncated, nil
+}
+
+// prefixStreamBatch is how many pairs StreamPrefix reads under one hold
+// of the read lock, and so how many a streamed response flushes at once.
+const prefixStreamBatch = 256
+
+// StreamPrefix calls fn with the keys starting with prefix and their
+// values in key order, batch pairs at a time, stopping after limit pairs
+// unless limit is 0 or when fn returns an error. Only the matching keys
+// are copied up front; values are read a batch at a time, so memory is
+// bounded by the batch rather than the values matched. Unlike ScanPrefix
+// the result is not a snapshot: each batch is read as the store is then,
+// and keys deleted since the scan started are left out. Reserved keys are
+// left out.
+func StreamPrefix(prefix string, limit, batch int, fn func([]KeyValue) error) error {
+	var keys []string
+	store.RLock()
+	err := store.data.eachKey(func(k string) error {
+		if strings.HasPrefix(k, prefix) && !isReservedKey(k) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	store.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	pairs := make([]KeyValue, 0, batch)
+	for len(keys) > 0 {
+		n := min(batch, len(keys))
+
+		pairs = pairs[:0]
+		store.RLock()
+		for _, k := range keys[:n] {
+			v, ok, err := store.data.get(k)
+			if err != nil {
+				store.RUnlock()
+				return err
+			}
+			if ok {
+				pairs = append(pairs, KeyValue{k, v})
+			}
+		}
+		store.RUnlock()
+		keys = keys[n:]
+
+		if err := fn(pairs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prefixHandler returns every key under the prefix in the path along with
+// its value, as {"values": {key: value, ...}, "truncated": bool}. At most
+// config.MaxPrefixResults pairs are returned, or fewer with ?limit=, and
+// truncated is set when more keys matched, along with a next_token that
+// ?token= takes to return the pairs after them. Values can be encoded with
+// ?encoding= as they can for GET. The response is written pair by pair
+// rather than built up in memory.
+//
+// Clients that accept application/x-ndjson get the pairs streamed
+// instead, one {"key": ..., "value": ...} line per pair, flushed every
+// prefixStreamBatch pairs, as read by StreamPrefix. Streams are meant for
+// exporting large subtrees, so config.MaxPrefixResults doesn't apply to
+// them, though ?limit= does, and there is no truncated marker or token.
+func prefixHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["prefix"]
+
+	codec, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := intQueryParam(r.URL.Query(), "limit", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if accepts(r, "application/x-ndjson") {
+		if token != "" {
+			http.Error(w, "token doesn't apply to streamed prefix reads", http.StatusBadRequest)
+			return
+		}
+		streamPrefix(w, r, prefix, limit, codec)
+		return
+	}
+	var after string
+	if token != "" {
+		if after, err = decodePageToken(token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.MaxPrefixResults > 0 && (limit == 0 || limit > config.MaxPrefixResults) {
+		limit = config.MaxPrefixResults
+	}
+
+	span := startSpan(r.Context(), "store.scan_prefix")
+	pairs, truncated, err := ScanPrefix(prefix, after, limit)
+	endSpan(span, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"values":{`)
+	for i, p := range pairs {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		value := p.Value
+		if codec != nil {
+			value = codec.encode([]byte(value))
+		}
+		k, _ := json.Marshal(p.Key)
+		v, _ := json.Marshal(value)
+		bw.Write(k)
+		bw.WriteByte(':')
+		bw.Write(v)
+	}
+	bw.WriteString(`},"truncated":`)
+	if truncated {
+		bw.WriteString(`true,"next_token":`)
+		t, _ := json.Marshal(encodePageToken(pairs[len(pairs)-1].Key))
+		bw.Write(t)
+		bw.WriteString("}\n")
+	} else {
+		bw.WriteString("false}\n")
+	}
+	bw.Flush()
+
+	slog.Debug("GET prefix", "prefix", prefix, "keys", len(pairs), "truncated", truncated)
+}
+
+// streamPrefix writes the pairs under prefix as newline-delimited JSON,
+// flushing after every batch. It stops early if the client goes away.
+func streamPrefix(w http.ResponseWriter, r *http.Request, prefix string, limit int, codec *valueCodec) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var sent int
+	span := startSpan(r.Context(), "store.stream_prefix")
+	err := StreamPrefix(prefix, limit, prefixStreamBatch, func(pairs []KeyValue) error {
+		for _, p := range pairs {
+			value := p.Value
+			if codec != nil {
+				value = codec.encode([]byte(value))
+			}
+			if err := enc.Encode(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}{p.Key, value}); err != nil {
+				return err
+			}
+		}
+		sent += len(pairs)
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return r.Context().Err()
+	})
+	endSpan(span, err)
+	if err != nil {
+		// Once lines have gone out the status can't change, so the
+		// client only sees the stream end early.
+		slog.Warn("prefix stream ended early", "prefix", prefix, "sent", sent, "err", err)
+		if sent == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	bw.Flush()
+
+	slog.Debug("GET prefix stream", "prefix", prefix, "keys", sent)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type prefixResponse struct {
+	Values    map[string]string `json:"values"`
+	Truncated bool              `json:"truncated"`
+	NextToken string            `json:"next_token"`
+}
+
+func getPrefix(t *testing.T, path string) prefixResponse {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body)
+	}
+
+	var resp prefixResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestPrefixNested(t *testing.T) {
+	withStore(t, map[string]string{
+		"config:a":           "1",
+		"config:db/host":     "localhost",
+		"config:db/port":     "5432",
+		"configuration":      "other",
+		"user:1":             "alice",
+		reservedPrefix + "x": "internal",
+	})
+
+	got := getPrefix(t, "/v1/_prefix/config:")
+	want := map[string]string{"config:a": "1", "config:db/host": "localhost", "config:db/port": "5432"}
+	if !reflect.DeepEqual(got.Values, want) || got.Truncated {
+		t.Errorf("got %+v, want %v", got, want)
+	}
+
+	got = getPrefix(t, "/v1/_prefix/config:db/")
+	want = map[string]string{"config:db/host": "localhost", "config:db/port": "5432"}
+	if !reflect.DeepEqual(got.Values, want) {
+		t.Errorf("nested prefix: got %v, want %v", got.Values, want)
+	}
+
+	if got := getPrefix(t, "/v1/_prefix/missing"); len(got.Values) != 0 || got.Truncated {
+		t.Errorf("expected no values, got %+v", got)
+	}
+
+	got = getPrefix(t, "/v1/_prefix/user:?encoding=hex")
+	if got.Values["user:1"] != "616c696365" {
+		t.Errorf("expected a hex encoded value, got %v", got.Values)
+	}
+}
+
+func TestPrefixTruncated(t *testing.T) {
+	withStore(t, map[string]string{"p/1": "a", "p/2": "b", "p/3": "c"})
+	saved := config.MaxPrefixResults
+	config.MaxPrefixResults = 2
+	defer func() { config.MaxPrefixResults = saved }()
+
+	got := getPrefix(t, "/v1/_prefix/p/")
+	if want := map[string]string{"p/1": "a", "p/2": "b"}; !reflect.DeepEqual(got.Values, want) || !got.Truncated {
+		t.Errorf("got %+v, want the first two keys and truncated", got)
+	}
+
+	// ?limit can lower the maximum but not raise it.
+	if got := getPrefix(t, "/v1/_prefix/p/?limit=1"); len(got.Values) != 1 || !got.Truncated {
+		t.Errorf("limit=1: got %+v", got)
+	}
+	if got := getPrefix(t, "/v1/_prefix/p/?limit=10"); len(got.Values) != 2 || !got.Truncated {
+		t.Errorf("limit=10: got %+v", got)
+	}
+}
+
+// flushRecorder notes how much of the body had been written at each
+// flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushedAt = append(f.flushedAt, f.Body.Len())
+	f.ResponseRecorder.Flush()
+}
+
+func TestPrefixStream(t *testing.T) {
+	const n = 1000
+	data := map[string]string{"other": "x"}
+	for i := 0; i < n; i++ {
+		data[fmt.Sprintf("exp/%04d", i)] = strconv.Itoa(i)
+	}
+	withStore(t, data)
+
+	for _, gzipped := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/_prefix/exp/", nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		newRouter().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("gzip=%v: status %d: %s", gzipped, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+			t.Errorf("gzip=%v: unexpected Content-Type %q", gzipped, got)
+		}
+
+		// The client gets the pairs a batch at a time, not all at the end.
+		if want := n / prefixStreamBatch; len(rec.flushedAt) < want {
+			t.Errorf("gzip=%v: expected at least %d flushes, got %d", gzipped, want, len(rec.flushedAt))
+		} else if rec.flushedAt[0] == 0 || rec.flushedAt[0] >= rec.Body.Len() {
+			t.Errorf("gzip=%v: first flush at %d of %d bytes", gzipped, rec.flushedAt[0], rec.Body.Len())
+		}
+
+		var body io.Reader = rec.Body
+		if gzipped {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("gzip=%v: %v", gzipped, err)
+			}
+			body = zr
+		}
+		dec := json.NewDecoder(body)
+		var i int
+		for ; dec.More(); i++ {
+			var line struct{ Key, Value string }
+			if err := dec.Decode(&line); err != nil {
+				t.Fatalf("gzip=%v: line %d: %v", gzipped, i, err)
+			}
+			if want := fmt.Sprintf("exp/%04d", i); line.Key != want || line.Value != strconv.Itoa(i) {
+				t.Fatalf("gzip=%v: line %d: expected %s, got %+v", gzipped, i, want, line)
+			}
+		}
+		if i != n {
+			t.Errorf("gzip=%v: expected %d lines, got %d", gzipped, n, i)
+		}
+	}
+}
+
+func TestPrefixStreamLimit(t *testing.T) {
+	withStore(t, map[string]string{"p/1": "a", "p/2": "b", "p/3": "c"})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/_prefix/p/?limit=2", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if want := "{\"key\":\"p/1\",\"value\":\"a\"}\n{\"key\":\"p/2\",\"value\":\"b\"}\n"; rec.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, rec.Body.String())
+	}
+}
+
+func TestPrefixTokenPages(t *testing.T) {
+	withStore(t, map[string]string{"p/1": "a", "p/2": "b", "p/3": "c", "p/4": "d", "p/5": "e", "q": "x"})
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.MaxPrefixResults = 2
+
+	got := make(map[string]string)
+	path := "/v1/_prefix/p/"
+	for pages := 1; ; pages++ {
+		resp := getPrefix(t, path)
+		for k, v := range resp.Values {
+			if _, ok := got[k]; ok {
+				t.Errorf("page %d repeated key %s", pages, k)
+			}
+			got[k] = v
+		}
+		if resp.Truncated != (resp.NextToken != "") {
+			t.Errorf("page %d: truncated %v with token %q", pages, resp.Truncated, resp.NextToken)
+		}
+		if resp.NextToken == "" {
+			if pages != 3 {
+				t.Errorf("expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		path = "/v1/_prefix/p/?token=" + resp.NextToken
+	}
+
+	want := map[string]string{"p/1": "a", "p/2": "b", "p/3": "c", "p/4": "d", "p/5": "e"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrQuotaExceeded is returned for writes that would take a namespace past
+// its quota.
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// NamespaceQuota caps what a namespace can hold: its number of keys and
+// the total length of its keys and values. Zero leaves either unlimited.
+type NamespaceQuota struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// NamespaceUsage is what a namespace holds, counted as its quota is.
+type NamespaceUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// namespaceQuotas holds the quota of each namespace, set from
+// -namespace-quotas at startup. The quota under "*" applies to namespaces
+// without one of their own.
+var namespaceQuotas map[string]NamespaceQuota
+
+// namespaceOf returns the namespace of key: the part before its first
+// slash, as tenant in tenant/config. Keys without a slash are in no
+// namespace, and no quota applies to them.
+func namespaceOf(key string) string {
+	ns, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return ns
+}
+
+// parseNamespaceQuotas parses comma-separated namespace=keys:bytes pairs,
+// such as acme=1000:1048576, where a limit of 0 is no limit. The namespace
+// * gives the quota of every namespace not listed.
+func parseNamespaceQuotas(spec string) (map[string]NamespaceQuota, error) {
+	quotas := make(map[string]NamespaceQuota)
+	if spec == "" {
+		return quotas, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		ns, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		keys, bytes, ok2 := strings.Cut(limits, ":")
+		if !ok || !ok2 || ns == "" || strings.Contains(ns, "/") {
+			return nil, fmt.Errorf("bad namespace quota %q, expected namespace=keys:bytes", entry)
+		}
+		if _, ok := quotas[ns]; ok {
+			return nil, fmt.Errorf("more than one quota for namespace %q", ns)
+		}
+
+		var q NamespaceQuota
+		var err error
+		if q.Keys, err = strconv.ParseInt(keys, 10, 64); err != nil || q.Keys < 0 {
+			return nil, fmt.Errorf("bad key limit %q for namespace %q", keys, ns)
+		}
+		if q.Bytes, err = strconv.ParseInt(bytes, 10, 64); err != nil || q.Bytes < 0 {
+			return nil, fmt.Errorf("bad byte limit %q for namespace %q", bytes, ns)
+		}
+		quotas[ns] = q
+	}
+
+	return quotas, nil
+}
+
+// quotaOf returns the quota of namespace ns, and false if it has none.
+func quotaOf(ns string) (NamespaceQuota, bool) {
+	if ns == "" {
+		return NamespaceQuota{}, false
+	}
+	if q, ok := namespaceQuotas[ns]; ok {
+		return q, true
+	}
+	q, ok := namespaceQuotas["*"]
+	return q, ok
+}
+
+// namespaceUsage returns what each namespace holds.
+func namespaceUsage() map[string]NamespaceUsage {
+	store.RLock()
+	defer store.RUnlock()
+
+	usage := make(map[string]NamespaceUsage, len(store.usage))
+	for ns, u := range store.usage {
+		usage[ns] = u
+	}
+	return usage
+}
+
+// trackUsage adds keys and bytes to the usage of key's namespace. The
+// caller must hold the store's write lock.
+func trackUsage(key string, keys, bytes int64) {
+	ns := namespaceOf(key)
+	if ns == "" {
+		return
+	}
+
+	u := store.usage[ns]
+	u.Keys += keys
+	u.Bytes += bytes
+	if u.Keys == 0 {
+		delete(store.usage, ns)
+		return
+	}
+	store.usage[ns] = u
+}
+
+// usageDelta collects the change a write makes to the usage of each
+// namespace, so it can be checked against the quotas before it is made.
+type usageDelta map[string]NamespaceUsage
+
+// put records storing a value of size bytes under key, which held one of
+// old bytes if existed.
+func (d usageDelta) put(key string, old int, existed bool, size int) {
+	if existed {
+		d.add(key, 0, int64(size-old))
+	} else {
+		d.add(key, 1, int64(len(key)+size))
+	}
+}
+
+// remove records deleting key, whose value was old bytes long.
+func (d usageDelta) remove(key string, old int) {
+	d.add(key, -1, -int64(len(key)+old))
+}
+
+func (d usageDelta) add(key string, keys, bytes int64) {
+	ns := namespaceOf(key)
+	if ns == "" {
+		return
+	}
+	u := d[ns]
+	u.Keys += keys
+	u.Bytes += bytes
+	d[ns] = u
+}
+
+// check fails with ErrQuotaExceeded if d would take a namespace past its
+// quota. A write that doesn't add to a namespace's keys or bytes is let
+// through even if the namespace is already past its quota, as it may be
+// after the quota was lowered, so that it can be brought back under. The
+// caller must hold at least the store's read lock.
+func (d usageDelta) check() error {
+	for ns, delta := range d {
+		q, ok := quotaOf(ns)
+		if !ok {
+			continue
+		}
+		u := store.usage[ns]
+		if q.Keys > 0 && delta.Keys > 0 && u.Keys+delta.Keys > q.Keys {
+			return fmt.Errorf("namespace %s would hold more than its %d keys: %w", ns, q.Keys, ErrQuotaExceeded)
+		}
+		if q.Bytes > 0 && delta.Bytes > 0 && u.Bytes+delta.Bytes > q.Bytes {
+			return fmt.Errorf("namespace %s would hold more than its %d bytes: %w", ns, q.Bytes, ErrQuotaExceeded)
+		}
+	}
+	return nil
+}
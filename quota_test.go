@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withQuotas(t *testing.T, spec string) {
+	t.Helper()
+
+	quotas, err := parseNamespaceQuotas(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := namespaceQuotas
+	t.Cleanup(func() { namespaceQuotas = saved })
+	namespaceQuotas = quotas
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	withQuotas(t, "acme=2:0,small=0:20")
+
+	do := func(method, path, value string) int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(value)))
+		return rec.Code
+	}
+
+	for _, key := range []string{"acme/a", "acme/b"} {
+		if code := do(http.MethodPut, "/v1/"+key, "v"); code != http.StatusCreated {
+			t.Fatalf("%s: expected status %d, got %d", key, http.StatusCreated, code)
+		}
+	}
+	if code := do(http.MethodPut, "/v1/acme/c", "v"); code != http.StatusInsufficientStorage {
+		t.Errorf("third acme key: expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+	if code := do(http.MethodPost, "/v1/acme/a/rename?newKey=acme/c", ""); code != http.StatusOK {
+		t.Errorf("rename within acme: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := do(http.MethodPut, "/v1/acme/a", "updated"); code != http.StatusInsufficientStorage {
+		t.Errorf("acme key after rename: expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+	if code := do(http.MethodPut, "/v1/acme/b", "updated"); code != http.StatusOK {
+		t.Errorf("update within acme: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Other namespaces, and keys in none, are unaffected.
+	for _, key := range []string{"globex/a", "globex/b", "globex/c", "plain"} {
+		if code := do(http.MethodPut, "/v1/"+key, "v"); code != http.StatusCreated {
+			t.Errorf("%s: expected status %d, got %d", key, http.StatusCreated, code)
+		}
+	}
+
+	// Deleting a key makes room for another.
+	if code := do(http.MethodDelete, "/v1/acme/c", ""); code != http.StatusOK {
+		t.Fatalf("delete: expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := do(http.MethodPut, "/v1/acme/d", "v"); code != http.StatusCreated {
+		t.Errorf("after delete: expected status %d, got %d", http.StatusCreated, code)
+	}
+
+	// The key small/x is 7 of small's 20 bytes, leaving 13 for its value.
+	if code := do(http.MethodPut, "/v1/small/x", "v"); code != http.StatusCreated {
+		t.Fatalf("small: expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := do(http.MethodPut, "/v1/small/x", strings.Repeat("v", 14)); code != http.StatusInsufficientStorage {
+		t.Errorf("growing past the byte quota: expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+	if code := do(http.MethodPut, "/v1/small/x", strings.Repeat("v", 13)); code != http.StatusOK {
+		t.Errorf("growing up to the byte quota: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	usage := namespaceUsage()
+	if want := (NamespaceUsage{Keys: 2, Bytes: int64(len("acme/b") + len("updated") + len("acme/d") + 1)}); usage["acme"] != want {
+		t.Errorf("expected acme to use %+v, got %+v", want, usage["acme"])
+	}
+	if want := (NamespaceUsage{Keys: 1, Bytes: 20}); usage["small"] != want {
+		t.Errorf("expected small to use %+v, got %+v", want, usage["small"])
+	}
+}
+
+func TestNamespaceQuotaDefault(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	withQuotas(t, "*=1:0,big=0:0")
+
+	if _, _, err := PutContent("a/1", "v", "", writeAlways); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PutContent("a/2", "v", "", writeAlways); err == nil {
+		t.Error("expected the default quota to apply to a")
+	}
+	for _, key := range []string{"b/1", "big/1", "big/2"} {
+		if _, _, err := PutContent(key, "v", "", writeAlways); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestTxNamespaceQuota(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	withQuotas(t, "acme=2:0")
+
+	rec := postTx(t, `{"ops": [{"op": "put", "key": "acme/a", "value": "1"}, {"op": "put", "key": "acme/b", "value": "2"}, {"op": "put", "key": "acme/c", "value": "3"}]}`)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("expected status %d, got %d", http.StatusInsufficientStorage, rec.Code)
+	}
+	if len(storeMap()) != 0 {
+		t.Errorf("expected nothing to be stored, got %v", storeMap())
+	}
+
+	// Deletes in the same transaction make room.
+	PutContent("acme/a", "1", "", writeAlways)
+	PutContent("acme/b", "2", "", writeAlways)
+	rec = postTx(t, `{"ops": [{"op": "delete", "key": "acme/a"}, {"op": "put", "key": "acme/c", "value": "3"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+}
+
+func TestParseNamespaceQuotas(t *testing.T) {
+	quotas, err := parseNamespaceQuotas("acme=10:1024, *=5:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas["acme"] != (NamespaceQuota{Keys: 10, Bytes: 1024}) || quotas["*"] != (NamespaceQuota{Keys: 5}) {
+		t.Errorf("unexpected quotas %+v", quotas)
+	}
+
+	for _, spec := range []string{"acme", "acme=10", "=1:1", "a/b=1:1", "acme=x:1", "acme=1:-1", "acme=1:1,acme=2:2"} {
+		if _, err := parseNamespaceQuotas(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
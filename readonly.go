@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// readOnly holds the reason the server refuses writes, or nil while it
+// accepts them.
+var readOnly atomic.Pointer[string]
+
+// diskFull holds the reason writes are refused for lack of disk space,
+// or nil while there is enough. It is set and cleared by the disk
+// monitor.
+var diskFull atomic.Pointer[string]
+
+// readOnlyConfigured is set while config.ReadOnly asks for writes to be
+// refused. It is kept apart from readOnly so that reloading the setting
+// can't lift a read-only state the server fell into by itself.
+var readOnlyConfigured atomic.Bool
+
+// setReadOnly makes the server refuse writes for reason. An empty reason
+// accepts writes again.
+func setReadOnly(reason string) {
+	if reason == "" {
+		readOnly.Store(nil)
+		return
+	}
+	readOnly.Store(&reason)
+}
+
+// readOnlyReason returns why the server refuses writes, or "" if it
+// accepts them.
+func readOnlyReason() string {
+	_, reason := readOnlyStatus()
+	return reason
+}
+
+// readOnlyStatus returns why the server refuses writes and the status
+// refused writes are answered with: 507 Insufficient Storage when the
+// disk is full, 503 otherwise. It returns 0 and "" if writes are
+// accepted.
+func readOnlyStatus() (int, string) {
+	if reason := readOnly.Load(); reason != nil {
+		return http.StatusServiceUnavailable, *reason
+	}
+	if reason := diskFull.Load(); reason != nil {
+		return http.StatusInsufficientStorage, *reason
+	}
+	if readOnlyConfigured.Load() {
+		return http.StatusServiceUnavailable, "-read-only is set"
+	}
+	return 0, ""
+}
+
+// watchTransactionLog makes the server read-only once tl reports a write
+// failure that isn't transient. Under write-behind nothing else would
+// notice: the file logger's writer stops, and the events of later writes
+// are dead-lettered rather than logged. Transient failures, which the
+// postgres logger carries on after, are only reported.
+func watchTransactionLog(tl TransactionLogger) {
+	errs := tl.Err()
+	if errs == nil {
+		return
+	}
+
+	for err := range errs {
+		if isTransient(err) {
+			slog.Warn("transaction log write failed transiently", "err", err)
+			continue
+		}
+		setReadOnly(fmt.Sprintf("transaction log write failed: %v", err))
+		slog.Error("transaction log write failed, serving read-only", "err", err)
+	}
+}
+
+// rejectWhenReadOnly answers 503, or 507 if the disk is full, instead of
+// calling next while the server is read-only.
+func rejectWhenReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, reason := readOnlyStatus(); reason != "" {
+			http.Error(w, "server is read-only: "+reason, status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withReplayFailure replays a log that breaks after its first event with
+// the given failure policy, restoring the logger, configuration and
+// read-only state when the test ends.
+func withReplayFailure(t *testing.T, policy string) error {
+	t.Helper()
+
+	withStore(t, make(map[string]string))
+	savedConfig, savedLogger := config, transactionLogger
+	t.Cleanup(func() {
+		if transactionLogger != nil {
+			transactionLogger.Close()
+		}
+		config, transactionLogger = savedConfig, savedLogger
+		setReadOnly("")
+	})
+
+	config.Backend = "file"
+	config.LogFile = writeLogFile(t, "1\t2\ta\t1\ngarbage\n")
+	config.ReplayFailure = policy
+
+	return initializeTransactionLog(0)
+}
+
+func TestReplayFailureAborts(t *testing.T) {
+	if err := withReplayFailure(t, "abort"); err == nil {
+		t.Fatal("expected the replay to fail")
+	}
+	if readOnly.Load() != nil {
+		t.Error("an aborted replay made the server read-only")
+	}
+}
+
+func TestReplayFailureReadOnly(t *testing.T) {
+	if err := withReplayFailure(t, "read-only"); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeMap()["a"]; got != "1" {
+		t.Errorf("expected the replayed key to be served, got %q", got)
+	}
+
+	router := newRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/a", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, "/v1/a", strings.NewReader("2")))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected status %d, got %d", method, http.StatusServiceUnavailable, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "read-only") {
+			t.Errorf("%s: unexpected body %q", method, rec.Body.String())
+		}
+	}
+	if got := storeMap()["a"]; got != "1" {
+		t.Errorf("a write went through while read-only, a is %q", got)
+	}
+}
+
+func TestReplayTimeout(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	tl, err := NewTransactionLogger(writeLogFile(t, "1\t2\ta\t1\n2\t2\tb\t2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := replayEventsContext(ctx, tl, 0, 0, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the replay to be cancelled, got %v", err)
+	}
+}
+
+// withUnavailableBackend starts the server on a postgres backend that
+// can't be reached, with the given fallback, restoring the logger,
+// configuration and read-only state when the test ends.
+func withUnavailableBackend(t *testing.T, fallback string) error {
+	t.Helper()
+
+	withStore(t, make(map[string]string))
+	savedConfig, savedLogger := config, transactionLogger
+	t.Cleanup(func() {
+		if transactionLogger != nil {
+			transactionLogger.Close()
+		}
+		config, transactionLogger = savedConfig, savedLogger
+		setReadOnly("")
+	})
+
+	// A directory without a server socket in it fails the connection
+	// straight away.
+	config.Backend = "postgres"
+	config.DBHost = t.TempDir()
+	config.BackendFallback = fallback
+	config.LogFile = writeLogFile(t, "1\t2\ta\t1\n")
+
+	return initializeTransactionLog(0)
+}
+
+func TestBackendFallback(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		if err := withUnavailableBackend(t, "none"); err == nil {
+			t.Error("expected startup to fail")
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		if err := withUnavailableBackend(t, "file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := transactionLogger.(*FileTransactionLogger); !ok || config.Backend != "file" {
+			t.Errorf("expected the file logger, got %T on the %s backend", transactionLogger, config.Backend)
+		}
+		if got := storeMap()["a"]; got != "1" {
+			t.Errorf("expected the file log to be replayed, a is %q", got)
+		}
+		if code := putKey(newRouter(), "b", "2"); code != http.StatusCreated {
+			t.Errorf("PUT: expected status %d, got %d", http.StatusCreated, code)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		if err := withUnavailableBackend(t, "read-only"); err != nil {
+			t.Fatal(err)
+		}
+		if reason := readOnlyReason(); !strings.Contains(reason, "postgres backend is unavailable") {
+			t.Errorf("unexpected read-only reason %q", reason)
+		}
+		if code := putKey(newRouter(), "b", "2"); code != http.StatusServiceUnavailable {
+			t.Errorf("PUT: expected status %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	})
+}
+
+// failingWriter fails every write, like a disk that has gone bad.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("input/output error") }
+
+func TestFailedLoggerTurnsReadOnly(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withWritePolicy(t, WriteBehind)
+	d := withDeadLetters(t)
+	t.Cleanup(func() { setReadOnly("") })
+
+	logger := withLogger(t)
+	logger.mu.Lock()
+	logger.writer = bufio.NewWriter(failingWriter{})
+	logger.mu.Unlock()
+	go watchTransactionLog(logger)
+
+	// Under write-behind the put is answered before its event fails, and
+	// the writer stops.
+	router := newRouter()
+	if code := putKey(router, "a", "1"); code != http.StatusCreated {
+		t.Fatalf("expected the put to be accepted, got %d", code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for readOnlyReason() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("the server didn't turn read-only")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if code := putKey(router, "b", "2"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the logger failed, got %d", code)
+	}
+
+	// Writes that get past the read-only check don't block once the
+	// queue is full, but are dead-lettered.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 100; i++ {
+			logger.WritePut(fmt.Sprintf("late-%d", i), "v")
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked after the logger failed")
+	}
+	if err := logger.Flush(); !errors.Is(err, errLoggerStopped) {
+		t.Errorf("expected Flush to report the logger stopped, got %v", err)
+	}
+
+	letters, err := d.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 101 {
+		t.Errorf("expected the failed put and the 100 late ones dead-lettered, got %d letters", len(letters))
+	}
+}
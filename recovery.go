@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventQueue is the channel a logger's writer goroutine reads events from,
+// along with the event it is writing. If the writer is stuck when the
+// logger is closed, for instance on a database that stopped answering,
+// what it hasn't written can then be saved to a recovery file rather than
+// lost, and is logged again on the next startup.
+type eventQueue struct {
+	events chan Event
+
+	mu      sync.Mutex
+	writing *Event // taken from events, not yet written
+
+	sendMu  sync.Mutex    // serializes send with stop and close
+	stopped bool          // set once the writer has exited or the queue is closed
+	closing chan struct{} // closed by close, waking senders waiting on a full queue
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{events: make(chan Event, size), closing: make(chan struct{})}
+}
+
+// send queues e for the writer, whose exit closes done. Once the writer
+// has stopped, as it does when a write fails, or the queue is closed, e is
+// dead-lettered instead of blocking the caller for good, and the next
+// Flush reports the logger stopped. A nil queue is that of a logger that
+// was never run.
+func (q *eventQueue) send(e Event, done <-chan struct{}) {
+	if !q.enqueue(e, done) {
+		dropEvents([]Event{e})
+	}
+}
+
+// enqueue queues e for the writer like send, but reports false rather
+// than dead-lettering e if it can't.
+func (q *eventQueue) enqueue(e Event, done <-chan struct{}) bool {
+	if q == nil {
+		return false
+	}
+
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+	if q.stopped {
+		return false
+	}
+	select {
+	case q.events <- e:
+		return true
+	case <-done:
+	case <-q.closing:
+	}
+	return false
+}
+
+// stop is called by the writer as it exits, after closing done. It stops
+// send queueing events and dead-letters those left in the queue, failing
+// the flushes among them.
+func (q *eventQueue) stop() {
+	q.sendMu.Lock()
+	q.stopped = true
+	q.sendMu.Unlock()
+
+	var left []Event
+	for {
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				dropEvents(left)
+				return
+			}
+			if e.flushed != nil {
+				e.flushed <- errLoggerStopped
+				continue
+			}
+			left = append(left, e)
+		default:
+			dropEvents(left)
+			return
+		}
+	}
+}
+
+// dropEvents dead-letters events, as taken from a queue, that a stopped
+// logger won't write.
+func dropEvents(events []Event) {
+	var dropped []Event
+	for _, e := range events {
+		if e.batch != nil {
+			dropped = append(dropped, e.batch...)
+		} else {
+			dropped = append(dropped, e)
+		}
+	}
+	if len(dropped) > 0 {
+		deadLetterUnlogged(dropped, errLoggerStopped)
+	}
+}
+
+// start notes that the writer took e from the queue and is writing it.
+func (q *eventQueue) start(e Event) {
+	q.mu.Lock()
+	q.writing = &e
+	q.mu.Unlock()
+}
+
+// finish notes that the writer is done with the event it took last.
+func (q *eventQueue) finish() {
+	q.mu.Lock()
+	q.writing = nil
+	q.mu.Unlock()
+}
+
+// close stops the queue accepting events and waits for the writer, whose
+// exit closes done, to write out the rest. If it hasn't within timeout,
+// the events it hasn't written are saved to recoveryFile and an error
+// says so. A timeout of zero, or no recoveryFile, waits for as long as
+// the writer takes.
+func (q *eventQueue) close(done <-chan struct{}, timeout time.Duration, recoveryFile string) error {
+	// A sender waiting on a full queue holds sendMu, so it is woken before
+	// the lock is taken. Once stopped is set under the lock, nothing sends
+	// on events any more and it can be closed.
+	close(q.closing)
+	q.sendMu.Lock()
+	q.stopped = true
+	q.sendMu.Unlock()
+	close(q.events)
+	if timeout <= 0 || recoveryFile == "" {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	unwritten := q.unwritten()
+	if err := saveRecovery(recoveryFile, unwritten); err != nil {
+		return fmt.Errorf("writer still busy after %s, and failed to save %d unwritten events: %w", timeout, len(unwritten), err)
+	}
+	slog.Warn("transaction logger still busy, saved unwritten events", "after", timeout, "events", len(unwritten), "file", recoveryFile)
+	return fmt.Errorf("writer still busy after %s, saved %d unwritten events to %s", timeout, len(unwritten), recoveryFile)
+}
+
+// unwritten empties the closed queue, returning the event being written,
+// if any, followed by those the writer hasn't taken. The writer may still
+// finish some of them, so they can end up logged twice.
+func (q *eventQueue) unwritten() []Event {
+	var events []Event
+	q.mu.Lock()
+	if q.writing != nil {
+		events = append(events, *q.writing)
+	}
+	q.mu.Unlock()
+
+	for e := range q.events {
+		if e.flushed != nil {
+			// Nothing will answer the flush now.
+			e.flushed <- errLoggerStopped
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// checkRecovered fails if the store would now refuse events, a record of
+// the recovery file: with ErrImmutable for a put or delete of an
+// immutable key, with ErrKeyExists for creating an immutable key that
+// already exists, and with ErrQuotaExceeded for a net change taking a namespace past its quota.
+// Creating an immutable key with the value it already holds is let
+// through, as the event may have reached the log before the logger got
+// stuck. The caller must hold at least the store's read lock.
+func checkRecovered(events []Event) error {
+	pending := make(map[string]*string)
+	for _, e := range events {
+		if _, ok := pending[e.Key]; !ok {
+			if err := checkRecoveredEvent(e); err != nil {
+				return fmt.Errorf("key %s: %w", e.Key, err)
+			}
+		}
+		value := e.Value
+		if e.EventType == EventDelete {
+			pending[e.Key] = nil
+		} else {
+			pending[e.Key] = &value
+		}
+	}
+
+	delta := make(usageDelta)
+	for key, v := range pending {
+		old, existed := storedSize(key)
+		switch {
+		case v != nil:
+			delta.put(key, old, existed, len(*v))
+		case existed:
+			delta.remove(key, old)
+		}
+	}
+	return delta.check()
+}
+
+// checkRecoveredEvent checks the first event of a record on e.Key against
+// the key as the store holds it.
+func checkRecoveredEvent(e Event) error {
+	if e.EventType != EventPutImmutable {
+		return mutable(e.Key)
+	}
+
+	value, exists, err := store.data.get(e.Key)
+	if err != nil || !exists {
+		return err
+	}
+	if mutable(e.Key) == nil {
+		return ErrKeyExists
+	}
+	if value != e.Value {
+		return ErrImmutable
+	}
+	return nil
+}
+
+// recoveryRecord is a line of the recovery file: a single event, or the
+// events of a batch, which are logged again as one.
+type recoveryRecord struct {
+	Batch  bool            `json:"batch,omitempty"`
+	Events []recoveryEvent `json:"events"`
+}
+
+type recoveryEvent struct {
+	Type  EventType `json:"type"`
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+}
+
+// saveRecovery appends events, as taken from a logger's queue, to the
+// recovery file at path and syncs it, since it holds the only copy of
+// them. Several loggers may save to the same file.
+func saveRecovery(path string, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var lines []byte
+	for _, e := range events {
+		rec := recoveryRecord{Batch: e.batch != nil}
+		batch := e.batch
+		if batch == nil {
+			batch = []Event{e}
+		}
+		for _, b := range batch {
+			rec.Events = append(rec.Events, recoveryEvent{Type: b.EventType, Key: b.Key, Value: b.Value})
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recoverEvents applies the events saved in the recovery file at path to
+// the store and logs them again, in the order they were written, then
+// removes the file. It runs after the log has been replayed, as the
+// events came after everything in it. Some of them may have made it into
+// the log before the logger got stuck; applying and logging them again
+// leaves the store as it was, since every event sets or deletes a key
+// outright. The number of events recovered is returned.
+//
+// The events were checked when they were first written, but the store
+// they are applied to now is the one rebuilt from the log, so they are
+// checked again. A record with an event that would now be refused, such
+// as a put to a key that is immutable in the log, is dead-lettered
+// rather than applied, the whole of it for a batch.
+func recoverEvents(tl TransactionLogger, path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot open recovery file: %w", err)
+	}
+	defer f.Close()
+
+	var records []recoveryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var rec recoveryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return 0, fmt.Errorf("malformed recovery file %s, line %d: %w", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("cannot read recovery file: %w", err)
+	}
+
+	n := 0
+	for _, rec := range records {
+		events := make([]Event, len(rec.Events))
+		for i, e := range rec.Events {
+			events[i] = Event{EventType: e.Type, Key: normalizeKey(e.Key), Value: e.Value}
+		}
+
+		store.RLock()
+		err := checkRecovered(events)
+		store.RUnlock()
+		if err != nil {
+			slog.Warn("not recovering events the store now refuses", "events", len(events), "err", err)
+			deadLetter(events, fmt.Errorf("recovered events refused: %w", err))
+			continue
+		}
+
+		// As with any write, the events are logged before they are
+		// applied.
+		if rec.Batch {
+			tl.WriteBatch(events)
+		} else {
+			for _, e := range events {
+				switch e.EventType {
+				case EventPut:
+					tl.WritePut(e.Key, e.Value)
+				case EventPutImmutable:
+					tl.WritePutImmutable(e.Key, e.Value)
+				case EventDelete:
+					tl.WriteDelete(e.Key)
+				}
+			}
+		}
+		if err := applyEvents(events); err != nil {
+			return n, fmt.Errorf("failed to apply recovered event: %w", err)
+		}
+		n += len(events)
+	}
+
+	// The file is only removed once its events are safely logged, so a
+	// failure here recovers them again next time.
+	if err := tl.Flush(); err != nil {
+		return n, fmt.Errorf("failed to log recovered events: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Remove(path); err != nil {
+		return n, fmt.Errorf("cannot remove recovery file: %w", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecoverEventsOfWedgedLogger(t *testing.T) {
+	withStore(t, make(map[string]string))
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "transaction.log")
+	recoveryFile := filepath.Join(dir, "transaction.recovery")
+	options := FileLoggerOptions{CloseTimeout: 50 * time.Millisecond, RecoveryFile: recoveryFile}
+
+	tl, err := NewTransactionLoggerWithOptions(logFile, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ftl := tl.(*FileTransactionLogger)
+	ftl.Run()
+	ftl.WritePut("a", "1")
+	if err := ftl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding the logger's lock wedges its writer on the next event
+	// until the test ends.
+	ftl.mu.Lock()
+	defer ftl.mu.Unlock()
+	ftl.WritePut("b", "2")
+	ftl.WriteBatch([]Event{{EventType: EventPut, Key: "c", Value: "3"}, {EventType: EventDelete, Key: "a"}})
+	ftl.WritePutImmutable("d", "4")
+	if err := ftl.Close(); err == nil {
+		t.Fatal("expected Close to report the wedged writer")
+	}
+	if _, err := os.Stat(recoveryFile); err != nil {
+		t.Fatalf("expected a recovery file: %v", err)
+	}
+
+	// Restart from what reached the log, then recover the rest.
+	restart := func() *FileTransactionLogger {
+		t.Helper()
+		withStore(t, make(map[string]string))
+		tl, err := NewTransactionLoggerWithOptions(logFile, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := replayEvents(tl, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		tl.Run()
+		return tl.(*FileTransactionLogger)
+	}
+	restarted := restart()
+	if got := fmt.Sprint(storeMap()); got != "map[a:1]" {
+		t.Errorf("expected only a in the log, got %s", got)
+	}
+	n, err := recoverEvents(restarted, recoveryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 events recovered, got %d", n)
+	}
+	const want = "map[b:2 c:3 d:4]"
+	if got := fmt.Sprint(storeMap()); got != want {
+		t.Errorf("expected %s after recovery, got %s", want, got)
+	}
+	if _, err := os.Stat(recoveryFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the recovery file to be removed, got %v", err)
+	}
+	if err := restarted.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recovered events are in the log now.
+	restarted = restart()
+	defer restarted.Close()
+	if got := fmt.Sprint(storeMap()); got != want {
+		t.Errorf("expected %s after the next replay, got %s", want, got)
+	}
+	if err := mutable("d"); !errors.Is(err, ErrImmutable) {
+		t.Error("expected d to be recovered as immutable")
+	}
+}
+
+func TestRecoverRechecksEvents(t *testing.T) {
+	withStore(t, map[string]string{"d": "4"})
+	store.meta["d"].Immutable = true
+	d := withDeadLetters(t)
+
+	recoveryFile := filepath.Join(t.TempDir(), "transaction.recovery")
+	err := saveRecovery(recoveryFile, []Event{
+		{EventType: EventPut, Key: "d", Value: "5"},
+		{batch: []Event{{EventType: EventPut, Key: "c", Value: "3"}, {EventType: EventDelete, Key: "d"}}},
+		{EventType: EventPutImmutable, Key: "d", Value: "4"},
+		{EventType: EventPut, Key: "e", Value: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The put and the batch touching the immutable key are refused, the
+	// batch as a whole. Creating it again with its value, as an event
+	// that reached the log before the logger got stuck would, isn't.
+	tl := NewMemoryTransactionLogger()
+	n, err := recoverEvents(tl, recoveryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 events recovered, got %d", n)
+	}
+	const want = "map[d:4 e:1]"
+	if got := fmt.Sprint(storeMap()); got != want {
+		t.Errorf("expected %s after recovery, got %s", want, got)
+	}
+	if mutable("d") == nil {
+		t.Error("expected d to stay immutable")
+	}
+	if logged := tl.Events(); len(logged) != 2 || logged[0].Key != "d" || logged[1].Key != "e" {
+		t.Errorf("expected only the accepted events logged, got %+v", logged)
+	}
+
+	letters, err := d.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 dead letters, got %+v", letters)
+	}
+	var ops int
+	for _, l := range letters {
+		ops += len(l.Ops)
+	}
+	if ops != 3 {
+		t.Errorf("expected the put and both events of the batch dead-lettered, got %+v", letters)
+	}
+}
+
+func TestCloseWakesBlockedSenders(t *testing.T) {
+	withStore(t, make(map[string]string))
+	d := withDeadLetters(t)
+	recoveryFile := filepath.Join(t.TempDir(), "transaction.recovery")
+
+	// No writer takes from the queue, so once it is full a send waits,
+	// and the writer never exits.
+	q := newEventQueue(1)
+	done := make(chan struct{})
+	q.send(Event{EventType: EventPut, Key: "a", Value: "1"}, done)
+	sent := make(chan struct{})
+	go func() {
+		q.send(Event{EventType: EventPut, Key: "b", Value: "2"}, done)
+		close(sent)
+	}()
+	flushed := make(chan error, 1)
+	go func() { flushed <- flushEvents(q, done) }()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := q.close(done, 10*time.Millisecond, recoveryFile); err == nil {
+		t.Error("expected close to report the writer still busy")
+	}
+	<-sent
+	if err := <-flushed; !errors.Is(err, errLoggerStopped) {
+		t.Errorf("expected the waiting flush to fail with %v, got %v", errLoggerStopped, err)
+	}
+
+	// The queued event is saved for recovery and the waiting one
+	// dead-lettered.
+	if _, err := recoverEvents(NewMemoryTransactionLogger(), recoveryFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(storeMap()); got != "map[a:1]" {
+		t.Errorf("expected a to be recovered, got %s", got)
+	}
+	letters, err := d.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || len(letters[0].Ops) != 1 || letters[0].Ops[0].Key != "b" {
+		t.Errorf("expected b to be dead-lettered, got %+v", letters)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// configArgs are the command line arguments the configuration was parsed
+// from, which are parsed again on reload so that they still take
+// precedence over the -config file.
+var configArgs []string
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// reloadableFlags are the settings a reload applies to the running
+// server. Changes to any other setting only take effect on restart.
+var reloadableFlags = map[string]func(fresh *Config){
+	"log-level": func(fresh *Config) {
+		config.LogLevel = fresh.LogLevel
+		setLogLevel(fresh.LogLevel)
+	},
+	"verbose": func(fresh *Config) { config.Verbose = fresh.Verbose },
+	"slow-op-threshold": func(fresh *Config) {
+		config.SlowOpThreshold = fresh.SlowOpThreshold
+		slowOpThreshold.Store(int64(fresh.SlowOpThreshold))
+	},
+	"max-concurrent-writes": func(fresh *Config) {
+		config.MaxConcurrentWrites = fresh.MaxConcurrentWrites
+		writeLimits.Store(newWriteLimiter(fresh.MaxConcurrentWrites, fresh.MaxQueuedWrites))
+	},
+	"max-queued-writes": func(fresh *Config) {
+		config.MaxQueuedWrites = fresh.MaxQueuedWrites
+		writeLimits.Store(newWriteLimiter(fresh.MaxConcurrentWrites, fresh.MaxQueuedWrites))
+	},
+	"read-only": func(fresh *Config) {
+		config.ReadOnly = fresh.ReadOnly
+		readOnlyConfigured.Store(fresh.ReadOnly)
+	},
+}
+
+// reloadConfig parses the command line and the -config file again and
+// applies the reloadable settings that changed. It returns the names of
+// the flags applied and of those that changed but need a restart. If the
+// configuration doesn't parse, nothing is applied.
+func reloadConfig() (applied, restart []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fresh := defaultConfig
+	freshFlags := flag.NewFlagSet("kvstore", flag.ContinueOnError)
+	freshFlags.SetOutput(io.Discard)
+	if err := parseConfig(&fresh, freshFlags, configArgs); err != nil {
+		return nil, nil, err
+	}
+
+	live := config
+	liveFlags := flag.NewFlagSet("kvstore", flag.ContinueOnError)
+	registerFlags(&live, liveFlags)
+
+	freshFlags.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == liveFlags.Lookup(f.Name).Value.String() {
+			return
+		}
+		if apply, ok := reloadableFlags[f.Name]; ok {
+			apply(&fresh)
+			applied = append(applied, f.Name)
+		} else {
+			restart = append(restart, f.Name)
+		}
+	})
+	sort.Strings(applied)
+	sort.Strings(restart)
+
+	return applied, restart, nil
+}
+
+// reloadHandler reloads the configuration and reports which settings
+// were applied and which need a restart.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	applied, restart, err := reloadConfig()
+	if err != nil {
+		slog.Error("configuration reload failed", "err", err)
+		http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("configuration reloaded", "applied", applied, "restart_required", restart)
+
+	if applied == nil {
+		applied = []string{}
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restart_required"`
+	}{applied, restart})
+}
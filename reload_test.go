@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	savedConfig, savedArgs := config, configArgs
+	t.Cleanup(func() {
+		config, configArgs = savedConfig, savedArgs
+		readOnlyConfigured.Store(false)
+		setLogLevel("info")
+	})
+
+	file := filepath.Join(t.TempDir(), "kvstore.conf")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("# start writable\nread-only = false\n")
+
+	configArgs = []string{"-config", file, "-addr", ":5000"}
+	if err := parseTestFlags(t, configArgs...); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter()
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader("value")))
+		return rec
+	}
+	if rec := request(http.MethodPut, "/v1/key"); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT before reload: status %d", rec.Code)
+	}
+
+	// The command line still wins over the file, so addr isn't changed.
+	writeConfig("read-only = true\nlog-level = debug\naddr = :6000\nidle-timeout = 1m\n")
+	rec := request(http.MethodPost, "/admin/reload")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload: status %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restart_required"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"log-level", "read-only"}; !reflect.DeepEqual(got.Applied, want) {
+		t.Errorf("applied %v, want %v", got.Applied, want)
+	}
+	if want := []string{"idle-timeout"}; !reflect.DeepEqual(got.RestartRequired, want) {
+		t.Errorf("restart required for %v, want %v", got.RestartRequired, want)
+	}
+
+	if rec := request(http.MethodPut, "/v1/key"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT after reload: expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec := request(http.MethodGet, "/v1/key"); rec.Code != http.StatusOK {
+		t.Errorf("GET after reload: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if config.Addr != ":5000" {
+		t.Errorf("addr changed to %q", config.Addr)
+	}
+
+	// A file that doesn't parse changes nothing.
+	writeConfig("read-only = false\nmax-concurrent-writes = many\n")
+	if rec := request(http.MethodPost, "/admin/reload"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("bad reload: expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if !config.ReadOnly || !readOnlyConfigured.Load() {
+		t.Error("a failed reload changed the read-only setting")
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "kvstore.conf")
+	content := "# comment\n\nmax-prefix-results = 10\ncompact-records=5\naddr = :7000\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parseTestFlags(t, "-config", file, "-addr", ":5000"); err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxPrefixResults != 10 || config.CompactRecords != 5 {
+		t.Errorf("settings from the file weren't applied: %+v", config)
+	}
+	if config.Addr != ":5000" {
+		t.Errorf("expected the command line to win, got addr %q", config.Addr)
+	}
+
+	// Flags set in the file count towards backend conflicts.
+	if err := parseTestFlags(t, "-config", file, "-backend", "postgres"); err == nil {
+		t.Error("expected a backend conflict with compact-records from the file")
+	}
+
+	for _, bad := range []string{"no-equals-sign\n", "unknown-flag = 1\n", "config = other.conf\n"} {
+		if err := os.WriteFile(file, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := parseTestFlags(t, "-config", file); err == nil {
+			t.Errorf("expected an error for config file %q", bad)
+		}
+	}
+}
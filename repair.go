@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ReplayErrorPolicy selects what reading the file log does with a bad
+// record: one that can't be parsed or is out of sequence.
+type ReplayErrorPolicy string
+
+const (
+	// ReplayAbort stops reading with an error. It is the default.
+	ReplayAbort ReplayErrorPolicy = "abort"
+	// ReplaySkip logs the record and reads on without it. A bad record
+	// inside a batch drops the whole batch.
+	ReplaySkip ReplayErrorPolicy = "skip"
+	// ReplayRepair skips bad records as ReplaySkip does, then cuts them
+	// out of the log when the logger is started, so that they aren't met
+	// again on the next startup. What is cut out is appended to a
+	// .rejected file next to the log.
+	ReplayRepair ReplayErrorPolicy = "repair"
+)
+
+// byteRange is the part of a file from start up to but not including end.
+type byteRange struct {
+	start, end int64
+}
+
+// repair rewrites the log without the byte ranges in rejected, which are
+// in order and don't overlap, appending them to the .rejected file
+// instead. Like compaction, it writes the new log beside the old one and
+// renames it into place.
+func (ftl *FileTransactionLogger) repair(rejected []byteRange) error {
+	src, err := os.Open(ftl.filename)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log: %w", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	bad, err := os.OpenFile(ftl.filename+".rejected", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open rejected records file: %w", err)
+	}
+	defer bad.Close()
+
+	tmpName := ftl.filename + ".repair"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create repaired log: %w", err)
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+
+	copyRange := func(dst io.Writer, start, end int64) error {
+		_, err := io.Copy(dst, io.NewSectionReader(src, start, end-start))
+		return err
+	}
+
+	var kept int64
+	for _, r := range rejected {
+		if err = copyRange(tmp, kept, r.start); err != nil {
+			break
+		}
+		if err = copyRange(bad, r.start, r.end); err != nil {
+			break
+		}
+		kept = r.end
+	}
+	if err == nil {
+		err = copyRange(tmp, kept, info.Size())
+	}
+	if err == nil {
+		err = bad.Sync()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write repaired log: %w", err)
+	}
+
+	if err := os.Rename(tmpName, ftl.filename); err != nil {
+		return fmt.Errorf("failed to replace transaction log: %w", err)
+	}
+
+	file, err := os.OpenFile(ftl.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot reopen transaction log: %w", err)
+	}
+	ftl.file.Close()
+	ftl.file = file
+	ftl.writer.Reset(file)
+
+	return nil
+}
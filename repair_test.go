@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// badRecordLog has one bad record between two good ones, and a batch
+// holding a record that is out of sequence.
+const badRecordLog = "1\t2\tkey-a\tone\n" +
+	"not a record\n" +
+	"2\t2\tkey-b\ttwo\n" +
+	"3\t3\t\t2\n" +
+	"4\t2\tkey-c\tthree\n" +
+	"1\t2\tkey-d\tfour\n" +
+	"5\t1\tkey-a\t\n"
+
+func TestReplayOnErrorAbort(t *testing.T) {
+	filename := writeLogFile(t, badRecordLog)
+
+	events, err := readAll(t, filename, FileLoggerOptions{OnError: ReplayAbort})
+	if err == nil {
+		t.Fatal("expected the bad record to stop the replay")
+	}
+	if len(events) != 1 {
+		t.Errorf("expected only the event before the bad record, got %+v", events)
+	}
+}
+
+func TestReplayOnErrorSkip(t *testing.T) {
+	filename := writeLogFile(t, badRecordLog)
+
+	events, err := readAll(t, filename, FileLoggerOptions{OnError: ReplaySkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Sequence: 1, EventType: EventPut, Key: "key-a", Value: "one"},
+		{Sequence: 2, EventType: EventPut, Key: "key-b", Value: "two"},
+		{Sequence: 5, EventType: EventDelete, Key: "key-a"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %+v, want %+v", events, want)
+	}
+
+	// Skipping leaves the log as it was.
+	content, _ := os.ReadFile(filename)
+	if string(content) != badRecordLog {
+		t.Errorf("skip changed the log to %q", content)
+	}
+}
+
+func TestReplayOnErrorRepair(t *testing.T) {
+	filename := writeLogFile(t, badRecordLog)
+
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{OnError: ReplayRepair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, errs := tl.ReadEvents()
+	n := 0
+	for range events {
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 events replayed, got %d", n)
+	}
+	tl.Run()
+	tl.WritePut("key-e", "five")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filename)
+	want := "1\t2\tkey-a\tone\n2\t2\tkey-b\ttwo\n5\t1\tkey-a\t\n6\t2\tkey-e\tfive\n"
+	if string(content) != want {
+		t.Errorf("got repaired log %q, want %q", content, want)
+	}
+	rejected, _ := os.ReadFile(filename + ".rejected")
+	if want := "not a record\n3\t3\t\t2\n4\t2\tkey-c\tthree\n1\t2\tkey-d\tfour\n"; string(rejected) != want {
+		t.Errorf("got rejected records %q, want %q", rejected, want)
+	}
+
+	// The repaired log replays cleanly even under abort.
+	if _, err := readAll(t, filename, FileLoggerOptions{}); err != nil {
+		t.Errorf("repaired log still fails to replay: %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// replayProgressEvery is how many events are replayed between progress
+// reports.
+const replayProgressEvery = 100000
+
+// ReplayProgress reports how far a replay of the transaction log has got.
+type ReplayProgress struct {
+	Events int   // events applied so far
+	Bytes  int64 // bytes of the log applied so far, if the logger knows its size
+	Total  int64 // size of the whole log in bytes, or 0 if unknown
+	Done   bool  // set on the final report
+}
+
+// Percent estimates how much of the log has been replayed, returning -1
+// when the size of the log is unknown.
+func (p ReplayProgress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+
+	return float64(p.Bytes) * 100 / float64(p.Total)
+}
+
+// sizedLogger is implemented by loggers that can tell how large their
+// log is, which lets replay estimate its progress.
+type sizedLogger interface {
+	Size() (int64, error)
+}
+
+// versionedLogger is implemented by loggers that keep the version of
+// every key durably, apart from the events.
+type versionedLogger interface {
+	Versions() (map[string]uint64, error)
+}
+
+// restoreVersions sets the versions of the keys in the store to those
+// recorded by tl, if it records them. Counting writes during replay only
+// gets them right when the whole log is replayed, which the bbolt store
+// and snapshots skip.
+func restoreVersions(tl TransactionLogger) error {
+	vl, ok := tl.(versionedLogger)
+	if !ok {
+		return nil
+	}
+
+	versions, err := vl.Versions()
+	if err != nil {
+		return fmt.Errorf("failed to read key versions: %w", err)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	for key, meta := range store.meta {
+		if v, ok := versions[key]; ok {
+			meta.Version = v
+		}
+	}
+
+	return nil
+}
+
+// replayEvents applies every event read from tl to the store. progress,
+// if not nil, is called every `every` events and once more when the
+// replay finishes.
+func replayEvents(tl TransactionLogger, every int, progress func(ReplayProgress)) (int, error) {
+	return replayEventsAfter(tl, 0, every, progress)
+}
+
+// replayEventsAfter is like replayEvents, but skips events with sequence
+// numbers up to and including after, which the store already reflects.
+// Skipped events count towards the bytes replayed but not the events.
+func replayEventsAfter(tl TransactionLogger, after uint64, every int, progress func(ReplayProgress)) (int, error) {
+	return replayEventsContext(context.Background(), tl, after, every, progress)
+}
+
+// replayEventsContext is like replayEventsAfter, but gives up with an error
+// once ctx is done. The events replayed until then stay in the store.
+func replayEventsContext(ctx context.Context, tl TransactionLogger, after uint64, every int, progress func(ReplayProgress)) (int, error) {
+	var p ReplayProgress
+	if s, ok := tl.(sizedLogger); ok {
+		if size, err := s.Size(); err == nil {
+			p.Total = size
+		}
+	}
+
+	// The fast path replays into a copy of the store nothing else can
+	// see, taking no locks, and installs it once the replay is over.
+	// Stores that keep their data on disk are replayed in place.
+	apply := applyEvent
+	var fresh *freshReplay
+	if config.FastReplay {
+		if fresh = newFreshReplay(); fresh != nil {
+			apply = fresh.apply
+		}
+	}
+
+	// The blobs the log refers to, skipped events included, are kept for
+	// the next replay.
+	logged := make(map[string]bool)
+	defer keepLoggedBlobs(logged)
+
+	events, errors := tl.ReadEvents()
+	ok, e := true, Event{}
+	var err error
+
+	for ok && err == nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("replay stopped after %d events: %w", p.Events, ctx.Err())
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			// Checked again at the top of the loop.
+		case err, ok = <-errors: //retrieving any errors
+		case e, ok = <-events:
+			if !ok {
+				// The loggers close the error channel before the event
+				// channel, so this doesn't block, and picks up an error
+				// the select would otherwise have lost to the close.
+				err = <-errors
+				break
+			}
+			if ref, err := parseBlobRef(e.Value); e.blob && err == nil {
+				logged[ref.name] = true
+			}
+			if e.Sequence <= after {
+				p.Bytes += e.size
+				continue
+			}
+			e.Key = normalizeKey(e.Key)
+			err = apply(e)
+
+			p.Events++
+			p.Bytes += e.size
+			if progress != nil && every > 0 && p.Events%every == 0 {
+				progress(p)
+			}
+		}
+	}
+
+	// What was replayed before a failure is kept, as it is when
+	// replaying in place.
+	if fresh != nil {
+		if installErr := fresh.install(); err == nil {
+			err = installErr
+		}
+	}
+
+	if progress != nil {
+		p.Done = true
+		progress(p)
+	}
+
+	return p.Events, err
+}
+
+// freshReplay is a memory store being rebuilt from the log apart from the
+// live one, so that replay takes no locks. It starts from a copy of the
+// live store, which may hold a snapshot, and keeps the metadata that
+// set, remove and stampEvent would.
+type freshReplay struct {
+	data       memoryBackend
+	meta       map[string]*Metadata
+	tombstones map[string]time.Time
+}
+
+// newFreshReplay copies the store for a fast replay, or returns nil if
+// its backend isn't the memory one.
+func newFreshReplay() *freshReplay {
+	store.RLock()
+	defer store.RUnlock()
+
+	data, ok := store.data.(memoryBackend)
+	if !ok {
+		return nil
+	}
+	r := &freshReplay{
+		data:       make(memoryBackend, len(data)),
+		meta:       make(map[string]*Metadata, len(store.meta)),
+		tombstones: make(map[string]time.Time, len(store.tombstones)),
+	}
+	for k, v := range data {
+		r.data[k] = v
+	}
+	for k, meta := range store.meta {
+		copied := *meta
+		r.meta[k] = &copied
+	}
+	for k, t := range store.tombstones {
+		r.tombstones[k] = t
+	}
+
+	return r
+}
+
+// apply applies e to the copy.
+func (r *freshReplay) apply(e Event) error {
+	now := time.Now()
+
+	switch e.EventType {
+	case EventDelete:
+		if _, ok := r.data[e.Key]; !ok {
+			return nil
+		}
+		delete(r.data, e.Key)
+		delete(r.meta, e.Key)
+		if config.TombstoneRetention > 0 {
+			r.tombstones[e.Key] = now
+		}
+	case EventPut, EventPutImmutable:
+		value, err := eventValue(e)
+		if err != nil {
+			return err
+		}
+		meta, exists := r.meta[e.Key]
+		if !exists {
+			meta = &Metadata{Created: now}
+			r.meta[e.Key] = meta
+		}
+		r.data[e.Key] = value
+		meta.Version++
+		meta.Updated = now
+		meta.ContentType = ""
+		if !e.Time.IsZero() {
+			meta.Updated = e.Time
+			if !exists {
+				meta.Created = e.Time
+			}
+		}
+		if e.EventType == EventPutImmutable {
+			meta.Immutable = true
+		}
+		delete(r.tombstones, e.Key)
+	}
+
+	return nil
+}
+
+// install makes the copy the store, as loadSnapshot does with the
+// snapshot it reads.
+func (r *freshReplay) install() error {
+	if err := useBackend(r.data); err != nil {
+		return err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	for k, meta := range store.meta {
+		replayed := r.meta[k]
+		meta.Version = replayed.Version
+		meta.Created, meta.Updated = replayed.Created, replayed.Updated
+		meta.ContentType = replayed.ContentType
+		meta.Immutable = replayed.Immutable
+	}
+	store.tombstones = r.tombstones
+
+	return nil
+}
+
+// applyEvent applies e to the store.
+func applyEvent(e Event) error {
+	store.Lock()
+	defer store.Unlock()
+
+	return applyEventLocked(e)
+}
+
+// applyEventLocked applies e to the store. The caller must hold the
+// store's write lock. Immutable keys aren't protected from the log's
+// events: a store that is ahead of its checkpoint replays writes made
+// before a key was deleted and created again as immutable. If the log
+// recorded when e was logged, the key's timestamps are taken from it.
+func applyEventLocked(e Event) error {
+	return store.data.update(func(w kvWriter) error {
+		return applyEventTo(w, e)
+	})
+}
+
+// applyEvents applies events to the store in one step, so that readers
+// see all of them or none. It is how checked writes of several keys,
+// transactions and restores, are made once their events are logged.
+func applyEvents(events []Event) error {
+	store.Lock()
+	defer store.Unlock()
+
+	return applyEventsLocked(events)
+}
+
+// applyEventsLocked is applyEvents for a caller holding the store's write
+// lock. The values are staged first, so that a blob store can't fail
+// with some of the events applied.
+func applyEventsLocked(events []Event) error {
+	var values []string
+	for _, e := range events {
+		if !e.blob && (e.EventType == EventPut || e.EventType == EventPutImmutable) {
+			values = append(values, e.Value)
+		}
+	}
+	if err := stageValues(values); err != nil {
+		return err
+	}
+
+	return store.data.update(func(w kvWriter) error {
+		for _, e := range events {
+			if err := applyEventTo(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// applyEventTo applies e through w. The caller must hold the store's
+// write lock.
+func applyEventTo(w kvWriter, e Event) error {
+	switch e.EventType {
+	case EventDelete:
+		return remove(w, e.Key)
+	case EventPut:
+		created, err := putEvent(w, e)
+		stampEvent(e, created)
+		return err
+	case EventPutImmutable:
+		created, err := putEvent(w, e)
+		if err != nil {
+			return err
+		}
+		stampEvent(e, created)
+		return makeImmutable(w, e.Key)
+	}
+	return nil
+}
+
+// stampEvent sets the timestamps of the key e put to the time e was
+// logged, if the log recorded it, its creation time too if e created it.
+// The caller must hold the store's write lock.
+func stampEvent(e Event, created bool) {
+	meta := store.meta[e.Key]
+	if e.Time.IsZero() || meta == nil {
+		return
+	}
+	meta.Updated = e.Time
+	if created {
+		meta.Created = e.Time
+	}
+}
+
+// logReplayProgress is the progress callback used at startup.
+func logReplayProgress(p ReplayProgress) {
+	switch {
+	case p.Done:
+		slog.Info("transaction log replayed", "events", p.Events)
+	case p.Percent() >= 0:
+		slog.Info("replaying transaction log", "events", p.Events, "percent", fmt.Sprintf("%.1f", p.Percent()))
+	default:
+		slog.Info("replaying transaction log", "events", p.Events)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayProgress(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	var log strings.Builder
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&log, "%d\t2\tkey-%d\tvalue %d\n", i, i%10, i)
+	}
+	tl, err := NewTransactionLogger(writeLogFile(t, log.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var reports []ReplayProgress
+	count, err := replayEvents(tl, 100, func(p ReplayProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1000 {
+		t.Errorf("expected 1000 events replayed, got %d", count)
+	}
+
+	if len(reports) != 11 {
+		t.Fatalf("expected 10 progress reports and a final one, got %d", len(reports))
+	}
+	for i, p := range reports[:10] {
+		if p.Events != (i+1)*100 || p.Done {
+			t.Errorf("report %d: unexpected progress %+v", i, p)
+		}
+		if i > 0 && p.Percent() <= reports[i-1].Percent() {
+			t.Errorf("report %d: percentage did not increase: %+v", i, p)
+		}
+	}
+
+	final := reports[10]
+	if !final.Done || final.Events != 1000 || final.Percent() != 100 {
+		t.Errorf("unexpected final report %+v (%.1f%%)", final, final.Percent())
+	}
+	if len(storeMap()) != 10 {
+		t.Errorf("expected 10 keys after replay, got %d", len(storeMap()))
+	}
+}
+
+func TestReplayProgressJSON(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	// The JSON format's records are much longer than the tab format's,
+	// and the header and batch markers hold no events of their own.
+	filename := writeLogFile(t, "#kvstore-log format=json version=1\n"+
+		`{"seq":1,"type":"PUT","key":"a","value":"one"}`+"\n"+
+		`{"seq":2,"type":"BEGIN","value":"2"}`+"\n"+
+		`{"seq":3,"type":"PUT","key":"b","value":"two"}`+"\n"+
+		`{"seq":4,"type":"DELETE","key":"a"}`+"\n")
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var reports []ReplayProgress
+	if _, err := replayEvents(tl, 1, func(p ReplayProgress) {
+		reports = append(reports, p)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, final := reports[0], reports[len(reports)-1]
+	if first.Events != 1 || first.Bytes != int64(len("#kvstore-log format=json version=1\n")+len(`{"seq":1,"type":"PUT","key":"a","value":"one"}`+"\n")) {
+		t.Errorf("unexpected first report %+v", first)
+	}
+	if !final.Done || final.Bytes != final.Total || final.Percent() != 100 {
+		t.Errorf("unexpected final report %+v (%.1f%%)", final, final.Percent())
+	}
+}
+
+// pagedLogger serves its events through readPages, the way the postgres
+// logger reads its table.
+type pagedLogger struct {
+	*MemoryTransactionLogger
+	rows     []Event
+	pageSize int
+	prefetch int
+	fetches  int
+}
+
+func (l *pagedLogger) fetch(after uint64, limit int) ([]Event, error) {
+	l.fetches++
+	i := sort.Search(len(l.rows), func(i int) bool { return l.rows[i].Sequence > after })
+	end := i + limit
+	if end > len(l.rows) {
+		end = len(l.rows)
+	}
+	return l.rows[i:end], nil
+}
+
+func (l *pagedLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		if err := readPages(l.fetch, l.pageSize, l.prefetch, func(e Event) { outEvent <- e }); err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func TestReplayPaged(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	tl := &pagedLogger{MemoryTransactionLogger: NewMemoryTransactionLogger(), pageSize: 1000, prefetch: 2}
+	for seq := uint64(1); seq <= 25000; seq++ {
+		e := Event{Sequence: seq, EventType: EventPut, Key: fmt.Sprintf("key-%d", seq%100), Value: fmt.Sprint(seq)}
+		if seq%7 == 0 {
+			e.EventType, e.Value = EventDelete, ""
+		}
+		tl.rows = append(tl.rows, e)
+	}
+
+	count, err := replayEvents(tl, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 25000 {
+		t.Errorf("expected 25000 events replayed, got %d", count)
+	}
+	if tl.fetches != 26 {
+		t.Errorf("expected 25 full pages and an empty one, got %d fetches", tl.fetches)
+	}
+
+	// Every key's final state is decided by its last event, which only
+	// comes out right if the pages were applied in order.
+	want := make(map[string]string)
+	for _, e := range tl.rows {
+		if e.EventType == EventDelete {
+			delete(want, e.Key)
+		} else {
+			want[e.Key] = e.Value
+		}
+	}
+	if fmt.Sprint(storeMap()) != fmt.Sprint(want) {
+		t.Errorf("unexpected state after paged replay")
+	}
+}
+
+func TestReadPagesError(t *testing.T) {
+	fetch := func(after uint64, limit int) ([]Event, error) {
+		if after > 0 {
+			return nil, fmt.Errorf("connection reset")
+		}
+		return []Event{{Sequence: 1}, {Sequence: 2}}, nil
+	}
+
+	var emitted int
+	err := readPages(fetch, 2, 1, func(Event) { emitted++ })
+	if err == nil {
+		t.Error("expected the fetch error to be returned")
+	}
+	if emitted != 2 {
+		t.Errorf("expected the first page to be emitted, got %d events", emitted)
+	}
+}
+
+func TestFastReplayMatchesLocked(t *testing.T) {
+	logged := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := replayBenchEvents(10000)
+	events = append(events,
+		Event{Sequence: 10001, EventType: EventPutImmutable, Key: "frozen", Value: "v"},
+		Event{Sequence: 10002, EventType: EventPut, Key: "stamped", Value: "v", Time: logged},
+	)
+
+	states := make([]string, 2)
+	for i, fast := range []bool{false, true} {
+		// The store starts out with a key, as it would from a snapshot.
+		withStore(t, map[string]string{"key-0": "from snapshot", "kept": "v"})
+		saved := config.FastReplay
+		config.FastReplay = fast
+
+		if _, err := replayEvents(NewMemoryTransactionLogger(events...), 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		var meta []string
+		for _, key := range []string{"key-0", "key-1", "kept", "frozen", "stamped"} {
+			_, m, _ := GetWithMetadata(key)
+			meta = append(meta, fmt.Sprintf("%s: version %d, immutable %v, size %d", key, m.Version, m.Immutable, m.Size))
+		}
+		_, m, _ := GetWithMetadata("stamped")
+		if !m.Created.Equal(logged) || !m.Updated.Equal(logged) {
+			t.Errorf("fast=%v: expected stamped to keep the time it was logged, got %v and %v", fast, m.Created, m.Updated)
+		}
+		states[i] = fmt.Sprint(storeMap(), Stats(), meta)
+		config.FastReplay = saved
+	}
+
+	if states[0] != states[1] {
+		t.Error("fast replay built a different store than locked replay")
+	}
+}
+
+// gatedLogger hands out the events sent on events, for tests to pace a
+// replay.
+type gatedLogger struct {
+	TransactionLogger
+	events chan Event
+	errors chan error
+}
+
+func (l gatedLogger) ReadEvents() (<-chan Event, <-chan error) { return l.events, l.errors }
+
+func TestFastReplayLeavesStoreUnlocked(t *testing.T) {
+	withStore(t, map[string]string{"old": "v"})
+	saved := config.FastReplay
+	config.FastReplay = true
+	defer func() { config.FastReplay = saved }()
+
+	tl := gatedLogger{events: make(chan Event), errors: make(chan error)}
+	done := make(chan error, 1)
+	go func() {
+		_, err := replayEvents(tl, 0, nil)
+		done <- err
+	}()
+	tl.events <- Event{Sequence: 1, EventType: EventPut, Key: "new", Value: "v"}
+	tl.events <- Event{Sequence: 2, EventType: EventDelete, Key: "old"}
+
+	// Mid-replay the live store is neither locked nor changed.
+	if !store.TryLock() {
+		t.Fatal("the store is locked during a fast replay")
+	}
+	store.Unlock()
+	if _, err := Get("new"); err == nil {
+		t.Error("a replayed event reached the live store before the replay finished")
+	}
+
+	close(tl.errors)
+	close(tl.events)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := storeMap(); fmt.Sprint(got) != "map[new:v]" {
+		t.Errorf("expected the replayed store to be installed, got %v", got)
+	}
+}
+
+func replayBenchEvents(n int) []Event {
+	events := make([]Event, n)
+	for i := range events {
+		events[i] = Event{Sequence: uint64(i + 1), EventType: EventPut, Key: fmt.Sprintf("key-%d", i%1000), Value: "value"}
+		if i%5 == 4 {
+			events[i].EventType, events[i].Value = EventDelete, ""
+		}
+	}
+	return events
+}
+
+func benchmarkReplay(b *testing.B, fast bool) {
+	events := replayBenchEvents(100000)
+
+	saved, savedFast := store.data, config.FastReplay
+	config.FastReplay = fast
+	defer func() { store.data, config.FastReplay = saved, savedFast }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.data = memoryBackend{}
+		if _, err := replayEvents(NewMemoryTransactionLogger(events...), 0, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReplayLocked(b *testing.B)   { benchmarkReplay(b, false) }
+func BenchmarkReplayUnlocked(b *testing.B) { benchmarkReplay(b, true) }
+
+// versionedMemoryLogger is a memory logger that also keeps key versions,
+// as the postgres logger does in its key_versions table.
+type versionedMemoryLogger struct {
+	*MemoryTransactionLogger
+	versions map[string]uint64
+}
+
+func (l versionedMemoryLogger) Versions() (map[string]uint64, error) {
+	return l.versions, nil
+}
+
+func TestVersionsSurviveReplay(t *testing.T) {
+	// The store comes back with a and b from a checkpoint at sequence 4,
+	// and only a later put of a is replayed, so counting writes would
+	// leave a at version 1 and b at 0.
+	withStore(t, map[string]string{"a": "1", "b": "2"})
+	tl := versionedMemoryLogger{
+		MemoryTransactionLogger: NewMemoryTransactionLogger(
+			Event{Sequence: 5, EventType: EventPut, Key: "a", Value: "3"},
+		),
+		versions: map[string]uint64{"a": 7, "b": 2, "deleted": 4},
+	}
+
+	if _, err := replayEventsAfter(tl, 4, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreVersions(tl); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]uint64{"a": 7, "b": 2} {
+		_, meta, err := GetWithMetadata(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Version != want {
+			t.Errorf("%s: got version %d, want %d", key, meta.Version, want)
+		}
+	}
+	if _, ok := storeMap()["deleted"]; ok {
+		t.Error("a version brought back a key that isn't in the store")
+	}
+
+	// Writes carry on from the restored version.
+	if _, err := Put("a", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := GetWithMetadata("a"); meta.Version != 8 {
+		t.Errorf("expected version 8 after another put, got %d", meta.Version)
+	}
+}
+
+func TestTimesSurviveReplay(t *testing.T) {
+	withStore(t, make(map[string]string))
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	tl := NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1", Time: created},
+		Event{Sequence: 2, EventType: EventPut, Key: "a", Value: "2", Time: updated},
+		Event{Sequence: 3, EventType: EventPut, Key: "untimed", Value: "1"},
+	)
+
+	before := time.Now()
+	if _, err := replayEvents(tl, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, meta, err := GetWithMetadata("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Created.Equal(created) || !meta.Updated.Equal(updated) {
+		t.Errorf("expected a created %v and updated %v, got %v and %v", created, updated, meta.Created, meta.Updated)
+	}
+
+	// An event logged without a time is dated by its replay.
+	if _, meta, _ := GetWithMetadata("untimed"); meta.Created.Before(before) {
+		t.Errorf("expected untimed to be dated by the replay, got %v", meta.Created)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// version is the version of the server, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// Endpoint is a path the server serves and the methods it serves it with.
+type Endpoint struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+// routeVariable matches a path variable's pattern, such as the :.+ of
+// {key:.+}, which the banner leaves out.
+var routeVariable = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// endpoints lists the paths router serves, in the order they were
+// registered, each with the methods it is served with.
+func endpoints(router *mux.Router) []Endpoint {
+	var list []Endpoint
+	index := make(map[string]int)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		tmpl = routeVariable.ReplaceAllString(tmpl, "{$1}")
+
+		i, ok := index[tmpl]
+		if !ok {
+			i = len(list)
+			index[tmpl] = i
+			list = append(list, Endpoint{Path: tmpl, Methods: []string{}})
+		}
+		list[i].Methods = append(list[i].Methods, methods...)
+		return nil
+	})
+	return list
+}
+
+// rootHandler answers GET / with a banner naming the service and its
+// version and listing the endpoints router serves, for people finding
+// their way around the API.
+func rootHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Name      string     `json:"name"`
+			Version   string     `json:"version"`
+			Endpoints []Endpoint `json:"endpoints"`
+		}{config.ServiceName, version, endpoints(router)})
+	}
+}
+
+// notFoundHandler answers requests for paths the server doesn't serve
+// with a JSON 404 pointing at the banner.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+		Path   string `json:"path"`
+		Hint   string `json:"hint"`
+	}{"not found", http.StatusNotFound, r.URL.Path, "GET / lists the endpoints"})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRootBanner(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ServiceName = "kvstore-test"
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("unexpected Content-Type %q", got)
+	}
+
+	var banner struct {
+		Name      string
+		Version   string
+		Endpoints []Endpoint
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&banner); err != nil {
+		t.Fatal(err)
+	}
+	if banner.Name != "kvstore-test" || banner.Version != version {
+		t.Errorf("unexpected banner %s %s", banner.Name, banner.Version)
+	}
+
+	listed := make(map[string][]string)
+	for _, e := range banner.Endpoints {
+		listed[e.Path] = e.Methods
+	}
+	for path, methods := range map[string][]string{
+		"/v1/{key}":        {"PUT", "GET", "DELETE"},
+		"/v1/{key}/rename": {"POST"},
+		"/v1/_keys":        {"GET"},
+		"/":                {"GET"},
+	} {
+		if !reflect.DeepEqual(listed[path], methods) {
+			t.Errorf("%s: expected methods %v, got %v", path, methods, listed[path])
+		}
+	}
+}
+
+func TestNotFoundJSON(t *testing.T) {
+	for _, path := range []string{"/nope", "/v1/", "/admin/unknown"} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusNotFound, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: unexpected Content-Type %q", path, got)
+		}
+		var body struct {
+			Error  string
+			Status int
+			Path   string
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if body.Status != http.StatusNotFound || body.Path != path || body.Error == "" {
+			t.Errorf("%s: unexpected body %+v", path, body)
+		}
+	}
+
+	// A missing key is still the key's own 404, not an unknown path.
+	withStore(t, make(map[string]string))
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/missing", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") == "application/json" {
+		t.Errorf("expected the plain 404 of a missing key, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaMaxErrors bounds the validation errors reported for one value.
+const schemaMaxErrors = 20
+
+// valueSchema is a compiled JSON Schema. Only the validation keywords
+// listed in compileSchema are supported; a schema using any other keyword,
+// such as $ref, fails to load rather than being partly enforced.
+type valueSchema struct {
+	reject bool // the false schema, which nothing matches
+
+	types    []string
+	enum     []any
+	constant any
+	hasConst bool
+
+	properties           map[string]*valueSchema
+	required             []string
+	additionalProperties *valueSchema
+	minProperties        *int
+	maxProperties        *int
+
+	items       *valueSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf, anyOf, oneOf []*valueSchema
+	not                 *valueSchema
+}
+
+// schemaAnnotations are keywords that don't affect validation.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "format": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// compileSchema compiles a schema decoded from JSON. It supports type,
+// enum, const, properties, required, additionalProperties, minProperties,
+// maxProperties, items (a single schema), minItems, maxItems, uniqueItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum (as numbers),
+// multipleOf, minLength, maxLength, pattern, allOf, anyOf, oneOf and not.
+func compileSchema(raw any) (*valueSchema, error) {
+	switch v := raw.(type) {
+	case bool:
+		return &valueSchema{reject: !v}, nil
+	case map[string]any:
+		s := new(valueSchema)
+		for kw, val := range v {
+			if err := s.compileKeyword(kw, val); err != nil {
+				return nil, fmt.Errorf("%s: %w", kw, err)
+			}
+		}
+		return s, nil
+	default:
+		return nil, errors.New("a schema must be an object or a boolean")
+	}
+}
+
+func (s *valueSchema) compileKeyword(kw string, val any) error {
+	var err error
+	switch kw {
+	case "type":
+		switch t := val.(type) {
+		case string:
+			s.types = []string{t}
+		case []any:
+			for _, e := range t {
+				name, ok := e.(string)
+				if !ok {
+					return errors.New("must be a string or an array of strings")
+				}
+				s.types = append(s.types, name)
+			}
+		default:
+			return errors.New("must be a string or an array of strings")
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	case "enum":
+		list, ok := val.([]any)
+		if !ok {
+			return errors.New("must be an array")
+		}
+		s.enum = list
+	case "const":
+		s.constant, s.hasConst = val, true
+	case "properties":
+		props, ok := val.(map[string]any)
+		if !ok {
+			return errors.New("must be an object")
+		}
+		s.properties = make(map[string]*valueSchema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = compileSchema(sub); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	case "required":
+		list, ok := val.([]any)
+		if !ok {
+			return errors.New("must be an array of strings")
+		}
+		for _, e := range list {
+			name, ok := e.(string)
+			if !ok {
+				return errors.New("must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	case "additionalProperties":
+		s.additionalProperties, err = compileSchema(val)
+	case "items":
+		s.items, err = compileSchema(val)
+	case "not":
+		s.not, err = compileSchema(val)
+	case "allOf":
+		s.allOf, err = compileSchemaList(val)
+	case "anyOf":
+		s.anyOf, err = compileSchemaList(val)
+	case "oneOf":
+		s.oneOf, err = compileSchemaList(val)
+	case "minProperties":
+		s.minProperties, err = schemaCount(val)
+	case "maxProperties":
+		s.maxProperties, err = schemaCount(val)
+	case "minItems":
+		s.minItems, err = schemaCount(val)
+	case "maxItems":
+		s.maxItems, err = schemaCount(val)
+	case "minLength":
+		s.minLength, err = schemaCount(val)
+	case "maxLength":
+		s.maxLength, err = schemaCount(val)
+	case "uniqueItems":
+		b, ok := val.(bool)
+		if !ok {
+			return errors.New("must be a boolean")
+		}
+		s.uniqueItems = b
+	case "minimum":
+		s.minimum, err = schemaNumber(val)
+	case "maximum":
+		s.maximum, err = schemaNumber(val)
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = schemaNumber(val)
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = schemaNumber(val)
+	case "multipleOf":
+		if s.multipleOf, err = schemaNumber(val); err == nil && *s.multipleOf <= 0 {
+			return errors.New("must be positive")
+		}
+	case "pattern":
+		p, ok := val.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		s.pattern, err = regexp.Compile(p)
+	default:
+		if !schemaAnnotations[kw] {
+			return errors.New("unsupported keyword")
+		}
+	}
+	return err
+}
+
+func compileSchemaList(val any) ([]*valueSchema, error) {
+	list, ok := val.([]any)
+	if !ok || len(list) == 0 {
+		return nil, errors.New("must be a non-empty array of schemas")
+	}
+	schemas := make([]*valueSchema, len(list))
+	for i, sub := range list {
+		var err error
+		if schemas[i], err = compileSchema(sub); err != nil {
+			return nil, fmt.Errorf("%d: %w", i, err)
+		}
+	}
+	return schemas, nil
+}
+
+func schemaNumber(val any) (*float64, error) {
+	n, ok := val.(float64)
+	if !ok {
+		return nil, errors.New("must be a number")
+	}
+	return &n, nil
+}
+
+func schemaCount(val any) (*int, error) {
+	n, ok := val.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return nil, errors.New("must be a non-negative integer")
+	}
+	i := int(n)
+	return &i, nil
+}
+
+// jsonType returns the JSON Schema type of a value decoded from JSON.
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// matches reports whether v conforms to s.
+func (s *valueSchema) matches(v any) bool {
+	var errs []string
+	s.validate(v, "", &errs)
+	return len(errs) == 0
+}
+
+// validate appends to errs a message for every way v, found at the JSON
+// Pointer path, fails to conform to s.
+func (s *valueSchema) validate(v any, path string, errs *[]string) {
+	fail := func(format string, args ...any) {
+		where := path
+		if where == "" {
+			where = "(root)"
+		}
+		*errs = append(*errs, where+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.reject {
+		fail("no value is allowed here")
+		return
+	}
+
+	typ := jsonType(v)
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if t == typ || (t == "integer" && typ == "number" && v.(float64) == math.Trunc(v.(float64))) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.types, " or "), typ)
+			return
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("must be one of the enumerated values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		fail("must equal the constant value")
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(val) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(val) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub, ok := s.properties[name]
+			if !ok {
+				sub = s.additionalProperties
+			}
+			if sub != nil {
+				sub.validate(val[name], path+"/"+escapePointer(name), errs)
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+		unique:
+			for i := range val {
+				for j := 0; j < i; j++ {
+					if reflect.DeepEqual(val[i], val[j]) {
+						fail("items %d and %d are equal", j, i)
+						break unique
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range val {
+				s.items.validate(item, fmt.Sprintf("%s/%d", path, i), errs)
+			}
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && val > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && val <= *s.exclusiveMinimum {
+			fail("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && val >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := val / *s.multipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.minLength != nil && n < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("must match the pattern %q", s.pattern)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if s.anyOf != nil {
+		ok := false
+		for _, sub := range s.anyOf {
+			if sub.matches(v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.matches(v) {
+				n++
+			}
+		}
+		if n != 1 {
+			fail("must match exactly one schema in oneOf, matched %d", n)
+		}
+	}
+	if s.not != nil && s.not.matches(v) {
+		fail("must not match the schema in not")
+	}
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer.
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// prefixSchema is the schema values of keys under prefix must conform to.
+type prefixSchema struct {
+	prefix string
+	schema *valueSchema
+}
+
+// schemaHook is a ValueHook that rejects values which aren't JSON or
+// don't conform to the schema for their key: that of the longest prefix
+// the key starts with. Keys under no prefix with a schema are not checked.
+type schemaHook struct {
+	schemas []prefixSchema // longest prefix first
+}
+
+// loadSchemaHook loads the schemas named by spec, which is either the path
+// of a single schema file that applies to every key, or comma-separated
+// prefix=path pairs, where the schema in path applies to the keys under
+// prefix. An empty prefix, as in =path, also applies to every key.
+func loadSchemaHook(spec string) (*schemaHook, error) {
+	h := new(schemaHook)
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		prefix, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			prefix, path = "", entry
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("more than one schema for prefix %q", prefix)
+		}
+		seen[prefix] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var raw any
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		s, err := compileSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		h.schemas = append(h.schemas, prefixSchema{prefix, s})
+	}
+	sort.Slice(h.schemas, func(i, j int) bool { return len(h.schemas[i].prefix) > len(h.schemas[j].prefix) })
+	return h, nil
+}
+
+// OnPut checks value against the schema for key, returning it unchanged
+// if it conforms.
+func (h *schemaHook) OnPut(key, value string) (string, error) {
+	var s *valueSchema
+	for _, ps := range h.schemas {
+		if strings.HasPrefix(key, ps.prefix) {
+			s = ps.schema
+			break
+		}
+	}
+	if s == nil {
+		return value, nil
+	}
+
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return "", fmt.Errorf("value is not JSON: %v", err)
+	}
+	var errs []string
+	s.validate(v, "", &errs)
+	if len(errs) == 0 {
+		return value, nil
+	}
+	if len(errs) > schemaMaxErrors {
+		errs = append(errs[:schemaMaxErrors], fmt.Sprintf("and %d more", len(errs)-schemaMaxErrors))
+	}
+	return "", fmt.Errorf("value doesn't conform to the schema: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const userSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true}
+	},
+	"additionalProperties": false
+}`
+
+func writeSchema(t *testing.T, schema string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(schema), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSchemaHook(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	hook, err := loadSchemaHook("users/=" + writeSchema(t, userSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withValueHook(t, hook)
+
+	for _, tc := range []struct {
+		key, value string
+		status     int
+		reason     string
+	}{
+		{"users/1", `{"name": "alice", "age": 30}`, http.StatusCreated, ""},
+		{"users/2", `{"name": "bob", "age": 0, "email": "bob@example.com", "tags": ["a", "b"]}`, http.StatusCreated, ""},
+		{"users/3", `{"name": "carol"}`, http.StatusUnprocessableEntity, `missing required property "age"`},
+		{"users/4", `{"name": "dave", "age": 1.5}`, http.StatusUnprocessableEntity, "/age: expected integer, got number"},
+		{"users/5", `{"name": "", "age": -1}`, http.StatusUnprocessableEntity, "/age: must be at least 0; /name: must be at least 1 characters long"},
+		{"users/6", `{"name": "erin", "age": 2, "admin": true}`, http.StatusUnprocessableEntity, "/admin: no value is allowed here"},
+		{"users/7", `{"name": "frank", "age": 3, "tags": ["a", "a"]}`, http.StatusUnprocessableEntity, "/tags: items 0 and 1 are equal"},
+		{"users/8", `[1, 2]`, http.StatusUnprocessableEntity, "(root): expected object, got array"},
+		{"users/9", `not json`, http.StatusUnprocessableEntity, "value is not JSON"},
+		{"users/10", `{"name": "gina", "age": 4} trailing`, http.StatusUnprocessableEntity, "value is not JSON"},
+		{"other", `not json`, http.StatusCreated, ""},
+	} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+tc.key, strings.NewReader(tc.value)))
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.key, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.reason) {
+			t.Errorf("%s: expected %q in the body, got %q", tc.key, tc.reason, rec.Body)
+		}
+		if _, err := Get(tc.key); (err == nil) != (tc.status == http.StatusCreated) {
+			t.Errorf("%s: stored is %v, expected %v", tc.key, err == nil, tc.status == http.StatusCreated)
+		}
+	}
+}
+
+func TestSchemaLongestPrefix(t *testing.T) {
+	hook, err := loadSchemaHook(strings.Join([]string{
+		writeSchema(t, `{"type": "object"}`),
+		"users/=" + writeSchema(t, `{"type": "string"}`),
+		"users/admin/=" + writeSchema(t, `{"const": "root"}`),
+	}, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key, value string
+		ok         bool
+	}{
+		{"config", `{}`, true},
+		{"config", `"x"`, false},
+		{"users/1", `"x"`, true},
+		{"users/1", `{}`, false},
+		{"users/admin/1", `"root"`, true},
+		{"users/admin/1", `"x"`, false},
+	} {
+		if _, err := hook.OnPut(tc.key, tc.value); (err == nil) != tc.ok {
+			t.Errorf("%s = %s: expected ok=%v, got %v", tc.key, tc.value, tc.ok, err)
+		}
+	}
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	hook, err := loadSchemaHook(writeSchema(t, `{
+		"oneOf": [
+			{"type": "string", "enum": ["on", "off"]},
+			{"type": "number", "multipleOf": 5, "exclusiveMaximum": 100}
+		],
+		"not": {"const": "off"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for value, ok := range map[string]bool{
+		`"on"`:  true,
+		`"off"`: false,
+		`"dim"`: false,
+		`15`:    true,
+		`16`:    false,
+		`100`:   false,
+		`null`:  false,
+	} {
+		if _, err := hook.OnPut("k", value); (err == nil) != ok {
+			t.Errorf("%s: expected ok=%v, got %v", value, ok, err)
+		}
+	}
+}
+
+func TestLoadSchemaHookErrors(t *testing.T) {
+	valid := writeSchema(t, `true`)
+	for _, spec := range []string{
+		writeSchema(t, `{"$ref": "#/$defs/user"}`),
+		writeSchema(t, `{"type": "decimal"}`),
+		writeSchema(t, `{"properties": {"a": {"minLength": -1}}}`),
+		writeSchema(t, `{"pattern": "("}`),
+		writeSchema(t, `not json`),
+		writeSchema(t, `3`),
+		"a/=" + valid + ",a/=" + valid,
+		filepath.Join(t.TempDir(), "missing.json"),
+	} {
+		if _, err := loadSchemaHook(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestSchemaTx(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	hook, err := loadSchemaHook(writeSchema(t, `{"type": "number"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withValueHook(t, hook)
+
+	body := `{"ops": [{"op": "put", "key": "a", "value": "1"}, {"op": "put", "key": "b", "value": "one"}]}`
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/_tx", strings.NewReader(body)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, rec.Code, rec.Body)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Error("a transaction with a nonconforming value was partly applied")
+	}
+}
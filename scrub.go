@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logScanner is a transaction logger whose log can be read again while it
+// runs, without disturbing the sequence numbers of new events.
+type logScanner interface {
+	TransactionLogger
+	ScanEvents(fn func(Event)) error
+}
+
+// scrubLogDrift is how many drifted keys a scrub logs one by one before
+// only counting them.
+const scrubLogDrift = 10
+
+// drift is a key whose value in the store differs from the one its
+// transaction log leads to.
+type drift struct {
+	key                  string
+	logValue, storeValue string
+	inLog, inStore       bool
+}
+
+// scrubber periodically checks that replaying the transaction log would
+// rebuild the store as it is, catching drift left by events that were
+// never persisted or by edits made to the log behind the server's back.
+//
+// Scrubs don't block traffic. The log is read without any lock. The
+// store's keys are listed under one hold of its read lock, as for GET
+// /v1/_keys, and their values are read one at a time. Keys written while a
+// scrub runs are left out of it, since the store and the log may
+// legitimately disagree about them until the write is logged.
+type scrubber struct {
+	tl     logScanner
+	repair bool
+
+	mu       sync.Mutex
+	touched  map[string]bool // keys changed during the running scrub
+	notified uint64          // Seq of the latest change recorded
+
+	statsMu   sync.Mutex
+	lastDrift int
+	lastRun   time.Time
+}
+
+// startScrubber scrubs the store against tl every interval until the
+// returned function is called. If repair is set, drifted keys are reset
+// to what the log holds. Loggers whose log can't be read again are not
+// scrubbed.
+func startScrubber(tl TransactionLogger, interval time.Duration, repair bool) (stop func()) {
+	ls, ok := tl.(logScanner)
+	if !ok {
+		slog.Warn("the transaction logger can't be scrubbed")
+		return func() {}
+	}
+	s := &scrubber{tl: ls, repair: repair}
+	s.registerMetrics()
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if _, err := s.scrub(); err != nil {
+					slog.Error("scrub failed", "err", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func (s *scrubber) registerMetrics() {
+	registerGauge("kvstore_scrub_drift_keys", "Keys whose stored value differed from the transaction log at the last scrub.", func() float64 {
+		s.statsMu.Lock()
+		defer s.statsMu.Unlock()
+		return float64(s.lastDrift)
+	})
+	registerGauge("kvstore_scrub_last_run_seconds", "Unix time the last scrub finished, 0 before the first.", func() float64 {
+		s.statsMu.Lock()
+		defer s.statsMu.Unlock()
+		if s.lastRun.IsZero() {
+			return 0
+		}
+		return float64(s.lastRun.Unix())
+	})
+}
+
+// Notify records keys changed while a scrub runs.
+func (s *scrubber) Notify(c Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.touched != nil {
+		s.touched[c.Key] = true
+		s.notified = c.Seq
+	}
+}
+
+func (s *scrubber) describe(info *SubscriberInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info.Kind = "scrub"
+	info.Patterns = []SubscriberPattern{{}}
+	info.LastDelivered = s.notified
+}
+
+func (s *scrubber) isTouched(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.touched[key]
+}
+
+// scrub compares the store with the state the log leads to, returning
+// the keys that drifted apart, and resets them to the log's state if the
+// scrubber repairs.
+func (s *scrubber) scrub() ([]drift, error) {
+	s.mu.Lock()
+	s.touched = make(map[string]bool)
+	s.mu.Unlock()
+	addChangeSubscriber(s)
+	defer func() {
+		removeChangeSubscriber(s)
+		s.mu.Lock()
+		s.touched = nil
+		s.mu.Unlock()
+	}()
+
+	// Every write applied before the subscription is logged once the
+	// flush returns; those applied after it are touched.
+	if err := s.tl.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush the transaction log: %w", err)
+	}
+
+	logged := make(map[string]string)
+	err := s.tl.ScanEvents(func(e Event) {
+		key := normalizeKey(e.Key)
+		switch e.EventType {
+		case EventPut, EventPutImmutable:
+			logged[key] = e.Value
+		case EventDelete:
+			delete(logged, key)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the transaction log: %w", err)
+	}
+
+	keys := make(map[string]bool, len(logged))
+	for key := range logged {
+		keys[key] = true
+	}
+	stored, err := List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the store: %w", err)
+	}
+	for _, info := range stored {
+		keys[info.Key] = true
+	}
+
+	var drifted []drift
+	for key := range keys {
+		if isReservedKey(key) || s.isTouched(key) {
+			continue
+		}
+		d := drift{key: key}
+		d.logValue, d.inLog = logged[key]
+		if d.storeValue, d.inStore, err = peek(key); err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", key, err)
+		}
+		if d.inLog != d.inStore || d.logValue != d.storeValue {
+			drifted = append(drifted, d)
+		}
+	}
+	sort.Slice(drifted, func(i, j int) bool { return drifted[i].key < drifted[j].key })
+
+	repaired := 0
+	if s.repair {
+		for _, d := range drifted {
+			ok, err := s.reset(d)
+			if err != nil {
+				return drifted, fmt.Errorf("failed to repair key %s: %w", d.key, err)
+			}
+			if ok {
+				repaired++
+			}
+		}
+	}
+
+	s.report(drifted, repaired)
+	return drifted, nil
+}
+
+// reset puts d's key back to the state in the log, unless it has been
+// written since it was compared. Nothing is logged, since the log already
+// holds that state, but subscribers are told of the change.
+func (s *scrubber) reset(d drift) (bool, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if s.isTouched(d.key) {
+		return false, nil
+	}
+	if !d.inLog {
+		if err := Delete(d.key); err != nil {
+			return false, err
+		}
+		notifyChange(EventDelete, d.key, "")
+		return true, nil
+	}
+	if _, err := Put(d.key, d.logValue); err != nil {
+		return false, err
+	}
+	notifyChange(EventPut, d.key, d.logValue)
+	return true, nil
+}
+
+func (s *scrubber) report(drifted []drift, repaired int) {
+	s.statsMu.Lock()
+	s.lastDrift, s.lastRun = len(drifted), time.Now()
+	s.statsMu.Unlock()
+
+	if len(drifted) == 0 {
+		slog.Debug("scrub found no drift")
+		return
+	}
+	for i, d := range drifted {
+		if i == scrubLogDrift {
+			break
+		}
+		slog.Warn("stored value differs from the transaction log", "key", d.key,
+			"in_log", d.inLog, "in_store", d.inStore, "log_bytes", len(d.logValue), "store_bytes", len(d.storeValue))
+	}
+	slog.Warn("store has drifted from the transaction log", "keys", len(drifted), "repaired", repaired)
+}
+
+// peek returns the value stored under key without recording an access,
+// so that scrubbing doesn't keep idle keys alive.
+func peek(key string) (string, bool, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.data.get(key)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scanLogger is a memory logger whose log can be scanned while it runs,
+// as the postgres logger's can. duringScan, if set, is called half way
+// through every scan.
+type scanLogger struct {
+	*MemoryTransactionLogger
+	duringScan func()
+}
+
+func (l scanLogger) ScanEvents(fn func(Event)) error {
+	l.mu.Lock()
+	events := append([]Event(nil), l.events...)
+	l.mu.Unlock()
+
+	for i, e := range events {
+		if i == len(events)/2 && l.duringScan != nil {
+			l.duringScan()
+		}
+		fn(e)
+	}
+	return nil
+}
+
+func driftedKeys(drifted []drift) []string {
+	keys := []string{}
+	for _, d := range drifted {
+		keys = append(keys, d.key)
+	}
+	return keys
+}
+
+func TestScrubDetectsDrift(t *testing.T) {
+	withStore(t, map[string]string{"a": "1", "b": "edited", "e": "unlogged", selfTestKey: "x"})
+	tl := scanLogger{MemoryTransactionLogger: NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1"},
+		Event{Sequence: 2, EventType: EventPut, Key: "b", Value: "2"},
+		Event{Sequence: 3, EventType: EventPut, Key: "c", Value: "3"},
+		Event{Sequence: 4, EventType: EventDelete, Key: "c"},
+		Event{Sequence: 5, EventType: EventPut, Key: "d", Value: "4"},
+	)}
+	savedGauges := metrics.gauges
+	t.Cleanup(func() { metrics.gauges = savedGauges })
+	metrics.gauges = nil
+
+	s := &scrubber{tl: tl}
+	s.registerMetrics()
+	drifted, err := s.scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "d", "e"}; !reflect.DeepEqual(driftedKeys(drifted), want) {
+		t.Errorf("expected drifted keys %v, got %+v", want, drifted)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "kvstore_scrub_drift_keys 3") {
+		t.Errorf("expected the drift in the metrics, got:\n%s", rec.Body)
+	}
+
+	// Without repair the store is left alone.
+	if got := storeMap()["b"]; got != "edited" {
+		t.Errorf("expected b to be left as it was, got %q", got)
+	}
+}
+
+func TestScrubRepair(t *testing.T) {
+	withStore(t, map[string]string{"a": "edited", "e": "unlogged"})
+	tl := scanLogger{MemoryTransactionLogger: NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1"},
+		Event{Sequence: 2, EventType: EventPut, Key: "d", Value: "4"},
+	)}
+
+	s := &scrubber{tl: tl, repair: true}
+	if _, err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "1", "d": "4"}; !reflect.DeepEqual(map[string]string(storeMap()), want) {
+		t.Errorf("expected the store to be reset to %v, got %v", want, storeMap())
+	}
+
+	drifted, err := s.scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifted) != 0 {
+		t.Errorf("expected no drift after the repair, got %+v", drifted)
+	}
+}
+
+func TestScrubSkipsKeysWrittenDuringIt(t *testing.T) {
+	withStore(t, map[string]string{"a": "1", "b": "1"})
+	tl := scanLogger{MemoryTransactionLogger: NewMemoryTransactionLogger(
+		Event{Sequence: 1, EventType: EventPut, Key: "a", Value: "1"},
+		Event{Sequence: 2, EventType: EventPut, Key: "b", Value: "1"},
+	)}
+	// b is written while the log is read, and logged after the scrub.
+	tl.duringScan = func() {
+		Put("b", "2")
+		notifyChange(EventPut, "b", "2")
+	}
+
+	s := &scrubber{tl: tl, repair: true}
+	drifted, err := s.scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifted) != 0 {
+		t.Errorf("expected the key written during the scrub to be skipped, got %+v", drifted)
+	}
+	if got := storeMap()["b"]; got != "2" {
+		t.Errorf("the concurrent write was undone, b is %q", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// seedStore loads the JSON object of string keys and values in the file
+// at path into the store, logging each key written so that the seed
+// persists like any other write. Keys that already exist, say from the
+// replay, are left alone unless overwrite is set, and immutable ones
+// always are. It returns the number
+// of keys written.
+//
+// Keys are normalized like those of requests. Nothing is written if the
+// file can't be read, holds a reserved key or holds two keys that
+// normalize to the same one. Keys are written in sorted order, so
+// seeding the same file always produces the same log.
+func seedStore(path string, overwrite bool) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read seed file: %w", err)
+	}
+
+	var seed map[string]string
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return 0, fmt.Errorf("malformed seed file %s: %w", path, err)
+	}
+
+	normalized := make(map[string]string, len(seed))
+	for sent, value := range seed {
+		key := normalizeKey(sent)
+		if key == "" || isReservedKey(key) {
+			return 0, fmt.Errorf("seed file %s: invalid key %q", path, sent)
+		}
+		if err := checkLoggable(key, value); err != nil {
+			return 0, fmt.Errorf("seed file %s: key %q: %w", path, sent, err)
+		}
+		if _, dup := normalized[key]; dup {
+			return 0, fmt.Errorf("seed file %s: more than one key normalizes to %q", path, key)
+		}
+		normalized[key] = value
+	}
+	seed = normalized
+
+	keys := make([]string, 0, len(seed))
+	for key := range seed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	cond := writeIfAbsent
+	if overwrite {
+		cond = writeAlways
+	}
+	var written int
+	for _, key := range keys {
+		value := seed[key]
+		_, stored, err := CheckPut(key, value, cond)
+		if errors.Is(err, ErrImmutable) {
+			slog.Warn("not seeding immutable key", "key", key)
+			continue
+		}
+		if err == nil && !stored {
+			continue
+		}
+		if err == nil {
+			err = commitWrite(func() {
+				transactionLogger.WritePut(key, value)
+			}, func() error {
+				_, _, err := PutContent(key, value, "", cond)
+				return err
+			})
+		}
+		if err != nil {
+			return written, fmt.Errorf("failed to seed %q: %w", key, err)
+		}
+		written++
+	}
+
+	return written, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSeedFile(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestSeedStore(t *testing.T) {
+	for _, overwrite := range []bool{false, true} {
+		withStore(t, map[string]string{"a": "replayed"})
+		tl := withLogger(t)
+
+		seed := writeSeedFile(t, `{"a": "seeded", "b": "2", "c/d": "3"}`)
+		n, err := seedStore(seed, overwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"a": "replayed", "b": "2", "c/d": "3"}
+		wantWritten := 2
+		if overwrite {
+			want["a"] = "seeded"
+			wantWritten = 3
+		}
+		if n != wantWritten {
+			t.Errorf("overwrite=%v: seeded %d keys, want %d", overwrite, n, wantWritten)
+		}
+		for key, value := range want {
+			if got := storeMap()[key]; got != value {
+				t.Errorf("overwrite=%v: store has %s=%q, want %q", overwrite, key, got, value)
+			}
+		}
+
+		if err := tl.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		events, err := readAll(t, tl.filename, FileLoggerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != wantWritten {
+			t.Fatalf("overwrite=%v: logged %d events, want %d", overwrite, len(events), wantWritten)
+		}
+		for _, e := range events {
+			if e.EventType != EventPut || want[e.Key] != e.Value {
+				t.Errorf("overwrite=%v: unexpected event %+v", overwrite, e)
+			}
+		}
+	}
+}
+
+func TestSeedStoreRejectsBadFiles(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	for _, content := range []string{`["a", "b"]`, `{"a": 1}`, `{"a": "1", "_b": "2"}`} {
+		if _, err := seedStore(writeSeedFile(t, content), false); err == nil {
+			t.Errorf("expected an error seeding %s", content)
+		}
+	}
+	if len(storeMap()) != 0 {
+		t.Errorf("a rejected seed file changed the store: %v", storeMap())
+	}
+}
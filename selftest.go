@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reservedPrefix marks keys that belong to the server itself. Clients
+// can't read or write them, and admin endpoints live under the same
+// prefix.
+const reservedPrefix = "_"
+
+// selfTestKey is the key written and removed by the self-test.
+const selfTestKey = reservedPrefix + "selftest"
+
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+type selfTestStep struct {
+	Step  string `json:"step"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// selfTestHandler checks that the persistence layer works end to end: it
+// writes a probe key, commits it to the transaction log, reads it back
+// and deletes it again. It answers 200 only if every step succeeded, and
+// 500 with the failing step otherwise.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	steps, ok := runSelfTest()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(struct {
+		OK    bool           `json:"ok"`
+		Steps []selfTestStep `json:"steps"`
+	}{ok, steps})
+	slog.Debug("SELFTEST", "ok", ok)
+}
+
+func runSelfTest() ([]selfTestStep, bool) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	var steps []selfTestStep
+	run := func(name string, fn func() error) bool {
+		err := fn()
+		step := selfTestStep{Step: name, OK: err == nil}
+		if err != nil {
+			step.Error = err.Error()
+		}
+		steps = append(steps, step)
+		return err == nil
+	}
+
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer Delete(selfTestKey) // don't leave the probe in memory if a step failed
+
+	ok := run("write", func() error {
+		transactionLogger.WritePut(selfTestKey, value)
+		if err := transactionLogger.Flush(); err != nil {
+			return err
+		}
+		_, err := Put(selfTestKey, value)
+		return err
+	}) && run("read", func() error {
+		got, err := Get(selfTestKey)
+		if err != nil {
+			return err
+		}
+		if got != value {
+			return fmt.Errorf("read back %q, wrote %q", got, value)
+		}
+		return nil
+	}) && run("delete", func() error {
+		transactionLogger.WriteDelete(selfTestKey)
+		if err := transactionLogger.Flush(); err != nil {
+			return err
+		}
+		return Delete(selfTestKey)
+	})
+
+	return steps, ok
+}
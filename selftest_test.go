@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// brokenLogger accepts events but can never commit them, like a logger
+// writing to a read-only disk.
+type brokenLogger struct{ TransactionLogger }
+
+func (brokenLogger) WritePut(key, value string) {}
+func (brokenLogger) WriteDelete(key string)     {}
+func (brokenLogger) Flush() error               { return errors.New("read-only file system") }
+
+func TestSelfTest(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_selftest", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if _, err := Get(selfTestKey); err == nil {
+		t.Error("self-test key was left behind")
+	}
+}
+
+func TestSelfTestFailure(t *testing.T) {
+	withStore(t, make(map[string]string))
+	saved := transactionLogger
+	transactionLogger = brokenLogger{}
+	defer func() { transactionLogger = saved }()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_selftest", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+
+	var body struct {
+		OK    bool
+		Steps []selfTestStep
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.OK || len(body.Steps) != 1 {
+		t.Fatalf("expected the first step to fail, got %+v", body)
+	}
+	if step := body.Steps[0]; step.Step != "write" || step.OK || !strings.Contains(step.Error, "read-only") {
+		t.Errorf("unexpected step result %+v", step)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(method, "/v1/"+selfTestKey+"x", strings.NewReader("value")))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", method, http.StatusBadRequest, rec.Code)
+		}
+	}
+}
+
+func TestListKeysHidesReserved(t *testing.T) {
+	withStore(t, map[string]string{"visible": "", selfTestKey: ""})
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/_keys", nil))
+
+	var body struct{ Keys []string }
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Keys) != 1 || body.Keys[0] != "visible" {
+		t.Errorf("expected only the visible key, got %v", body.Keys)
+	}
+}
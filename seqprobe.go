@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// seqProbeExamples bounds the duplicate and out-of-order sequence numbers a
+// probe lists; the rest are only counted.
+const seqProbeExamples = 100
+
+// DuplicateSequence is a sequence number held by more than one event.
+type DuplicateSequence struct {
+	Sequence uint64 `json:"sequence"`
+	Count    int    `json:"count"`
+}
+
+// OutOfOrderSequence is an event stored after one with the same or a
+// higher sequence number.
+type OutOfOrderSequence struct {
+	Sequence uint64 `json:"sequence"`
+	After    uint64 `json:"after"`
+}
+
+// SequenceReport is what a sequence probe found in a transaction log.
+type SequenceReport struct {
+	OK         bool                 `json:"ok"`
+	Events     int64                `json:"events"`
+	Last       uint64               `json:"last_sequence"`
+	Next       *uint64              `json:"next_sequence,omitempty"` // the number the next event will get, if known
+	Duplicates []DuplicateSequence  `json:"duplicates"`
+	OutOfOrder []OutOfOrderSequence `json:"out_of_order"`
+	// OutOfOrderCount counts every out of order event, including those
+	// past the listed examples.
+	OutOfOrderCount int64    `json:"out_of_order_count"`
+	Problems        []string `json:"problems"`
+}
+
+// sequenceSource gives a sequence probe access to a log's sequence numbers.
+type sequenceSource interface {
+	// duplicateSequences returns up to limit sequence numbers held by
+	// more than one event, lowest first.
+	duplicateSequences(limit int) ([]DuplicateSequence, error)
+	// scanSequences calls fn with every event's sequence number in the
+	// order the events are stored.
+	scanSequences(fn func(uint64)) error
+	// nextSequence returns the number the next event will get, and false
+	// if nothing hands out sequence numbers.
+	nextSequence() (uint64, bool, error)
+}
+
+// probeSequences checks the sequence numbers of src the way the file
+// logger checks its own on replay: every event's number must be unique and
+// higher than those of the events stored before it. It also checks that
+// the next event will be numbered above every logged one, which a restore
+// that resets the numbering breaks.
+func probeSequences(src sequenceSource) (SequenceReport, error) {
+	r := SequenceReport{Duplicates: []DuplicateSequence{}, OutOfOrder: []OutOfOrderSequence{}, Problems: []string{}}
+
+	var err error
+	if r.Duplicates, err = src.duplicateSequences(seqProbeExamples); err != nil {
+		return r, fmt.Errorf("failed to look for duplicate sequence numbers: %w", err)
+	}
+	for _, d := range r.Duplicates {
+		r.Problems = append(r.Problems, fmt.Sprintf("sequence %d is held by %d events", d.Sequence, d.Count))
+	}
+
+	err = src.scanSequences(func(seq uint64) {
+		r.Events++
+		if r.Events > 1 && seq <= r.Last {
+			r.OutOfOrderCount++
+			if len(r.OutOfOrder) < seqProbeExamples {
+				r.OutOfOrder = append(r.OutOfOrder, OutOfOrderSequence{seq, r.Last})
+			}
+			return
+		}
+		r.Last = seq
+	})
+	if err != nil {
+		return r, fmt.Errorf("failed to read sequence numbers: %w", err)
+	}
+	if r.OutOfOrderCount > 0 {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d events are stored after events with the same or higher sequence numbers", r.OutOfOrderCount))
+	}
+
+	next, ok, err := src.nextSequence()
+	if err != nil {
+		return r, fmt.Errorf("failed to read the next sequence number: %w", err)
+	}
+	if !ok {
+		r.Problems = append(r.Problems, "nothing assigns sequence numbers to new events")
+	} else {
+		r.Next = &next
+		if next <= r.Last {
+			r.Problems = append(r.Problems, fmt.Sprintf("the next event will get sequence %d, not above the last logged %d", next, r.Last))
+		}
+	}
+
+	r.OK = len(r.Problems) == 0
+	return r, nil
+}
+
+// CheckSequences probes the transactions table for duplicate and out of
+// order sequence numbers. The primary key rules both out, but a restore
+// without constraints, or one that leaves the serial's counter behind the
+// table, lets them in. Out of order means stored after a row with the
+// same or a higher number, in the table's physical order, which for this
+// append-only table follows insertion.
+func (ptl *PostgresTransactionLogger) CheckSequences() (SequenceReport, error) {
+	return probeSequences(ptl)
+}
+
+func (ptl *PostgresTransactionLogger) duplicateSequences(limit int) ([]DuplicateSequence, error) {
+	rows, err := ptl.db.Query(`SELECT sequence, COUNT(*) FROM transactions
+		GROUP BY sequence HAVING COUNT(*) > 1 ORDER BY sequence LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	dups := []DuplicateSequence{}
+	for rows.Next() {
+		var d DuplicateSequence
+		if err := rows.Scan(&d.Sequence, &d.Count); err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+		dups = append(dups, d)
+	}
+
+	return dups, rows.Err()
+}
+
+func (ptl *PostgresTransactionLogger) scanSequences(fn func(uint64)) error {
+	// Only the numbers are read, over a single cursor, so unlike replay
+	// the scan isn't paginated by sequence, which would hide the very
+	// rows it looks for.
+	rows, err := ptl.db.Query(`SELECT sequence FROM transactions ORDER BY ctid`)
+	if err != nil {
+		return fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq uint64
+		if err := rows.Scan(&seq); err != nil {
+			return fmt.Errorf("error reading row: %w", err)
+		}
+		fn(seq)
+	}
+
+	return rows.Err()
+}
+
+func (ptl *PostgresTransactionLogger) nextSequence() (uint64, bool, error) {
+	var name sql.NullString
+	if err := ptl.db.QueryRow(`SELECT pg_get_serial_sequence('transactions', 'sequence')`).Scan(&name); err != nil {
+		return 0, false, err
+	}
+	if !name.Valid {
+		return 0, false, nil
+	}
+
+	// The name comes back quoted where needed.
+	var last uint64
+	var called bool
+	if err := ptl.db.QueryRow(fmt.Sprintf(`SELECT last_value, is_called FROM %s`, name.String)).Scan(&last, &called); err != nil {
+		return 0, false, err
+	}
+	if called {
+		last++
+	}
+	return last, true, nil
+}
+
+// sequenceProber is a transaction logger that can probe its sequence
+// numbers while it runs.
+type sequenceProber interface {
+	CheckSequences() (SequenceReport, error)
+}
+
+// sequenceCheckHandler probes the transaction log for duplicate and out of
+// order sequence numbers and reports what it found. The report's ok field
+// says whether the log is sound. File logs are checked offline with the
+// verify command instead.
+func sequenceCheckHandler(w http.ResponseWriter, r *http.Request) {
+	prober, ok := transactionLogger.(sequenceProber)
+	if !ok {
+		http.Error(w, fmt.Sprintf("the %s backend can't check sequences while running", config.Backend), http.StatusNotImplemented)
+		return
+	}
+
+	span := startSpan(r.Context(), "log.check_sequences")
+	report, err := prober.CheckSequences()
+	endSpan(span, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !report.OK {
+		slog.Warn("transaction log sequence check failed", "problems", report.Problems)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedTransactionLogger spreads the file log over several files by the
+// hash of each event's key, each written by a FileTransactionLogger with
+// its own appender goroutine, so that writes to different keys are
+// encoded, written and synced side by side rather than one after another.
+//
+// Sequence numbers are global: they are handed out here as events are
+// submitted, and the shards log them as given. Replay merges the shards by
+// sequence number, which puts the events back in the order they were
+// submitted. Every event for a key goes to the same shard, so compacting a
+// shard, which drops deletes, can't bring back a value another shard
+// deleted.
+//
+// Two guarantees of the single file are weaker. A batch touching keys in
+// several shards is logged as a batch in each of them, so a crash can
+// leave some of those logged and not the others. And while a crash leaves
+// each shard holding a prefix of its events, the shards together need not
+// hold a prefix of all events: a later write to one key can survive an
+// earlier write to another.
+type ShardedTransactionLogger struct {
+	shards   []*FileTransactionLogger
+	locks    []sync.Mutex // keep the events sent to each shard in sequence order
+	sequence uint64       // last sequence number handed out, accessed atomically
+	options  FileLoggerOptions
+
+	errors <-chan error
+	done   chan struct{} // closed by Close to stop forwarding the shards' errors
+}
+
+// shardFile is the path of shard i of the log at filename.
+func shardFile(filename string, i int) string {
+	return filename + "." + strconv.Itoa(i)
+}
+
+// checkShardLayout checks that the log files at filename were written with
+// the given number of shards, or don't exist yet. A key's events have to
+// stay in one shard, so an unsharded log can't be sharded in place, nor a
+// sharded one resharded, without rewriting it.
+func checkShardLayout(filename string, shards int) error {
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	if shards <= 1 {
+		if exists(shardFile(filename, 0)) {
+			return fmt.Errorf("transaction log %s is sharded; set -log-shards to its number of shards", filename)
+		}
+		return nil
+	}
+
+	if exists(filename) {
+		return fmt.Errorf("transaction log %s isn't sharded and can't be split into %d shards in place", filename, shards)
+	}
+	found := 0
+	for i := 0; i < shards; i++ {
+		if exists(shardFile(filename, i)) {
+			found++
+		}
+	}
+	if (found > 0 && found < shards) || exists(shardFile(filename, shards)) {
+		return fmt.Errorf("transaction log %s was written with a different number of shards than %d", filename, shards)
+	}
+
+	return nil
+}
+
+// NewShardedTransactionLogger opens a file log split into shards files,
+// named after filename with the shard's number appended. Strict sequence
+// checks are refused, as the numbers within a shard have gaps wherever
+// another shard's events came in between.
+func NewShardedTransactionLogger(filename string, shards int, options FileLoggerOptions) (TransactionLogger, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("a sharded log needs at least one shard, got %d", shards)
+	}
+	if options.SequenceCheck == SequenceStrict {
+		return nil, errors.New("strict sequence checks can't be used with a sharded log")
+	}
+	if err := checkShardLayout(filename, shards); err != nil {
+		return nil, err
+	}
+
+	s := &ShardedTransactionLogger{locks: make([]sync.Mutex, shards), options: options}
+	for i := 0; i < shards; i++ {
+		tl, err := NewTransactionLoggerWithOptions(shardFile(filename, i), options)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		ftl := tl.(*FileTransactionLogger)
+		ftl.presequenced = true
+		s.shards = append(s.shards, ftl)
+	}
+
+	return s, nil
+}
+
+// shardOf returns the shard key's events are logged to.
+func (s *ShardedTransactionLogger) shardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedTransactionLogger) Run() {
+	errs := make(chan error, len(s.shards))
+	s.errors = errs
+	s.done = make(chan struct{})
+
+	for _, shard := range s.shards {
+		shard.Run()
+		go func(shard *FileTransactionLogger) {
+			select {
+			case err := <-shard.Err():
+				errs <- fmt.Errorf("%s: %w", shard.filename, err)
+			case <-s.done:
+			}
+		}(shard)
+	}
+}
+
+// send numbers e and passes it to the shard of its key.
+func (s *ShardedTransactionLogger) send(e Event) {
+	i := s.shardOf(e.Key)
+	s.locks[i].Lock()
+	defer s.locks[i].Unlock()
+
+	e.Sequence = atomic.AddUint64(&s.sequence, 1)
+	s.shards[i].queue.send(e, s.shards[i].done)
+}
+
+func (s *ShardedTransactionLogger) checkEntry(key, value string) error {
+	return s.shards[s.shardOf(key)].checkEntry(key, value)
+}
+
+func (s *ShardedTransactionLogger) WritePut(key, value string) {
+	s.send(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+func (s *ShardedTransactionLogger) WritePutImmutable(key, value string) {
+	s.send(Event{EventType: EventPutImmutable, Key: key, Value: value})
+}
+
+func (s *ShardedTransactionLogger) WriteDelete(key string) {
+	s.send(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteBatch logs the events of each shard as a batch of their own. Their
+// BEGIN events are numbered first and the events after them in their
+// original order, so each shard's batch starts below its events.
+func (s *ShardedTransactionLogger) WriteBatch(events []Event) {
+	parts := make(map[int][]Event)
+	for _, e := range events {
+		i := s.shardOf(e.Key)
+		parts[i] = append(parts[i], e)
+	}
+	shards := make([]int, 0, len(parts))
+	for i := range parts {
+		shards = append(shards, i)
+	}
+	sort.Ints(shards) // lock in a fixed order so concurrent batches can't deadlock
+
+	for _, i := range shards {
+		s.locks[i].Lock()
+		defer s.locks[i].Unlock()
+	}
+
+	n := uint64(len(shards) + len(events))
+	seq := atomic.AddUint64(&s.sequence, n) - n
+	begins := make(map[int]uint64, len(shards))
+	for _, i := range shards {
+		seq++
+		begins[i] = seq
+	}
+	next := make(map[int]int, len(shards))
+	for _, e := range events {
+		i := s.shardOf(e.Key)
+		seq++
+		parts[i][next[i]].Sequence = seq
+		next[i]++
+	}
+
+	for _, i := range shards {
+		s.shards[i].queue.send(Event{Sequence: begins[i], batch: parts[i]}, s.shards[i].done)
+	}
+}
+
+func (s *ShardedTransactionLogger) Err() <-chan error {
+	return s.errors
+}
+
+// Flush flushes every shard at once, returning the errors of those that
+// failed.
+func (s *ShardedTransactionLogger) Flush() error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func(i int, shard *FileTransactionLogger) {
+			defer wg.Done()
+			errs[i] = shard.Flush()
+		}(i, shard)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (s *ShardedTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&s.sequence)
+}
+
+// Size returns the combined size of the shards' files in bytes.
+func (s *ShardedTransactionLogger) Size() (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		size, err := shard.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
+// Compact compacts every shard in turn, returning their combined stats.
+func (s *ShardedTransactionLogger) Compact() (CompactionStats, error) {
+	return s.compact(nil)
+}
+
+func (s *ShardedTransactionLogger) compact(read *atomic.Int64) (CompactionStats, error) {
+	var total CompactionStats
+	for _, shard := range s.shards {
+		stats, err := shard.compact(read)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", shard.filename, err)
+		}
+		total.BytesBefore += stats.BytesBefore
+		total.BytesAfter += stats.BytesAfter
+		total.RecordsBefore += stats.RecordsBefore
+		total.RecordsAfter += stats.RecordsAfter
+	}
+
+	return total, nil
+}
+
+// Truncate drops the events up to and including seq from every shard.
+func (s *ShardedTransactionLogger) Truncate(seq uint64) error {
+	for _, shard := range s.shards {
+		if err := shard.Truncate(seq); err != nil {
+			return fmt.Errorf("%s: %w", shard.filename, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedTransactionLogger) Close() error {
+	if s.done != nil {
+		close(s.done)
+	}
+
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// shardReader is the replay of one shard and the event it is up to.
+type shardReader struct {
+	shard  *FileTransactionLogger
+	events <-chan Event
+	errs   <-chan error
+	next   Event
+	ok     bool
+}
+
+// advance reads the shard's next event, returning the error that ended
+// its replay, if any.
+func (r *shardReader) advance() error {
+	if r.next, r.ok = <-r.events; r.ok {
+		return nil
+	}
+	if err := <-r.errs; err != nil {
+		return fmt.Errorf("%s: %w", r.shard.filename, err)
+	}
+	return nil
+}
+
+// ReadEvents replays the shards side by side, passing on their events in
+// sequence order. Each shard checks its own numbers as it is read; the
+// merge checks that no number turns up in two shards.
+func (s *ShardedTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		readers := make([]*shardReader, len(s.shards))
+		for i, shard := range s.shards {
+			events, errs := shard.ReadEvents()
+			readers[i] = &shardReader{shard: shard, events: events, errs: errs}
+		}
+		// A shard's replay blocks until its events are taken, so drain
+		// what is left of any when the merge stops early.
+		defer func() {
+			for _, r := range readers {
+				go func(events <-chan Event) {
+					for range events {
+					}
+				}(r.events)
+			}
+		}()
+
+		for _, r := range readers {
+			if err := r.advance(); err != nil {
+				outError <- err
+				return
+			}
+		}
+
+		var last uint64
+		for {
+			var min *shardReader
+			for _, r := range readers {
+				if r.ok && (min == nil || r.next.Sequence < min.next.Sequence) {
+					min = r
+				}
+			}
+			if min == nil {
+				break
+			}
+
+			e := min.next
+			if err := min.advance(); err != nil {
+				outError <- err
+				return
+			}
+			if last != 0 && e.Sequence <= last && s.options.SequenceCheck != SequenceLenient {
+				err := fmt.Errorf("transaction number %d is in more than one shard", e.Sequence)
+				if s.options.OnError != ReplaySkip && s.options.OnError != ReplayRepair {
+					outError <- err
+					return
+				}
+				slog.Warn("skipping bad transaction log record", "log", min.shard.filename, "err", err)
+				continue
+			}
+			last = e.Sequence
+			outEvent <- e
+		}
+
+		// The shards know where numbering carries on from, having read
+		// their headers and dropped any incomplete batches.
+		var seq uint64
+		for _, shard := range s.shards {
+			seq = max(seq, shard.LastSequence())
+		}
+		atomic.StoreUint64(&s.sequence, seq)
+	}()
+
+	return outEvent, outError
+}
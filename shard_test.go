@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// readSharded replays a sharded log, returning the events read, the
+// logger's last sequence afterwards and the error that stopped the replay.
+func readSharded(t *testing.T, filename string, shards int, options FileLoggerOptions) ([]Event, uint64, error) {
+	t.Helper()
+
+	tl, err := NewShardedTransactionLogger(filename, shards, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var events []Event
+	in, errs := tl.ReadEvents()
+	for e := range in {
+		// The bytes read for each event only matter to replay progress,
+		// which has its own tests.
+		e.size = 0
+		events = append(events, e)
+	}
+
+	return events, tl.LastSequence(), <-errs
+}
+
+func TestShardedRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	tl, err := NewShardedTransactionLogger(filename, 4, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+
+	var want []Event
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		tl.WritePut(key, "v")
+		want = append(want, Event{Sequence: uint64(len(want) + 1), EventType: EventPut, Key: key, Value: "v"})
+	}
+	tl.WriteDelete("key-3")
+	want = append(want, Event{Sequence: uint64(len(want) + 1), EventType: EventDelete, Key: "key-3"})
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are spread over every shard.
+	for i := 0; i < 4; i++ {
+		if info, err := os.Stat(shardFile(filename, i)); err != nil || info.Size() == 0 {
+			t.Errorf("expected shard %d to hold events: %v", i, err)
+		}
+	}
+
+	got, last, err := readSharded(t, filename, 4, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected events\n%v\ngot\n%v", want, got)
+	}
+	if last != 21 {
+		t.Errorf("expected numbering to carry on from 21, got %d", last)
+	}
+}
+
+func TestShardedBatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	tl, err := NewShardedTransactionLogger(filename, 2, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tl.(*ShardedTransactionLogger)
+
+	// Find keys in each shard, so the batch has to be split.
+	keys := make(map[int]string)
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, ok := keys[s.shardOf(key)]; !ok {
+			keys[s.shardOf(key)] = key
+		}
+	}
+
+	tl.Run()
+	tl.WritePut("before", "x")
+	tl.WriteBatch([]Event{
+		{EventType: EventPut, Key: keys[0], Value: "a"},
+		{EventType: EventPut, Key: keys[1], Value: "b"},
+		{EventType: EventDelete, Key: keys[0]},
+	})
+	tl.WritePut("after", "y")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		content, err := os.ReadFile(shardFile(filename, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), fmt.Sprintf("\t%d\t\t", EventBegin)) {
+			t.Errorf("expected shard %d to hold its part of the batch, got %q", i, content)
+		}
+	}
+
+	got, last, err := readSharded(t, filename, 2, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, e := range got {
+		order = append(order, e.EventType.String()+" "+e.Key)
+	}
+	want := []string{"PUT before", "PUT " + keys[0], "PUT " + keys[1], "DELETE " + keys[0], "PUT after"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("expected events %v, got %v", want, order)
+	}
+	// One number for each event and for each shard's BEGIN.
+	if last != 7 {
+		t.Errorf("expected last sequence 7, got %d", last)
+	}
+}
+
+func TestShardedDuplicateSequence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	os.WriteFile(shardFile(filename, 0), []byte("1\t2\tkey-a\tone\n2\t2\tkey-a\ttwo\n"), 0644)
+	os.WriteFile(shardFile(filename, 1), []byte("2\t2\tkey-b\tthree\n"), 0644)
+
+	if _, _, err := readSharded(t, filename, 2, FileLoggerOptions{}); err == nil || !strings.Contains(err.Error(), "more than one shard") {
+		t.Errorf("expected the repeated sequence to be refused, got %v", err)
+	}
+
+	got, _, err := readSharded(t, filename, 2, FileLoggerOptions{OnError: ReplaySkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected the repeat to be skipped, got %v", got)
+	}
+}
+
+func TestShardLayout(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "transaction.log")
+
+	if err := checkShardLayout(filename, 1); err != nil {
+		t.Errorf("expected a new log to be accepted, got %v", err)
+	}
+	if err := checkShardLayout(filename, 4); err != nil {
+		t.Errorf("expected a new sharded log to be accepted, got %v", err)
+	}
+
+	os.WriteFile(filename, nil, 0644)
+	if err := checkShardLayout(filename, 4); err == nil {
+		t.Error("expected an unsharded log not to be sharded")
+	}
+	os.Remove(filename)
+
+	for i := 0; i < 2; i++ {
+		os.WriteFile(shardFile(filename, i), nil, 0644)
+	}
+	if err := checkShardLayout(filename, 2); err != nil {
+		t.Errorf("expected the matching shards to be accepted, got %v", err)
+	}
+	for _, n := range []int{1, 3} {
+		if err := checkShardLayout(filename, n); err == nil {
+			t.Errorf("expected a log of 2 shards not to be opened with %d", n)
+		}
+	}
+
+	if _, err := NewShardedTransactionLogger(filename, 2, FileLoggerOptions{SequenceCheck: SequenceStrict}); err == nil {
+		t.Error("expected strict sequence checks to be refused")
+	}
+}
+
+func TestShardedSnapshotTruncate(t *testing.T) {
+	withStore(t, make(map[string]string))
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "transaction.log")
+
+	tl, err := NewShardedTransactionLogger(filename, 3, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := transactionLogger
+	transactionLogger = tl
+	t.Cleanup(func() { transactionLogger = saved })
+	tl.Run()
+
+	for i := 0; i < 10; i++ {
+		tl.WritePut(fmt.Sprintf("key-%d", i), "v")
+	}
+	if err := snapshotStore(filepath.Join(dir, "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	tl.WritePut("key-10", "v")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, last, err := readSharded(t, filename, 3, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Sequence != 11 || last != 11 {
+		t.Errorf("expected only the event after the snapshot, numbered 11, got %v (last %d)", got, last)
+	}
+}
+
+// BenchmarkShardedWrites writes distinct keys from many goroutines, syncing
+// every event, to show how write throughput scales with the number of
+// shards: each shard writes and syncs its events while the others do too.
+func BenchmarkShardedWrites(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			tl, err := NewShardedTransactionLogger(filepath.Join(b.TempDir(), "transaction.log"), shards, FileLoggerOptions{Sync: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			tl.Run()
+
+			var n atomic.Uint64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					tl.WritePut("bench-key-"+fmt.Sprint(n.Add(1)), "bench-value")
+				}
+			})
+			if err := tl.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// requestTracker counts in-flight requests and, once draining has
+// started, turns new requests away with 503 so that the ones already
+// running can finish before the server stops.
+type requestTracker struct {
+	mu       sync.Mutex
+	draining bool
+	stop     chan struct{} // closed when draining starts
+	active   sync.WaitGroup
+}
+
+var inflight requestTracker
+
+func (t *requestTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		if t.draining {
+			t.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		t.active.Add(1)
+		t.mu.Unlock()
+
+		defer t.active.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stopping returns a channel that is closed once draining starts, so that
+// requests that would otherwise run until the client leaves, such as
+// WebSocket connections, know to finish.
+func (t *requestTracker) stopping() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	return t.stop
+}
+
+// drain stops new requests from being served and waits until in-flight
+// requests have completed or ctx is done.
+func (t *requestTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	close(t.stop)
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("requests still in flight: %w", ctx.Err())
+	}
+}
+
+// shutdown drains in-flight requests, stops the HTTP server and closes
+// the transaction logger so that buffered events are written out.
+func shutdown(ctx context.Context, srv *http.Server) error {
+	slog.Info("shutting down, draining in-flight requests")
+
+	drainErr := inflight.drain(ctx)
+	if err := srv.Shutdown(ctx); err != nil && drainErr == nil {
+		drainErr = err
+	}
+	if err := transactionLogger.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction logger: %w", err)
+	}
+
+	return drainErr
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForInFlightRequests(t *testing.T) {
+	var tracker requestTracker
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := tracker.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("done"))
+	}))
+
+	slow := httptest.NewRecorder()
+	slowDone := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(slow, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(slowDone)
+	}()
+	<-started
+
+	drained := make(chan error)
+	go func() { drained <- tracker.drain(context.Background()) }()
+
+	// Wait for draining to start, then check new requests are turned away.
+	deadline := time.Now().Add(time.Second)
+	for {
+		tracker.mu.Lock()
+		draining := tracker.draining
+		tracker.mu.Unlock()
+		if draining {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tracker did not start draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rejected := httptest.NewRecorder()
+	handler.ServeHTTP(rejected, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if rejected.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected new request to get status %d, got %d", http.StatusServiceUnavailable, rejected.Code)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a request was still in flight")
+	default:
+	}
+
+	close(release)
+	<-slowDone
+	if err := <-drained; err != nil {
+		t.Error(err)
+	}
+	if slow.Code != http.StatusOK || slow.Body.String() != "done" {
+		t.Errorf("slow request did not complete: status %d, body %q", slow.Code, slow.Body.String())
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var tracker requestTracker
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := tracker.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tracker.drain(ctx); err == nil {
+		t.Error("expected drain to time out")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// slowOpThreshold is config.SlowOpThreshold, held apart so that a reload
+// can change it while operations are being timed.
+var slowOpThreshold atomic.Int64
+
+// slowOps counts the operations reported as slow since the server started.
+var slowOps atomic.Uint64
+
+// reportSlowOp warns about op, on key if it has one, when it took longer
+// than the slow operation threshold. Unlike the debug log, the warning
+// names the key, as that is often what explains the delay.
+func reportSlowOp(op, key string, took time.Duration) {
+	threshold := time.Duration(slowOpThreshold.Load())
+	if threshold <= 0 || took <= threshold {
+		return
+	}
+
+	slowOps.Add(1)
+	attrs := []any{"op", op, "took", took, "threshold", threshold}
+	if key != "" {
+		attrs = append(attrs, "key", key)
+	}
+	slog.Warn("slow operation", attrs...)
+}
+
+// registerSlowOpMetrics exposes the number of slow operations as a gauge.
+func registerSlowOpMetrics() {
+	registerGauge("kvstore_slow_operations", "Store and transaction log operations that took longer than -slow-op-threshold.", func() float64 {
+		return float64(slowOps.Load())
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSlowOpThreshold(t *testing.T, threshold time.Duration) {
+	t.Helper()
+
+	saved := slowOpThreshold.Load()
+	t.Cleanup(func() { slowOpThreshold.Store(saved) })
+	slowOpThreshold.Store(int64(threshold))
+}
+
+func TestSlowOpWarning(t *testing.T) {
+	withStore(t, map[string]string{"k": "v"})
+	withLogger(t)
+	withSlowOpThreshold(t, 20*time.Millisecond)
+	buf := withLogOutput(t, slog.LevelWarn)
+	before := slowOps.Load()
+
+	get := func() {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/k", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("unexpected status %d", rec.Code)
+		}
+	}
+
+	get()
+	if buf.Len() != 0 {
+		t.Errorf("expected no warning for a fast get, got %q", buf)
+	}
+
+	// Holding the store lock makes the get wait for it.
+	store.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	store.Unlock()
+	<-done
+
+	out := buf.String()
+	if !strings.Contains(out, `msg="slow operation" op=store.get`) || !strings.Contains(out, "key=k") {
+		t.Errorf("expected a slow operation warning naming store.get and k, got %q", out)
+	}
+	if got := slowOps.Load() - before; got != 1 {
+		t.Errorf("expected 1 slow operation counted, got %d", got)
+	}
+}
+
+func TestSlowLogFlushWarning(t *testing.T) {
+	withStore(t, make(map[string]string))
+	logger := slowLogger{release: make(chan struct{})}
+	saved := transactionLogger
+	transactionLogger = logger
+	t.Cleanup(func() { transactionLogger = saved })
+	withWritePolicy(t, WriteAhead)
+	withSlowOpThreshold(t, 20*time.Millisecond)
+	buf := withLogOutput(t, slog.LevelWarn)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(logger.release) })
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/k", strings.NewReader("v")))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	if !strings.Contains(buf.String(), "op=log.flush") {
+		t.Errorf("expected a slow flush warning, got %q", buf)
+	}
+}
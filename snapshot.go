@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotHeaderPrefix starts the first line of a snapshot file, which
+// records the sequence number of the latest event the snapshot reflects.
+// Each following line is a JSON object holding one key, its value and
+// whether it is immutable.
+const snapshotHeaderPrefix = "#kvstore-snapshot version=1 seq="
+
+type snapshotEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Immutable bool   `json:"immutable,omitempty"`
+}
+
+// writeSnapshot writes the contents of the store to path as reflecting
+// the events up to seq. The snapshot is written to a temporary file and
+// renamed into place, so path always holds a complete snapshot. The
+// caller must make sure no writes are made to the store meanwhile.
+func writeSnapshot(path string, seq uint64) error {
+	tmpName := path + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create snapshot: %w", err)
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "%s%d\n", snapshotHeaderPrefix, seq)
+	enc := json.NewEncoder(w)
+
+	store.RLock()
+	err = store.data.each(func(k, v string) error {
+		return enc.Encode(snapshotEntry{k, v, mutable(k) != nil})
+	})
+	store.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	// Sync the directory so that the rename itself survives a crash
+	// before the log is truncated.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// loadSnapshot replaces the contents of the store with the snapshot at
+// path and returns the sequence number it reflects. A missing snapshot
+// leaves the store alone and reflects nothing, so 0 is returned.
+func loadSnapshot(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, snapshotHeaderPrefix) {
+		return 0, fmt.Errorf("snapshot %s has no valid header", path)
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(header, snapshotHeaderPrefix)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad snapshot sequence in %q", header)
+	}
+
+	data, err := newMemoryStore()
+	if err != nil {
+		return 0, err
+	}
+	var immutable []string
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return 0, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		if err := data.update(func(w kvWriter) error { return w.put(e.Key, e.Value) }); err != nil {
+			return 0, err
+		}
+		if e.Immutable {
+			immutable = append(immutable, e.Key)
+		}
+	}
+
+	if err := useBackend(data); err != nil {
+		return 0, err
+	}
+	store.Lock()
+	for _, k := range immutable {
+		store.meta[k].Immutable = true
+	}
+	store.Unlock()
+
+	return seq, nil
+}
+
+// snapshotStore writes a snapshot of the store to path and truncates the
+// file transaction log to the events after it. Writes are blocked while
+// the snapshot is taken, so it reflects exactly the events logged so far.
+func snapshotStore(path string) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := transactionLogger.Flush(); err != nil {
+		return err
+	}
+	seq := transactionLogger.LastSequence()
+	if err := writeSnapshot(path, seq); err != nil {
+		return err
+	}
+
+	if t, ok := transactionLogger.(interface{ Truncate(seq uint64) error }); ok {
+		if err := t.Truncate(seq); err != nil {
+			return fmt.Errorf("failed to truncate transaction log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// startSnapshotter snapshots the store at interval until the returned
+// function is called.
+func startSnapshotter(path string, interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if err := snapshotStore(path); err != nil {
+					slog.Error("snapshot failed", "err", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
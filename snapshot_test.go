@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotTruncateRestart(t *testing.T) {
+	withStore(t, make(map[string]string))
+	logger := withLogger(t)
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	request := func(method, key, value string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(method, "/v1/"+key, strings.NewReader(value)))
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status %d", method, key, rec.Code)
+		}
+	}
+
+	request(http.MethodPut, "a", "1")
+	request(http.MethodPut, "b", "2")
+	request(http.MethodDelete, "a", "")
+
+	if err := snapshotStore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#kvstore-log format=tab version=1 base=3\n"; string(content) != want {
+		t.Errorf("got truncated log %q, want %q", content, want)
+	}
+
+	request(http.MethodPut, "b", "two")
+	request(http.MethodPut, "c", "3")
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart: load the snapshot, then replay the tail of the log.
+	withStore(t, make(map[string]string))
+	seq, err := loadSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 3 {
+		t.Errorf("expected snapshot at sequence 3, got %d", seq)
+	}
+	if want := map[string]string{"b": "2"}; !reflect.DeepEqual(map[string]string(storeMap()), want) {
+		t.Errorf("snapshot holds %v, want %v", storeMap(), want)
+	}
+
+	tl, err := NewTransactionLogger(logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := replayEventsAfter(tl, seq, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 events replayed, got %d", n)
+	}
+	if want := map[string]string{"b": "two", "c": "3"}; !reflect.DeepEqual(map[string]string(storeMap()), want) {
+		t.Errorf("restarted store holds %v, want %v", storeMap(), want)
+	}
+	if tl.LastSequence() != 5 {
+		t.Errorf("expected last sequence 5, got %d", tl.LastSequence())
+	}
+}
+
+func TestTruncateKeepsSequence(t *testing.T) {
+	filename := writeLogFile(t, "1\t2\tkey-a\tone\n2\t2\tkey-b\ttwo\n3\t1\tkey-a\t\n")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.(*FileTransactionLogger).Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	tl.Close()
+
+	// With no events left, sequence numbers carry on from the header.
+	tl, err = NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, errs := tl.ReadEvents()
+	for range events {
+		t.Error("expected no events after truncation")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("key-c", "three")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readAll(t, filename, FileLoggerOptions{SequenceCheck: SequenceStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Sequence != 4 {
+		t.Errorf("expected one event at sequence 4, got %+v", got)
+	}
+}
+
+func TestLoadMissingSnapshot(t *testing.T) {
+	withStore(t, map[string]string{"kept": "value"})
+
+	seq, err := loadSnapshot(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || seq != 0 {
+		t.Errorf("expected 0, nil for a missing snapshot, got %d, %v", seq, err)
+	}
+	if _, ok := storeMap()["kept"]; !ok {
+		t.Error("loading a missing snapshot changed the store")
+	}
+}
+
+func TestSnapshotKeepsImmutable(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	PutContent("fixed", "1", "", writeImmutable)
+	Put("loose", "2")
+	if err := snapshotStore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	withStore(t, make(map[string]string))
+	if _, err := loadSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete("fixed"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("expected fixed to be immutable after loading the snapshot, got %v", err)
+	}
+	if err := Delete("loose"); err != nil {
+		t.Errorf("expected loose to be deleted, got %v", err)
+	}
+}
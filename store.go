@@ -2,27 +2,340 @@ package main
 
 import (
 	"errors"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNoSuchKey = errors.New("no such key")
+var ErrKeyExists = errors.New("key already exists")
+var ErrImmutable = errors.New("key is immutable")
 var store = struct {
 	sync.RWMutex
-	m map[string]string
-}{m: make(map[string]string)}
+	data kvBackend
+	meta map[string]*Metadata // bookkeeping for the values in data
 
-func Put(key, value string) error {
+	// tombstones records when keys were deleted, if tombstone retention
+	// is enabled. A key is never in both data and tombstones.
+	tombstones map[string]time.Time
+
+	// keys, keyBytes and valueBytes count the keys in data and total the
+	// lengths of the keys and values, kept up to date on every write.
+	keys       int
+	keyBytes   int64
+	valueBytes int64
+
+	// usage is what each namespace holds, kept up to date on every
+	// write like the totals above.
+	usage map[string]NamespaceUsage
+}{data: memoryBackend{}, meta: make(map[string]*Metadata), tombstones: make(map[string]time.Time), usage: make(map[string]NamespaceUsage)}
+
+// kvBackend holds the keys and values of the store. Access to it is
+// serialized by the store's lock.
+type kvBackend interface {
+	kvReader
+	// update runs fn with a writer whose changes are applied atomically.
+	update(fn func(w kvWriter) error) error
+	// each calls fn with every key and its value, stopping at the first
+	// error, which it returns.
+	each(fn func(key, value string) error) error
+	// eachKey is each without the values, which backends that keep them
+	// on disk then don't read.
+	eachKey(fn func(key string) error) error
+}
+
+type kvReader interface {
+	get(key string) (value string, ok bool, err error)
+}
+
+// kvWriter changes the store within an update. Its get sees the changes
+// made so far in the same update.
+type kvWriter interface {
+	kvReader
+	put(key, value string) error
+	delete(key string) error
+}
+
+// memoryBackend keeps the store in a map, relying on the transaction log
+// to rebuild it after a restart.
+type memoryBackend map[string]string
+
+func (m memoryBackend) get(key string) (string, bool, error) {
+	value, ok := m[key]
+	return value, ok, nil
+}
+
+func (m memoryBackend) update(fn func(w kvWriter) error) error { return fn(m) }
+
+func (m memoryBackend) each(fn func(key, value string) error) error {
+	for k, v := range m {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryBackend) eachKey(fn func(key string) error) error {
+	for k := range m {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryBackend) put(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryBackend) delete(key string) error {
+	delete(m, key)
+	return nil
+}
+
+// useBackend makes data the store's backend, recounting its contents.
+func useBackend(data kvBackend) error {
 	store.Lock()
-	store.m[key] = value
-	store.Unlock()
+	defer store.Unlock()
+
+	store.data = data
+	store.meta = make(map[string]*Metadata)
+	store.tombstones = make(map[string]time.Time)
+	store.keys, store.keyBytes, store.valueBytes = 0, 0, 0
+	store.usage = make(map[string]NamespaceUsage)
+
+	now := time.Now()
+	err := data.each(func(k, v string) error {
+		meta := &Metadata{Created: now, Updated: now, Size: len(v), accessed: new(atomic.Int64)}
+		meta.accessed.Store(now.UnixNano())
+		store.meta[k] = meta
+		store.keys++
+		store.keyBytes += int64(len(k))
+		store.valueBytes += int64(len(v))
+		trackUsage(k, 1, int64(len(k)+len(v)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if b, ok := data.(interface{ immutableKeys() ([]string, error) }); ok {
+		keys, err := b.immutableKeys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if meta := store.meta[k]; meta != nil {
+				meta.Immutable = true
+			}
+		}
+	}
 
 	return nil
 }
 
+// Metadata describes a stored value. Values restored from the transaction
+// log get the times their events were logged, where the log records them
+// (the JSON format and postgres do, the tab format doesn't), and
+// otherwise the time they were replayed.
+type Metadata struct {
+	Version uint64    `json:"version"` // number of writes since the key was created
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// ContentType is the media type the value was put with, if any.
+	// Writes that give none clear it.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Immutable keys were created with the immutable flag, and refuse
+	// every later put and delete.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// Size is the length of the value in bytes, kept here so that sizing
+	// a value doesn't mean reading it, as it does for a value the blob
+	// store keeps on disk.
+	Size int `json:"size"`
+
+	// accessed is when the value was last read or written, in Unix
+	// nanoseconds. Reads only hold the store's read lock, so it is updated
+	// atomically rather than under the write lock.
+	accessed *atomic.Int64
+}
+
+// Put stores value under key, reporting whether the key was newly
+// created rather than overwritten.
+func Put(key, value string) (created bool, err error) {
+	created, _, err = PutContent(key, value, "", writeAlways)
+	return created, err
+}
+
+// writeCondition limits when PutContent stores a value.
+type writeCondition int
+
+const (
+	writeAlways    writeCondition = iota
+	writeIfAbsent                 // only create the key
+	writeIfExists                 // only replace the value of an existing key
+	writeImmutable                // only create the key, making it immutable
+)
+
+// PutContent stores value under key if cond holds, recording contentType,
+// the value's media type, in its metadata along with it. It reports
+// whether the key was newly created and whether the value was stored. It
+// fails with ErrImmutable if the key is immutable and cond would replace
+// its value, and with ErrQuotaExceeded if the value would take the key's
+// namespace past its quota.
+func PutContent(key, value, contentType string, cond writeCondition) (created, stored bool, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, stored, err := checkPut(key, value, cond); !stored || err != nil {
+		return false, false, err
+	}
+	err = store.data.update(func(w kvWriter) error {
+		if created, err = set(w, key, value); err != nil {
+			return err
+		}
+		if cond == writeImmutable {
+			return makeImmutable(w, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, false, err
+	}
+	store.meta[key].ContentType = contentType
+
+	return created, true, nil
+}
+
+// CheckPut reports what PutContent would do with the same arguments
+// without doing it: whether the key would be created and whether the
+// value would be stored, or the error PutContent would fail with.
+func CheckPut(key, value string, cond writeCondition) (created, stored bool, err error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkPut(key, value, cond)
+}
+
+// checkPut is CheckPut for a caller holding at least the store's read
+// lock.
+func checkPut(key, value string, cond writeCondition) (created, stored bool, err error) {
+	old, exists := storedSize(key)
+	if (cond == writeIfAbsent || cond == writeImmutable) && exists || cond == writeIfExists && !exists {
+		return false, false, nil
+	}
+	if err := mutable(key); err != nil {
+		return false, false, err
+	}
+	delta := make(usageDelta)
+	delta.put(key, old, exists, len(value))
+	if err := delta.check(); err != nil {
+		return false, false, err
+	}
+
+	return !exists, true, nil
+}
+
+// set stores value under key through w, keeping the metadata, size totals
+// and tombstones in step. The caller must hold the store's write lock.
+func set(w kvWriter, key, value string) (created bool, err error) {
+	old, exists := storedSize(key)
+	if err := w.put(key, value); err != nil {
+		return false, err
+	}
+	recordSet(key, old, exists, len(value))
+
+	return !exists, nil
+}
+
+// recordSet brings the metadata, size totals and tombstones up to date
+// with a value of size bytes stored under key, replacing one of old bytes
+// if it existed. The caller must hold the store's write lock.
+func recordSet(key string, old int, exists bool, size int) {
+	if exists {
+		store.valueBytes -= int64(old)
+		trackUsage(key, 0, int64(size-old))
+	} else {
+		store.keys++
+		store.keyBytes += int64(len(key))
+		trackUsage(key, 1, int64(len(key)+size))
+	}
+	store.valueBytes += int64(size)
+	touch(key)
+	store.meta[key].Size = size
+	delete(store.tombstones, key)
+}
+
+// storedSize returns the size of the value stored under key, and false if
+// there is none, going by the key's metadata rather than reading the
+// value. The caller must hold at least the store's read lock.
+func storedSize(key string) (int, bool) {
+	meta, ok := store.meta[key]
+	if !ok {
+		return 0, false
+	}
+	return meta.Size, true
+}
+
+// mutable fails with ErrImmutable if key is immutable. The caller must
+// hold at least the store's read lock.
+func mutable(key string) error {
+	if meta := store.meta[key]; meta != nil && meta.Immutable {
+		return ErrImmutable
+	}
+	return nil
+}
+
+// makeImmutable marks key immutable, in the backend too if it keeps the
+// mark. The caller must hold the store's write lock.
+func makeImmutable(w kvWriter, key string) error {
+	store.meta[key].Immutable = true
+	if m, ok := w.(interface{ markImmutable(key string) error }); ok {
+		return m.markImmutable(key)
+	}
+	return nil
+}
+
+// touch records a write to key in its metadata. The caller must hold the
+// store's write lock.
+func touch(key string) {
+	now := time.Now()
+
+	meta, ok := store.meta[key]
+	if !ok {
+		meta = &Metadata{Created: now, accessed: new(atomic.Int64)}
+		store.meta[key] = meta
+	}
+	meta.Version++
+	meta.Updated = now
+	meta.ContentType = ""
+	meta.accessed.Store(now.UnixNano())
+}
+
+// markAccessed records a read of key. The caller must hold at least the
+// store's read lock.
+func markAccessed(key string) {
+	if meta := store.meta[key]; meta != nil {
+		meta.accessed.Store(time.Now().UnixNano())
+	}
+}
+
+// Get returns the value stored under key, recording the access.
 func Get(key string) (string, error) {
 	store.RLock()
-	value, ok := store.m[key]
+	value, ok, err := store.data.get(key)
+	if ok {
+		markAccessed(key)
+	}
 	store.RUnlock()
+	if err != nil {
+		return "", err
+	}
 	if !ok {
 		return "", ErrNoSuchKey
 	}
@@ -30,10 +343,436 @@ func Get(key string) (string, error) {
 	return value, nil
 }
 
+// Exists reports whether key is in the store, recording the access as
+// Get does but without copying its value.
+func Exists(key string) (bool, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	_, ok, err := store.data.get(key)
+	if ok {
+		markAccessed(key)
+	}
+	return ok, err
+}
+
+// errFound stops a walk over the store once it has found what it is after.
+var errFound = errors.New("found")
+
+// RandomKey returns a key chosen uniformly at random and its value, and
+// false if the store is empty. Picking one means walking the keys up to
+// it, so it takes time in proportion to the size of the store. It isn't
+// counted as an access, so sampling doesn't keep idle keys alive.
+func RandomKey() (key, value string, ok bool, err error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	if store.keys == 0 {
+		return "", "", false, nil
+	}
+
+	n := rand.Intn(store.keys)
+	err = store.data.eachKey(func(k string) error {
+		if n > 0 {
+			n--
+			return nil
+		}
+		key = k
+		return errFound
+	})
+	if !errors.Is(err, errFound) {
+		return "", "", false, err
+	}
+	value, ok, err = store.data.get(key)
+	if err != nil || !ok {
+		return "", "", false, err
+	}
+	return key, value, true, nil
+}
+
+// GetWithMetadata returns the value stored under key along with its
+// metadata.
+func GetWithMetadata(key string) (string, Metadata, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	value, ok, err := store.data.get(key)
+	if err != nil {
+		return "", Metadata{}, err
+	}
+	if !ok {
+		return "", Metadata{}, ErrNoSuchKey
+	}
+
+	markAccessed(key)
+	var meta Metadata
+	if m := store.meta[key]; m != nil {
+		meta = *m
+	}
+
+	return value, meta, nil
+}
+
+// SetIfAbsent stores value under key only if the key doesn't exist yet,
+// reporting whether the value was stored.
+func SetIfAbsent(key, value string) (bool, error) {
+	_, stored, err := PutContent(key, value, "", writeIfAbsent)
+	return stored, err
+}
+
+// UpdateExisting stores value under key only if the key already exists,
+// reporting whether the value was stored.
+func UpdateExisting(key, value string) (bool, error) {
+	_, stored, err := PutContent(key, value, "", writeIfExists)
+	return stored, err
+}
+
+// Delete removes key from the store. When tombstone retention is enabled
+// the deletion is remembered until purgeTombstones discards it. It fails
+// with ErrImmutable if the key is immutable.
 func Delete(key string) error {
 	store.Lock()
-	delete(store.m, key)
-	store.Unlock()
+	defer store.Unlock()
+
+	if err := mutable(key); err != nil {
+		return err
+	}
+	return store.data.update(func(w kvWriter) error {
+		return remove(w, key)
+	})
+}
+
+// CompareAndDelete removes key only if its current value is expected,
+// reporting whether it was removed. It fails with ErrNoSuchKey if the key
+// doesn't exist.
+func CompareAndDelete(key, expected string) (bool, error) {
+	return deleteIf(key, matchValue(expected))
+}
+
+// DeleteIfVersion removes key only if its current version is version,
+// reporting whether it was removed. It fails with ErrNoSuchKey if the key
+// doesn't exist.
+func DeleteIfVersion(key string, version uint64) (bool, error) {
+	return deleteIf(key, matchVersion(version))
+}
+
+// deleteMatch decides from a key's current value and metadata whether a
+// conditional delete goes ahead.
+type deleteMatch func(value string, meta *Metadata) bool
+
+// matchValue matches a key holding expected.
+func matchValue(expected string) deleteMatch {
+	return func(value string, meta *Metadata) bool { return value == expected }
+}
+
+// matchVersion matches a key at version.
+func matchVersion(version uint64) deleteMatch {
+	return func(value string, meta *Metadata) bool { return meta != nil && meta.Version == version }
+}
+
+// deleteIf removes key if match holds for its current value and metadata,
+// checking and deleting under one hold of the store's write lock.
+func deleteIf(key string, match deleteMatch) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if deleted, err := checkDelete(key, match); !deleted || err != nil {
+		return false, err
+	}
+	err := store.data.update(func(w kvWriter) error {
+		return remove(w, key)
+	})
+
+	return err == nil, err
+}
+
+// CheckDelete reports whether key would be deleted if match, when not
+// nil, holds for its current value and metadata, without deleting it. It
+// fails with ErrNoSuchKey if the key doesn't exist, and with ErrImmutable
+// if it would be deleted but is immutable.
+func CheckDelete(key string, match deleteMatch) (bool, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkDelete(key, match)
+}
+
+// checkDelete is CheckDelete for a caller holding at least the store's
+// read lock. Only a match is given the value, so that an unconditional
+// delete doesn't read it.
+func checkDelete(key string, match deleteMatch) (bool, error) {
+	if _, ok := storedSize(key); !ok {
+		return false, ErrNoSuchKey
+	}
+	if match != nil {
+		value, ok, err := store.data.get(key)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, ErrNoSuchKey
+		}
+		if !match(value, store.meta[key]) {
+			return false, nil
+		}
+	}
+	if err := mutable(key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Rename moves the value stored under oldKey to newKey in one step, so no
+// reader sees the value under both keys or under neither. It fails with
+// ErrNoSuchKey if oldKey doesn't exist, ErrKeyExists if newKey does,
+// ErrImmutable if either is immutable and ErrQuotaExceeded if the move
+// would take newKey's namespace past its quota.
+func Rename(oldKey, newKey string) error {
+	_, err := rename(oldKey, newKey, false)
+	return err
+}
+
+// rename is Rename, replacing the value of newKey if overwrite is set. It
+// returns the value that was moved.
+func rename(oldKey, newKey string, overwrite bool) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	value, err := checkRename(oldKey, newKey, overwrite)
+	if err != nil || oldKey == newKey {
+		return value, err
+	}
+	if err := stageValues([]string{value}); err != nil {
+		return value, err
+	}
+	err = store.data.update(func(w kvWriter) error {
+		var contentType string
+		if meta := store.meta[oldKey]; meta != nil {
+			contentType = meta.ContentType
+		}
+		if err := remove(w, oldKey); err != nil {
+			return err
+		}
+		if _, err = set(w, newKey, value); err != nil {
+			return err
+		}
+		store.meta[newKey].ContentType = contentType
+		return nil
+	})
+
+	return value, err
+}
+
+// CheckRename reports what rename would do with the same arguments
+// without doing it: the value that would be moved, or the error rename
+// would fail with.
+func CheckRename(oldKey, newKey string, overwrite bool) (string, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkRename(oldKey, newKey, overwrite)
+}
+
+// checkRename is CheckRename for a caller holding at least the store's
+// read lock.
+func checkRename(oldKey, newKey string, overwrite bool) (string, error) {
+	value, ok, err := store.data.get(oldKey)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNoSuchKey
+	}
+	if oldKey == newKey {
+		return value, nil
+	}
+
+	replaced, exists := storedSize(newKey)
+	if exists && !overwrite {
+		return "", ErrKeyExists
+	}
+	if err := mutable(oldKey); err != nil {
+		return "", err
+	}
+	if err := mutable(newKey); err != nil {
+		return "", err
+	}
+	delta := make(usageDelta)
+	delta.remove(oldKey, len(value))
+	delta.put(newKey, replaced, exists, len(value))
+	if err := delta.check(); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// remove deletes key along with its metadata through w. The caller must
+// hold the store's write lock.
+func remove(w kvWriter, key string) error {
+	old, ok := storedSize(key)
+	if !ok {
+		return nil
+	}
+	if err := w.delete(key); err != nil {
+		return err
+	}
+
+	store.keys--
+	store.keyBytes -= int64(len(key))
+	store.valueBytes -= int64(old)
+	trackUsage(key, -1, -int64(len(key)+old))
+	if config.TombstoneRetention > 0 {
+		store.tombstones[key] = time.Now()
+	}
+	delete(store.meta, key)
 
 	return nil
 }
+
+// IdleKeys returns the keys that have not been read or written since
+// cutoff, along with the sizes of their values.
+//
+// Like List, the result is a snapshot copied under a single hold of the
+// read lock.
+func IdleKeys(cutoff time.Time) ([]KeyInfo, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	keys := []KeyInfo{}
+	err := store.data.eachKey(func(k string) error {
+		if isIdle(k, cutoff) {
+			size, _ := storedSize(k)
+			keys = append(keys, KeyInfo{Key: k, Size: size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteIdle removes the keys that have not been read or written since
+// cutoff, returning the keys removed. Reserved and immutable keys are never
+// removed.
+func DeleteIdle(cutoff time.Time) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	idle, err := checkDeleteIdle(cutoff)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeKeys(idle); err != nil {
+		return nil, err
+	}
+
+	return idle, nil
+}
+
+// CheckDeleteIdle returns the keys DeleteIdle would remove, without
+// removing them.
+func CheckDeleteIdle(cutoff time.Time) ([]string, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkDeleteIdle(cutoff)
+}
+
+// checkDeleteIdle is CheckDeleteIdle for a caller holding at least the
+// store's read lock.
+func checkDeleteIdle(cutoff time.Time) ([]string, error) {
+	var idle []string
+	err := store.data.eachKey(func(k string) error {
+		if !isReservedKey(k) && mutable(k) == nil && isIdle(k, cutoff) {
+			idle = append(idle, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return idle, nil
+}
+
+// DeleteKeys removes keys from the store in one step, skipping those that
+// don't exist. Unlike Delete it doesn't refuse immutable keys: it is for
+// deletes that have been checked already.
+func DeleteKeys(keys []string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	return removeKeys(keys)
+}
+
+// removeKeys is DeleteKeys for a caller holding the store's write lock.
+func removeKeys(keys []string) error {
+	return store.data.update(func(w kvWriter) error {
+		for _, k := range keys {
+			if err := remove(w, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// isIdle reports whether key was last accessed before cutoff. The caller
+// must hold at least the store's read lock.
+func isIdle(key string, cutoff time.Time) bool {
+	meta := store.meta[key]
+	return meta != nil && meta.accessed.Load() < cutoff.UnixNano()
+}
+
+// KeyInfo describes a stored key and the size in bytes of its value.
+type KeyInfo struct {
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+}
+
+// List returns every key in the store along with the size of its value.
+// The order of the result is unspecified.
+//
+// The keys are copied under a single hold of the read lock, so the result
+// is a snapshot of the store at one point in time: a transaction or rename
+// is either wholly in it or not at all. The price is a 24-byte KeyInfo per
+// key, about 240MB for ten million keys, plus a copy of the keys
+// themselves with the bbolt store, where they don't live in memory.
+// Writers wait until the copy is done. Values aren't read: their sizes
+// come from the keys' metadata.
+func List() ([]KeyInfo, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	keys := make([]KeyInfo, 0, store.keys)
+	err := store.data.eachKey(func(k string) error {
+		size, _ := storedSize(k)
+		keys = append(keys, KeyInfo{Key: k, Size: size})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// StoreStats summarizes the size of the store.
+type StoreStats struct {
+	Keys       int   `json:"keys"`
+	KeyBytes   int64 `json:"key_bytes"`
+	ValueBytes int64 `json:"value_bytes"`
+}
+
+// Stats returns the number of keys and the total bytes of keys and values
+// in the store. The totals are maintained on write, so this is cheap.
+func Stats() StoreStats {
+	store.RLock()
+	defer store.RUnlock()
+
+	return StoreStats{Keys: store.keys, KeyBytes: store.keyBytes, ValueBytes: store.valueBytes}
+}
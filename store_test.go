@@ -2,9 +2,18 @@ package main
 
 import (
 	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// storeMap returns the map behind the in-memory store backend.
+func storeMap() memoryBackend {
+	return store.data.(memoryBackend)
+}
+
 func TestPut(t *testing.T) {
 	const key = "create-key"
 	const value = "create-value"
@@ -12,21 +21,24 @@ func TestPut(t *testing.T) {
 	var val interface{}
 	var contains bool
 
-	defer delete(store.m, key)
+	defer delete(storeMap(), key)
 
 	// sanity check
-	_, contains = store.m[key]
+	_, contains = storeMap()[key]
 	if contains {
 		t.Error("key/value already exists")
 	}
 
 	// err should be nil
-	err := Put(key, value)
+	created, err := Put(key, value)
 	if err != nil {
 		t.Error(err)
 	}
+	if !created {
+		t.Error("expected the key to be reported as created")
+	}
 
-	val, contains = store.m[key]
+	val, contains = storeMap()[key]
 	if !contains {
 		t.Error("create failed")
 	}
@@ -36,6 +48,25 @@ func TestPut(t *testing.T) {
 	}
 }
 
+func TestPutOverwrite(t *testing.T) {
+	const key = "overwrite-key"
+
+	// Seeded through useBackend, so that the key has its metadata.
+	withStore(t, map[string]string{key: "old-value"})
+
+	created, err := Put(key, "new-value")
+	if err != nil {
+		t.Error(err)
+	}
+	if created {
+		t.Error("expected the key to be reported as overwritten")
+	}
+
+	if storeMap()[key] != "new-value" {
+		t.Error("overwrite failed")
+	}
+}
+
 func TestGet(t *testing.T) {
 	const key = "read-key"
 	const value = "read-value"
@@ -43,7 +74,7 @@ func TestGet(t *testing.T) {
 	var val interface{}
 	var err error
 
-	defer delete(store.m, key)
+	defer delete(storeMap(), key)
 
 	// read non existing value
 	val, err = Get(key)
@@ -54,7 +85,7 @@ func TestGet(t *testing.T) {
 		t.Error("unexpected error: ", err)
 	}
 
-	store.m[key] = value
+	storeMap()[key] = value
 
 	// reading the value
 	val, err = Get(key)
@@ -73,19 +104,343 @@ func TestDelete(t *testing.T) {
 
 	var contains bool
 
-	defer delete(store.m, key)
-
-	store.m[key] = value
+	withStore(t, map[string]string{key: value})
 
-	_, contains = store.m[key]
+	_, contains = storeMap()[key]
 	if !contains {
 		t.Error("key/value doesn't exist")
 	}
 
 	Delete(key)
 
-	_, contains = store.m[key]
+	_, contains = storeMap()[key]
 	if contains {
 		t.Error("delete failed")
 	}
 }
+
+func TestSetIfAbsent(t *testing.T) {
+	const key = "setnx-key"
+
+	defer delete(storeMap(), key)
+
+	created, err := SetIfAbsent(key, "first")
+	if err != nil {
+		t.Error(err)
+	}
+	if !created {
+		t.Error("expected the key to be created")
+	}
+
+	created, err = SetIfAbsent(key, "second")
+	if err != nil {
+		t.Error(err)
+	}
+	if created {
+		t.Error("expected the existing key to be kept")
+	}
+
+	if storeMap()[key] != "first" {
+		t.Error("value was overwritten")
+	}
+}
+
+func TestUpdateExisting(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+
+	updated, err := UpdateExisting("a", "2")
+	if err != nil {
+		t.Error(err)
+	}
+	if !updated || storeMap()["a"] != "2" {
+		t.Errorf("expected a to be updated, got %q", storeMap()["a"])
+	}
+
+	updated, err = UpdateExisting("b", "1")
+	if err != nil {
+		t.Error(err)
+	}
+	if updated {
+		t.Error("expected the missing key not to be updated")
+	}
+	if _, ok := storeMap()["b"]; ok {
+		t.Error("the missing key was created")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+
+	deleted, err := CompareAndDelete("a", "2")
+	if err != nil {
+		t.Error(err)
+	}
+	if deleted || storeMap()["a"] != "1" {
+		t.Error("expected a mismatched value not to be deleted")
+	}
+
+	deleted, err = CompareAndDelete("a", "1")
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok := storeMap()["a"]; !deleted || ok {
+		t.Error("expected a matching value to be deleted")
+	}
+
+	if _, err := CompareAndDelete("a", "1"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("missing key: expected %v, got %v", ErrNoSuchKey, err)
+	}
+}
+
+func TestDeleteIfVersion(t *testing.T) {
+	withStore(t, make(map[string]string))
+	Put("a", "1")
+	Put("a", "2")
+
+	deleted, err := DeleteIfVersion("a", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if deleted || storeMap()["a"] != "2" {
+		t.Error("expected a stale version not to be deleted")
+	}
+
+	deleted, err = DeleteIfVersion("a", 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok := storeMap()["a"]; !deleted || ok {
+		t.Error("expected the current version to be deleted")
+	}
+
+	if _, err := DeleteIfVersion("a", 2); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("missing key: expected %v, got %v", ErrNoSuchKey, err)
+	}
+}
+
+func TestSetIfAbsentConcurrent(t *testing.T) {
+	const key = "setnx-race-key"
+
+	defer delete(storeMap(), key)
+
+	var wg sync.WaitGroup
+	var winners int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			created, _ := SetIfAbsent(key, strconv.Itoa(i))
+			if created {
+				atomic.AddInt32(&winners, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Errorf("expected exactly one winner, got %d", winners)
+	}
+}
+
+func TestStats(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	check := func(step string, want StoreStats) {
+		t.Helper()
+		if got := Stats(); got != want {
+			t.Errorf("%s: expected %+v, got %+v", step, want, got)
+		}
+	}
+
+	Put("alpha", "12345")
+	check("put", StoreStats{Keys: 1, KeyBytes: 5, ValueBytes: 5})
+
+	SetIfAbsent("be", "xyz")
+	check("set if absent", StoreStats{Keys: 2, KeyBytes: 7, ValueBytes: 8})
+
+	Put("alpha", "1")
+	check("overwrite", StoreStats{Keys: 2, KeyBytes: 7, ValueBytes: 4})
+
+	Delete("alpha")
+	check("delete", StoreStats{Keys: 1, KeyBytes: 2, ValueBytes: 3})
+
+	Delete("missing")
+	check("delete missing", StoreStats{Keys: 1, KeyBytes: 2, ValueBytes: 3})
+}
+
+func TestRename(t *testing.T) {
+	withStore(t, map[string]string{"old": "value", "taken": "other"})
+
+	if err := Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("old"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected old key to be gone, got %v", err)
+	}
+	if v, err := Get("new"); err != nil || v != "value" {
+		t.Errorf("expected new key to hold value, got %q, %v", v, err)
+	}
+	if s := Stats(); s.Keys != 2 {
+		t.Errorf("expected 2 keys after rename, got %d", s.Keys)
+	}
+
+	if err := Rename("missing", "elsewhere"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected ErrNoSuchKey renaming a missing key, got %v", err)
+	}
+
+	if err := Rename("new", "taken"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists renaming onto an existing key, got %v", err)
+	}
+	if v, _ := Get("taken"); v != "other" {
+		t.Errorf("failed rename overwrote destination with %q", v)
+	}
+	if _, err := rename("new", "taken", true); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := Get("taken"); v != "value" {
+		t.Errorf("expected overwriting rename to move value, got %q", v)
+	}
+}
+
+// setAccessed pretends key was last accessed at t.
+func setAccessed(key string, t time.Time) {
+	store.meta[key].accessed.Store(t.UnixNano())
+}
+
+func TestIdleKeys(t *testing.T) {
+	withStore(t, map[string]string{"cold": "1", "warm": "22", "hot": "333"})
+	now := time.Now()
+	setAccessed("cold", now.Add(-2*time.Hour))
+	setAccessed("warm", now.Add(-2*time.Hour))
+	setAccessed("hot", now.Add(-time.Minute))
+
+	// Reading warm makes it recently accessed.
+	if _, err := Get("warm"); err != nil {
+		t.Fatal(err)
+	}
+
+	idle, err := IdleKeys(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idle) != 1 || idle[0] != (KeyInfo{Key: "cold", Size: 1}) {
+		t.Errorf("expected only cold to be idle, got %v", idle)
+	}
+
+	deleted, err := DeleteIdle(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "cold" {
+		t.Errorf("expected cold to be deleted, got %v", deleted)
+	}
+	if _, err := Get("cold"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected cold to be gone, got %v", err)
+	}
+	if s := Stats(); s.Keys != 2 {
+		t.Errorf("expected 2 keys left, got %d", s.Keys)
+	}
+}
+
+func TestListConsistentUnderWrites(t *testing.T) {
+	withStore(t, map[string]string{"pair/a": "0", "pair/b": "0", "moving-0": "x"})
+
+	// The writer keeps pair/a and pair/b equal through transactions and
+	// moves a single key along with renames, so any scan that sees the
+	// pair differ or other than one moving key saw a torn store.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			v := strconv.Itoa(i)
+			if _, err := ApplyTx([]TxOp{{Op: "put", Key: "pair/a", Value: v}, {Op: "put", Key: "pair/b", Value: v}}); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := Rename("moving-"+strconv.Itoa(i-1), "moving-"+v); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		moving := 0
+		keys, err := List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if len(k.Key) > 7 && k.Key[:7] == "moving-" {
+				moving++
+			}
+		}
+		if moving != 1 {
+			t.Errorf("listing %d: saw %d moving keys, want 1", i, moving)
+			break
+		}
+
+		pairs, _, err := ScanPrefix("pair/", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 2 || pairs[0].Value != pairs[1].Value {
+			t.Errorf("scan %d: torn pair %+v", i, pairs)
+			break
+		}
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestRandomKey(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	if _, _, ok, err := RandomKey(); ok || err != nil {
+		t.Errorf("expected nothing from an empty store, got %v, %v", ok, err)
+	}
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	withStore(t, map[string]string{"a": "1", "b": "2", "c": "3"})
+	seen := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key, value, ok, err := RandomKey()
+		if !ok || err != nil {
+			t.Fatalf("expected a key, got %v, %v", ok, err)
+		}
+		if want[key] != value {
+			t.Fatalf("unexpected key %q with value %q", key, value)
+		}
+		seen[key]++
+	}
+	if len(seen) != len(want) {
+		t.Errorf("expected every key to be picked at some point, got %v", seen)
+	}
+}
+
+// brokenBackend is a memory backend whose walks fail, like a database
+// that can't be read.
+type brokenBackend struct{ memoryBackend }
+
+var errBrokenBackend = errors.New("backend unreadable")
+
+func (brokenBackend) eachKey(func(key string) error) error { return errBrokenBackend }
+
+func TestListReturnsBackendErrors(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+	store.data = brokenBackend{store.data.(memoryBackend)}
+
+	if _, err := List(); !errors.Is(err, errBrokenBackend) {
+		t.Errorf("List: expected the backend's error, got %v", err)
+	}
+	if _, err := IdleKeys(time.Now()); !errors.Is(err, errBrokenBackend) {
+		t.Errorf("IdleKeys: expected the backend's error, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// subscription is what the subscriber registry knows of every subscriber.
+type subscription struct {
+	id    uint64
+	since time.Time
+}
+
+// SubscriberPattern selects the keys a subscriber receives changes to:
+// those starting with Prefix and, if Pattern is set, matching it as a
+// glob. The zero value selects every key.
+type SubscriberPattern struct {
+	Prefix  string `json:"prefix"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// SubscriberInfo describes an active change subscriber. LastDelivered is
+// the Seq of the latest change it passed on, which, compared with the
+// latest change notified, shows how far behind it is.
+type SubscriberInfo struct {
+	ID            uint64              `json:"id"`
+	Kind          string              `json:"kind"`
+	Remote        string              `json:"remote,omitempty"`
+	Since         time.Time           `json:"since"`
+	AgeSeconds    float64             `json:"age_seconds"`
+	Patterns      []SubscriberPattern `json:"patterns"`
+	LastDelivered uint64              `json:"last_delivered"`
+	Queued        int                 `json:"queued"`
+}
+
+// subscriberDescriber is a ChangeSubscriber that can describe itself.
+type subscriberDescriber interface {
+	describe(info *SubscriberInfo)
+}
+
+// listSubscribers describes every active change subscriber, oldest first.
+// Subscribers that can't describe themselves are listed with kind other.
+func listSubscribers() []SubscriberInfo {
+	now := time.Now()
+
+	subscribers.RLock()
+	infos := make([]SubscriberInfo, 0, len(subscribers.list))
+	for _, s := range subscribers.list {
+		sub := subscribers.since[s]
+		info := SubscriberInfo{ID: sub.id, Kind: "other", Since: sub.since, Patterns: []SubscriberPattern{}}
+		if !sub.since.IsZero() {
+			info.AgeSeconds = now.Sub(sub.since).Seconds()
+		}
+		if d, ok := s.(subscriberDescriber); ok {
+			d.describe(&info)
+		}
+		infos = append(infos, info)
+	}
+	subscribers.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// subscribersHandler lists the active change subscribers, such as open
+// websockets and webhooks, along with the Seq of the latest change, so
+// that slow consumers and subscriptions leaked by dropped connections can
+// be spotted.
+func subscribersHandler(w http.ResponseWriter, r *http.Request) {
+	infos := listSubscribers()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Count       int              `json:"count"`
+		LastChange  uint64           `json:"last_change"`
+		Subscribers []SubscriberInfo `json:"subscribers"`
+	}{len(infos), changeSeq.Load(), infos})
+}
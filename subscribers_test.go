@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type subscribersResponse struct {
+	Count       int              `json:"count"`
+	LastChange  uint64           `json:"last_change"`
+	Subscribers []SubscriberInfo `json:"subscribers"`
+}
+
+func getSubscribers(t *testing.T, url string) subscribersResponse {
+	t.Helper()
+
+	resp, err := http.Get(url + "/v1/_subscribers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body subscribersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// findWebsocket returns the websocket subscriber in body, if any.
+func findWebsocket(body subscribersResponse) (SubscriberInfo, bool) {
+	for _, s := range body.Subscribers {
+		if s.Kind == "websocket" {
+			return s, true
+		}
+	}
+	return SubscriberInfo{}, false
+}
+
+func TestSubscribers(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	subscribers.Lock()
+	saved := subscribers.list
+	subscribers.list = nil
+	subscribers.Unlock()
+	t.Cleanup(func() {
+		subscribers.Lock()
+		subscribers.list = saved
+		subscribers.Unlock()
+	})
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	if body := getSubscribers(t, srv.URL); body.Count != 0 || len(body.Subscribers) != 0 {
+		t.Fatalf("expected no subscribers, got %+v", body)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := conn.WriteJSON(wsRequest{Op: "subscribe", Prefix: "users/", Pattern: "users/*"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply wsReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Error != "" {
+		t.Fatalf("subscribe: %v %s", err, reply.Error)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/v1/users/1", strings.NewReader("value"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var msg struct {
+		Change struct{ Key string }
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Change.Key != "users/1" {
+		t.Fatalf("expected the change to users/1, got %+v (%v)", msg, err)
+	}
+
+	// The change is recorded as delivered just after it is written, so
+	// the client may see it first.
+	var body subscribersResponse
+	var ws SubscriberInfo
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		body = getSubscribers(t, srv.URL)
+		var ok bool
+		if ws, ok = findWebsocket(body); !ok || body.Count != 1 {
+			t.Fatalf("expected the websocket to be listed, got %+v", body)
+		}
+		if ws.LastDelivered != 0 && ws.LastDelivered == body.LastChange {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the latest change %d to be delivered, got %d", body.LastChange, ws.LastDelivered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want := []SubscriberPattern{{"users/", "users/*"}}; !reflect.DeepEqual(ws.Patterns, want) {
+		t.Errorf("expected patterns %v, got %v", want, ws.Patterns)
+	}
+	if ws.Remote == "" || ws.Since.IsZero() || ws.AgeSeconds < 0 {
+		t.Errorf("expected the client's address and age, got %+v", ws)
+	}
+
+	// Closing the socket drops it from the list.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := getSubscribers(t, srv.URL)
+		if _, ok := findWebsocket(body); !ok && body.Count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("websocket still listed after it closed: %+v", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
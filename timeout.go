@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// timeoutMiddleware answers 503 Service Unavailable to requests whose
+// handler hasn't finished within config.HandlerTimeout, so that one slow
+// handler can't hold a connection open for as long as it likes. The
+// handler's context is cancelled, but work it has already started, such
+// as a write waiting on the transaction log, still completes.
+//
+// Websocket connections and streamed prefix reads are meant to outlast
+// any handler timeout and need to hijack or flush the connection, which
+// http.TimeoutHandler doesn't allow, so they are left to the server's
+// own timeouts and their own deadlines.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	if config.HandlerTimeout <= 0 {
+		return next
+	}
+
+	timed := http.TimeoutHandler(next, config.HandlerTimeout, "request timed out\n")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLongLived(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
+
+// isLongLived reports whether r is a websocket connection, a streamed
+// prefix read, or a backup or restore.
+func isLongLived(r *http.Request) bool {
+	return r.URL.Path == "/v1/_ws" || r.URL.Path == "/admin/backup" || r.URL.Path == "/admin/restore" ||
+		strings.HasPrefix(r.URL.Path, "/v1/_prefix/") && accepts(r, "application/x-ndjson")
+}
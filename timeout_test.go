@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	withStore(t, map[string]string{"a": "1"})
+	withWritePolicy(t, WriteAhead)
+	config.HandlerTimeout = 50 * time.Millisecond
+
+	// Under write-ahead the PUT waits for the log, which never commits
+	// until the test is over.
+	logger := slowLogger{release: make(chan struct{})}
+	saved := transactionLogger
+	transactionLogger = logger
+	t.Cleanup(func() { transactionLogger = saved })
+
+	router := newRouter()
+	codes := make(chan int, 1)
+	go func() { codes <- putKey(router, "b", "2") }()
+	select {
+	case code := <-codes:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("slow PUT: expected status %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow PUT wasn't cut off")
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/a", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "1" {
+		t.Errorf("GET: expected 1, got status %d and %q", rec.Code, rec.Body)
+	}
+
+	// The cut off handler carries on; wait for it to finish before the
+	// test's settings are restored.
+	close(logger.release)
+	writeMu.Lock()
+	writeMu.Unlock()
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	withStore(t, make(map[string]string))
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ReadHeaderTimeout = 50 * time.Millisecond
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer(newRouter())
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Trickle the headers, never finishing them.
+	if _, err := io.WriteString(conn, "GET /v1/a HTTP/1.1\r\nHost: kvstore\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Error("the server kept a connection with unfinished headers open")
+	}
+}
+
+func TestIsLongLived(t *testing.T) {
+	for _, tt := range []struct {
+		path, accept string
+		want         bool
+	}{
+		{"/v1/_ws", "", true},
+		{"/v1/_prefix/a", "application/x-ndjson", true},
+		{"/v1/_prefix/a", "application/json", false},
+		{"/v1/a", "application/x-ndjson", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := isLongLived(r); got != tt.want {
+			t.Errorf("%s with Accept %q: expected %v, got %v", tt.path, tt.accept, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Tombstone marks a key that was deleted, so replicas and auditors can
+// learn about the delete until its retention period runs out. Tombstones
+// of keys deleted during log replay carry the replay time.
+type Tombstone struct {
+	Key     string    `json:"key"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// Tombstones returns the retained tombstones ordered by key.
+func Tombstones() []Tombstone {
+	store.RLock()
+	defer store.RUnlock()
+
+	tombstones := make([]Tombstone, 0, len(store.tombstones))
+	for k, t := range store.tombstones {
+		tombstones = append(tombstones, Tombstone{Key: k, Deleted: t})
+	}
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].Key < tombstones[j].Key })
+
+	return tombstones
+}
+
+// purgeTombstones discards tombstones of keys deleted before cutoff,
+// returning how many were removed.
+func purgeTombstones(cutoff time.Time) int {
+	store.Lock()
+	defer store.Unlock()
+
+	n := 0
+	for k, t := range store.tombstones {
+		if t.Before(cutoff) {
+			delete(store.tombstones, k)
+			n++
+		}
+	}
+
+	return n
+}
+
+// startTombstoneGC purges tombstones older than retention in the
+// background until the returned function is called.
+func startTombstoneGC(retention time.Duration) (stop func()) {
+	// Check often enough that a tombstone outlives its retention by at
+	// most a tenth of it, without spinning for tiny retentions.
+	interval := retention / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case now := <-ticker.C:
+				purgeTombstones(now.Add(-retention))
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withTombstoneRetention(t *testing.T, retention time.Duration) {
+	t.Helper()
+
+	saved := config.TombstoneRetention
+	config.TombstoneRetention = retention
+	t.Cleanup(func() { config.TombstoneRetention = saved })
+}
+
+func TestDeleteTombstoned(t *testing.T) {
+	withStore(t, map[string]string{"doomed": "value"})
+	withTombstoneRetention(t, time.Hour)
+
+	if err := Delete("doomed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get("doomed"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected ErrNoSuchKey for a tombstoned key, got %v", err)
+	}
+
+	tombstones := Tombstones()
+	if len(tombstones) != 1 || tombstones[0].Key != "doomed" {
+		t.Fatalf("expected a tombstone for doomed, got %v", tombstones)
+	}
+
+	if n := purgeTombstones(tombstones[0].Deleted); n != 0 {
+		t.Errorf("purged %d tombstones still within retention", n)
+	}
+	if n := purgeTombstones(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("expected 1 tombstone purged, got %d", n)
+	}
+	if tombstones := Tombstones(); len(tombstones) != 0 {
+		t.Errorf("expected no tombstones after purge, got %v", tombstones)
+	}
+}
+
+func TestDeleteWithoutRetention(t *testing.T) {
+	withStore(t, map[string]string{"doomed": "value"})
+	withTombstoneRetention(t, 0)
+
+	Delete("doomed")
+
+	if tombstones := Tombstones(); len(tombstones) != 0 {
+		t.Errorf("expected no tombstones with retention disabled, got %v", tombstones)
+	}
+}
+
+func TestPutClearsTombstone(t *testing.T) {
+	withStore(t, map[string]string{"phoenix": "value"})
+	withTombstoneRetention(t, time.Hour)
+
+	Delete("phoenix")
+	Put("phoenix", "again")
+
+	if tombstones := Tombstones(); len(tombstones) != 0 {
+		t.Errorf("expected the tombstone to be cleared by PUT, got %v", tombstones)
+	}
+}
+
+func TestTombstoneGC(t *testing.T) {
+	withStore(t, map[string]string{"doomed": "value"})
+	withTombstoneRetention(t, 50*time.Millisecond)
+
+	stop := startTombstoneGC(config.TombstoneRetention)
+	defer stop()
+
+	Delete("doomed")
+	if len(Tombstones()) != 1 {
+		t.Fatal("expected the deleted key to be tombstoned")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(Tombstones()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tombstone was not purged after retention")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTombstonesHandler(t *testing.T) {
+	withStore(t, map[string]string{"gone": "value", selfTestKey: "probe"})
+	withTombstoneRetention(t, time.Hour)
+
+	Delete("gone")
+	Delete(selfTestKey)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/tombstones", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var body struct {
+		Tombstones []Tombstone `json:"tombstones"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Tombstones) != 1 || body.Tombstones[0].Key != "gone" {
+		t.Errorf("expected only the tombstone for gone, got %v", body.Tombstones)
+	}
+}
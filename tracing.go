@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies the spans the server creates.
+const tracerName = "github.com/muchiri08/kvstore"
+
+// tracer creates every span. It is a no-op until setupTracing configures
+// an exporter, so tracing costs next to nothing by default.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracing is set once spans are exported, and turns on tracingMiddleware.
+var tracing bool
+
+// tracePropagator reads and writes the W3C trace context and baggage
+// headers.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, a URL such as
+// http://localhost:4318. The returned function flushes the spans not yet
+// exported and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", "kvstore"))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	useTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// useTracerProvider makes the server create its spans with tp.
+func useTracerProvider(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(tracePropagator)
+	tracer = tp.Tracer(tracerName)
+	tracing = true
+}
+
+// tracingMiddleware starts a span for every request, continuing the
+// trace of the client if it sent a traceparent header, and returns the
+// trace context in the response headers. Spans are named after the route
+// template rather than the path, so keys don't end up in span names.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := r.URL.Path
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("client.address", r.RemoteAddr),
+			))
+		defer span.End()
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		// WebSocket connections are hijacked, which a statusWriter
+		// can't be.
+		if websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// opSpan is the span of an operation such as a store call, timed so that
+// endSpan can report the operation if it was slow, whether or not spans
+// are exported.
+type opSpan struct {
+	trace.Span
+	name  string
+	key   string
+	start time.Time
+}
+
+// startSpan starts a child span of the one in ctx for an operation such
+// as a store call. Pass the operation's error to endSpan to finish it.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) *opSpan {
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return &opSpan{Span: span, name: name, start: time.Now()}
+}
+
+// onKey notes the key the span's operation is on, to be named if the
+// operation is slow. The key isn't recorded on the span itself.
+func (s *opSpan) onKey(key string) *opSpan {
+	s.key = key
+	return s
+}
+
+// endSpan records err, if any, on span and ends it. A missing key is an
+// answer rather than a failure, so ErrNoSuchKey isn't recorded.
+func endSpan(span *opSpan, err error) {
+	if err != nil && !errors.Is(err, ErrNoSuchKey) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	reportSlowOp(span.name, span.key, time.Since(span.start))
+}
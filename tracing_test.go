@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withSpanRecorder records the spans the server creates until the test
+// ends.
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	savedTracer, savedTracing := tracer, tracing
+	t.Cleanup(func() { tracer, tracing = savedTracer, savedTracing })
+
+	sr := tracetest.NewSpanRecorder()
+	useTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	return sr
+}
+
+func TestTracingPut(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	sr := withSpanRecorder(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPut, "/v1/traced", strings.NewReader("value"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	spans := sr.Ended()
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byName[s.Name()] = s
+	}
+	server, ok := byName["PUT /v1/{key:.+}"]
+	if !ok {
+		t.Fatalf("no span for the request among %d spans", len(spans))
+	}
+	store, ok := byName["store.put"]
+	if !ok {
+		t.Fatal("no span for the store operation")
+	}
+
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("request span has kind %v", server.SpanKind())
+	}
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("request span is in trace %s, want the client's %s", got, traceID)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("request span has parent %s, want the client's span", got)
+	}
+	if store.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("store span is not a child of the request span")
+	}
+	found := false
+	for _, a := range server.Attributes() {
+		if a == attribute.Int("http.response.status_code", http.StatusCreated) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("request span lacks the response status: %v", server.Attributes())
+	}
+
+	if tp := rec.Header().Get("traceparent"); !strings.Contains(tp, traceID) {
+		t.Errorf("response traceparent %q doesn't carry the trace", tp)
+	}
+}
+
+func TestTracingOffByDefault(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/untraced", strings.NewReader("value")))
+	if rec.Header().Get("traceparent") != "" {
+		t.Error("a trace context was returned with tracing off")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// transientError marks a logger error that is expected to pass, such as
+// a dropped database connection, so that the write may succeed if tried
+// again. Errors that aren't marked are permanent.
+type transientError struct{ error }
+
+func (e transientError) Unwrap() error { return e.error }
+
+// isTransient reports whether err is a transient logger error. An error
+// joining several, as the multi and sharded loggers' Flush returns, is
+// transient only if all of them are.
+func isTransient(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case transientError:
+			return true
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				if !isTransient(err) {
+					return false
+				}
+			}
+			return true
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// classifyDBError marks err as transient if it is one a later insert may
+// not run into: the circuit breaker being open, a connection that was
+// lost, refused or timed out, or postgres reporting a connection problem
+// (class 08), a conflict with another transaction (40), a lack of
+// resources (53) or a shutdown (57). Others, like a constraint violation
+// or a missing table, are left permanent.
+func classifyDBError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var netErr net.Error
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, errCircuitOpen),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr):
+		return transientError{err}
+	case errors.As(err, &pqErr):
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57":
+			return transientError{err}
+		}
+	}
+
+	return err
+}
+
+// logFailureStatus returns the status a write is answered with when its
+// event couldn't be logged because of err: 503 if the failure is
+// transient and the write can be tried again, 500 otherwise.
+func logFailureStatus(err error) int {
+	if isTransient(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// logFailed answers a write whose event couldn't be logged because of
+// err. A transient failure is answered with 503 and a Retry-After of
+// config.TransientRetryAfter, or of how much longer the database circuit
+// breaker stays open if that is longer.
+func logFailed(w http.ResponseWriter, err error) {
+	status := logFailureStatus(err)
+	if status == http.StatusServiceUnavailable {
+		wait := max(config.TransientRetryAfter, loggerBreaker().retryAfter())
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
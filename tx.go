@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrPreconditionFailed is returned by ApplyTx when a cas operation's
+// expected value doesn't match the stored one.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// TxOp is one operation of a transaction. Op is put, delete or cas. A cas
+// stores Value only if the key currently holds Expected, or, when Expected
+// is nil, only if the key doesn't exist.
+type TxOp struct {
+	Op       string  `json:"op"`
+	Key      string  `json:"key"`
+	Value    string  `json:"value,omitempty"`
+	Expected *string `json:"expected,omitempty"`
+}
+
+func (op TxOp) validate() error {
+	switch op.Op {
+	case "put", "delete", "cas":
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	if op.Key == "" {
+		return fmt.Errorf("%s operation without a key", op.Op)
+	}
+	if isReservedKey(op.Key) {
+		return fmt.Errorf("keys starting with %q are reserved", reservedPrefix)
+	}
+
+	return nil
+}
+
+// ApplyTx applies ops in order as a single atomic change: either all of
+// them are applied or, if a cas precondition fails or an operation is on
+// an immutable key, none are. Each cas is
+// checked against the state left by the operations before it. The events
+// to log for the transaction are returned.
+func ApplyTx(ops []TxOp) ([]Event, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	events, err := checkTx(ops)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEventsLocked(events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// CheckTx reports what ApplyTx would do with ops without doing it: the
+// events it would log, or the error it would fail with.
+func CheckTx(ops []TxOp) ([]Event, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	return checkTx(ops)
+}
+
+// checkTx is CheckTx for a caller holding at least the store's read lock.
+func checkTx(ops []TxOp) ([]Event, error) {
+	// Check the preconditions against an overlay of the transaction's
+	// own writes before touching the store.
+	pending := make(map[string]*string)
+	lookup := func(key string) (string, bool, error) {
+		if v, ok := pending[key]; ok {
+			if v == nil {
+				return "", false, nil
+			}
+			return *v, true, nil
+		}
+		return store.data.get(key)
+	}
+	for i, op := range ops {
+		if err := mutable(op.Key); err != nil {
+			return nil, fmt.Errorf("operation %d on key %s: %w", i, op.Key, err)
+		}
+		switch op.Op {
+		case "cas":
+			current, exists, err := lookup(op.Key)
+			if err != nil {
+				return nil, err
+			}
+			if op.Expected == nil && exists || op.Expected != nil && (!exists || current != *op.Expected) {
+				return nil, fmt.Errorf("operation %d on key %s: %w", i, op.Key, ErrPreconditionFailed)
+			}
+			fallthrough
+		case "put":
+			value := op.Value
+			pending[op.Key] = &value
+		case "delete":
+			pending[op.Key] = nil
+		}
+	}
+
+	// Check the quotas against the net change of every key written.
+	delta := make(usageDelta)
+	for key, v := range pending {
+		old, existed := storedSize(key)
+		switch {
+		case v != nil:
+			delta.put(key, old, existed, len(*v))
+		case existed:
+			delta.remove(key, old)
+		}
+	}
+	if err := delta.check(); err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, len(ops))
+	for _, op := range ops {
+		if op.Op == "delete" {
+			events = append(events, Event{EventType: EventDelete, Key: op.Key})
+		} else {
+			events = append(events, Event{EventType: EventPut, Key: op.Key, Value: op.Value})
+		}
+	}
+
+	return events, nil
+}
+
+// txHandler applies the operations in the request body atomically and
+// logs them as one batch, so replay also applies all of them or none.
+// A failed cas, or an operation on an immutable key, aborts the whole
+// transaction with 409.
+func txHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	body, err := readBody(r, config.MaxBodyBytes)
+	defer r.Body.Close()
+
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	var req struct {
+		Ops []TxOp `json:"ops"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, fmt.Sprintf("malformed transaction: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Ops) == 0 {
+		http.Error(w, "transaction has no operations", http.StatusBadRequest)
+		return
+	}
+	if config.MaxTxOps > 0 && len(req.Ops) > config.MaxTxOps {
+		http.Error(w, fmt.Sprintf("transaction has %d operations, more than the limit of %d", len(req.Ops), config.MaxTxOps), http.StatusBadRequest)
+		return
+	}
+	for i, op := range req.Ops {
+		op.Key = normalizeKey(op.Key)
+		req.Ops[i].Key = op.Key
+		if err := op.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		logged := "" // the value of a delete isn't logged
+		if op.Op != "delete" {
+			v, err := checkValue(op.Key, op.Value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusUnprocessableEntity)
+				return
+			}
+			req.Ops[i].Value = v
+			logged = v
+		}
+		if err := checkLoggable(op.Key, logged); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	events, err := CheckTx(req.Ops)
+	if err == nil {
+		span := startSpan(r.Context(), "store.apply_tx", attribute.Int("kvstore.tx.ops", len(req.Ops)))
+		err = commitWrite(func() {
+			transactionLogger.WriteBatch(events)
+		}, func() error {
+			return applyEvents(events)
+		})
+		endSpan(span, err)
+	}
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, ErrPreconditionFailed), errors.Is(err, ErrImmutable):
+		status = http.StatusConflict
+	case errors.Is(err, ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case err != nil:
+		status = logFailureStatus(err)
+	}
+	for _, op := range req.Ops {
+		audit(r, op.Op, op.Key, status)
+	}
+	if status == http.StatusServiceUnavailable {
+		logFailed(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	for _, e := range events {
+		notifyChange(e.EventType, e.Key, e.Value)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Applied int `json:"applied"`
+	}{len(events)})
+	slog.Debug("TX", "ops", len(events))
+}
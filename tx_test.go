@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func postTx(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/_tx", strings.NewReader(body)))
+	return rec
+}
+
+func TestTxCommit(t *testing.T) {
+	withStore(t, map[string]string{"balance:a": "10", "stale": "x"})
+	tl := withLogger(t)
+
+	rec := postTx(t, `{"ops": [
+		{"op": "cas", "key": "balance:a", "expected": "10", "value": "5"},
+		{"op": "cas", "key": "balance:b", "value": "5"},
+		{"op": "delete", "key": "stale"}
+	]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	want := map[string]string{"balance:a": "5", "balance:b": "5"}
+	if fmt.Sprint(storeMap()) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, storeMap())
+	}
+
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readAll(t, tl.filename, FileLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected the 3 operations to be logged, got %v", events)
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	withStore(t, map[string]string{"balance:a": "10"})
+	tl := withLogger(t)
+
+	rec := postTx(t, `{"ops": [
+		{"op": "put", "key": "balance:b", "value": "5"},
+		{"op": "cas", "key": "balance:a", "expected": "7", "value": "5"}
+	]}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, rec.Code)
+	}
+
+	if len(storeMap()) != 1 || storeMap()["balance:a"] != "10" {
+		t.Errorf("aborted transaction changed the store: %v", storeMap())
+	}
+	if err := tl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := tl.LastSequence(); seq != 0 {
+		t.Errorf("aborted transaction was logged up to sequence %d", seq)
+	}
+}
+
+func TestTxCasSeesEarlierOps(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	value := "one"
+	if _, err := ApplyTx([]TxOp{
+		{Op: "put", Key: "k", Value: "one"},
+		{Op: "cas", Key: "k", Expected: &value, Value: "two"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if storeMap()["k"] != "two" {
+		t.Errorf("expected k=two, got %q", storeMap()["k"])
+	}
+}
+
+func TestTxInvalid(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	for _, body := range []string{
+		`not json`,
+		`{"ops": []}`,
+		`{"ops": [{"op": "rename", "key": "k"}]}`,
+		`{"ops": [{"op": "put", "value": "v"}]}`,
+		`{"ops": [{"op": "put", "key": "_reserved", "value": "v"}]}`,
+	} {
+		if rec := postTx(t, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+}
+
+func TestTxMaxOps(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.MaxTxOps = 3
+
+	ops := func(n int) string {
+		var buf strings.Builder
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, `{"op": "put", "key": "k%d", "value": "v"}`, i)
+		}
+		return `{"ops": [` + buf.String() + `]}`
+	}
+
+	if rec := postTx(t, ops(4)); rec.Code != http.StatusBadRequest {
+		t.Errorf("over the limit: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if n := len(storeMap()); n != 0 {
+		t.Errorf("over the limit: expected nothing applied, got %d keys", n)
+	}
+	if rec := postTx(t, ops(3)); rec.Code != http.StatusOK {
+		t.Errorf("at the limit: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if n := len(storeMap()); n != 3 {
+		t.Errorf("at the limit: expected 3 keys, got %d", n)
+	}
+}
+
+func TestReplayDropsIncompleteBatch(t *testing.T) {
+	withStore(t, make(map[string]string))
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	complete := "1\t2\tbefore\tone\n2\t3\t\t2\n3\t2\ta\t1\n4\t2\tb\t2\n"
+	if err := os.WriteFile(filename, []byte(complete+"5\t3\t\t2\n6\t2\ttorn\t1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayEvents(tl, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"before": "one", "a": "1", "b": "2"}
+	if fmt.Sprint(storeMap()) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, storeMap())
+	}
+	if seq := tl.LastSequence(); seq != 4 {
+		t.Errorf("expected last sequence 4, got %d", seq)
+	}
+
+	// Running the logger cuts the incomplete batch off, so events written
+	// afterwards aren't mistaken for the rest of it.
+	tl.Run()
+	tl.WritePut("after", "two")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := complete + "5\t2\tafter\ttwo\n"; string(data) != want {
+		t.Errorf("expected log %q, got %q", want, data)
+	}
+}
+
+func TestTxImmutable(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+	if _, _, err := PutContent("fixed", "1", "", writeImmutable); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{
+		`{"op": "put", "key": "fixed", "value": "2"}`,
+		`{"op": "delete", "key": "fixed"}`,
+		`{"op": "cas", "key": "fixed", "expected": "1", "value": "2"}`,
+	} {
+		rec := postTx(t, `{"ops": [{"op": "put", "key": "other", "value": "x"}, `+op+`]}`)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("%s: expected status %d, got %d", op, http.StatusConflict, rec.Code)
+		}
+	}
+	if want := map[string]string{"fixed": "1"}; fmt.Sprint(storeMap()) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, storeMap())
+	}
+}
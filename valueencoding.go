@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// valueCodec converts between stored bytes and a text encoding of them.
+type valueCodec struct {
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+// valueEncodings are the encodings that can be asked for with ?encoding=.
+// A GET returns the stored bytes encoded, and a PUT body is decoded before
+// it is stored.
+var valueEncodings = map[string]valueCodec{
+	"base64": {base64.StdEncoding.EncodeToString, base64.StdEncoding.DecodeString},
+	"hex":    {hex.EncodeToString, hex.DecodeString},
+}
+
+// requestEncoding returns the codec named by the request's encoding query
+// parameter, or nil if it has none.
+func requestEncoding(r *http.Request) (*valueCodec, error) {
+	name := r.URL.Query().Get("encoding")
+	if name == "" {
+		return nil, nil
+	}
+
+	codec, ok := valueEncodings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q, expected base64 or hex", name)
+	}
+
+	return &codec, nil
+}
+
+// decodeValue decodes a request body, ignoring surrounding whitespace
+// such as a trailing newline.
+func (c *valueCodec) decodeValue(body []byte) ([]byte, error) {
+	return c.decode(strings.TrimSpace(string(body)))
+}
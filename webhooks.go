@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Change describes a committed mutation of the store. Seq numbers changes
+// in the order they are notified, from 1 when the server starts; it is not
+// the event's sequence number in the transaction log, which the logger
+// may not have assigned yet.
+type Change struct {
+	Seq   uint64
+	Type  EventType
+	Key   string
+	Value string
+	Time  time.Time
+}
+
+func (c Change) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type  string    `json:"type"`
+		Key   string    `json:"key"`
+		Value string    `json:"value,omitempty"`
+		Time  time.Time `json:"time"`
+	}{c.Type.String(), c.Key, c.Value, c.Time})
+}
+
+// ChangeSubscriber is notified of every change once it has been applied
+// and written to the transaction log. Notify is called with the write
+// lock held, in the order changes are applied, so it must not block.
+type ChangeSubscriber interface {
+	Notify(Change)
+}
+
+var subscribers = struct {
+	sync.RWMutex
+	list   []ChangeSubscriber
+	since  map[ChangeSubscriber]subscription // when each subscriber was added
+	nextID uint64
+}{since: make(map[ChangeSubscriber]subscription)}
+
+// changeSeq is the Seq of the latest change notified.
+var changeSeq atomic.Uint64
+
+func addChangeSubscriber(s ChangeSubscriber) {
+	subscribers.Lock()
+	subscribers.list = append(subscribers.list, s)
+	subscribers.nextID++
+	subscribers.since[s] = subscription{subscribers.nextID, time.Now()}
+	subscribers.Unlock()
+}
+
+// removeChangeSubscriber stops notifying s of changes.
+func removeChangeSubscriber(s ChangeSubscriber) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for i, sub := range subscribers.list {
+		if sub == s {
+			subscribers.list = append(subscribers.list[:i:i], subscribers.list[i+1:]...)
+			delete(subscribers.since, s)
+			return
+		}
+	}
+}
+
+// notifyChange passes a change on to every subscriber.
+func notifyChange(t EventType, key, value string) {
+	c := Change{Seq: changeSeq.Add(1), Type: t, Key: key, Value: value, Time: time.Now()}
+
+	subscribers.RLock()
+	defer subscribers.RUnlock()
+	for _, s := range subscribers.list {
+		s.Notify(c)
+	}
+}
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed with the shared secret, so receivers can authenticate deliveries.
+const webhookSignatureHeader = "X-Kvstore-Signature"
+
+// webhookQueueSize bounds the changes waiting for delivery. Changes that
+// arrive while the queue is full are dropped rather than stalling writes.
+const webhookQueueSize = 1024
+
+// webhookNotifier POSTs changes as JSON to a set of URLs. Deliveries
+// happen on a single goroutine, so each URL sees changes in order; a
+// failed delivery is retried with exponential backoff before moving on.
+type webhookNotifier struct {
+	urls    []string
+	secret  []byte
+	client  *http.Client
+	retries int           // extra attempts after the first failed one
+	backoff time.Duration // wait before the first retry, doubled each time
+
+	queue     chan Change
+	done      chan struct{}
+	delivered atomic.Uint64 // Seq of the latest change delivered to every URL
+}
+
+func newWebhookNotifier(urls []string, secret string, retries int) *webhookNotifier {
+	n := &webhookNotifier{
+		urls:    urls,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: retries,
+		backoff: 500 * time.Millisecond,
+		queue:   make(chan Change, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go n.run()
+
+	return n
+}
+
+func (n *webhookNotifier) Notify(c Change) {
+	select {
+	case n.queue <- c:
+	default:
+		slog.Warn("webhook queue full, dropping change", "type", c.Type, "key", c.Key)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+
+	for c := range n.queue {
+		body, err := json.Marshal(c)
+		if err != nil {
+			slog.Error("failed to encode webhook payload", "err", err)
+			continue
+		}
+		ok := true
+		for _, url := range n.urls {
+			if err := n.deliver(url, body); err != nil {
+				slog.Error("webhook failed", "url", url, "err", err)
+				ok = false
+			}
+		}
+		if ok {
+			n.delivered.Store(c.Seq)
+		}
+	}
+}
+
+func (n *webhookNotifier) describe(info *SubscriberInfo) {
+	info.Kind = "webhook"
+	info.Patterns = []SubscriberPattern{{}}
+	info.LastDelivered = n.delivered.Load()
+	info.Queued = len(n.queue)
+}
+
+func (n *webhookNotifier) deliver(url string, body []byte) error {
+	backoff := n.backoff
+
+	var err error
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = n.post(url, body); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (n *webhookNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Close waits for queued changes to be delivered. Nothing may be notified
+// after Close is called, so it belongs after the server has shut down.
+func (n *webhookNotifier) Close() {
+	close(n.queue)
+	<-n.done
+}
+
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookDelivery struct {
+	body      []byte
+	signature string
+}
+
+// webhookServer records the deliveries it receives, failing the first
+// failures of them with 500.
+func webhookServer(t *testing.T, failures int32) (*httptest.Server, <-chan webhookDelivery) {
+	t.Helper()
+
+	deliveries := make(chan webhookDelivery, 16)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{body, r.Header.Get(webhookSignatureHeader)}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, deliveries
+}
+
+func withNotifier(t *testing.T, n *webhookNotifier) {
+	t.Helper()
+
+	subscribers.Lock()
+	saved := subscribers.list
+	subscribers.list = nil
+	subscribers.Unlock()
+	addChangeSubscriber(n)
+
+	t.Cleanup(func() {
+		subscribers.Lock()
+		subscribers.list = saved
+		subscribers.Unlock()
+		n.Close()
+	})
+}
+
+func receive(t *testing.T, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+		return webhookDelivery{}
+	}
+}
+
+func TestPutFiresWebhook(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	srv, deliveries := webhookServer(t, 0)
+	withNotifier(t, newWebhookNotifier([]string{srv.URL}, "s3cret", 0))
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/hooked", strings.NewReader("value")))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	d := receive(t, deliveries)
+
+	var payload struct {
+		Type  string `json:"type"`
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(d.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Type != "PUT" || payload.Key != "hooked" || payload.Value != "value" {
+		t.Errorf("unexpected payload %s", d.body)
+	}
+	if want := "sha256=" + signPayload([]byte("s3cret"), d.body); d.signature != want {
+		t.Errorf("expected signature %q, got %q", want, d.signature)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	srv, deliveries := webhookServer(t, 2)
+
+	n := newWebhookNotifier([]string{srv.URL}, "", 2)
+	n.backoff = time.Millisecond
+	defer n.Close()
+
+	n.Notify(Change{Type: EventDelete, Key: "retried", Time: time.Now()})
+
+	if d := receive(t, deliveries); !strings.Contains(string(d.body), `"retried"`) {
+		t.Errorf("unexpected payload %s", d.body)
+	}
+}
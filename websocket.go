@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsPingInterval is how often the server pings a WebSocket client.
+	// A client that hasn't answered within wsPongWait is disconnected.
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = wsPingInterval + 10*time.Second
+
+	// wsWriteWait bounds the time taken to write a single message.
+	wsWriteWait = 10 * time.Second
+
+	// wsQueueSize bounds the messages waiting to be sent to a client. A
+	// client that falls this far behind is disconnected rather than
+	// holding up writers or silently missing changes.
+	wsQueueSize = 256
+)
+
+// wsUpgrader accepts WebSocket connections from pages of the server's own
+// origin, and from clients that send no Origin header. Browsers always
+// send one, so pages served from elsewhere can't connect.
+var wsUpgrader = websocket.Upgrader{}
+
+// wsRequest is a message from a WebSocket client. Op is one of:
+//
+//	subscribe    receive changes to keys starting with Prefix or matching
+//	             the glob Pattern, with the syntax of /v1/_keys?pattern=
+//	unsubscribe  drop the subscription with the same Prefix and Pattern
+//	get          read Key
+//	put          set Key to Value
+//
+// ID is echoed in the reply, so clients can match replies to requests.
+type wsRequest struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Op      string          `json:"op"`
+	Prefix  string          `json:"prefix,omitempty"`
+	Pattern string          `json:"pattern,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Value   string          `json:"value,omitempty"`
+}
+
+// wsReply answers a wsRequest. Value is set for a get, Error if the
+// request failed.
+type wsReply struct {
+	ID    json.RawMessage `json:"id,omitempty"`
+	Value *string         `json:"value,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// wsChange carries a change to a key a client subscribed to.
+type wsChange struct {
+	Change Change `json:"change"`
+}
+
+// wsFilter selects the keys a subscription is for.
+type wsFilter struct {
+	prefix  string
+	pattern string
+}
+
+func (f wsFilter) matches(key string) bool {
+	if !strings.HasPrefix(key, f.prefix) {
+		return false
+	}
+	if f.pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(f.pattern, key)
+	return ok
+}
+
+// wsSubscriber queues the changes matching any of a connection's
+// subscriptions for sending.
+type wsSubscriber struct {
+	mu      sync.Mutex
+	filters []wsFilter
+
+	remote    string        // address of the client
+	delivered atomic.Uint64 // Seq of the latest change written to the client
+
+	out      chan interface{} // messages waiting to be sent
+	overflow chan struct{}    // closed when out was found full
+	once     sync.Once
+}
+
+func newWSSubscriber() *wsSubscriber {
+	return &wsSubscriber{
+		out:      make(chan interface{}, wsQueueSize),
+		overflow: make(chan struct{}),
+	}
+}
+
+// Notify queues c if it matches a subscription. It never blocks: if the
+// queue is full the connection is closed instead.
+func (s *wsSubscriber) Notify(c Change) {
+	s.mu.Lock()
+	match := false
+	for _, f := range s.filters {
+		if f.matches(c.Key) {
+			match = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !match {
+		return
+	}
+
+	select {
+	case s.out <- wsChange{c}:
+	default:
+		s.once.Do(func() { close(s.overflow) })
+	}
+}
+
+func (s *wsSubscriber) describe(info *SubscriberInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info.Kind = "websocket"
+	info.Remote = s.remote
+	for _, f := range s.filters {
+		info.Patterns = append(info.Patterns, SubscriberPattern{f.prefix, f.pattern})
+	}
+	info.LastDelivered = s.delivered.Load()
+	info.Queued = len(s.out)
+}
+
+func (s *wsSubscriber) subscribe(f wsFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.filters {
+		if existing == f {
+			return
+		}
+	}
+	s.filters = append(s.filters, f)
+}
+
+func (s *wsSubscriber) unsubscribe(f wsFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, existing := range s.filters {
+		if existing == f {
+			s.filters = append(s.filters[:i:i], s.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// websocketHandler serves GET /v1/_ws, a WebSocket over which clients
+// subscribe to changes and read and write keys. Requests and replies are
+// JSON messages, as described by wsRequest and wsReply; changes arrive as
+// {"change": {...}} in the form webhooks receive them.
+//
+// The connection is closed when the client stops answering pings, when
+// it falls wsQueueSize messages behind, and when the server shuts down.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request.
+		slog.Debug("websocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	s := newWSSubscriber()
+	s.remote = r.RemoteAddr
+	addChangeSubscriber(s)
+	defer removeChangeSubscriber(s)
+
+	done := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		wsWriteLoop(conn, s, done)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var req wsRequest
+		reply := wsReply{}
+		if err := json.Unmarshal(msg, &req); err != nil {
+			reply.Error = "malformed request: " + err.Error()
+		} else {
+			reply = handleWSRequest(r, s, req)
+			reply.ID = req.ID
+		}
+		if !wsSend(s, done, reply) {
+			break
+		}
+	}
+
+	close(done)
+	<-written
+}
+
+// wsSend queues reply for sending, giving up once the write loop has
+// stopped.
+func wsSend(s *wsSubscriber, done <-chan struct{}, reply wsReply) bool {
+	select {
+	case s.out <- reply:
+		return true
+	case <-s.overflow:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// wsWriteLoop sends queued messages and pings until done is closed, the
+// queue overflows, a write fails or the server starts shutting down. It
+// then closes the connection, which also ends the read loop.
+func wsWriteLoop(conn *websocket.Conn, s *wsSubscriber, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	defer conn.Close()
+	stopping := inflight.stopping()
+
+	closeWith := func(code int, text string) {
+		msg := websocket.FormatCloseMessage(code, text)
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	}
+
+	for {
+		select {
+		case msg := <-s.out:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+			if c, ok := msg.(wsChange); ok {
+				s.delivered.Store(c.Change.Seq)
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-s.overflow:
+			closeWith(websocket.CloseTryAgainLater, "client is too slow to keep up with changes")
+			return
+		case <-stopping:
+			closeWith(websocket.CloseGoingAway, "server is shutting down")
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleWSRequest carries out a request received over the WebSocket
+// opened by r.
+func handleWSRequest(r *http.Request, s *wsSubscriber, req wsRequest) wsReply {
+	switch req.Op {
+	case "subscribe", "unsubscribe":
+		if _, err := path.Match(req.Pattern, ""); err != nil {
+			return wsReply{Error: fmt.Sprintf("invalid pattern %q: %v", req.Pattern, err)}
+		}
+		f := wsFilter{prefix: req.Prefix, pattern: req.Pattern}
+		if req.Op == "subscribe" {
+			s.subscribe(f)
+		} else {
+			s.unsubscribe(f)
+		}
+		return wsReply{}
+	case "get":
+		value, err := wsGet(r, normalizeKey(req.Key))
+		if err != nil {
+			return wsReply{Error: err.Error()}
+		}
+		return wsReply{Value: &value}
+	case "put":
+		if err := wsPut(r, normalizeKey(req.Key), req.Value); err != nil {
+			return wsReply{Error: err.Error()}
+		}
+		return wsReply{}
+	default:
+		return wsReply{Error: fmt.Sprintf("unknown op %q, expected subscribe, unsubscribe, get or put", req.Op)}
+	}
+}
+
+// wsGet reads key for a get sent over a WebSocket.
+func wsGet(r *http.Request, key string) (string, error) {
+	if key == "" || isReservedKey(key) {
+		audit(r, "get", key, http.StatusBadRequest)
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	value, err := Get(key)
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, ErrNoSuchKey):
+		status = http.StatusNotFound
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+	audit(r, "get", key, status)
+	slog.Debug("WS GET", "key", key)
+
+	return value, err
+}
+
+// wsPut stores a put sent over a WebSocket as PUT /v1/{key} would, with
+// the same limits, except that writes aren't queued behind
+// -max-concurrent-writes: each connection makes one write at a time.
+func wsPut(r *http.Request, key, value string) error {
+	status, err := func() (int, error) {
+		if key == "" || isReservedKey(key) {
+			return http.StatusBadRequest, fmt.Errorf("invalid key %q", key)
+		}
+		if int64(len(value)) > config.MaxBodyBytes {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("value is larger than %d bytes", config.MaxBodyBytes)
+		}
+		if status, reason := readOnlyStatus(); reason != "" {
+			return status, errors.New("server is read-only: " + reason)
+		}
+		if loggerBreaker().retryAfter() > 0 {
+			return http.StatusServiceUnavailable, errors.New("database is unavailable, try again later")
+		}
+		checked, err := checkValue(key, value)
+		if err != nil {
+			return http.StatusUnprocessableEntity, err
+		}
+		if err := checkLoggable(key, checked); err != nil {
+			return http.StatusBadRequest, err
+		}
+		value = checked
+
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		created, _, err := CheckPut(key, value, writeAlways)
+		if errors.Is(err, ErrImmutable) {
+			return http.StatusConflict, err
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			return http.StatusInsufficientStorage, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		err = commitWrite(func() {
+			transactionLogger.WritePut(key, value)
+		}, func() error {
+			_, err := Put(key, value)
+			return err
+		})
+		if err != nil {
+			return logFailureStatus(err), err
+		}
+		notifyChange(EventPut, key, value)
+
+		if created {
+			return http.StatusCreated, nil
+		}
+		return http.StatusOK, nil
+	}()
+
+	audit(r, "put", key, status)
+	slog.Debug("WS PUT", "key", key, "status", status)
+
+	return err
+}
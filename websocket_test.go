@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketNotifications(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withLogger(t)
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/_ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	roundTrip := func(req wsRequest) wsReply {
+		t.Helper()
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatal(err)
+		}
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.ID) != string(req.ID) {
+			t.Errorf("reply id %s, want %s", reply.ID, req.ID)
+		}
+		return reply
+	}
+
+	if reply := roundTrip(wsRequest{ID: []byte("1"), Op: "subscribe", Prefix: "users/"}); reply.Error != "" {
+		t.Fatalf("subscribe: %s", reply.Error)
+	}
+
+	// A change to another prefix isn't sent, so the first message is the
+	// change to users/1.
+	for _, key := range []string{"other", "users/1"} {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/v1/"+key, strings.NewReader("value"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	var msg struct {
+		Change struct {
+			Type  string `json:"type"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"change"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Change.Type != "PUT" || msg.Change.Key != "users/1" || msg.Change.Value != "value" {
+		t.Errorf("unexpected change %+v", msg.Change)
+	}
+
+	if reply := roundTrip(wsRequest{ID: []byte(`"get"`), Op: "get", Key: "users/1"}); reply.Value == nil || *reply.Value != "value" {
+		t.Errorf("get: unexpected reply %+v", reply)
+	}
+	if reply := roundTrip(wsRequest{ID: []byte("3"), Op: "unsubscribe", Prefix: "users/"}); reply.Error != "" {
+		t.Fatalf("unsubscribe: %s", reply.Error)
+	}
+	if reply := roundTrip(wsRequest{ID: []byte("4"), Op: "put", Key: "users/2", Value: "two"}); reply.Error != "" {
+		t.Fatalf("put: %s", reply.Error)
+	}
+	if got := storeMap()["users/2"]; got != "two" {
+		t.Errorf("put over the socket stored %q", got)
+	}
+	if reply := roundTrip(wsRequest{ID: []byte("5"), Op: "put", Key: "_reserved"}); reply.Error == "" {
+		t.Error("expected an error putting a reserved key")
+	}
+	if reply := roundTrip(wsRequest{ID: []byte("6"), Op: "watch"}); reply.Error == "" {
+		t.Error("expected an error for an unknown op")
+	}
+
+	// Closing the socket drops its subscription.
+	subscribers.RLock()
+	before := len(subscribers.list)
+	subscribers.RUnlock()
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subscribers.RLock()
+		after := len(subscribers.list)
+		subscribers.RUnlock()
+		if after == before-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription not removed on disconnect: %d subscribers, had %d", after, before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Write policies, chosen with -write-policy, decide when a write is
+// acknowledged.
+//
+// With write-behind, the default, a write's event is queued for the
+// transaction logger, the write is applied to the store, and the client is
+// answered without waiting for the event to be written. Writes are as
+// fast as the store, but those answered in the moments before a crash,
+// or before the logger fails, can be lost. How many depends on the
+// logger's buffering (-log-flush-interval, -log-sync). Once the logger
+// fails for good the server turns read-only, and the events of writes it
+// can no longer log are dead-lettered.
+//
+// With write-ahead, a write's event is logged and committed to stable
+// storage, as Flush reports, before the write is applied to the store
+// and the client answered. An acknowledged write survives a crash, at the
+// cost of a flush, and for the file logger an fsync, per write while
+// writes are serialized. Readers never see a write that isn't durable. If
+// the log can't be written, the store is left unchanged, the write is
+// answered with 500 and the server turns read-only, since the logger has
+// stopped. A failure the logger classifies as transient, such as a
+// dropped database connection, is answered with 503 and a Retry-After
+// instead, and the server carries on. Either way the store is left as
+// it was and the write isn't dead-lettered, so the client can retry it
+// as it was, conditions such as If-None-Match included.
+const (
+	WriteBehind = "write-behind"
+	WriteAhead  = "write-ahead"
+)
+
+// awaitDurable waits, under the write-ahead policy, until the events
+// written so far are committed to stable storage. If they can't be, it
+// returns the error, making the server read-only unless the failure is
+// transient. Under write-behind it returns at once.
+func awaitDurable() error {
+	if config.WritePolicy != WriteAhead {
+		return nil
+	}
+
+	span := startSpan(context.Background(), "log.flush")
+	err := transactionLogger.Flush()
+	endSpan(span, err)
+	if err != nil && isTransient(err) {
+		slog.Warn("transaction log write failed transiently", "err", err)
+		return fmt.Errorf("failed to log write: %w", err)
+	}
+	if err != nil {
+		setReadOnly(fmt.Sprintf("transaction log write failed: %v", err))
+		slog.Error("transaction log write failed, serving read-only", "err", err)
+		return fmt.Errorf("failed to log write: %w", err)
+	}
+
+	return nil
+}
+
+// commitWrite makes a write that has been checked against the store: it
+// queues the write's events with log, waits for them as the write policy
+// asks, then changes the store with apply, so the store is never ahead
+// of the log. The caller must hold writeMu from the check on, so that
+// nothing changes the store in between. If the events can't be made
+// durable, the store is left alone. If apply fails once they are
+// logged, the store no longer matches the log and the server turns
+// read-only.
+func commitWrite(log func(), apply func() error) error {
+	log()
+	if err := awaitDurable(); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		setReadOnly(fmt.Sprintf("logged write failed to apply: %v", err))
+		slog.Error("logged write failed to apply, serving read-only", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// withWritePolicy answers writes under policy until the test ends.
+func withWritePolicy(t *testing.T, policy string) {
+	t.Helper()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.WritePolicy = policy
+}
+
+// withBufferedLogger points the handlers at a file logger that only
+// writes to its file when flushed, returning the file's name.
+func withBufferedLogger(t *testing.T) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	tl, err := NewTransactionLoggerWithOptions(filename, FileLoggerOptions{FlushInterval: time.Hour, BufferSize: 1 << 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+
+	saved := transactionLogger
+	transactionLogger = tl
+	t.Cleanup(func() {
+		tl.Close()
+		transactionLogger = saved
+	})
+
+	return filename
+}
+
+func putKey(router http.Handler, key, value string) int {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/"+key, strings.NewReader(value)))
+	return rec.Code
+}
+
+func TestWritePolicyDurability(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		want   string
+	}{
+		{WriteBehind, ""},
+		{WriteAhead, "1\t2\ta\t1\n"},
+	} {
+		withStore(t, make(map[string]string))
+		filename := withBufferedLogger(t)
+		withWritePolicy(t, tt.policy)
+
+		if code := putKey(newRouter(), "a", "1"); code != http.StatusCreated {
+			t.Fatalf("%s: PUT: status %d", tt.policy, code)
+		}
+
+		// Read the file as soon as the write is answered, as a crash
+		// right after it would leave it.
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != tt.want {
+			t.Errorf("%s: expected log %q once the write was answered, got %q", tt.policy, tt.want, content)
+		}
+	}
+}
+
+// slowLogger takes until release is closed to commit events.
+type slowLogger struct {
+	TransactionLogger
+	release chan struct{}
+}
+
+func (slowLogger) WritePut(key, value string) {}
+func (l slowLogger) Flush() error {
+	<-l.release
+	return nil
+}
+
+func TestWriteBehindDoesNotWaitForTheLog(t *testing.T) {
+	withStore(t, make(map[string]string))
+	logger := slowLogger{release: make(chan struct{})}
+	saved := transactionLogger
+	transactionLogger = logger
+	t.Cleanup(func() { transactionLogger = saved })
+	withWritePolicy(t, WriteBehind)
+
+	answered := func(policy string) chan int {
+		config.WritePolicy = policy
+		codes := make(chan int, 1)
+		router := newRouter()
+		go func() { codes <- putKey(router, "a", policy) }()
+		return codes
+	}
+
+	select {
+	case <-answered(WriteBehind):
+	case <-time.After(5 * time.Second):
+		t.Fatal("a write-behind write waited for the log")
+	}
+
+	codes := answered(WriteAhead)
+	select {
+	case <-codes:
+		t.Fatal("a write-ahead write was answered before the log committed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if value, _ := Get("a"); value != WriteBehind {
+		t.Errorf("a write-ahead write reached the store before the log committed it: %q", value)
+	}
+	close(logger.release)
+	if code := <-codes; code != http.StatusOK {
+		t.Errorf("write-ahead PUT: expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestWriteAheadLogFailure(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withWritePolicy(t, WriteAhead)
+	saved := transactionLogger
+	transactionLogger = brokenLogger{}
+	t.Cleanup(func() {
+		transactionLogger = saved
+		setReadOnly("")
+	})
+
+	router := newRouter()
+	if code := putKey(router, "a", "1"); code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected a write the log failed to leave the store alone, got %v", err)
+	}
+	if code := putKey(router, "b", "1"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the server to turn read-only, got status %d", code)
+	}
+}
+
+// failingFlushLogger accepts events but fails every flush with err.
+type failingFlushLogger struct {
+	TransactionLogger
+	err error
+}
+
+func (failingFlushLogger) WritePut(key, value string) {}
+func (l failingFlushLogger) Flush() error             { return l.err }
+
+func TestWriteAheadTransientLogFailure(t *testing.T) {
+	withWritePolicy(t, WriteAhead)
+	config.TransientRetryAfter = 3 * time.Second
+	saved := transactionLogger
+	t.Cleanup(func() {
+		transactionLogger = saved
+		setReadOnly("")
+	})
+
+	for _, tt := range []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"dropped connection", classifyDBError(driver.ErrBadConn), http.StatusServiceUnavailable, "3"},
+		{"serialization failure", classifyDBError(&pq.Error{Code: "40001"}), http.StatusServiceUnavailable, "3"},
+		{"missing table", classifyDBError(&pq.Error{Code: "42P01"}), http.StatusInternalServerError, ""},
+		{"one shard failing for good", errors.Join(transientError{io.EOF}, errors.New("disk on fire")), http.StatusInternalServerError, ""},
+	} {
+		withStore(t, make(map[string]string))
+		setReadOnly("")
+		transactionLogger = failingFlushLogger{err: tt.err}
+
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/a", strings.NewReader("1")))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: expected Retry-After %q, got %q", tt.name, tt.retryAfter, got)
+		}
+
+		// Only a permanent failure turns the server read-only.
+		if readOnly := readOnlyReason() != ""; readOnly != (tt.status == http.StatusInternalServerError) {
+			t.Errorf("%s: unexpected read-only state %q", tt.name, readOnlyReason())
+		}
+	}
+}
+
+// orderLogger notes every event logged after the store already held its
+// change.
+type orderLogger struct {
+	TransactionLogger
+	logged int
+	late   []string
+}
+
+func (l *orderLogger) WritePut(key, value string) {
+	l.logged++
+	if got, err := Get(key); err == nil && got == value {
+		l.late = append(l.late, "put "+key)
+	}
+}
+
+func (l *orderLogger) WriteDelete(key string) {
+	l.logged++
+	if _, err := Get(key); errors.Is(err, ErrNoSuchKey) {
+		l.late = append(l.late, "delete "+key)
+	}
+}
+
+func (l *orderLogger) WriteBatch(events []Event) {
+	for _, e := range events {
+		if e.EventType == EventDelete {
+			l.WriteDelete(e.Key)
+		} else {
+			l.WritePut(e.Key, e.Value)
+		}
+	}
+}
+
+func (l *orderLogger) Flush() error { return nil }
+
+func TestWritesAreLoggedBeforeTheyAreApplied(t *testing.T) {
+	withStore(t, make(map[string]string))
+	logger := &orderLogger{}
+	saved := transactionLogger
+	transactionLogger = logger
+	t.Cleanup(func() { transactionLogger = saved })
+
+	router := newRouter()
+	do := func(method, target, body string, header ...string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		method, target, body string
+		header               []string
+		status               int
+	}{
+		{http.MethodPut, "/v1/a", "1", nil, http.StatusCreated},
+		{http.MethodPut, "/v1/a", "2", []string{"If-Match", "*"}, http.StatusOK},
+		{http.MethodPost, "/v1/a/rename?newKey=b", "", nil, http.StatusOK},
+		{http.MethodPost, "/v1/_tx", `{"ops": [{"op": "cas", "key": "c", "value": "3"}]}`, nil, http.StatusOK},
+		{http.MethodDelete, "/v1/b", "", []string{"If-Match", "2"}, http.StatusOK},
+		{http.MethodDelete, "/v1/c", "", nil, http.StatusOK},
+	} {
+		if code := do(tt.method, tt.target, tt.body, tt.header...); code != tt.status {
+			t.Fatalf("%s %s: expected status %d, got %d", tt.method, tt.target, tt.status, code)
+		}
+	}
+	if len(logger.late) > 0 {
+		t.Errorf("events logged after the store changed: %v", logger.late)
+	}
+
+	// A write refused by its check logs nothing.
+	logged := logger.logged
+	do(http.MethodPut, "/v1/d", "1")
+	if code := do(http.MethodPut, "/v1/d", "2", "If-None-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Errorf("conflicting create: expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+	if code := do(http.MethodDelete, "/v1/d", "", "If-Match", "2"); code != http.StatusPreconditionFailed {
+		t.Errorf("mismatched delete: expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+	if logger.logged != logged+1 {
+		t.Errorf("expected only the first put of d to be logged, got %d events", logger.logged-logged)
+	}
+}
+
+// flakyLogger fails its first flush with err and commits every later one.
+type flakyLogger struct {
+	TransactionLogger
+	err error
+}
+
+func (l *flakyLogger) WritePut(key, value string) {}
+func (l *flakyLogger) Flush() error {
+	err := l.err
+	l.err = nil
+	return err
+}
+
+func TestWriteAheadTransientFailureCanBeRetried(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withWritePolicy(t, WriteAhead)
+	saved := transactionLogger
+	transactionLogger = &flakyLogger{err: classifyDBError(driver.ErrBadConn)}
+	t.Cleanup(func() { transactionLogger = saved })
+
+	create := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/v1/a", strings.NewReader("1"))
+		req.Header.Set("If-None-Match", "*")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The 503 means nothing happened, so retrying the conditional create
+	// creates the key rather than finding it there already.
+	if code := create(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if _, err := Get("a"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected the failed write to leave the store alone, got %v", err)
+	}
+	if code := create(); code != http.StatusCreated {
+		t.Errorf("retry: expected status %d, got %d", http.StatusCreated, code)
+	}
+}
+
+func TestWriteAheadFailureIsNotDeadLettered(t *testing.T) {
+	withStore(t, make(map[string]string))
+	withWritePolicy(t, WriteAhead)
+	d := withDeadLetters(t)
+	tl := withLogger(t)
+	t.Cleanup(func() { setReadOnly("") })
+
+	// Pull the file out from under the logger, so its next write fails.
+	tl.file.Close()
+	if code := putKey(newRouter(), "a", "1"); code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	letters, err := d.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 0 {
+		t.Errorf("expected the refused write not to be dead-lettered, got %+v", letters)
+	}
+}